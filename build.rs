@@ -5,12 +5,13 @@ use std::{
     process::Command,
 };
 const LINK_TEST_BIN: &str = "LINK_TEST_BIN";
+// Build the slim bindings, which don't depend on the Erigon module
+const DBFAKER_SLIM: &str = "DBFAKER_SLIM";
 
 // ** This dir gets rm -rf'd **
 const DB_TMP_DIR: &str = "tmp/chaindata";
 
 const GO_PROJECT_DIR: &str = "dbfaker";
-const GO_MAIN_FILE: &str = "main.go";
 const GO_BIN_NAME: &str = "erigon";
 const TMP_DIR_ENV_LABEL: &str = "CHAINDATA_TMP_DIR";
 
@@ -19,6 +20,7 @@ const TMP_DIR_ENV_LABEL: &str = "CHAINDATA_TMP_DIR";
 fn main() {
     // re-run build script any time env var changes
     println!("cargo:rerun-if-env-changed={}", LINK_TEST_BIN);
+    println!("cargo:rerun-if-env-changed={}", DBFAKER_SLIM);
 
     // Only link if env var is set for tests
     let is_test = env::var(LINK_TEST_BIN);
@@ -45,11 +47,15 @@ fn main() {
 
     // build the erigon bindings
     let out_file = out_dir.join(format!("lib{}.a", GO_BIN_NAME));
-    let output = Command::new("go")
-        .arg("build")
-        .arg("-buildmode=c-archive")
+    let slim = env::var(DBFAKER_SLIM).map_or(false, |v| !v.is_empty());
+    let mut cmd = Command::new("go");
+    cmd.arg("build").arg("-buildmode=c-archive");
+    if slim {
+        cmd.args(["-tags", "slim"]);
+    }
+    let output = cmd
         .args(["-o", out_file.to_str().expect("bad out_file")])
-        .arg(GO_MAIN_FILE)
+        .arg(".")
         .current_dir(go_dir.clone())
         .output()
         .expect("failed to execute go build");
@@ -59,6 +65,11 @@ fn main() {
     io::stderr().write_all(&output.stderr).unwrap();
     assert!(output.status.success(), "failed to build go bindings");
 
+    // lets tests of exports the slim build lacks opt out
+    if slim {
+        println!("cargo:rustc-cfg=dbfaker_slim");
+    }
+
     // clean temp DBs
     let tmp_dir = path.join(DB_TMP_DIR);
     if tmp_dir.exists() {
@@ -0,0 +1,246 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// One account of a state allocation, in the format of a genesis alloc, but
+// for its "storage", which is written as it is decoded.
+type allocAccount struct {
+	Balance *math.HexOrDecimal256
+	Nonce   math.HexOrDecimal64
+	Code    hexutil.Bytes
+}
+
+// Writes a state allocation given as a JSON object of address => {"balance",
+// "nonce", "code", "storage"}, as in a genesis file, in one transaction. Each
+// account is written to the plain state with its code and storage, and to
+// the hashed state (HashedAccounts, ContractCode and HashedStorage) that
+// Erigon computes the state root from, replacing its balance, nonce and code;
+// slots not in the allocation are kept, and zero values delete slots.
+// Accounts with code or storage become contracts of incarnation 1 unless they
+// already are one. The object is decoded as it is written, down to single
+// storage slots, so large pre-states and contracts never sit in memory
+// decoded. With changesets,
+// the values written over are also recorded in the changesets and history
+// indices at blockNum, as writes in history mode (see SetHistory) are.
+//export PutAlloc
+func PutAlloc(dbPtr C.uintptr_t, allocJson string, blockNum uint64, changesets bool) (exit int) {
+	defer timeOp("PutAlloc", "size", len(allocJson), "blockNum", blockNum, "changesets", changesets)()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutAlloc", retryMapFull(db, "PutAlloc", func() error {
+		return putAlloc(context.Background(), db, allocJson, blockNum, changesets)
+	}))
+}
+
+func putAlloc(ctx context.Context, db kv.RwDB, allocJson string, blockNum uint64, changesets bool) (err error) {
+	dec := json.NewDecoder(strings.NewReader(allocJson))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return errors.New("invalid alloc: not a JSON object")
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	for dec.More() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("invalid alloc: %w", err)
+		}
+		var address common.Address
+		if err := address.UnmarshalText([]byte(tok.(string))); err != nil {
+			return fmt.Errorf("invalid alloc address %q: %w", tok, err)
+		}
+		if err := putAllocAccount(tx, dec, address, blockNum, changesets); err != nil {
+			return fmt.Errorf("account %x: %w", address, err)
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return fmt.Errorf("invalid alloc: %w", err)
+	}
+	if dec.More() {
+		return errors.New("invalid alloc: trailing data")
+	}
+	return nil
+}
+
+// Decodes the account object dec is at and writes it. Its storage slots are
+// written as they are decoded, under the incarnation the account has once it
+// is written: its own, or 1 if it has none, since having storage makes it a
+// contract.
+func putAllocAccount(tx kv.RwTx, dec *json.Decoder, address common.Address, blockNum uint64, changesets bool) error {
+	original := accounts.NewAccount()
+	if _, err := rawdb.ReadAccount(tx, address, &original); err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+	incarnation := original.Incarnation
+	if incarnation == 0 {
+		incarnation = 1
+	}
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return errors.New("invalid account: not a JSON object")
+	}
+	var a allocAccount
+	hasStorage := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("invalid account: %w", err)
+		}
+		// matched as encoding/json matches field names
+		field := tok.(string)
+		switch strings.ToLower(field) {
+		case "balance":
+			err = dec.Decode(&a.Balance)
+		case "nonce":
+			err = dec.Decode(&a.Nonce)
+		case "code":
+			err = dec.Decode(&a.Code)
+		case "storage":
+			var slots int
+			if slots, err = putAllocStorage(tx, dec, address, incarnation, blockNum, changesets); err != nil {
+				return err
+			}
+			hasStorage = hasStorage || slots > 0
+		default:
+			err = dec.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", field, err)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid account: %w", err)
+	}
+	return writeAllocAccount(tx, address, &original, &a, hasStorage, blockNum, changesets)
+}
+
+func writeAllocAccount(tx kv.RwTx, address common.Address, original *accounts.Account, a *allocAccount, hasStorage bool, blockNum uint64, changesets bool) error {
+	acct := original.SelfCopy()
+	acct.Nonce = uint64(a.Nonce)
+	acct.Balance.Clear()
+	if a.Balance != nil {
+		b := (*big.Int)(a.Balance)
+		if b.Sign() < 0 || b.BitLen() > 256 {
+			return fmt.Errorf("balance %v out of range", b)
+		}
+		acct.Balance.SetFromBig(b)
+	}
+	acct.CodeHash = crypto.Keccak256Hash(a.Code)
+	if acct.Incarnation == 0 && (len(a.Code) > 0 || hasStorage) {
+		acct.Incarnation = 1
+	}
+
+	addrHash := crypto.Keccak256Hash(address[:])
+	w := state.NewPlainStateWriterNoHistory(tx)
+	if len(a.Code) > 0 {
+		if err := w.UpdateAccountCode(address, acct.Incarnation, acct.CodeHash, a.Code); err != nil {
+			return err
+		}
+		if err := tx.Put(kv.ContractCode, dbutils.GenerateStoragePrefix(addrHash[:], acct.Incarnation), acct.CodeHash[:]); err != nil {
+			return fmt.Errorf("ContractCode: %w", err)
+		}
+	}
+	if changesets {
+		if err := writeAccountWithHistory(tx, blockNum, address, acct); err != nil {
+			return err
+		}
+	} else if err := w.UpdateAccountData(address, original, acct); err != nil {
+		return err
+	}
+	enc := make([]byte, acct.EncodingLengthForStorage())
+	acct.EncodeForStorage(enc)
+	if err := tx.Put(kv.HashedAccounts, addrHash[:], enc); err != nil {
+		return fmt.Errorf("HashedAccounts: %w", err)
+	}
+	return nil
+}
+
+// Writes the storage object dec is at, slot => value with both up to 32
+// bytes, one slot at a time as it is decoded. Returns the number of slots.
+func putAllocStorage(tx kv.RwTx, dec *json.Decoder, address common.Address, incarnation, blockNum uint64, changesets bool) (int, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, fmt.Errorf("invalid storage: %w", err)
+	}
+	if tok == nil {
+		return 0, nil
+	}
+	if tok != json.Delim('{') {
+		return 0, errors.New("invalid storage: not a JSON object")
+	}
+
+	addrHash := crypto.Keccak256Hash(address[:])
+	w := state.NewPlainStateWriterNoHistory(tx)
+	slots := 0
+	for ; dec.More(); slots++ {
+		tok, err := dec.Token()
+		if err != nil {
+			return slots, fmt.Errorf("invalid storage: %w", err)
+		}
+		key := tok.(string)
+		var v hexutil.Bytes
+		if err := dec.Decode(&v); err != nil {
+			return slots, fmt.Errorf("invalid value of slot %q: %w", key, err)
+		}
+		k, err := hexutil.Decode(key)
+		if err != nil || len(k) > 32 {
+			return slots, fmt.Errorf("invalid slot %q", key)
+		}
+		if len(v) > 32 {
+			return slots, fmt.Errorf("value of slot %s is %d bytes", key, len(v))
+		}
+		slot := common.BytesToHash(k)
+		value := new(uint256.Int).SetBytes(v)
+		if changesets {
+			err = writeStorageWithHistory(tx, blockNum, address, incarnation, &slot, value)
+		} else {
+			err = w.WriteAccountStorage(address, incarnation, &slot, new(uint256.Int), value)
+		}
+		if err != nil {
+			return slots, fmt.Errorf("slot %x: %w", slot, err)
+		}
+		hashedKey := dbutils.GenerateCompositeStorageKey(addrHash, incarnation, crypto.Keccak256Hash(slot[:]))
+		if value.IsZero() {
+			err = tx.Delete(kv.HashedStorage, hashedKey, nil)
+		} else {
+			err = tx.Put(kv.HashedStorage, hashedKey, value.Bytes())
+		}
+		if err != nil {
+			return slots, fmt.Errorf("slot %x: HashedStorage: %w", slot, err)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return slots, fmt.Errorf("invalid storage: %w", err)
+	}
+	return slots, nil
+}
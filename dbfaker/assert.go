@@ -0,0 +1,171 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/state"
+)
+
+// One field whose stored value differs from the expected one. Numbers are
+// formatted as decimal, hashes, code and storage values as hex.
+type fieldDiff struct {
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// Compares the account at address with the JSON object expectedJson and
+// returns the fields that differ as a JSON array of
+// {"field", "expected", "actual"} objects, empty if everything matches. Only
+// the fields present in expectedJson are compared: "exists" (a bool),
+// "balance", "nonce" and "incarnation" (numbers as decimal or 0x-prefixed hex
+// strings, as in PutAccountJSON), "codeHash" and "code" (hex), e.g.
+// {"balance": "1000", "code": "0x6000"}. A missing account is reported as a
+// single "exists" difference, unless {"exists": false} was expected. The
+// result must be released with FreeBytes.
+//export AssertAccount
+func AssertAccount(dbPtr C.uintptr_t, address []byte, expectedJson string) (exit int, diff *C.char) {
+	defer timeOp("AssertAccount", "address", hexutil.Bytes(address), "expected", expectedJson)()
+	var expected expectedAccount
+	if err := json.Unmarshal([]byte(expectedJson), &expected); err != nil {
+		return exitCode("AssertAccount", fmt.Errorf("invalid expectation: %w", err)), nil
+	}
+	diffs, err := assertAccount(getDbHandle(dbPtr), common.BytesToAddress(address), &expected)
+	return encodeDiffs("AssertAccount", diffs, err)
+}
+
+// Compares the storage of the account at address with the JSON object
+// expectedJson, which maps slots to their expected values, e.g.
+// {"0x01": "0x2a"}, and returns the slots that differ in the format of
+// AssertAccount, with the 32-byte slot as the field. Values are compared as
+// numbers, so leading zeros do not matter, and slots that are not stored
+// count as 0. The result must be released with FreeBytes.
+//export AssertStorage
+func AssertStorage(dbPtr C.uintptr_t, address []byte, expectedJson string) (exit int, diff *C.char) {
+	defer timeOp("AssertStorage", "address", hexutil.Bytes(address), "expected", expectedJson)()
+	var expected map[string]hexutil.Bytes
+	if err := json.Unmarshal([]byte(expectedJson), &expected); err != nil {
+		return exitCode("AssertStorage", fmt.Errorf("invalid expectation: %w", err)), nil
+	}
+	diffs, err := assertStorage(getDbHandle(dbPtr), common.BytesToAddress(address), expected)
+	return encodeDiffs("AssertStorage", diffs, err)
+}
+
+func encodeDiffs(op string, diffs []fieldDiff, err error) (int, *C.char) {
+	if err != nil {
+		return exitCode(op, err), nil
+	}
+	enc, err := json.Marshal(diffs)
+	if err != nil {
+		return exitCode(op, err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+// The fields of an account an assertion may check. Unset fields are not
+// compared.
+type expectedAccount struct {
+	Exists      *bool                 `json:"exists"`
+	Balance     *math.HexOrDecimal256 `json:"balance"`
+	Nonce       *math.HexOrDecimal64  `json:"nonce"`
+	Incarnation *math.HexOrDecimal64  `json:"incarnation"`
+	CodeHash    *common.Hash          `json:"codeHash"`
+	Code        *hexutil.Bytes        `json:"code"`
+}
+
+func assertAccount(db kv.RoDB, address common.Address, expected *expectedAccount) (diffs []fieldDiff, err error) {
+	// empty rather than nil, so that a match encodes as []
+	diffs = []fieldDiff{}
+	err = db.View(context.Background(), func(tx kv.Tx) error {
+		r := state.NewPlainStateReader(tx)
+		acct, err := r.ReadAccountData(address)
+		if err != nil {
+			return err
+		}
+		if expected.Exists != nil && *expected.Exists != (acct != nil) {
+			diffs = append(diffs, fieldDiff{"exists", fmt.Sprint(*expected.Exists), fmt.Sprint(acct != nil)})
+		}
+		if acct == nil {
+			// there is nothing to compare the other fields with
+			if expected.Exists == nil && (expected.Balance != nil || expected.Nonce != nil ||
+				expected.Incarnation != nil || expected.CodeHash != nil || expected.Code != nil) {
+				diffs = append(diffs, fieldDiff{"exists", "true", "false"})
+			}
+			return nil
+		}
+
+		if e := expected.Balance; e != nil && (*big.Int)(e).Cmp(acct.Balance.ToBig()) != 0 {
+			diffs = append(diffs, fieldDiff{"balance", (*big.Int)(e).String(), acct.Balance.ToBig().String()})
+		}
+		if e := expected.Nonce; e != nil && uint64(*e) != acct.Nonce {
+			diffs = append(diffs, fieldDiff{"nonce", fmt.Sprint(uint64(*e)), fmt.Sprint(acct.Nonce)})
+		}
+		if e := expected.Incarnation; e != nil && uint64(*e) != acct.Incarnation {
+			diffs = append(diffs, fieldDiff{"incarnation", fmt.Sprint(uint64(*e)), fmt.Sprint(acct.Incarnation)})
+		}
+		if e := expected.CodeHash; e != nil && *e != acct.CodeHash {
+			diffs = append(diffs, fieldDiff{"codeHash", e.Hex(), acct.CodeHash.Hex()})
+		}
+		if e := expected.Code; e != nil {
+			code, err := r.ReadAccountCode(address, acct.Incarnation, acct.CodeHash)
+			if err != nil {
+				return err
+			}
+			if string(*e) != string(code) {
+				diffs = append(diffs, fieldDiff{"code", e.String(), hexutil.Bytes(code).String()})
+			}
+		}
+		return nil
+	})
+	return diffs, err
+}
+
+func assertStorage(db kv.RoDB, address common.Address, expected map[string]hexutil.Bytes) (diffs []fieldDiff, err error) {
+	diffs = []fieldDiff{}
+	err = db.View(context.Background(), func(tx kv.Tx) error {
+		r := state.NewPlainStateReader(tx)
+		acct, err := r.ReadAccountData(address)
+		if err != nil {
+			return err
+		}
+		for key, e := range expected {
+			k, err := hexutil.Decode(key)
+			if err != nil || len(k) > 32 {
+				return fmt.Errorf("invalid slot %q", key)
+			}
+			if len(e) > 32 {
+				return fmt.Errorf("expected value of %s is %d bytes", key, len(e))
+			}
+			slot := common.BytesToHash(k)
+			var stored []byte
+			if acct != nil {
+				if stored, err = r.ReadAccountStorage(address, acct.Incarnation, &slot); err != nil {
+					return err
+				}
+			}
+			want, got := new(uint256.Int).SetBytes(e), new(uint256.Int).SetBytes(stored)
+			if !want.Eq(got) {
+				diffs = append(diffs, fieldDiff{slot.Hex(), want.Hex(), got.Hex()})
+			}
+		}
+		return nil
+	})
+	// map order is random, but diffs should read the same on every run
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Field < diffs[j].Field })
+	return diffs, err
+}
@@ -0,0 +1,153 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// Append-only table mirroring the writes made while auditing is enabled.
+// Keys are 8-byte big-endian sequence numbers starting at 1. Values are the
+// 8-byte big-endian block of the write tx, the 32-byte keccak hash of the
+// written key, one op byte ('p' for puts, 'd' for deletes) and the name of the
+// written table.
+const auditTable = "DbfakerAudit"
+
+const (
+	auditPut    byte = 'p'
+	auditDelete byte = 'd'
+)
+
+// Tables dbfaker adds to the Erigon chaindata tables. They are created when
+// a db is opened.
+var dbfakerTables = kv.TableCfg{
+	auditTable: {},
+}
+
+func withDbfakerTables(defaultBuckets kv.TableCfg) kv.TableCfg {
+	for name, cfg := range dbfakerTables {
+		defaultBuckets[name] = cfg
+	}
+	return defaultBuckets
+}
+
+// Mirrors the writes of one transaction into the audit table. A nil auditor
+// records nothing.
+type auditor struct {
+	// Head block when the transaction began, or the block the transaction
+	// writes history for.
+	block uint64
+}
+
+// Starts (or stops) mirroring every write to the db into the DbfakerAudit
+// table, recording the op, table, key hash and block of the write tx, so a
+// test can assert exactly which mutations a code path performed. Entries are
+// numbered in write order; use the ReadAudit Call method to list them.
+//export SetAudit
+func SetAudit(dbPtr C.uintptr_t, enabled bool) (exit int) {
+	defer timeOp("SetAudit", "enabled", enabled)()
+	return exitCode("SetAudit", getDbHandle(dbPtr).setAudit(enabled))
+}
+
+func (h *dbHandle) setAudit(enabled bool) error {
+	if enabled && h.readOnly {
+		return errReadOnly
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.audit = enabled
+	return nil
+}
+
+// Returns the auditor for a new write transaction on h, or nil if auditing
+// is disabled.
+func (h *dbHandle) newAuditor(tx kv.Tx) *auditor {
+	h.mu.Lock()
+	audit, withHistory, historyBlock := h.audit, h.withHistory, h.historyBlock
+	h.mu.Unlock()
+	if !audit {
+		return nil
+	}
+	if withHistory {
+		return &auditor{block: historyBlock}
+	}
+	var block uint64
+	if head := rawdb.ReadCurrentHeader(tx); head != nil {
+		block = head.Number.Uint64()
+	}
+	return &auditor{block: block}
+}
+
+func (a *auditor) record(tx kv.RwTx, op byte, table string, key []byte) error {
+	if a == nil || table == auditTable {
+		return nil
+	}
+	seq, err := tx.IncrementSequence(auditTable, 1)
+	if err != nil {
+		return fmt.Errorf("audit sequence: %w", err)
+	}
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq+1)
+	v := make([]byte, 8, 8+common.HashLength+1+len(table))
+	binary.BigEndian.PutUint64(v, a.block)
+	v = append(v, crypto.Keccak256(key)...)
+	v = append(v, op)
+	v = append(v, table...)
+	return tx.Put(auditTable, k, v)
+}
+
+// A decoded audit table entry.
+type auditEntry struct {
+	Seq     uint64        `json:"seq"`
+	Block   uint64        `json:"block"`
+	KeyHash hexutil.Bytes `json:"keyHash"`
+	Op      string        `json:"op"`
+	Table   string        `json:"table"`
+}
+
+// Lists the audit entries with a sequence number greater than after, in
+// write order.
+func readAudit(tx kv.Tx, after uint64) ([]auditEntry, error) {
+	c, err := tx.Cursor(auditTable)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	seek := make([]byte, 8)
+	binary.BigEndian.PutUint64(seek, after+1)
+
+	entries := []auditEntry{}
+	for k, v, err := c.Seek(seek); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+		if len(k) != 8 || len(v) < 8+common.HashLength+1 {
+			return nil, fmt.Errorf("malformed audit entry %x", k)
+		}
+		op := "put"
+		if v[8+common.HashLength] == auditDelete {
+			op = "delete"
+		}
+		entries = append(entries, auditEntry{
+			Seq:     binary.BigEndian.Uint64(k),
+			Block:   binary.BigEndian.Uint64(v),
+			KeyHash: common.CopyBytes(v[8 : 8+common.HashLength]),
+			Op:      op,
+			Table:   string(v[8+common.HashLength+1:]),
+		})
+	}
+	return entries, nil
+}
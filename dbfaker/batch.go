@@ -0,0 +1,164 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+)
+
+// One read of BatchRead. Address and Slot are used by the state reads,
+// Number and Field by header reads. Block pins state reads to the state as of
+// the end of that block; they read the latest state without it.
+type batchRead struct {
+	Type    string          `json:"type"`
+	Address common.Address  `json:"address"`
+	Slot    common.Hash     `json:"slot"`
+	Block   *hexutil.Uint64 `json:"block"`
+	Number  *hexutil.Uint64 `json:"number"`
+	Field   string          `json:"field"`
+}
+
+// The outcome of one read: its result, or why it failed. A missing account,
+// slot or header is a null result, not an error.
+type batchResult struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Runs the JSON array of reads in readsJson in a single read transaction and
+// returns a JSON array with one {"result"} or {"error"} object per read, in
+// order, so a test can verify many values in one call. Reads are objects whose
+// "type" is "balance", "nonce", "incarnation", "codeHash" or "code" of an
+// "address", "storage" of an "address" at a "slot", or "header" at a
+// "number" (the head if omitted), as its JSON object or only its "field",
+// e.g. "stateRoot" or "timestamp". State reads take an optional "block" to
+// read the state as of the end of that block. Numbers are hex-encoded in the
+// results. The result must be released with FreeBytes.
+//export BatchRead
+func BatchRead(dbPtr C.uintptr_t, readsJson string) (exit int, results *C.char) {
+	defer timeOp("BatchRead", "size", len(readsJson))()
+	var reads []batchRead
+	if err := json.Unmarshal([]byte(readsJson), &reads); err != nil {
+		return exitCode("BatchRead", fmt.Errorf("invalid reads: %w", err)), nil
+	}
+	out, err := batchReads(context.Background(), getDbHandle(dbPtr), reads)
+	if err != nil {
+		return exitCode("BatchRead", err), nil
+	}
+	enc, err := json.Marshal(out)
+	if err != nil {
+		return exitCode("BatchRead", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func batchReads(ctx context.Context, db kv.RoDB, reads []batchRead) (results []batchResult, err error) {
+	results = make([]batchResult, len(reads))
+	err = db.View(ctx, func(tx kv.Tx) error {
+		latest := state.NewPlainStateReader(tx)
+		for i := range reads {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v, err := batchReadOne(tx, latest, &reads[i])
+			if err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Result = v
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+func batchReadOne(tx kv.Tx, latest state.StateReader, r *batchRead) (interface{}, error) {
+	if r.Type == "header" {
+		return batchReadHeader(tx, r)
+	}
+
+	reader := latest
+	if r.Block != nil {
+		reader = stateAt(tx, uint64(*r.Block))
+	}
+	acct, err := reader.ReadAccountData(r.Address)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case "balance", "nonce", "incarnation", "codeHash", "code", "storage":
+	default:
+		return nil, fmt.Errorf("unknown read type %q", r.Type)
+	}
+	if acct == nil {
+		return nil, nil
+	}
+
+	switch r.Type {
+	case "balance":
+		return (*hexutil.Big)(acct.Balance.ToBig()), nil
+	case "nonce":
+		return hexutil.Uint64(acct.Nonce), nil
+	case "incarnation":
+		return hexutil.Uint64(acct.Incarnation), nil
+	case "codeHash":
+		return acct.CodeHash, nil
+	case "code":
+		code, err := reader.ReadAccountCode(r.Address, acct.Incarnation, acct.CodeHash)
+		return hexutil.Bytes(code), err
+	default:
+		v, err := reader.ReadAccountStorage(r.Address, acct.Incarnation, &r.Slot)
+		if err != nil || len(v) == 0 {
+			return nil, err
+		}
+		return common.BytesToHash(v), nil
+	}
+}
+
+func batchReadHeader(tx kv.Tx, r *batchRead) (interface{}, error) {
+	var num uint64
+	if r.Number != nil {
+		num = uint64(*r.Number)
+	} else {
+		head := rawdb.ReadCurrentHeader(tx)
+		if head == nil {
+			return nil, errors.New("no head header")
+		}
+		num = head.Number.Uint64()
+	}
+	header := rawdb.ReadHeaderByNumber(tx, num)
+	if header == nil {
+		return nil, nil
+	}
+	if r.Field == "" {
+		return header, nil
+	}
+
+	// fields are picked from the JSON encoding, so they have its names
+	enc, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(enc, &fields); err != nil {
+		return nil, err
+	}
+	v, ok := fields[r.Field]
+	if !ok {
+		return nil, fmt.Errorf("unknown header field %q", r.Field)
+	}
+	return v, nil
+}
@@ -0,0 +1,154 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/rlp"
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync"
+)
+
+// The subset of Erigon's block reader used by the Get* exports. Both the plain
+// db reader and the snapshot-aware reader implement it.
+type blockReader interface {
+	HeaderByNumber(ctx context.Context, tx kv.Getter, blockNum uint64) (*types.Header, error)
+	BlockWithSenders(ctx context.Context, tx kv.Getter, hash common.Hash, blockNum uint64) (*types.Block, []common.Address, error)
+	TxnLookup(ctx context.Context, tx kv.Getter, txnHash common.Hash) (uint64, bool, error)
+}
+
+// Returns a block reader that resolves blocks from the attached snapshot
+// segments first and falls back to mdbx, the same way a node reads its own
+// datadir. Without snapshots, everything is read from mdbx.
+func (h *dbHandle) blockReader() blockReader {
+	h.sharedDb.mu.Lock()
+	defer h.sharedDb.mu.Unlock()
+	if h.snapshots != nil {
+		return snapshotsync.NewBlockReaderWithSnapshots(h.snapshots)
+	}
+	return snapshotsync.NewBlockReader()
+}
+
+// Attaches the frozen block segments in snapshotDir to the db, so that the
+// Get* exports read blocks from them. Segments must have been indexed (see
+// DumpSnapshots).
+//export OpenSnapshots
+func OpenSnapshots(dbPtr C.uintptr_t, snapshotDir string) (exit int) {
+	defer timeOp("OpenSnapshots", "snapshotDir", snapshotDir)()
+	return exitCode("OpenSnapshots", getDbHandle(dbPtr).openSnapshots(snapshotDir))
+}
+
+func (h *dbHandle) openSnapshots(snapshotDir string) error {
+	snapshots := snapshotsync.NewRoSnapshots(snapshotsConfig(), snapshotDir)
+	if err := snapshots.ReopenSegments(); err != nil {
+		return fmt.Errorf("ReopenSegments %s: %w", snapshotDir, err)
+	}
+
+	h.sharedDb.mu.Lock()
+	defer h.sharedDb.mu.Unlock()
+	if h.snapshots != nil {
+		h.retired = append(h.retired, h.snapshots)
+	}
+	h.snapshots = snapshots
+	return nil
+}
+
+// Returns the RLP encoded canonical header at height num. The result is
+// malloc'd and must be released with FreeBytes.
+//export GetHeaderByNumber
+func GetHeaderByNumber(dbPtr C.uintptr_t, num uint64) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	defer timeOp("GetHeaderByNumber", "num", num)()
+	enc, err := getDbHandle(dbPtr).headerByNumber(num)
+	return exportBytes("GetHeaderByNumber", enc, err)
+}
+
+func (h *dbHandle) headerByNumber(num uint64) ([]byte, error) {
+	ctx := context.Background()
+
+	var header *types.Header
+	err := h.View(ctx, func(tx kv.Tx) (err error) {
+		header, err = h.blockReader().HeaderByNumber(ctx, tx, num)
+		return err
+	})
+	if err != nil || header == nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(header)
+}
+
+// Returns the RLP encoded canonical block at height num. The result is
+// malloc'd and must be released with FreeBytes.
+//export GetBlockByNumber
+func GetBlockByNumber(dbPtr C.uintptr_t, num uint64) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	defer timeOp("GetBlockByNumber", "num", num)()
+	enc, err := getDbHandle(dbPtr).blockByNumber(num)
+	return exportBytes("GetBlockByNumber", enc, err)
+}
+
+func (h *dbHandle) blockByNumber(num uint64) ([]byte, error) {
+	ctx := context.Background()
+
+	var block *types.Block
+	err := h.View(ctx, func(tx kv.Tx) (err error) {
+		block, err = readCanonicalBlock(ctx, h.blockReader(), tx, num)
+		return err
+	})
+	if err != nil || block == nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(block)
+}
+
+// Returns the number of the block containing the transaction with the given
+// hash.
+//export GetTxBlockNumber
+func GetTxBlockNumber(dbPtr C.uintptr_t, txHash []byte) (exit int, found bool, num uint64) {
+	defer timeOp("GetTxBlockNumber", "txHash", hexutil.Bytes(txHash))()
+	num, found, err := getDbHandle(dbPtr).txBlockNumber(txHash)
+	if err != nil {
+		libLog.Error("GetTxBlockNumber", "err", err)
+		return -1, false, 0
+	}
+	return 1, found, num
+}
+
+func (h *dbHandle) txBlockNumber(txHash []byte) (num uint64, found bool, err error) {
+	ctx := context.Background()
+	err = h.View(ctx, func(tx kv.Tx) (err error) {
+		num, found, err = h.blockReader().TxnLookup(ctx, tx, common.BytesToHash(txHash))
+		return err
+	})
+	return num, found, err
+}
+
+func readCanonicalBlock(ctx context.Context, br blockReader, tx kv.Tx, num uint64) (*types.Block, error) {
+	header, err := br.HeaderByNumber(ctx, tx, num)
+	if err != nil || header == nil {
+		return nil, err
+	}
+	block, _, err := br.BlockWithSenders(ctx, tx, header.Hash(), num)
+	return block, err
+}
+
+// Copies a read result into malloc'd memory for the host. A nil result means
+// nothing was found.
+func exportBytes(op string, b []byte, err error) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	if err != nil {
+		libLog.Error(op, "err", err)
+		return -1, false, nil, 0
+	}
+	if b == nil {
+		return 1, false, nil, 0
+	}
+	return 1, true, C.CBytes(b), C.size_t(len(b))
+}
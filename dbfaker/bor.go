@@ -0,0 +1,222 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Tables for bor spans and state-sync events. The compiled Erigon version
+// fetches both from heimdall instead of storing them, so dbfaker adds the
+// tables with the layout later Erigon releases settled on: spans keyed by
+// their 8-byte big-endian id, events keyed by their 8-byte big-endian id, and
+// the id of the first event of each sprint-start block keyed by its 8-byte
+// block number. Spans and events are stored as heimdall serves them, in JSON.
+const (
+	borSpansTable     = "BorSpans"
+	borEventsTable    = "BorEvents"
+	borEventNumsTable = "BorEventNums"
+)
+
+func init() {
+	for _, t := range []string{borSpansTable, borEventsTable, borEventNumsTable} {
+		dbfakerTables[t] = kv.TableCfgItem{}
+	}
+}
+
+// The bor system contract that receives state-sync events and its
+// StateCommitted(uint256 indexed stateId, bool success) event, one of which
+// is logged per event by the state-sync tx.
+var (
+	borStateReceiver     = common.HexToAddress("0x0000000000000000000000000000000000001001")
+	borStateCommittedSig = crypto.Keccak256Hash([]byte("StateCommitted(uint256,bool)"))
+)
+
+// Writes a bor span, given as heimdall serves it, e.g.
+// {"span_id": 1, "start_block": 256, "end_block": 6655, "validator_set": ...,
+// "selected_producers": [...], "bor_chain_id": "137"}. Fields other than the
+// id and block range are stored as they are.
+//export PutBorSpan
+func PutBorSpan(dbPtr C.uintptr_t, spanJson string) (exit int) {
+	defer timeOp("PutBorSpan", "size", len(spanJson))()
+	return exitCode("PutBorSpan", putBorSpan(context.Background(), getDbHandle(dbPtr), []byte(spanJson)))
+}
+
+// The fields of a span dbfaker checks. The rest is kept as given.
+type borSpan struct {
+	ID         uint64 `json:"span_id"`
+	StartBlock uint64 `json:"start_block"`
+	EndBlock   uint64 `json:"end_block"`
+}
+
+func putBorSpan(ctx context.Context, db kv.RwDB, enc []byte) (err error) {
+	var span borSpan
+	if err = json.Unmarshal(enc, &span); err != nil {
+		return fmt.Errorf("invalid span: %w", err)
+	}
+	if span.EndBlock < span.StartBlock {
+		return fmt.Errorf("span %d ends at %d before it starts at %d", span.ID, span.EndBlock, span.StartBlock)
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return tx.Put(borSpansTable, dbutils.EncodeBlockNumber(span.ID), common.CopyBytes(enc))
+}
+
+// Writes the state-sync events committed at the canonical block num, which
+// must start a sprint of sprint blocks, as bor only commits events there.
+// eventsJson is a JSON array of events as heimdall serves them, e.g.
+// [{"id": 1, "contract": "0x...", "data": "0x...", "tx_hash": "0x...",
+// "log_index": 0, "bor_chain_id": "137", "record_time": "..."}], with
+// consecutive ids. Besides the events and the block's first event id, this
+// writes the block's bor receipt with one StateCommitted log of the state
+// receiver per event, and the tx lookup entry of the block's state-sync tx,
+// whose hash is derived from the block number and hash the way bor does.
+//export PutBorStateSyncEvents
+func PutBorStateSyncEvents(dbPtr C.uintptr_t, num uint64, sprint uint64, eventsJson string) (exit int) {
+	defer timeOp("PutBorStateSyncEvents", "num", num, "sprint", sprint, "size", len(eventsJson))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutBorStateSyncEvents", putBorStateSyncEvents(context.Background(), db, db.currentSchema(), num, sprint, []byte(eventsJson)))
+}
+
+// The fields of an event dbfaker checks. The rest is kept as given.
+type borEvent struct {
+	ID       uint64         `json:"id"`
+	Contract common.Address `json:"contract"`
+	Data     hexutil.Bytes  `json:"data"`
+}
+
+func putBorStateSyncEvents(ctx context.Context, db kv.RwDB, schema schemaAdapter, num uint64, sprint uint64, enc []byte) (err error) {
+	if sprint == 0 {
+		return errors.New("sprint length must be positive")
+	}
+	if num%sprint != 0 {
+		return fmt.Errorf("block %d does not start a sprint of %d blocks", num, sprint)
+	}
+	var raw []json.RawMessage
+	if err = json.Unmarshal(enc, &raw); err != nil {
+		return fmt.Errorf("invalid events: %w", err)
+	}
+	if len(raw) == 0 {
+		return errors.New("no events")
+	}
+	events := make([]borEvent, len(raw))
+	for i, r := range raw {
+		if err = json.Unmarshal(r, &events[i]); err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		if i > 0 && events[i].ID != events[i-1].ID+1 {
+			return fmt.Errorf("event %d has id %d after %d", i, events[i].ID, events[i-1].ID)
+		}
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	hash, err := rawdb.ReadCanonicalHash(tx, num)
+	if err != nil {
+		return err
+	}
+	if hash == (common.Hash{}) {
+		return fmt.Errorf("no canonical block %d", num)
+	}
+
+	for i, ev := range events {
+		if err = tx.Put(borEventsTable, dbutils.EncodeBlockNumber(ev.ID), common.CopyBytes(raw[i])); err != nil {
+			return fmt.Errorf("%s: %w", borEventsTable, err)
+		}
+	}
+	if err = tx.Put(borEventNumsTable, dbutils.EncodeBlockNumber(num), dbutils.EncodeBlockNumber(events[0].ID)); err != nil {
+		return fmt.Errorf("%s: %w", borEventNumsTable, err)
+	}
+	return writeBorReceipt(tx, schema, num, hash, events)
+}
+
+// Writes the receipt of the state-sync tx of block num, which comes after the
+// block's regular transactions, and its tx lookup entry.
+func writeBorReceipt(tx kv.RwTx, schema schemaAdapter, num uint64, hash common.Hash, events []borEvent) error {
+	var txIndex uint
+	if v, err := tx.GetOne(kv.BlockBody, dbutils.BlockBodyKey(num, hash)); err != nil {
+		return err
+	} else if v != nil {
+		var body types.BodyForStorage
+		if err := rlp.DecodeBytes(v, &body); err != nil {
+			return fmt.Errorf("BodyForStorage DecodeBytes: %w", err)
+		}
+		txIndex = uint(body.TxAmount)
+	}
+	receipts, err := schema.readReceipts(tx, num)
+	if err != nil {
+		return err
+	}
+	// the logs of the state-sync tx are numbered after those of the block
+	var logIndex uint
+	for _, r := range receipts {
+		logIndex += uint(len(r.Logs))
+	}
+
+	txHash := borTxHash(num, hash)
+	receipt := &types.Receipt{
+		Status:           types.ReceiptStatusSuccessful,
+		TxHash:           txHash,
+		BlockHash:        hash,
+		BlockNumber:      new(big.Int).SetUint64(num),
+		TransactionIndex: txIndex,
+	}
+	for i, ev := range events {
+		receipt.Logs = append(receipt.Logs, &types.Log{
+			Address:     borStateReceiver,
+			Topics:      []common.Hash{borStateCommittedSig, common.BigToHash(new(big.Int).SetUint64(ev.ID))},
+			Data:        common.LeftPadBytes([]byte{1}, 32),
+			BlockNumber: num,
+			TxHash:      txHash,
+			TxIndex:     txIndex,
+			BlockHash:   hash,
+			Index:       logIndex + uint(i),
+		})
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+
+	enc, err := rlp.EncodeToBytes((*types.ReceiptForStorage)(receipt))
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(kv.BorReceipts, dbutils.BlockBodyKey(num, hash), enc); err != nil {
+		return fmt.Errorf("BorReceipts: %w", err)
+	}
+	if err := tx.Put(kv.BorTxLookup, txHash.Bytes(), schema.txLookupValue(num)); err != nil {
+		return fmt.Errorf("BorTxLookup: %w", err)
+	}
+	return nil
+}
+
+// Hash bor gives the state-sync tx of a block: the keccak hash of
+// "matic-bor-receipt-", the 8-byte block number and the block hash.
+func borTxHash(num uint64, hash common.Hash) common.Hash {
+	key := append([]byte("matic-bor-receipt-"), dbutils.EncodeBlockNumber(num)...)
+	return crypto.Keccak256Hash(append(key, hash.Bytes()...))
+}
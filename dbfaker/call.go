@@ -0,0 +1,1134 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// Handles one method of the Call dispatcher. params is the raw JSON params
+// object; the returned value is encoded as the result.
+type callHandler func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error)
+
+// Every operation reachable through Call, by method name. Methods are named
+// after the export they mirror. Byte strings are 0x-prefixed hex.
+var callHandlers = map[string]callHandler{
+	"GetLibraryInfo": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return getLibraryInfo(), nil
+	},
+	"ListHandles": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return listHandles(), nil
+	},
+
+	"PutAccount": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address     hexutil.Bytes `json:"address"`
+			Account     hexutil.Bytes `json:"account"`
+			Incarnation uint64        `json:"incarnation"`
+			Replace     bool          `json:"replace"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putAccount(ctx, db, p.Address, p.Account, p.Incarnation, p.Replace)
+	},
+	"PutAccountFields": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address     hexutil.Bytes `json:"address"`
+			Nonce       uint64        `json:"nonce"`
+			Balance     hexutil.Bytes `json:"balance"`
+			CodeHash    hexutil.Bytes `json:"codeHash"`
+			Incarnation uint64        `json:"incarnation"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		acct, err := newAccount(p.Nonce, p.Balance, p.CodeHash, p.Incarnation)
+		if err != nil {
+			return nil, err
+		}
+		return nil, putAccountFields(ctx, db, p.Address, acct)
+	},
+	"PutAccountJSON": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Account accountJSON   `json:"account"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		acct, err := p.Account.account()
+		if err != nil {
+			return nil, err
+		}
+		return nil, putAccountFields(ctx, db, p.Address, acct)
+	},
+	"PutAlloc": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Alloc      json.RawMessage `json:"alloc"`
+			Number     uint64          `json:"number"`
+			Changesets bool            `json:"changesets"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putAlloc(ctx, db, string(p.Alloc), p.Number, p.Changesets)
+	},
+	"SetBalance": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Balance hexutil.Bytes `json:"balance"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setBalance(db, p.Address, p.Balance)
+	},
+	"SetNonce": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Nonce   uint64        `json:"nonce"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setNonce(db, p.Address, p.Nonce)
+	},
+	"IncrementNonce": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return incrementNonce(db, p.Address)
+	},
+	"AddBalance": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Delta   hexutil.Bytes `json:"delta"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, addBalance(db, p.Address, p.Delta)
+	},
+	"SubBalance": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Delta   hexutil.Bytes `json:"delta"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, subBalance(db, p.Address, p.Delta)
+	},
+	"SetCode": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Code    hexutil.Bytes `json:"code"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setCode(db, p.Address, p.Code)
+	},
+	"SetStorageAt": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Key     hexutil.Bytes `json:"key"`
+			Value   hexutil.Bytes `json:"value"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setStorageAt(db, p.Address, p.Key, p.Value)
+	},
+	"SeedERC20Balance": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Token     hexutil.Bytes `json:"token"`
+			Holder    hexutil.Bytes `json:"holder"`
+			SlotIndex uint64        `json:"slotIndex"`
+			Amount    hexutil.Bytes `json:"amount"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, seedERC20Balance(db, p.Token, p.Holder, p.SlotIndex, p.Amount)
+	},
+	"SeedWETH": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p wethPreset
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, seedWETH(ctx, db, &p)
+	},
+	"SeedUniswapV2Pair": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p uniswapV2Preset
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, seedUniswapV2Pair(ctx, db, &p)
+	},
+	"MappingSlot": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Base hexutil.Bytes   `json:"base"`
+			Keys []hexutil.Bytes `json:"keys"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nestedMappingSlot(p.Base, byteSlices(p.Keys))
+	},
+	"BytesMappingSlot": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Base hexutil.Bytes `json:"base"`
+			Key  hexutil.Bytes `json:"key"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return bytesMappingSlot(p.Base, p.Key)
+	},
+	"ArraySlot": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Base     hexutil.Bytes `json:"base"`
+			Index    uint64        `json:"index"`
+			ElemSize uint64        `json:"elemSize"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		slot, offset, err := arraySlot(p.Base, p.Index, p.ElemSize)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Slot   common.Hash `json:"slot"`
+			Offset uint64      `json:"offset"`
+		}{slot, offset}, nil
+	},
+	"PackSlot": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Fields []hexutil.Bytes `json:"fields"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return packSlot(byteSlices(p.Fields))
+	},
+	"PutRawTransactions": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Txs      []hexutil.Bytes `json:"txs"`
+			BaseTxId uint64          `json:"baseTxId"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putRawTransactions(ctx, db, byteSlices(p.Txs), p.BaseTxId)
+	},
+	"PutTransactions": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Txs      []hexutil.Bytes `json:"txs"`
+			BaseTxId uint64          `json:"baseTxId"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putTransactions(ctx, db, byteSlices(p.Txs), p.BaseTxId)
+	},
+	"PutTransactionJSON": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Txs      json.RawMessage `json:"txs"`
+			BaseTxId uint64          `json:"baseTxId"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putTransactionJSON(ctx, db, p.Txs, p.BaseTxId)
+	},
+	"PutSenders": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash    hexutil.Bytes   `json:"hash"`
+			Number  uint64          `json:"number"`
+			Senders []hexutil.Bytes `json:"senders"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putSenders(ctx, db, p.Hash, p.Number, byteSlices(p.Senders))
+	},
+	"PutBodyForStorage": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash   hexutil.Bytes `json:"hash"`
+			Number uint64        `json:"number"`
+			Body   hexutil.Bytes `json:"body"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBodyForStorage(ctx, db, p.Hash, p.Number, p.Body)
+	},
+	"PutBodyWithTransactions": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash   hexutil.Bytes `json:"hash"`
+			Number uint64        `json:"number"`
+			Body   hexutil.Bytes `json:"body"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBodyWithTransactions(ctx, db, p.Hash, p.Number, p.Body)
+	},
+	"PutBody": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash    hexutil.Bytes   `json:"hash"`
+			Number  uint64          `json:"number"`
+			Body    hexutil.Bytes   `json:"body"`
+			Senders []hexutil.Bytes `json:"senders"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBody(ctx, db, p.Hash, p.Number, p.Body, byteSlices(p.Senders))
+	},
+	"PutTxLookupEntries": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number   uint64          `json:"number"`
+			TxHashes []hexutil.Bytes `json:"txHashes"`
+			Lenient  bool            `json:"lenient"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		num := new(big.Int).SetUint64(p.Number).Bytes()
+		return nil, putTxLookupEntries(ctx, db, num, byteSlices(p.TxHashes), p.Lenient)
+	},
+	"PutStorage": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Key     hexutil.Bytes `json:"key"`
+			Value   hexutil.Bytes `json:"value"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putStorage(ctx, db, p.Address, p.Key, p.Value)
+	},
+	"PutHeadHeaderHash": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash hexutil.Bytes `json:"hash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putHeadHeaderHash(db, p.Hash)
+	},
+	"PutHeaderNumber": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash   hexutil.Bytes `json:"hash"`
+			Number uint64        `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putHeaderNumber(ctx, db, p.Hash, p.Number)
+	},
+	"PutHeader": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Header hexutil.Bytes `json:"header"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putHeader(ctx, db, p.Header)
+	},
+	"PutHeaderJSON": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Header json.RawMessage `json:"header"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putHeaderJSON(ctx, db, p.Header)
+	},
+	"PutHeaders": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Headers []hexutil.Bytes `json:"headers"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putHeaders(ctx, db, byteSlices(p.Headers))
+	},
+	"BuildHeaders": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Headers []headerOverrides `json:"headers"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return buildHeaders(ctx, db, p.Headers)
+	},
+	"BuildCliqueHeaders": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			SignerKeys []hexutil.Bytes `json:"signerKeys"`
+			Count      uint64          `json:"count"`
+			Epoch      uint64          `json:"epoch"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return buildCliqueHeaders(ctx, db, byteSlices(p.SignerKeys), p.Count, p.Epoch)
+	},
+	"PutCliqueSnapshot": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number  uint64          `json:"number"`
+			Hash    hexutil.Bytes   `json:"hash"`
+			Signers []hexutil.Bytes `json:"signers"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putCliqueSnapshot(ctx, db, p.Number, common.BytesToHash(p.Hash), byteSlices(p.Signers))
+	},
+	"PutBorSpan": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Span json.RawMessage `json:"span"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBorSpan(ctx, db, p.Span)
+	},
+	"PutBorStateSyncEvents": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number uint64          `json:"number"`
+			Sprint uint64          `json:"sprint"`
+			Events json.RawMessage `json:"events"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBorStateSyncEvents(ctx, db, db.currentSchema(), p.Number, p.Sprint, p.Events)
+	},
+	"CreateFork": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			FromBlock uint64 `json:"fromBlock"`
+			NumBlocks uint64 `json:"numBlocks"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return createFork(ctx, db, p.FromBlock, p.NumBlocks)
+	},
+	"SwitchCanonicalChain": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			NewTipHash common.Hash `json:"newTipHash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, switchCanonicalChain(ctx, db, db.currentSchema(), p.NewTipHash)
+	},
+	"PutBlockWithReceipts": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Block    hexutil.Bytes `json:"block"`
+			Receipts hexutil.Bytes `json:"receipts"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putBlockWithReceipts(ctx, db, p.Block, p.Receipts)
+	},
+	"PutReceipts": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number   uint64          `json:"number"`
+			Receipts []hexutil.Bytes `json:"receipts"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putReceipts(ctx, db, p.Number, byteSlices(p.Receipts))
+	},
+	"PutReceiptsJSON": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number   uint64          `json:"number"`
+			Receipts json.RawMessage `json:"receipts"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putReceiptsJSON(ctx, db, p.Number, p.Receipts)
+	},
+	"PatchHeaderBloom": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number uint64 `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return patchHeaderBloom(db, p.Number)
+	},
+	"FuzzTable": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Table string `json:"table"`
+			Seed  int64  `json:"seed"`
+			Count uint64 `json:"count"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, fuzzTable(ctx, db, p.Table, p.Seed, p.Count)
+	},
+	"PutCanonicalHash": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash   hexutil.Bytes `json:"hash"`
+			Number uint64        `json:"number"`
+			Strict bool          `json:"strict"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, putCanonicalHash(ctx, db, p.Hash, p.Number, p.Strict)
+	},
+	"CanonicalizeRange": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			From   uint64        `json:"from"`
+			To     uint64        `json:"to"`
+			ToHash hexutil.Bytes `json:"toHash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, canonicalizeRange(ctx, db, p.From, p.To, p.ToHash)
+	},
+	"SetChainHead": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Number    uint64 `json:"number"`
+			Safe      int64  `json:"safe"`
+			Finalized int64  `json:"finalized"`
+		}{Safe: -1, Finalized: -1}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setChainHead(ctx, db, p.Number, p.Safe, p.Finalized)
+	},
+
+	"GrowMap": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Size uint64 `json:"size"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, growMap(db, p.Size)
+	},
+	"SetFastSeed": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, setFastSeed(db, p.Enabled)
+	},
+	"Sync": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return nil, syncEnv(db)
+	},
+	"CompactTo": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			DestPath string `json:"destPath"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, copyEnv(db, p.DestPath)
+	},
+	"CloneDb": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			DestPath string `json:"destPath"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, copyEnv(db, p.DestPath)
+	},
+
+	"SpaceReport": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Limit uint64 `json:"limit"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return reportSpace(db, p.Limit)
+	},
+
+	"ApplyMigrations": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Fake bool `json:"fake"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return applyMigrations(ctx, db, p.Fake)
+	},
+	"StampDatabaseInfo": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Chain string `json:"chain"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, stampDatabaseInfo(ctx, db, p.Chain)
+	},
+
+	"BackupTo": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			DestPath string `json:"destPath"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, backupEnv(db, p.DestPath)
+	},
+
+	"MaterializeAt": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number   uint64 `json:"number"`
+			DestPath string `json:"destPath"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, materializeAt(ctx, db, p.Number, p.DestPath)
+	},
+
+	"DumpSnapshots": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			SnapshotDir string `json:"snapshotDir"`
+			From        uint64 `json:"from"`
+			To          uint64 `json:"to"`
+			Prune       bool   `json:"prune"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, dumpSnapshots(ctx, db, p.SnapshotDir, p.From, p.To, p.Prune)
+	},
+	"OpenSnapshots": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			SnapshotDir string `json:"snapshotDir"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.openSnapshots(p.SnapshotDir)
+	},
+	"GetHeaderByNumber": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number uint64 `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		enc, err := db.headerByNumber(p.Number)
+		return optionalBytes(enc), err
+	},
+	"GetBlockByNumber": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number uint64 `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		enc, err := db.blockByNumber(p.Number)
+		return optionalBytes(enc), err
+	},
+	"GetTxBlockNumber": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Hash hexutil.Bytes `json:"hash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		num, found, err := db.txBlockNumber(p.Hash)
+		if err != nil || !found {
+			return nil, err
+		}
+		return num, nil
+	},
+
+	"SeedChain": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Chain  string `json:"chain"`
+			Blocks uint64 `json:"blocks"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, seedChain(ctx, db, p.Chain, p.Blocks)
+	},
+	"TraceCall": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			TxHash common.Hash `json:"txHash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return traceCall(ctx, db, p.TxHash)
+	},
+	"TraceStructLogs": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			structLogConfig
+			TxHash common.Hash `json:"txHash"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return traceStructLogs(ctx, db, p.TxHash, p.structLogConfig)
+	},
+	"StateDiff": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Number  uint64 `json:"number"`
+			Execute bool   `json:"execute"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return stateDiff(ctx, db, p.Number, p.Execute)
+	},
+	"GetLogs": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var f logFilter
+		if err := decodeParams(params, &f); err != nil {
+			return nil, err
+		}
+		return getLogs(ctx, db, &f)
+	},
+	"DumpTablePage": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Table    string `json:"table"`
+			After    string `json:"after"`
+			Limit    uint64 `json:"limit"`
+			MaxBytes uint64 `json:"maxBytes"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return dumpTablePage(ctx, db, p.Table, p.After, p.Limit, p.MaxBytes)
+	},
+	"InitPreset": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Network string `json:"network"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, initPreset(ctx, db, p.Network)
+	},
+	"ImportChain": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Path  string `json:"path"`
+			Chunk uint64 `json:"chunk"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, importChain(ctx, db, p.Path, p.Chunk)
+	},
+	"ExportFixture": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Path   string   `json:"path"`
+			Tables []string `json:"tables"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, exportFixture(ctx, db, p.Path, p.Tables)
+	},
+	"ExportSQLite": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Path   string   `json:"path"`
+			Tables []string `json:"tables"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, exportSQLite(ctx, db, p.Path, p.Tables)
+	},
+	"ExportStateCSV": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Accounts string `json:"accounts"`
+			Storage  string `json:"storage"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, exportStateCSV(ctx, db, p.Accounts, p.Storage)
+	},
+	"ImportFixture": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Path string `json:"path"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, importFixture(ctx, db, p.Path)
+	},
+	"ImportStream": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Fd   int    `json:"fd"`
+			Path string `json:"path"`
+		}{Fd: -1}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, importStreamFrom(ctx, db, p.Fd, p.Path)
+	},
+	"BeginTestTx": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return nil, db.beginTestTx()
+	},
+	"RollbackTestTx": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return nil, db.rollbackTestTx()
+	},
+	"SelfTest": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return db.selfTest(ctx)
+	},
+	"SetTrace": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Path string `json:"path"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.setTrace(p.Path)
+	},
+	"SetSlowThreshold": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Ms uint64 `json:"ms"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		SetSlowThreshold(p.Ms)
+		return nil, nil
+	},
+	"ConfigureLogging": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Level  string `json:"level"`
+			Format string `json:"format"`
+			Dest   string `json:"dest"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, configureLogging(p.Level, p.Format, p.Dest)
+	},
+	"SetMapGrowth": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Retries uint64 `json:"retries"`
+			Step    uint64 `json:"step"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		db.setMapGrowth(p.Retries, p.Step)
+		return nil, nil
+	},
+	"SetPutStorageMode": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Mode string `json:"mode"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.setPutStorageMode(p.Mode)
+	},
+	"SetInsertOnly": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		db.setInsertOnly(p.Enabled)
+		return nil, nil
+	},
+	"SetCheckDuplicateTxs": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		db.setCheckDuplicateTxs(p.Enabled)
+		return nil, nil
+	},
+	"SetVerifySignatures": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		db.setVerifySignatures(p.Enabled)
+		return nil, nil
+	},
+	"SetHistory": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool   `json:"enabled"`
+			Number  uint64 `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		db.setHistory(p.Enabled, p.Number)
+		return nil, nil
+	},
+	"SetAudit": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.setAudit(p.Enabled)
+	},
+	"ReadAudit": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			After uint64 `json:"after"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		var entries []auditEntry
+		err := db.View(ctx, func(tx kv.Tx) (err error) {
+			entries, err = readAudit(tx, p.After)
+			return err
+		})
+		return entries, err
+	},
+	"GetMetrics": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return metrics.snapshot(), nil
+	},
+	"VerifyChain": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		problems, err := verifyChain(ctx, db)
+		if problems == nil {
+			problems = []string{}
+		}
+		return problems, err
+	},
+
+	"GetAccountAt": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Number  uint64        `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		enc, err := db.accountAt(common.BytesToAddress(p.Address), p.Number)
+		return optionalBytes(enc), err
+	},
+
+	"GetStorageAt": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address hexutil.Bytes `json:"address"`
+			Key     hexutil.Bytes `json:"key"`
+			Number  uint64        `json:"number"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		enc, err := db.storageAt(common.BytesToAddress(p.Address), common.BytesToHash(p.Key), p.Number)
+		return optionalBytes(enc), err
+	},
+
+	"AssertAccount": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address  hexutil.Bytes   `json:"address"`
+			Expected expectedAccount `json:"expected"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return assertAccount(db, common.BytesToAddress(p.Address), &p.Expected)
+	},
+	"AssertStorage": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Address  hexutil.Bytes            `json:"address"`
+			Expected map[string]hexutil.Bytes `json:"expected"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return assertStorage(db, common.BytesToAddress(p.Address), p.Expected)
+	},
+
+	"ServeRemoteKV": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Addr string `json:"addr"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.serveRemoteKV(p.Addr)
+	},
+	"StopRemoteKV": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		db.stopKvServer()
+		return nil, nil
+	},
+	"ServeRPC": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Addr string `json:"addr"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, db.serveRPC(p.Addr)
+	},
+	"StopRPC": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		db.stopRPCServer()
+		return nil, nil
+	},
+	"BatchRead": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Reads []batchRead `json:"reads"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return batchReads(ctx, db, p.Reads)
+	},
+	"RunQueries": func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Queries []diffQuery `json:"queries"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return runQueries(ctx, db, p.Queries)
+	},
+}
+
+func init() {
+	// registered here since they refer back to callHandlers, the queued
+	// writes through call
+	callHandlers["Methods"] = func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		return callMethods(), nil
+	}
+	callHandlers["EnqueueWrite"] = func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return db.enqueueWrite(p.Method, p.Params)
+	}
+	callHandlers["WaitTicket"] = func(ctx context.Context, db *dbHandle, params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Ticket uint64 `json:"ticket"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return db.waitTicket(p.Ticket)
+	}
+}
+
+type callResponse struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Dispatches method to the operation of the same name with the JSON encoded
+// paramsJson, returning a JSON response of the form {"result": ...} or
+// {"result": null, "error": "..."}. This covers every operation without a new
+// exported symbol per operation; "Methods" lists what is available. Params
+// may set "insertOnly" to true or false to override SetInsertOnly for the
+// call. The response must be released with FreeBytes.
+//export Call
+func Call(dbPtr C.uintptr_t, method string, paramsJson string) *C.char {
+	result, err := call(context.Background(), getDbHandle(dbPtr), method, []byte(paramsJson))
+	return C.CString(string(encodeResponse(result, err)))
+}
+
+func call(ctx context.Context, db *dbHandle, method string, params json.RawMessage) (interface{}, error) {
+	handler, ok := callHandlers[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+	defer timeOp(method, "params", string(params))()
+	ctx = callInsertOnly(ctx, params)
+	var result interface{}
+	err := retryMapFull(db, method, func() (err error) {
+		result, err = handler(ctx, db, params)
+		return err
+	})
+	if err != nil {
+		metrics.opError(method)
+	}
+	return result, err
+}
+
+func encodeResponse(result interface{}, err error) []byte {
+	resp := callResponse{Result: result}
+	if err != nil {
+		resp = callResponse{Error: err.Error()}
+	}
+	enc, err := json.Marshal(resp)
+	if err != nil {
+		enc, _ = json.Marshal(callResponse{Error: fmt.Sprintf("encoding result: %v", err)})
+	}
+	return enc
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	return nil
+}
+
+func callMethods() []string {
+	methods := make([]string, 0, len(callHandlers))
+	for m := range callHandlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func byteSlices(in []hexutil.Bytes) [][]byte {
+	out := make([][]byte, len(in))
+	for i, b := range in {
+		out[i] = b
+	}
+	return out
+}
+
+// Encodes a read result as hex, or null if nothing was found.
+func optionalBytes(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return hexutil.Bytes(b)
+}
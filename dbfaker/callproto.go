@@ -0,0 +1,387 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Version of proto/dbfaker.proto understood by CallProto.
+const protoVersion = 1
+
+// Field numbers of the Request op oneof, see proto/dbfaker.proto.
+const (
+	protoPutAccount         protowire.Number = 10
+	protoPutStorage         protowire.Number = 11
+	protoPutHeader          protowire.Number = 12
+	protoPutHeaderNumber    protowire.Number = 13
+	protoPutCanonicalHash   protowire.Number = 14
+	protoPutHeadHeaderHash  protowire.Number = 15
+	protoPutBodyForStorage  protowire.Number = 16
+	protoPutTransactions    protowire.Number = 17
+	protoPutRawTransactions protowire.Number = 18
+	protoPutSenders         protowire.Number = 19
+	protoPutTxLookupEntries protowire.Number = 20
+	protoPutBlockReceipts   protowire.Number = 21
+	protoGetHeaderByNumber  protowire.Number = 30
+	protoGetBlockByNumber   protowire.Number = 31
+	protoGetTxBlockNumber   protowire.Number = 32
+)
+
+// The ops CallProto runs, named like the exports they mirror. Other fields of
+// a Request are skipped, so that requests from clients of a newer schema only
+// fail if they set an op this version does not know.
+var protoOps = map[protowire.Number]string{
+	protoPutAccount:         "PutAccount",
+	protoPutStorage:         "PutStorage",
+	protoPutHeader:          "PutHeader",
+	protoPutHeaderNumber:    "PutHeaderNumber",
+	protoPutCanonicalHash:   "PutCanonicalHash",
+	protoPutHeadHeaderHash:  "PutHeadHeaderHash",
+	protoPutBodyForStorage:  "PutBodyForStorage",
+	protoPutTransactions:    "PutTransactions",
+	protoPutRawTransactions: "PutRawTransactions",
+	protoPutSenders:         "PutSenders",
+	protoPutTxLookupEntries: "PutTxLookupEntries",
+	protoPutBlockReceipts:   "PutBlockWithReceipts",
+	protoGetHeaderByNumber:  "GetHeaderByNumber",
+	protoGetBlockByNumber:   "GetBlockByNumber",
+	protoGetTxBlockNumber:   "GetTxBlockNumber",
+}
+
+// Executes a protobuf encoded dbfaker.v1.Request (see proto/dbfaker.proto)
+// and returns the encoded dbfaker.v1.Response. exit is -1 if the operation
+// failed, in which case the response carries the error. The response is
+// malloc'd and must be released with FreeBytes.
+//export CallProto
+func CallProto(dbPtr C.uintptr_t, request []byte) (exit int, resp unsafe.Pointer, respLen C.size_t) {
+	defer timeOp("CallProto", "size", len(request))()
+	r, err := callProto(context.Background(), getDbHandle(dbPtr), request)
+	if err != nil {
+		r = protoResponse{err: err.Error()}
+		exit = -1
+	} else {
+		exit = 1
+	}
+	enc := r.encode()
+	return exit, C.CBytes(enc), C.size_t(len(enc))
+}
+
+type protoResponse struct {
+	err    string
+	found  bool
+	data   []byte
+	number uint64
+}
+
+func (r protoResponse) encode() []byte {
+	var b []byte
+	if r.err != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, r.err)
+	}
+	if r.found {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if len(r.data) > 0 {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.data)
+	}
+	if r.number != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, r.number)
+	}
+	return b
+}
+
+func callProto(ctx context.Context, db *dbHandle, request []byte) (protoResponse, error) {
+	req, err := parseProto(request)
+	if err != nil {
+		return protoResponse{}, err
+	}
+	if v := req.uint64(1); v != protoVersion {
+		return protoResponse{}, fmt.Errorf("unsupported request version %d", v)
+	}
+	if _, ok := req[2]; ok {
+		ctx = withInsertOnly(ctx, req.uint64(2) != 0)
+	}
+
+	op, m, err := req.oneof()
+	if err != nil {
+		return protoResponse{}, err
+	}
+	// bulk writes are retried after the map grew, as through Call
+	var resp protoResponse
+	err = retryMapFull(db, protoOps[op], func() (err error) {
+		resp, err = runProtoOp(ctx, db, op, m)
+		return err
+	})
+	return resp, err
+}
+
+func runProtoOp(ctx context.Context, db *dbHandle, op protowire.Number, m protoMessage) (protoResponse, error) {
+	switch op {
+	case protoPutAccount:
+		return protoResponse{}, putAccount(ctx, db, m.bytes(1), m.bytes(2), m.uint64(3), m.uint64(4) != 0)
+	case protoPutStorage:
+		return protoResponse{}, putStorage(ctx, db, m.bytes(1), m.bytes(2), m.bytes(3))
+	case protoPutHeader:
+		return protoResponse{}, putHeader(ctx, db, m.bytes(1))
+	case protoPutHeaderNumber:
+		return protoResponse{}, putHeaderNumber(ctx, db, m.bytes(1), m.uint64(2))
+	case protoPutCanonicalHash:
+		return protoResponse{}, putCanonicalHash(ctx, db, m.bytes(1), m.uint64(2), m.uint64(3) != 0)
+	case protoPutHeadHeaderHash:
+		return protoResponse{}, putHeadHeaderHash(db, m.bytes(1))
+	case protoPutBodyForStorage:
+		return protoResponse{}, putBodyForStorage(ctx, db, m.bytes(1), m.uint64(2), m.bytes(3))
+	case protoPutTransactions:
+		return protoResponse{}, putTransactions(ctx, db, m.repeatedBytes(1), m.uint64(2))
+	case protoPutRawTransactions:
+		return protoResponse{}, putRawTransactions(ctx, db, m.repeatedBytes(1), m.uint64(2))
+	case protoPutSenders:
+		return protoResponse{}, putSenders(ctx, db, m.bytes(1), m.uint64(2), m.repeatedBytes(3))
+	case protoPutTxLookupEntries:
+		num := new(big.Int).SetUint64(m.uint64(1)).Bytes()
+		return protoResponse{}, putTxLookupEntries(ctx, db, num, m.repeatedBytes(2), m.uint64(3) != 0)
+	case protoPutBlockReceipts:
+		block, receipts, err := protoBlockWithReceipts(m)
+		if err != nil {
+			return protoResponse{}, err
+		}
+		return protoResponse{}, writeBlockWithReceipts(ctx, db, block, receipts)
+
+	case protoGetHeaderByNumber:
+		enc, err := db.headerByNumber(m.uint64(1))
+		return protoResponse{found: enc != nil, data: enc}, err
+	case protoGetBlockByNumber:
+		enc, err := db.blockByNumber(m.uint64(1))
+		return protoResponse{found: enc != nil, data: enc}, err
+	case protoGetTxBlockNumber:
+		num, found, err := db.txBlockNumber(m.bytes(1))
+		return protoResponse{found: found, number: num}, err
+	}
+	return protoResponse{}, fmt.Errorf("unknown op field %d", op)
+}
+
+// The fields of a decoded message, by field number. Values are the raw bytes
+// of length-delimited fields or the varint value of varint fields.
+type protoMessage map[protowire.Number][]protoValue
+
+type protoValue struct {
+	bytes  []byte
+	varint uint64
+}
+
+func parseProto(b []byte) (protoMessage, error) {
+	m := make(protoMessage)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v protoValue
+		switch typ {
+		case protowire.VarintType:
+			v.varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			// not used by the schema, skip it for forward compatibility
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		m[num] = append(m[num], v)
+	}
+	return m, nil
+}
+
+// Returns the field number and decoded message of the single op set in a
+// Request.
+func (m protoMessage) oneof() (protowire.Number, protoMessage, error) {
+	var op protowire.Number
+	for num := range m {
+		if _, ok := protoOps[num]; !ok {
+			continue
+		}
+		if op != 0 {
+			return 0, nil, errors.New("request sets more than one op")
+		}
+		op = num
+	}
+	if op == 0 {
+		return 0, nil, fmt.Errorf("request sets no op of schema version %d", protoVersion)
+	}
+	sub, err := parseProto(m.bytes(op))
+	return op, sub, err
+}
+
+// Returns the last value of a singular bytes field, as proto3 requires.
+func (m protoMessage) bytes(num protowire.Number) []byte {
+	vs := m[num]
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[len(vs)-1].bytes
+}
+
+// Copies a bytes field of fixed size into dst, leaving dst zero if the field
+// is unset.
+func (m protoMessage) fixedBytes(num protowire.Number, dst []byte) error {
+	b := m.bytes(num)
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) != len(dst) {
+		return fmt.Errorf("field %d has %d bytes, expected %d", num, len(b), len(dst))
+	}
+	copy(dst, b)
+	return nil
+}
+
+func (m protoMessage) uint64(num protowire.Number) uint64 {
+	vs := m[num]
+	if len(vs) == 0 {
+		return 0
+	}
+	return vs[len(vs)-1].varint
+}
+
+func (m protoMessage) repeatedBytes(num protowire.Number) [][]byte {
+	vs := m[num]
+	out := make([][]byte, len(vs))
+	for i, v := range vs {
+		out[i] = v.bytes
+	}
+	return out
+}
+
+// Decodes a PutBlockWithReceipts op into the block and receipts it describes.
+func protoBlockWithReceipts(m protoMessage) (*types.Block, types.Receipts, error) {
+	b, err := parseProto(m.bytes(1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("block: %w", err)
+	}
+	header, err := protoHeader(b.bytes(1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("header: %w", err)
+	}
+	txs, err := types.DecodeTransactions(b.repeatedBytes(2))
+	if err != nil {
+		return nil, nil, fmt.Errorf("DecodeTransactions: %w", err)
+	}
+	var uncles []*types.Header
+	for i, enc := range b.repeatedBytes(3) {
+		uncle, err := protoHeader(enc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("uncle %d: %w", i, err)
+		}
+		uncles = append(uncles, uncle)
+	}
+
+	var receipts types.Receipts
+	for i, enc := range m.repeatedBytes(2) {
+		receipt, err := protoReceipt(enc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("receipt %d: %w", i, err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return types.NewBlockWithHeader(header).WithBody(txs, uncles), receipts, nil
+}
+
+func protoHeader(enc []byte) (*types.Header, error) {
+	m, err := parseProto(enc)
+	if err != nil {
+		return nil, err
+	}
+	header := &types.Header{
+		Difficulty: new(big.Int).SetBytes(m.bytes(8)),
+		Number:     new(big.Int).SetUint64(m.uint64(9)),
+		GasLimit:   m.uint64(10),
+		GasUsed:    m.uint64(11),
+		Time:       m.uint64(12),
+		Extra:      m.bytes(13),
+	}
+	hashes := map[protowire.Number]*common.Hash{
+		1:  &header.ParentHash,
+		2:  &header.UncleHash,
+		4:  &header.Root,
+		5:  &header.TxHash,
+		6:  &header.ReceiptHash,
+		14: &header.MixDigest,
+	}
+	for num, hash := range hashes {
+		if err = m.fixedBytes(num, hash[:]); err != nil {
+			return nil, err
+		}
+	}
+	if err = m.fixedBytes(3, header.Coinbase[:]); err != nil {
+		return nil, err
+	}
+	if err = m.fixedBytes(7, header.Bloom[:]); err != nil {
+		return nil, err
+	}
+	header.Nonce = types.EncodeNonce(m.uint64(15))
+	if _, ok := m[16]; ok {
+		header.BaseFee = new(big.Int).SetBytes(m.bytes(16))
+	}
+	return header, nil
+}
+
+func protoReceipt(enc []byte) (*types.Receipt, error) {
+	m, err := parseProto(enc)
+	if err != nil {
+		return nil, err
+	}
+	typ := m.uint64(1)
+	if typ > 0xff {
+		return nil, fmt.Errorf("invalid receipt type %d", typ)
+	}
+	receipt := &types.Receipt{
+		Type:              uint8(typ),
+		PostState:         m.bytes(2),
+		Status:            m.uint64(3),
+		CumulativeGasUsed: m.uint64(4),
+	}
+	if len(receipt.PostState) > 0 {
+		receipt.Status = 0
+	}
+	for i, enc := range m.repeatedBytes(5) {
+		l, err := parseProto(enc)
+		if err != nil {
+			return nil, fmt.Errorf("log %d: %w", i, err)
+		}
+		log := &types.Log{Data: l.bytes(3)}
+		if err = l.fixedBytes(1, log.Address[:]); err != nil {
+			return nil, fmt.Errorf("log %d: %w", i, err)
+		}
+		for _, topic := range l.repeatedBytes(2) {
+			if len(topic) != common.HashLength {
+				return nil, fmt.Errorf("log %d: topic of %d bytes", i, len(topic))
+			}
+			log.Topics = append(log.Topics, common.BytesToHash(topic))
+		}
+		receipt.Logs = append(receipt.Logs, log)
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	return receipt, nil
+}
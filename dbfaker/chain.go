@@ -0,0 +1,333 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Seconds between the timestamps of generated blocks.
+const seedBlockTime = 12
+
+// Genesis blocks that seedChain can start a fresh db from, by chain name.
+var seedGenesis = map[string]func() *core.Genesis{
+	"mainnet": core.DefaultGenesisBlock,
+	"ropsten": core.DefaultRopstenGenesisBlock,
+	"rinkeby": core.DefaultRinkebyGenesisBlock,
+	"goerli":  core.DefaultGoerliGenesisBlock,
+	"sepolia": core.DefaultSepoliaGenesisBlock,
+}
+
+func seedChains() []string {
+	names := make([]string, 0, len(seedGenesis))
+	for name := range seedGenesis {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Extends the canonical chain by n empty blocks. If the db has no genesis yet,
+// the genesis block and allocations of chain are written first. Everything
+// is written in one transaction, so a failure leaves the db as it was. The
+// blocks carry no transactions or rewards, so every block keeps the genesis
+// state root.
+func seedChain(ctx context.Context, db *dbHandle, chain string, n uint64) (err error) {
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	if err = ensureGenesis(tx, chain); err != nil {
+		return err
+	}
+	parent := rawdb.ReadCurrentHeader(tx)
+	if parent == nil {
+		return errors.New("no head header")
+	}
+	td, err := rawdb.ReadTd(tx, parent.Hash(), parent.Number.Uint64())
+	if err != nil {
+		return err
+	}
+	if td == nil {
+		return fmt.Errorf("no total difficulty for head %x", parent.Hash())
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		header := childHeader(parent)
+		td = new(big.Int).Add(td, header.Difficulty)
+		if err = writeCanonicalBlock(tx, db.currentSchema(), types.NewBlockWithHeader(header), nil, td); err != nil {
+			return err
+		}
+		parent = header
+		reportProgress(ctx, i+1, n)
+	}
+	return nil
+}
+
+// Returns an empty block header on top of parent, seedBlockTime seconds
+// later and with the parent's difficulty, gas limit, base fee and state root.
+func childHeader(parent *types.Header) *types.Header {
+	return &types.Header{
+		ParentHash:  parent.Hash(),
+		UncleHash:   types.EmptyUncleHash,
+		Root:        parent.Root,
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  new(big.Int).Set(parent.Difficulty),
+		Number:      new(big.Int).Add(parent.Number, common.Big1),
+		GasLimit:    parent.GasLimit,
+		Time:        parent.Time + seedBlockTime,
+		BaseFee:     parent.BaseFee,
+	}
+}
+
+// Writes the genesis block and allocations of chain in tx, unless tx already
+// has a genesis block.
+func ensureGenesis(tx kv.RwTx, chain string) error {
+	genesis, err := rawdb.ReadCanonicalHash(tx, 0)
+	if err != nil || genesis != (common.Hash{}) {
+		return err
+	}
+
+	g, ok := seedGenesis[chain]
+	if !ok {
+		return fmt.Errorf("unknown chain %q, expected one of %v", chain, seedChains())
+	}
+	_, _, err = core.WriteGenesisBlock(tx, g())
+	return err
+}
+
+// Imports the RLP encoded blocks in path, as written by `geth export` or
+// `erigon export`, making them canonical. Blocks must be in ascending order
+// and each block's parent must already be in the db or earlier in the file.
+// Blocks that are already canonical are skipped. Senders are recovered when
+// the db has a chain config.
+//
+// The blocks are written in one transaction, or, with chunk > 0, in one
+// transaction per chunk blocks, which keeps transactions small for long
+// chains. Either way every commit covers whole blocks. If a chunked import
+// fails, the error says up to which block it committed, and importing the
+// file again resumes after it, since the committed blocks are skipped.
+//
+// Only the block data is written: transactions are not executed, so the
+// state is left untouched.
+func importChain(ctx context.Context, db *dbHandle, path string, chunk uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := &countingReader{r: f}
+	imp := &chainImport{stream: rlp.NewStream(r, 0), r: r, size: fi.Size()}
+
+	var committed *uint64
+	for {
+		last, eof, err := imp.importChunk(ctx, db, chunk)
+		if err != nil {
+			if committed != nil {
+				return fmt.Errorf("%w (committed up to block %d, importing the file again resumes after it)", err, *committed)
+			}
+			return err
+		}
+		if last != nil {
+			committed = last
+		}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// The state of an import across its transactions.
+type chainImport struct {
+	stream  *rlp.Stream
+	r       *countingReader
+	size    int64
+	decoded int
+}
+
+// Imports up to limit blocks, or all remaining blocks if limit is 0, in one
+// transaction. Returns the number of the last block written, if any, and
+// whether the end of the file was reached.
+func (imp *chainImport) importChunk(ctx context.Context, db *dbHandle, limit uint64) (last *uint64, eof bool, err error) {
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer(&err)
+
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for n := uint64(0); limit == 0 || n < limit; n++ {
+		if err = ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		var block types.Block
+		if err = imp.stream.Decode(&block); err == io.EOF {
+			return last, true, nil
+		} else if err != nil {
+			return nil, false, fmt.Errorf("decoding block %d of the file: %w", imp.decoded, err)
+		}
+		imp.decoded++
+
+		num := block.NumberU64()
+		existing, err := rawdb.ReadCanonicalHash(tx, num)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing == block.Hash() {
+			continue
+		}
+
+		td, err := totalDifficulty(tx, block.Header())
+		if err != nil {
+			return nil, false, fmt.Errorf("block %d: %w", num, err)
+		}
+
+		senders, err := recoverSenders(config, &block)
+		if err != nil {
+			return nil, false, fmt.Errorf("block %d: %w", num, err)
+		}
+
+		if err = writeCanonicalBlock(tx, db.currentSchema(), &block, senders, td); err != nil {
+			return nil, false, fmt.Errorf("block %d: %w", num, err)
+		}
+		last = &num
+		reportProgress(ctx, uint64(imp.r.n), uint64(imp.size))
+	}
+	return last, false, nil
+}
+
+// Reads the chain config stored for the genesis block, or returns nil if
+// there is none.
+func readChainConfig(tx kv.Tx) (*params.ChainConfig, error) {
+	genesis, err := rawdb.ReadCanonicalHash(tx, 0)
+	if err != nil || genesis == (common.Hash{}) {
+		return nil, err
+	}
+	return rawdb.ReadChainConfig(tx, genesis)
+}
+
+// Recovers the sender of every transaction of block, or returns nil if config
+// is nil.
+func recoverSenders(config *params.ChainConfig, block *types.Block) ([]common.Address, error) {
+	if config == nil {
+		return nil, nil
+	}
+	signer := types.MakeSigner(config, block.NumberU64())
+	senders := make([]common.Address, len(block.Transactions()))
+	for i, txn := range block.Transactions() {
+		var err error
+		if senders[i], err = txn.Sender(*signer); err != nil {
+			return nil, fmt.Errorf("recovering sender of tx %d: %w", i, err)
+		}
+	}
+	return senders, nil
+}
+
+// Returns the total difficulty of header: its own difficulty plus the total
+// difficulty of its parent, which must already be in tx.
+func totalDifficulty(tx kv.Tx, header *types.Header) (*big.Int, error) {
+	td := new(big.Int).Set(header.Difficulty)
+	num := header.Number.Uint64()
+	if num == 0 {
+		return td, nil
+	}
+	parentTd, err := rawdb.ReadTd(tx, header.ParentHash, num-1)
+	if err != nil {
+		return nil, err
+	}
+	if parentTd == nil {
+		return nil, fmt.Errorf("unknown parent %x", header.ParentHash)
+	}
+	return td.Add(td, parentTd), nil
+}
+
+// Writes block and makes it the canonical block and head at its height,
+// including its total difficulty and tx lookup entries. senders may be nil.
+func writeCanonicalBlock(tx kv.RwTx, schema schemaAdapter, block *types.Block, senders []common.Address, td *big.Int) error {
+	if err := writeBlock(tx, schema, block, senders, td); err != nil {
+		return err
+	}
+	if err := makeCanonical(tx, schema, block); err != nil {
+		return err
+	}
+	return rawdb.WriteHeadHeaderHash(tx, block.Hash())
+}
+
+// Writes the header, body and total difficulty of block, and its senders
+// unless they are nil, without making it canonical.
+func writeBlock(tx kv.RwTx, schema schemaAdapter, block *types.Block, senders []common.Address, td *big.Int) error {
+	hash, num := block.Hash(), block.NumberU64()
+
+	rawdb.WriteHeader(tx, block.Header())
+	if err := schema.writeBody(tx, hash, num, block.Body()); err != nil {
+		return fmt.Errorf("WriteBody: %w", err)
+	}
+	if senders != nil {
+		if err := rawdb.WriteSenders(tx, hash, num, senders); err != nil {
+			return fmt.Errorf("WriteSenders: %w", err)
+		}
+	}
+	if err := rawdb.WriteTd(tx, hash, num, td); err != nil {
+		return fmt.Errorf("WriteTd: %w", err)
+	}
+	return nil
+}
+
+// Makes block the canonical block at its height and points the tx lookup
+// entries of its transactions at it.
+func makeCanonical(tx kv.RwTx, schema schemaAdapter, block *types.Block) error {
+	num := block.NumberU64()
+	if err := rawdb.WriteCanonicalHash(tx, block.Hash(), num); err != nil {
+		return fmt.Errorf("WriteCanonicalHash: %w", err)
+	}
+
+	val := schema.txLookupValue(num)
+	for _, txn := range block.Transactions() {
+		if err := tx.Put(kv.TxLookup, txn.Hash().Bytes(), val); err != nil {
+			return fmt.Errorf("TxLookup: %w", err)
+		}
+	}
+	return nil
+}
+
+// Counts the bytes read so far, to report import progress against the file
+// size. The rlp stream buffers its input, so the count runs slightly ahead of
+// the decoded blocks.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/eth/stagedsync/stages"
+)
+
+// Makes the canonical block blockNum the head of the chain in one
+// transaction, as the last step of seeding a db: the head header and head
+// block hashes point to it and the progress of every sync stage is set to it,
+// so that Erigon and its RPC daemon take the db as synced up to the block.
+// safeNum and finalizedNum, when not negative, also point the safe and
+// finalized forkchoice hashes to those canonical blocks, which must not be
+// after blockNum; negative ones leave them as they are.
+//export SetChainHead
+func SetChainHead(dbPtr C.uintptr_t, blockNum uint64, safeNum, finalizedNum int64) (exit int) {
+	defer timeOp("SetChainHead", "blockNum", blockNum, "safeNum", safeNum, "finalizedNum", finalizedNum)()
+	db := getDbHandle(dbPtr)
+	return exitCode("SetChainHead", setChainHead(context.Background(), db, blockNum, safeNum, finalizedNum))
+}
+
+func setChainHead(ctx context.Context, db kv.RwDB, blockNum uint64, safeNum, finalizedNum int64) (err error) {
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	hash, err := canonicalHashAt(tx, blockNum)
+	if err != nil {
+		return err
+	}
+	if err = rawdb.WriteHeadHeaderHash(tx, hash); err != nil {
+		return err
+	}
+	rawdb.WriteHeadBlockHash(tx, hash)
+	rawdb.WriteForkchoiceHead(tx, hash)
+	for _, stage := range stages.AllStages {
+		if err = stages.SaveStageProgress(tx, stage, blockNum); err != nil {
+			return fmt.Errorf("stage %s: %w", stage, err)
+		}
+	}
+
+	pointers := []struct {
+		name  string
+		num   int64
+		write func(kv.Putter, common.Hash)
+	}{
+		{"safe", safeNum, rawdb.WriteForkchoiceSafe},
+		{"finalized", finalizedNum, rawdb.WriteForkchoiceFinalized},
+	}
+	for _, p := range pointers {
+		if p.num < 0 {
+			continue
+		}
+		if uint64(p.num) > blockNum {
+			return fmt.Errorf("%s block %d is after the head %d", p.name, p.num, blockNum)
+		}
+		hash, err := canonicalHashAt(tx, uint64(p.num))
+		if err != nil {
+			return fmt.Errorf("%s block: %w", p.name, err)
+		}
+		p.write(tx, hash)
+	}
+	return nil
+}
+
+func canonicalHashAt(tx kv.Tx, num uint64) (common.Hash, error) {
+	hash, err := rawdb.ReadCanonicalHash(tx, num)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if hash == (common.Hash{}) {
+		return common.Hash{}, fmt.Errorf("no canonical block %d", num)
+	}
+	return hash, nil
+}
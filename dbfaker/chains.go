@@ -0,0 +1,130 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// The dbs opened with OpenChain, by chain id. Each holds a pointer of its own
+// on its db, which CloseChain releases.
+var chainDbs = struct {
+	sync.Mutex
+	byID map[uint64]chainDb
+}{byID: make(map[uint64]chainDb)}
+
+type chainDb struct {
+	ptr  C.uintptr_t
+	path string
+}
+
+// Opens the db at path as the db of chainId, so that suites faking several
+// networks can look it up with GetChainHandle instead of passing pointers
+// around. If the db already stores a chain config, its chain id must be
+// chainId. Opening a chain id again with the same path returns the pointer it
+// already has; a different path fails until CloseChain. The pointer belongs
+// to the manager and must be released with CloseChain, not MdbxClose.
+//export OpenChain
+func OpenChain(chainId uint64, path string) (exit int, ptr C.uintptr_t) {
+	defer timeOp("OpenChain", "chainId", chainId, "path", path)()
+	ptr, err := openChain(chainId, path)
+	if err != nil {
+		return exitCode("OpenChain", err), *new(C.uintptr_t)
+	}
+	return 1, ptr
+}
+
+func openChain(chainId uint64, path string) (C.uintptr_t, error) {
+	chainDbs.Lock()
+	defer chainDbs.Unlock()
+
+	if c, ok := chainDbs.byID[chainId]; ok {
+		if c.path != canonicalPath(path) {
+			return 0, fmt.Errorf("chain %d is open at %s already", chainId, c.path)
+		}
+		return c.ptr, nil
+	}
+
+	ptr, err := mdbxOpen(path)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkChainID(getDbHandle(ptr), chainId); err != nil {
+		MdbxClose(ptr)
+		return 0, err
+	}
+	chainDbs.byID[chainId] = chainDb{ptr: ptr, path: canonicalPath(path)}
+	return ptr, nil
+}
+
+// Fails if the db stores a chain config for another chain than chainId. A db
+// without one, as most faked dbs are, can be used for any chain.
+func checkChainID(db kv.RoDB, chainId uint64) error {
+	return db.View(context.Background(), func(tx kv.Tx) error {
+		config, err := readChainConfig(tx)
+		if err != nil || config == nil || config.ChainID == nil {
+			return err
+		}
+		if !config.ChainID.IsUint64() || config.ChainID.Uint64() != chainId {
+			return fmt.Errorf("db is for chain %s, not %d", config.ChainID, chainId)
+		}
+		return nil
+	})
+}
+
+// Returns the pointer of the db opened for chainId with OpenChain.
+//export GetChainHandle
+func GetChainHandle(chainId uint64) (exit int, ptr C.uintptr_t) {
+	chainDbs.Lock()
+	defer chainDbs.Unlock()
+	c, ok := chainDbs.byID[chainId]
+	if !ok {
+		return exitCode("GetChainHandle", fmt.Errorf("no db open for chain %d", chainId)), *new(C.uintptr_t)
+	}
+	return 1, c.ptr
+}
+
+// Closes the db opened for chainId with OpenChain, as MdbxClose does.
+//export CloseChain
+func CloseChain(chainId uint64) (exit int) {
+	defer timeOp("CloseChain", "chainId", chainId)()
+	chainDbs.Lock()
+	c, ok := chainDbs.byID[chainId]
+	delete(chainDbs.byID, chainId)
+	chainDbs.Unlock()
+	if !ok {
+		return exitCode("CloseChain", fmt.Errorf("no db open for chain %d", chainId))
+	}
+	MdbxClose(c.ptr)
+	return 1
+}
+
+// Returns the chains opened with OpenChain as a JSON array of {"chainId",
+// "path"} objects, ordered by chain id. The result must be released with
+// FreeBytes.
+//export ListChains
+func ListChains() *C.char {
+	type entry struct {
+		ChainID uint64 `json:"chainId"`
+		Path    string `json:"path"`
+	}
+	chainDbs.Lock()
+	entries := make([]entry, 0, len(chainDbs.byID))
+	for id, c := range chainDbs.byID {
+		entries = append(entries, entry{ChainID: id, Path: c.path})
+	}
+	chainDbs.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ChainID < entries[j].ChainID })
+	enc, _ := json.Marshal(entries)
+	return C.CString(string(enc))
+}
@@ -0,0 +1,460 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// A subcommand of the dbfaker binary. run gets the arguments after the
+// command name.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"seed": {
+		usage: "seed [--datadir DIR] [--chain NAME] --blocks N",
+		run:   runSeed,
+	},
+	"grpc": {
+		usage: "grpc [--datadir DIR] --socket PATH",
+		run:   runGrpc,
+	},
+	"import-chain": {
+		usage: "import-chain [--datadir DIR] [--chunk N] FILE",
+		run:   runImportChain,
+	},
+	"dump": {
+		usage: "dump [--datadir DIR] --table NAME [--limit N] [--after TOKEN]",
+		run:   runDump,
+	},
+	"export-fixture": {
+		usage: "export-fixture [--datadir DIR] [--tables A,B] FILE",
+		run:   runExportFixture,
+	},
+	"export-sqlite": {
+		usage: "export-sqlite [--datadir DIR] [--tables A,B] FILE",
+		run:   runExportSQLite,
+	},
+	"export-state": {
+		usage: "export-state [--datadir DIR] [--accounts FILE] [--storage FILE]",
+		run:   runExportState,
+	},
+	"import-fixture": {
+		usage: "import-fixture [--datadir DIR] FILE",
+		run:   runImportFixture,
+	},
+	"import-stream": {
+		usage: "import-stream [--datadir DIR] [FILE]",
+		run:   runImportStream,
+	},
+	"inspect": {
+		usage: "inspect [--datadir DIR]",
+		run:   runInspect,
+	},
+	"restore": {
+		usage: "restore [--in-place] BACKUP DIR",
+		run:   runRestore,
+	},
+	"reclaim": {
+		usage: "reclaim DIR",
+		run:   runReclaim,
+	},
+	"space": {
+		usage: "space [--datadir DIR] [--limit N]",
+		run:   runSpace,
+	},
+	"serve": {
+		usage: "serve [--datadir DIR] [--snapshots DIR] [--addr HOST:PORT]",
+		run:   runServe,
+	},
+	"verify": {
+		usage: "verify [--datadir DIR]",
+		run:   runVerify,
+	},
+}
+
+// errUsage makes main print the usage of the command instead of an error.
+var errUsage = errors.New("usage")
+
+// main only runs when the package is built as an executable; the c-archive
+// build used by the Rust tests never calls it.
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		printUsage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "usage: dbfaker %s\n", cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbfaker %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  dbfaker %s\n", commands[name].usage)
+	}
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	datadir := fs.String("datadir", ".", "path of the mdbx chaindata directory")
+	return fs, datadir
+}
+
+func openCli(path string) (*dbHandle, error) {
+	db, err := openEnv(libLog.New("db", path), path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := newDbHandle(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func runSeed(args []string) error {
+	fs, datadir := newFlagSet("seed")
+	chain := fs.String("chain", "mainnet", fmt.Sprintf("genesis to start a fresh db from, one of %v", seedChains()))
+	blocks := fs.Uint64("blocks", 0, "number of empty blocks to append to the canonical chain")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return seedChain(context.Background(), db, *chain, *blocks)
+}
+
+func runImportChain(args []string) error {
+	fs, datadir := newFlagSet("import-chain")
+	chunk := fs.Uint64("chunk", 0, "number of blocks to commit at a time, 0 for one transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return importChain(context.Background(), db, fs.Arg(0), *chunk)
+}
+
+func runDump(args []string) error {
+	fs, datadir := newFlagSet("dump")
+	table := fs.String("table", "", "name of the table to dump, e.g. PlainState")
+	limit := fs.Uint64("limit", 0, "maximum number of entries to print, 0 for all")
+	after := fs.String("after", "", "continuation token printed by a previous dump, to print the entries after it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *table == "" {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	next, err := dumpTable(context.Background(), db, *table, *after, *limit, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Fprintf(os.Stderr, "more entries follow, continue with --after %s\n", next)
+	}
+	return nil
+}
+
+func runExportFixture(args []string) error {
+	fs, datadir := newFlagSet("export-fixture")
+	tables := fs.String("tables", "", "comma-separated tables to export, all non-empty tables if unset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return exportFixture(context.Background(), db, fs.Arg(0), splitTables(*tables))
+}
+
+func runExportSQLite(args []string) error {
+	fs, datadir := newFlagSet("export-sqlite")
+	tables := fs.String("tables", "", "comma-separated tables to export, the decoded tables if unset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return exportSQLite(context.Background(), db, fs.Arg(0), splitTables(*tables))
+}
+
+func runExportState(args []string) error {
+	fs, datadir := newFlagSet("export-state")
+	accounts := fs.String("accounts", "", "CSV file to write the accounts to")
+	storage := fs.String("storage", "", "CSV file to write the storage slots to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *accounts == "" && *storage == "" {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return exportStateCSV(context.Background(), db, *accounts, *storage)
+}
+
+func runImportFixture(args []string) error {
+	fs, datadir := newFlagSet("import-fixture")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return importFixture(context.Background(), db, fs.Arg(0))
+}
+
+// Reads the stream from stdin unless a file or named pipe is given.
+func runImportStream(args []string) error {
+	fs, datadir := newFlagSet("import-stream")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if fs.NArg() == 1 {
+		return importStreamFrom(context.Background(), db, -1, fs.Arg(0))
+	}
+	return importStream(context.Background(), db, os.Stdin)
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	inPlace := fs.Bool("in-place", false, "replace the db in DIR, which must be closed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	return restoreEnv(fs.Arg(0), fs.Arg(1), *inPlace)
+}
+
+func runSpace(args []string) error {
+	fs, datadir := newFlagSet("space")
+	limit := fs.Uint64("limit", 10, "number of tables to list, largest first, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := reportSpace(db, *limit)
+	if err != nil {
+		return err
+	}
+	enc, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(enc))
+	return nil
+}
+
+func runReclaim(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	freed, err := reclaimSpace(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("reclaimed %d bytes\n", freed)
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs, datadir := newFlagSet("verify")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problems, err := verifyChain(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	return nil
+}
+
+func runServe(args []string) error {
+	fs, datadir := newFlagSet("serve")
+	snapshots := fs.String("snapshots", "", "directory of frozen block segments to read blocks from")
+	addr := fs.String("addr", "127.0.0.1:8545", "address to serve JSON-RPC on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *snapshots != "" {
+		if err := db.openSnapshots(*snapshots); err != nil {
+			return err
+		}
+	}
+	if err := db.serveRPC(*addr); err != nil {
+		return err
+	}
+	libLog.Info("serving JSON-RPC", "addr", *addr)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	return nil
+}
+
+// Serves the whole API over gRPC until interrupted or terminated, for hosts
+// that drive dbfaker as a child process instead of linking it.
+func runGrpc(args []string) error {
+	fs, datadir := newFlagSet("grpc")
+	socket := fs.String("socket", "", "path of the unix socket to serve on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *socket == "" {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	libLog.Info("serving gRPC", "socket", *socket)
+	return serveFaker(db, *socket, stop)
+}
+
+func runInspect(args []string) error {
+	fs, datadir := newFlagSet("inspect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, err := openCli(*datadir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return runRepl(db, os.Stdin, os.Stdout)
+}
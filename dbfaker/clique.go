@@ -0,0 +1,222 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/consensus/clique"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// Layout of clique extra data: a fixed vanity prefix, the signer list on
+// checkpoint blocks, and the seal.
+const (
+	cliqueVanity = 32
+	// r, s and v of a secp256k1 signature
+	cliqueSeal = 65
+)
+
+// Checkpoint interval used when the caller passes none, as in clique.
+const cliqueDefaultEpoch = 30000
+
+// Difficulties of blocks sealed in and out of turn.
+var (
+	cliqueDiffInTurn = big.NewInt(2)
+	cliqueDiffNoTurn = big.NewInt(1)
+)
+
+// Extends the canonical chain by count clique blocks sealed by the signers
+// whose secp256k1 private keys are in signerKeys, and returns their hashes
+// concatenated. The signers take turns in address order, so every block is
+// sealed in turn with difficulty 2, and its extra data is the 32-byte vanity,
+// the sorted signer addresses on checkpoint blocks (every epoch blocks) and
+// the 65-byte seal over the clique seal hash, as a clique node expects. A
+// clique snapshot of the signers is written at every checkpoint and at the
+// last block. If the db has no head, the chain starts with a clique genesis
+// header listing the signers, whose hash comes first in the result. The
+// result is malloc'd and must be released with FreeBytes.
+//export BuildCliqueHeaders
+func BuildCliqueHeaders(dbPtr C.uintptr_t, signerKeys [][]byte, count uint64, epoch uint64) (exit int, hashes unsafe.Pointer, hashesLen C.size_t) {
+	defer timeOp("BuildCliqueHeaders", "signers", len(signerKeys), "count", count, "epoch", epoch)()
+	built, err := buildCliqueHeaders(context.Background(), getDbHandle(dbPtr), signerKeys, count, epoch)
+	if err != nil {
+		return exitCode("BuildCliqueHeaders", err), nil, 0
+	}
+	enc := make([]byte, 0, len(built)*common.HashLength)
+	for _, h := range built {
+		enc = append(enc, h.Bytes()...)
+	}
+	return 1, C.CBytes(enc), C.size_t(len(enc))
+}
+
+// Writes a clique snapshot for block num with the given hash, authorized to
+// the 20-byte signer addresses and with no recent signers or pending votes,
+// in the format and table a clique node loads snapshots from. Use it to give
+// headers written some other way the signer set they were sealed under.
+//export PutCliqueSnapshot
+func PutCliqueSnapshot(dbPtr C.uintptr_t, num uint64, hash []byte, signers [][]byte) (exit int) {
+	defer timeOp("PutCliqueSnapshot", "num", num, "signers", len(signers))()
+	return exitCode("PutCliqueSnapshot", putCliqueSnapshot(context.Background(), getDbHandle(dbPtr), num, common.BytesToHash(hash), signers))
+}
+
+func putCliqueSnapshot(ctx context.Context, db kv.RwDB, num uint64, hash common.Hash, signers [][]byte) (err error) {
+	addrs := make([]common.Address, len(signers))
+	for i, s := range signers {
+		if len(s) != common.AddressLength {
+			return fmt.Errorf("signer %d is %d bytes", i, len(s))
+		}
+		addrs[i] = common.BytesToAddress(s)
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeCliqueSnapshot(tx, num, hash, addrs)
+}
+
+// The JSON layout of Erigon's clique.Snapshot. Snapshots written here never
+// have votes, so their element types do not matter.
+type cliqueSnapshot struct {
+	Number  uint64                         `json:"number"`
+	Hash    common.Hash                    `json:"hash"`
+	Signers map[common.Address]struct{}    `json:"signers"`
+	Recents map[uint64]common.Address      `json:"recents"`
+	Votes   []interface{}                  `json:"votes"`
+	Tally   map[common.Address]interface{} `json:"tally"`
+}
+
+func writeCliqueSnapshot(tx kv.RwTx, num uint64, hash common.Hash, signers []common.Address) error {
+	snap := &cliqueSnapshot{
+		Number:  num,
+		Hash:    hash,
+		Signers: make(map[common.Address]struct{}, len(signers)),
+		Recents: make(map[uint64]common.Address),
+		Votes:   []interface{}{},
+		Tally:   make(map[common.Address]interface{}),
+	}
+	for _, s := range signers {
+		snap.Signers[s] = struct{}{}
+	}
+	blob, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// keyed like clique.SnapshotFullKey
+	key := append(dbutils.EncodeBlockNumber(num), hash.Bytes()...)
+	if err := tx.Put(kv.CliqueSeparate, key, blob); err != nil {
+		return fmt.Errorf("CliqueSeparate: %w", err)
+	}
+	return nil
+}
+
+// A clique signer, with its key.
+type cliqueSigner struct {
+	addr common.Address
+	key  *ecdsa.PrivateKey
+}
+
+func buildCliqueHeaders(ctx context.Context, db kv.RwDB, signerKeys [][]byte, count uint64, epoch uint64) (hashes []common.Hash, err error) {
+	if len(signerKeys) == 0 {
+		return nil, errors.New("clique needs at least one signer")
+	}
+	if epoch == 0 {
+		epoch = cliqueDefaultEpoch
+	}
+	signers := make([]cliqueSigner, len(signerKeys))
+	for i, k := range signerKeys {
+		key, err := crypto.ToECDSA(k)
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %w", i, err)
+		}
+		signers[i] = cliqueSigner{crypto.PubkeyToAddress(key.PublicKey), key}
+	}
+	sort.Slice(signers, func(i, j int) bool { return bytes.Compare(signers[i].addr[:], signers[j].addr[:]) < 0 })
+	addrs := make([]common.Address, len(signers))
+	for i, s := range signers {
+		addrs[i] = s.addr
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(&err)
+
+	var headers []*types.Header
+	parent := rawdb.ReadCurrentHeader(tx)
+	if parent == nil {
+		// the genesis header is not sealed, but lists the initial signers
+		parent = &types.Header{
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+			Difficulty:  new(big.Int).Set(cliqueDiffNoTurn),
+			Number:      new(big.Int),
+			GasLimit:    params.GenesisGasLimit,
+			Extra:       cliqueExtra(addrs, true),
+		}
+		headers = append(headers, parent)
+	}
+	for i := uint64(0); i < count; i++ {
+		header := childHeader(parent)
+		num := header.Number.Uint64()
+		header.Difficulty = new(big.Int).Set(cliqueDiffInTurn)
+		header.Extra = cliqueExtra(addrs, num%epoch == 0)
+
+		sig, err := crypto.Sign(clique.SealHash(header).Bytes(), signers[num%uint64(len(signers))].key)
+		if err != nil {
+			return nil, fmt.Errorf("sealing block %d: %w", num, err)
+		}
+		copy(header.Extra[len(header.Extra)-cliqueSeal:], sig)
+		headers = append(headers, header)
+		parent = header
+	}
+	if err = writeCanonicalHeaders(ctx, tx, headers); err != nil {
+		return nil, err
+	}
+
+	for i, header := range headers {
+		num, hash := header.Number.Uint64(), header.Hash()
+		if num%epoch == 0 || i == len(headers)-1 {
+			if err = writeCliqueSnapshot(tx, num, hash, addrs); err != nil {
+				return nil, err
+			}
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Returns extra data with an empty vanity and seal, and the signers in
+// between if checkpoint is set.
+func cliqueExtra(signers []common.Address, checkpoint bool) []byte {
+	extra := make([]byte, cliqueVanity, cliqueVanity+len(signers)*common.AddressLength+cliqueSeal)
+	if checkpoint {
+		for _, s := range signers {
+			extra = append(extra, s.Bytes()...)
+		}
+	}
+	return append(extra, make([]byte, cliqueSeal)...)
+}
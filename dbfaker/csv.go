@@ -0,0 +1,150 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+)
+
+// Column headers of the CSV files written by ExportStateCSV.
+var (
+	csvAccountColumns = []string{"address", "nonce", "balance", "incarnation", "code_hash"}
+	csvStorageColumns = []string{"address", "incarnation", "slot", "value"}
+)
+
+// Number of entries between progress reports of ExportStateCSV.
+const csvProgressInterval = 1 << 16
+
+// Streams the plain state into CSV files: accounts to accountsPath with the
+// columns address, nonce, balance, incarnation and code_hash, and storage to
+// storagePath with the columns address, incarnation, slot and value. Either
+// path may be empty to skip that file. Rows are in key order, numbers are
+// decimal and byte strings 0x-prefixed hex. The state is read with a cursor
+// and written as it goes, so the export runs in constant memory however large
+// the state is.
+//export ExportStateCSV
+func ExportStateCSV(dbPtr C.uintptr_t, accountsPath string, storagePath string) (exit int) {
+	defer timeOp("ExportStateCSV", "accounts", accountsPath, "storage", storagePath)()
+	return exitCode("ExportStateCSV", exportStateCSV(context.Background(), getDbHandle(dbPtr), accountsPath, storagePath))
+}
+
+// A CSV file being written, or nothing if its path was empty.
+type csvFile struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func createCSV(path string, columns []string) (*csvFile, error) {
+	if path == "" {
+		return &csvFile{}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &csvFile{f: f, w: csv.NewWriter(bufio.NewWriterSize(f, 1<<20))}
+	if err := c.w.Write(columns); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvFile) write(record ...string) error {
+	if c.w == nil {
+		return nil
+	}
+	return c.w.Write(record)
+}
+
+// Flushes and closes the file, keeping the first error in *err.
+func (c *csvFile) close(err *error) {
+	if c.f == nil {
+		return
+	}
+	c.w.Flush()
+	if ferr := c.w.Error(); *err == nil {
+		*err = ferr
+	}
+	if cerr := c.f.Close(); *err == nil {
+		*err = cerr
+	}
+}
+
+func exportStateCSV(ctx context.Context, db *dbHandle, accountsPath string, storagePath string) (err error) {
+	if accountsPath == "" && storagePath == "" {
+		return errors.New("no output file")
+	}
+	accts, err := createCSV(accountsPath, csvAccountColumns)
+	if err != nil {
+		return err
+	}
+	defer accts.close(&err)
+	storage, err := createCSV(storagePath, csvStorageColumns)
+	if err != nil {
+		return err
+	}
+	defer storage.close(&err)
+
+	return db.View(ctx, func(tx kv.Tx) error {
+		c, err := tx.Cursor(kv.PlainState)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		total, err := c.Count()
+		if err != nil {
+			return err
+		}
+
+		var done uint64
+		for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			switch len(k) {
+			case common.AddressLength:
+				var acct accounts.Account
+				if err := acct.DecodeForStorage(v); err != nil {
+					return fmt.Errorf("account %x: %w", k, err)
+				}
+				err = accts.write(hexutil.Encode(k), strconv.FormatUint(acct.Nonce, 10), acct.Balance.ToBig().String(),
+					strconv.FormatUint(acct.Incarnation, 10), acct.CodeHash.Hex())
+			case common.AddressLength + 8 + common.HashLength:
+				inc := binary.BigEndian.Uint64(k[common.AddressLength:])
+				err = storage.write(hexutil.Encode(k[:common.AddressLength]), strconv.FormatUint(inc, 10),
+					hexutil.Encode(k[common.AddressLength+8:]), hexutil.Encode(v))
+			default:
+				err = fmt.Errorf("unexpected PlainState key %x", k)
+			}
+			if err != nil {
+				return err
+			}
+
+			if done++; done%csvProgressInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				reportProgress(ctx, done, total)
+			}
+		}
+		reportProgress(ctx, done, total)
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// One query of RunQueries: an eth_* method served by ServeRPC and its
+// positional params.
+type diffQuery struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// The outcome of one query: its canonical JSON result, or the error the Go
+// readers returned for it.
+type diffResult struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// Runs the JSON array of queries in queriesJson, e.g.
+// [{"method": "eth_getBalance", "params": ["0x...", "latest"]}], through the
+// Go readers behind ServeRPC, all in one read transaction, and returns a JSON
+// array with one {"method", "params", "result"} or {"method", "params",
+// "error"} object per query, in order. Results are canonical JSON, with object
+// keys sorted and no insignificant whitespace, so a test suite can run the
+// same queries through another reader of the db and compare the outputs byte
+// for byte. The result must be released with FreeBytes.
+//export RunQueries
+func RunQueries(dbPtr C.uintptr_t, queriesJson string) (exit int, results *C.char) {
+	defer timeOp("RunQueries", "size", len(queriesJson))()
+	var queries []diffQuery
+	if err := json.Unmarshal([]byte(queriesJson), &queries); err != nil {
+		return exitCode("RunQueries", fmt.Errorf("invalid queries: %w", err)), nil
+	}
+	out, err := runQueries(context.Background(), getDbHandle(dbPtr), queries)
+	if err != nil {
+		return exitCode("RunQueries", err), nil
+	}
+	enc, err := json.Marshal(out)
+	if err != nil {
+		return exitCode("RunQueries", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func runQueries(ctx context.Context, h *dbHandle, queries []diffQuery) (results []diffResult, err error) {
+	results = make([]diffResult, len(queries))
+	err = h.View(ctx, func(tx kv.Tx) error {
+		for i, q := range queries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			results[i] = runQuery(ctx, h, tx, q)
+			reportProgress(ctx, uint64(i+1), uint64(len(queries)))
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Runs one query. Its failures are part of the output, since a reader that
+// fails where the other succeeds is a divergence too.
+func runQuery(ctx context.Context, h *dbHandle, tx kv.Tx, q diffQuery) diffResult {
+	res := diffResult{Method: q.Method, Params: q.Params}
+	if res.Params == nil {
+		res.Params = []json.RawMessage{}
+	}
+	method, ok := rpcMethods[q.Method]
+	if !ok {
+		res.Error = fmt.Sprintf("the method %s does not exist/is not available", q.Method)
+		return res
+	}
+	v, err := method(ctx, h, tx, q.Params)
+	if err == nil {
+		res.Result, err = canonicalJSON(v)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Encodes v as JSON with object keys sorted, by re-encoding it through
+// generic maps. Numbers are kept as they were encoded.
+func canonicalJSON(v interface{}) (json.RawMessage, error) {
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(enc))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after result")
+	}
+	return json.Marshal(generic)
+}
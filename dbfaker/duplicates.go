@@ -0,0 +1,119 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Turns duplicate transaction detection on or off for the db. While enabled,
+// PutTxLookupEntries fails for a hash that TxLookup already maps to another
+// block, and PutTransactions fails for a transaction that TxLookup maps to a
+// block whose stored body does not hold the tx id being written, instead of
+// silently remapping it. This catches the same fixture transactions being
+// reused across blocks, which otherwise only shows up as lookups returning
+// the wrong block. With lenient, PutTxLookupEntries logs and skips the
+// duplicates, keeping their old mapping.
+//export SetCheckDuplicateTxs
+func SetCheckDuplicateTxs(dbPtr C.uintptr_t, enabled bool) (exit int) {
+	defer timeOp("SetCheckDuplicateTxs", "enabled", enabled)()
+	getDbHandle(dbPtr).setCheckDuplicateTxs(enabled)
+	return 1
+}
+
+func (h *dbHandle) setCheckDuplicateTxs(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkDuplicateTxs = enabled
+}
+
+// Returns the handle of db if it checks for duplicate transactions.
+func duplicateTxChecker(db kv.RwDB) (*dbHandle, bool) {
+	h, ok := db.(*dbHandle)
+	if !ok {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h, h.checkDuplicateTxs
+}
+
+// Returns the block TxLookup maps hash to, if any.
+func readTxLookupBlock(tx kv.Tx, schema schemaAdapter, hash []byte) (num uint64, ok bool, err error) {
+	v, err := tx.GetOne(kv.TxLookup, hash)
+	if err != nil || v == nil {
+		return 0, false, err
+	}
+	return schema.txLookupBlock(v), true, nil
+}
+
+// Fails if hash is already mapped to a block other than num.
+func checkTxLookupDuplicate(tx kv.Tx, schema schemaAdapter, hash []byte, num uint64) error {
+	existing, ok, err := readTxLookupBlock(tx, schema, hash)
+	if err != nil {
+		return err
+	}
+	if ok && existing != num {
+		return fmt.Errorf("tx %x is already mapped to block %d", hash, existing)
+	}
+	return nil
+}
+
+// Fails for the first of txs, to be written from tx id firstTxId on, that is
+// mapped to a block whose canonical body does not cover its id. Transactions
+// mapped to blocks without a stored body cannot be told apart from ones
+// written ahead of their body, and pass.
+func checkTransactionDuplicates(tx kv.Tx, schema schemaAdapter, txs []types.Transaction, firstTxId uint64) error {
+	for i, txn := range txs {
+		hash := txn.Hash()
+		num, ok, err := readTxLookupBlock(tx, schema, hash[:])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		body, err := readCanonicalBodyForStorage(tx, num)
+		if err != nil {
+			return err
+		}
+		id := firstTxId + uint64(i)
+		if body != nil && (id < body.BaseTxId || id >= body.BaseTxId+uint64(body.TxAmount)) {
+			return fmt.Errorf("tx %d (%x) is already in block %d", i, hash, num)
+		}
+	}
+	return nil
+}
+
+// Returns the stored body of canonical block num, or nil if there is none.
+func readCanonicalBodyForStorage(tx kv.Tx, num uint64) (*types.BodyForStorage, error) {
+	hash, err := rawdb.ReadCanonicalHash(tx, num)
+	if err != nil || hash == (common.Hash{}) {
+		return nil, err
+	}
+	return readBodyForStorage(tx, hash, num)
+}
+
+// Returns the stored body of block num, or nil if there is none.
+func readBodyForStorage(tx kv.Tx, hash common.Hash, num uint64) (*types.BodyForStorage, error) {
+	v, err := tx.GetOne(kv.BlockBody, dbutils.BlockBodyKey(num, hash))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	body := new(types.BodyForStorage)
+	if err := rlp.DecodeBytes(v, body); err != nil {
+		return nil, fmt.Errorf("BodyForStorage DecodeBytes: %w", err)
+	}
+	return body, nil
+}
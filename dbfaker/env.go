@@ -0,0 +1,332 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import "runtime/cgo"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	mdbxgo "github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// Names of the data and lock files mdbx creates inside a db directory.
+const (
+	mdbxDataFile = "mdbx.dat"
+	mdbxLockFile = "mdbx.lck"
+)
+
+// Grows the mdbx map of the db to at least size bytes in one step. Seeding a
+// multi-gigabyte fixture otherwise pauses every time mdbx hits the current
+// map size and has to remap. The upper bound of the geometry is raised if it
+// is smaller than size. Shrinking is never performed.
+//export GrowMap
+func GrowMap(dbPtr C.uintptr_t, size uint64) (exit int) {
+	defer timeOp("GrowMap", "size", size)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("GrowMap", growMap(db, size))
+}
+
+func growMap(db kv.RwDB, size uint64) error {
+	env, err := mdbxEnv(db)
+	if err != nil {
+		return err
+	}
+
+	info, err := env.Info(nil)
+	if err != nil {
+		return fmt.Errorf("env info: %w", err)
+	}
+	if size <= info.Geo.Current {
+		return nil
+	}
+
+	upper := -1
+	if size > info.Geo.Upper {
+		upper = int(size)
+	}
+	// -1 leaves the corresponding geometry parameter unchanged
+	return env.SetGeometry(-1, int(size), upper, -1, -1, -1)
+}
+
+// Toggles fast-seed mode. While enabled, commits do not fsync, which makes
+// bulk fixture generation an order of magnitude faster at the cost of
+// durability: a crash may lose the most recent commits, but the db stays
+// consistent (MDBX_SAFE_NOSYNC). Disabling the mode flushes everything
+// written so far. Closing the db also flushes, so callers that seed and then
+// close do not need to call Sync themselves.
+//export SetFastSeed
+func SetFastSeed(dbPtr C.uintptr_t, enabled bool) (exit int) {
+	defer timeOp("SetFastSeed", "enabled", enabled)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("SetFastSeed", setFastSeed(db, enabled))
+}
+
+func setFastSeed(db kv.RwDB, enabled bool) error {
+	env, err := mdbxEnv(db)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		return env.SetFlags(mdbxgo.SafeNoSync)
+	}
+	if err = env.UnsetFlags(mdbxgo.SafeNoSync); err != nil {
+		return err
+	}
+	return env.Sync(true, false)
+}
+
+// Forces all committed data to disk.
+//export Sync
+func Sync(dbPtr C.uintptr_t) (exit int) {
+	defer timeOp("Sync")()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("Sync", syncEnv(db))
+}
+
+func syncEnv(db kv.RwDB) error {
+	env, err := mdbxEnv(db)
+	if err != nil {
+		return err
+	}
+	return env.Sync(true, false)
+}
+
+// Writes a compacted copy of the db into the directory destPath, which is
+// created if needed and must not already contain a database. Free pages are
+// omitted and the data is renumbered, so heavily rewritten fixtures shrink
+// considerably. The result can be opened directly with MdbxOpen.
+//export CompactTo
+func CompactTo(dbPtr C.uintptr_t, destPath string) (exit int) {
+	defer timeOp("CompactTo", "destPath", destPath)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("CompactTo", copyEnv(db, destPath))
+}
+
+// Writes a copy of the db into the directory destPath, which is created if
+// needed and must not already contain a database, so that each test can
+// start from a shared seeded baseline instead of seeding its own db. The copy
+// is written as CompactTo writes it, compacted. Open the copy with MdbxOpen.
+//export CloneDb
+func CloneDb(dbPtr C.uintptr_t, destPath string) (exit int) {
+	defer timeOp("CloneDb", "destPath", destPath)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("CloneDb", copyEnv(db, destPath))
+}
+
+// Writes a copy of the db into the directory destPath while the db stays open
+// and in use, replacing the copy a previous BackupTo left there, so that a
+// long-running test service can snapshot its state periodically. The copy is
+// written next to destPath and only moved into place once complete, so a
+// failed backup leaves the previous one as it was. Like CloneDb, it runs in a
+// read transaction: writers carry on meanwhile, and the backup holds the state
+// as of the last commit before it began, without the uncommitted writes of a
+// test transaction. The backup must not be open while it is replaced.
+//export BackupTo
+func BackupTo(dbPtr C.uintptr_t, destPath string) (exit int) {
+	defer timeOp("BackupTo", "destPath", destPath)()
+	return exitCode("BackupTo", backupEnv(getDbHandle(dbPtr), destPath))
+}
+
+func backupEnv(db kv.RwDB, dest string) (err error) {
+	env, err := mdbxEnv(db)
+	if err != nil {
+		return err
+	}
+	if dest, err = platformPath(dest); err != nil {
+		return err
+	}
+	dest = filepath.Clean(dest)
+	if path, err := env.Path(); err == nil && canonicalPath(path) == canonicalPath(dest) {
+		return fmt.Errorf("cannot back up the db into its own directory %s", dest)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dest), filepath.Base(dest)+".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err = copyEnv(db, tmp); err != nil {
+		return err
+	}
+
+	// move the previous backup aside rather than deleting it first, so that
+	// it can be restored if the new one cannot be moved into place
+	old := tmp + ".old"
+	if err = os.Rename(dest, old); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err = os.Rename(tmp, dest); err != nil {
+		os.Rename(old, dest)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// Materializes the backup in the directory path, as written by BackupTo,
+// CloneDb or CompactTo, as a fresh db in the directory destPath, which is
+// created if needed and must not already contain a database. Open it with
+// MdbxOpen. The backup is left as it is, so it can be restored again for the
+// next test run.
+//export RestoreFrom
+func RestoreFrom(path string, destPath string) (exit int) {
+	defer timeOp("RestoreFrom", "path", path, "destPath", destPath)()
+	return exitCode("RestoreFrom", restoreEnv(path, destPath, false))
+}
+
+// Like RestoreFrom, but replaces the db in destPath, if any, with the backup.
+// The db must be closed: the call fails while this process has it open, and
+// other processes must have closed it too, since its lock file is removed
+// along with the old data.
+//export RestoreInPlace
+func RestoreInPlace(path string, destPath string) (exit int) {
+	defer timeOp("RestoreInPlace", "path", path, "destPath", destPath)()
+	return exitCode("RestoreInPlace", restoreEnv(path, destPath, true))
+}
+
+func restoreEnv(src string, dest string, inPlace bool) error {
+	// keeps MdbxOpen from opening dest while it is being replaced
+	openDbs.Lock()
+	defer openDbs.Unlock()
+	if pathInUse(canonicalPath(dest)) {
+		return fmt.Errorf("db %s is open", dest)
+	}
+
+	var err error
+	if src, err = platformPath(src); err != nil {
+		return err
+	}
+	if dest, err = platformPath(dest); err != nil {
+		return err
+	}
+	srcFile := filepath.Join(src, mdbxDataFile)
+	in, err := os.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("no backup in %s: %w", src, err)
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	datFile := filepath.Join(dest, mdbxDataFile)
+	if _, err = os.Stat(datFile); err == nil && !inPlace {
+		return fmt.Errorf("%s already exists", datFile)
+	}
+
+	// the data is renamed into place once complete, so that a failed restore
+	// leaves the db as it was
+	out, err := os.CreateTemp(dest, mdbxDataFile+".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(out.Name(), datFile); err != nil {
+		return err
+	}
+	// the lock file tracks the readers of the replaced data
+	if err = os.Remove(filepath.Join(dest, mdbxLockFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Copies the tables of db into a new db in the directory dest, opened as
+// MdbxOpen opens dbs. The pinned mdbx-go does not bind mdbx_env_copy, so the
+// entries are appended one table at a time in key order instead, which leaves
+// out free pages as its MDBX_CP_COMPACT does. The copy is read in one read
+// transaction, so it is consistent and does not block writers.
+func copyEnv(db kv.RwDB, dest string) (err error) {
+	if dest, err = platformPath(dest); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	datFile := filepath.Join(dest, mdbxDataFile)
+	if _, err = os.Stat(datFile); err == nil {
+		return fmt.Errorf("%s already exists", datFile)
+	}
+
+	out, err := openEnv(libLog.New("db", dest), dest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(datFile)
+			os.Remove(filepath.Join(dest, mdbxLockFile))
+		}
+	}()
+
+	ctx := context.Background()
+	return db.View(ctx, func(tx kv.Tx) error {
+		for _, table := range dbTables() {
+			err := out.Update(ctx, func(outTx kv.RwTx) error {
+				c, err := outTx.RwCursor(table)
+				if err != nil {
+					return err
+				}
+				defer c.Close()
+				return tx.ForEach(table, nil, c.Append)
+			})
+			if err != nil {
+				return fmt.Errorf("copying %s: %w", table, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Flags every env is opened with on top of Erigon's defaults. NoTLS ties
+// reader slots to read transactions instead of OS threads: the host may use a
+// read transaction from any of its threads, and Go moves goroutines between
+// threads anyway, so thread-local slots would be leaked or shared.
+func envFlags(flags uint) uint {
+	return flags | mdbxgo.NoTLS
+}
+
+// Returns the limiter of concurrent read transactions every env is opened
+// with. Erigon's default admits runtime.NumCPU() of them and blocks BeginRo
+// beyond that, which read transactions the host keeps open across calls would
+// exhaust, hanging every later read. Under NoTLS each read transaction takes
+// a reader slot of its own, so the limit is the number of slots Erigon opens
+// envs with.
+func newRoTxsLimiter() chan struct{} {
+	return make(chan struct{}, kv.ReadersLimit)
+}
+
+// Returns the underlying mdbx environment of db.
+func mdbxEnv(db kv.RwDB) (*mdbxgo.Env, error) {
+	if h, ok := db.(*dbHandle); ok {
+		db = h.RwDB
+	}
+	e, ok := db.(interface{ Env() *mdbxgo.Env })
+	if !ok {
+		return nil, fmt.Errorf("db of type %T is not backed by an mdbx env", db)
+	}
+	return e.Env(), nil
+}
@@ -0,0 +1,95 @@
+//go:build !slim
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const slimBuild = false
+
+var buildFeatures = []string{
+	featureCoreWrites,
+	featureReads,
+	featureEnvControl,
+	featureSnapshots,
+	featureRemoteKV,
+	featureCall,
+	featureProto,
+	featureJobs,
+	featureRPC,
+	featureMetrics,
+	featureTrace,
+	featureSlowLog,
+	featureAudit,
+	featureHistory,
+	featureHistoricalReads,
+	featureMaterialize,
+	featureAccountSetters,
+	featureStateSetters,
+	featureIncrementNonce,
+	featureBalanceDeltas,
+	featureHeaderChains,
+	featureReorgs,
+	featureReceipts,
+	featureBodies,
+	featureVerifySignatures,
+	featureBloomPatching,
+	featureFuzz,
+	featureFixtures,
+	featureClone,
+	featureTestTx,
+	featureAssertions,
+	featureWriteQueue,
+	featureClique,
+	featureBor,
+	featureQueries,
+	featureSelfTest,
+	featureSQLite,
+	featureStateCSV,
+	featureERC20,
+	featureStorageLayout,
+	featureDeFiPresets,
+	featureBatchRead,
+	featureLogging,
+	featureStream,
+	featureSharedRegions,
+	featureMapGrowth,
+	featurePutStorageMode,
+	featureInsertOnly,
+	featureDuplicateTxs,
+	featureBackup,
+	featureRestore,
+	featureSpace,
+	featureMigrations,
+	featureStamp,
+	featureHandles,
+	featureReadTxTimeout,
+	featureChains,
+	featurePresetNetworks,
+	featureCodeUpload,
+	featureSubscriptions,
+	featureLogs,
+	featureCallTraces,
+	featureStructLogs,
+	featureStateDiff,
+	featureBodiesWithSenders,
+	featureCanonicalizeRange,
+	featureChainHead,
+	featureAlloc,
+	featureRPCHeaders,
+	featureRPCTransactions,
+	featureRPCReceipts,
+	featureTablePages,
+}
+
+func schemaVersions() []string {
+	var versions []string
+	for _, a := range schemaAdapters {
+		v := a.version()
+		versions = append(versions, fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch))
+	}
+	sort.Strings(versions)
+	return versions
+}
@@ -0,0 +1,299 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Fixture files start with fixtureMagic, the format version and the schema
+// version of the db they were taken from, uncompressed so that they can be
+// checked without inflating the file. The rest is gzip compressed: each table
+// as its name followed by its entries in key order and a 0, and an empty name
+// ending the file. An entry is the key length plus one, the key, the value
+// length and the value. Lengths and versions are uvarints.
+var fixtureMagic = []byte("dbfaker-fixture\n")
+
+const fixtureVersion = 1
+
+// Writes the tables in the comma-separated list tables, or every non-empty
+// chaindata table if tables is empty, to a fixture file at path that
+// ImportFixture loads back. The file holds the raw entries in key order along
+// with the schema version of the db, so the same db contents always give the
+// same file and can be reproduced exactly on any machine.
+//export ExportFixture
+func ExportFixture(dbPtr C.uintptr_t, path string, tables string) (exit int) {
+	defer timeOp("ExportFixture", "path", path, "tables", tables)()
+	return exitCode("ExportFixture", exportFixture(context.Background(), getDbHandle(dbPtr), path, splitTables(tables)))
+}
+
+// Loads a fixture file written by ExportFixture in one transaction. Each
+// table in the fixture is cleared before its entries are written, so that it
+// ends up exactly as exported; tables not in the fixture are left alone.
+// Fixtures taken from a db with a different schema major version are
+// rejected, since their entries would be read in the wrong format.
+//export ImportFixture
+func ImportFixture(dbPtr C.uintptr_t, path string) (exit int) {
+	defer timeOp("ImportFixture", "path", path)()
+	db := getDbHandle(dbPtr)
+	return exitCode("ImportFixture", retryMapFull(db, "ImportFixture", func() error {
+		return importFixture(context.Background(), db, path)
+	}))
+}
+
+func splitTables(tables string) []string {
+	if tables == "" {
+		return nil
+	}
+	return strings.Split(tables, ",")
+}
+
+func exportFixture(ctx context.Context, db *dbHandle, path string, tables []string) (err error) {
+	for _, table := range tables {
+		if !isChaindataTable(table) {
+			return fmt.Errorf("unknown table %q", table)
+		}
+	}
+	// listed tables are exported even when empty, so importing clears them
+	skipEmpty := len(tables) == 0
+	if skipEmpty {
+		tables = append(tables, kv.ChaindataTables...)
+	}
+	sort.Strings(tables)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+
+	if _, err = w.Write(fixtureMagic); err != nil {
+		return err
+	}
+	v := db.currentSchema().version()
+	for _, n := range []uint64{fixtureVersion, uint64(v.Major), uint64(v.Minor), uint64(v.Patch)} {
+		if err = writeUvarint(w, n); err != nil {
+			return err
+		}
+	}
+
+	// the gzip header carries no name or timestamp, so it does not vary
+	// between exports
+	zw := gzip.NewWriter(w)
+	err = db.View(ctx, func(tx kv.Tx) error {
+		for i, table := range tables {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := exportFixtureTable(tx, table, skipEmpty, zw); err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			reportProgress(ctx, uint64(i+1), uint64(len(tables)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = writeUvarint(zw, 0); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func exportFixtureTable(tx kv.Tx, table string, skipEmpty bool, w io.Writer) error {
+	c, err := tx.Cursor(table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	k, v, err := c.First()
+	if err != nil {
+		return err
+	}
+	if k == nil && skipEmpty {
+		return nil
+	}
+	if err := writeFixtureBytes(w, []byte(table)); err != nil {
+		return err
+	}
+	for ; k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(len(k))+1); err != nil {
+			return err
+		}
+		if _, err := w.Write(k); err != nil {
+			return err
+		}
+		if err := writeFixtureBytes(w, v); err != nil {
+			return err
+		}
+	}
+	return writeUvarint(w, 0)
+}
+
+func importFixture(ctx context.Context, db *dbHandle, path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(fixtureMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != string(fixtureMagic) {
+		return fmt.Errorf("%s is not a fixture file", path)
+	}
+	var header [4]uint64
+	for i := range header {
+		if header[i], err = binary.ReadUvarint(r); err != nil {
+			return fmt.Errorf("fixture header: %w", err)
+		}
+	}
+	if header[0] != fixtureVersion {
+		return fmt.Errorf("unsupported fixture version %d", header[0])
+	}
+	if v := db.currentSchema().version(); header[1] != uint64(v.Major) {
+		return fmt.Errorf("fixture of schema version %d.%d.%d cannot be loaded into a db of schema version %d.%d.%d",
+			header[1], header[2], header[3], v.Major, v.Minor, v.Patch)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("fixture body: %w", err)
+	}
+	br := bufio.NewReader(zr)
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name, err := readFixtureBytes(br)
+		if err != nil {
+			return fmt.Errorf("fixture body: %w", err)
+		}
+		if len(name) == 0 {
+			return nil
+		}
+		table := string(name)
+		if !isChaindataTable(table) {
+			return fmt.Errorf("unknown table %q in fixture", table)
+		}
+		if err := importFixtureTable(tx, table, br); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+}
+
+func importFixtureTable(tx kv.RwTx, table string, r *bufio.Reader) error {
+	if err := tx.ClearBucket(table); err != nil {
+		return err
+	}
+	kbuf, vbuf := getBuffer(), getBuffer()
+	defer putBuffer(kbuf)
+	defer putBuffer(vbuf)
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n > maxFixtureBytes {
+			return errFixtureEntryTooLarge
+		}
+		k := bufferBytes(kbuf, int(n-1))
+		if _, err := io.ReadFull(r, k); err != nil {
+			return err
+		}
+		v, err := readFixtureBytesTo(r, vbuf)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(table, k, v); err != nil {
+			return err
+		}
+	}
+}
+
+func writeUvarint(w io.Writer, n uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], n)])
+	return err
+}
+
+func writeFixtureBytes(w io.Writer, b []byte) error {
+	if err := writeUvarint(w, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Guards against allocating for the lengths of a corrupt fixture; real
+// entries are much smaller.
+const maxFixtureBytes = 1 << 30
+
+var errFixtureEntryTooLarge = errors.New("entry too large, the fixture is corrupt")
+
+func readFixtureBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFixtureBytes {
+		return nil, errFixtureEntryTooLarge
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// Like readFixtureBytes, but reads into buf instead of allocating. The result
+// is only valid until buf is used again.
+func readFixtureBytesTo(r *bufio.Reader, buf *bytes.Buffer) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFixtureBytes {
+		return nil, errFixtureEntryTooLarge
+	}
+	b := bufferBytes(buf, int(n))
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
@@ -0,0 +1,268 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/rand"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Writes count deterministic pseudo-random entries to table, the same ones
+// for the same seed. Entries of the tables in fuzzShapes have the key layout
+// and value encoding Erigon uses for that table, filled with random but
+// decodable contents (e.g. headers with random fields, keyed by their real
+// hash); other tables get random keys and values. The point is to stress
+// decoders with data that is plausible but not well-behaved.
+//export FuzzTable
+func FuzzTable(dbPtr C.uintptr_t, table string, seed int64, count uint64) (exit int) {
+	defer timeOp("FuzzTable", "table", table, "seed", seed, "count", count)()
+	db := getDbHandle(dbPtr)
+	return exitCode("FuzzTable", retryMapFull(db, "FuzzTable", func() error {
+		return fuzzTable(context.Background(), db, table, seed, count)
+	}))
+}
+
+func fuzzTable(ctx context.Context, db *dbHandle, table string, seed int64, count uint64) (err error) {
+	if !isChaindataTable(table) {
+		return fmt.Errorf("unknown table %q", table)
+	}
+	gen, ok := fuzzShapes[table]
+	if !ok {
+		gen = fuzzRaw
+	}
+	f := &fuzzer{r: rand.New(rand.NewSource(seed)), schema: db.currentSchema()}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	for i := uint64(0); i < count; i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		k, v, err := gen(f)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		if err = tx.Put(table, k, v); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		reportProgress(ctx, i+1, count)
+	}
+	return nil
+}
+
+// Generates one entry of a table.
+type fuzzGen func(f *fuzzer) (k, v []byte, err error)
+
+// Generators for the tables whose shape FuzzTable knows.
+var fuzzShapes = map[string]fuzzGen{
+	kv.PlainState:        fuzzPlainState,
+	kv.PlainContractCode: fuzzContractCode,
+	kv.Code:              fuzzCode,
+	kv.Headers:           fuzzHeader,
+	kv.HeaderNumber:      fuzzHeaderNumber,
+	kv.HeaderCanonical:   fuzzCanonicalHash,
+	kv.HeaderTD:          fuzzTd,
+	kv.BlockBody:         fuzzBody,
+	kv.Senders:           fuzzSenders,
+	kv.EthTx:             fuzzTx,
+	kv.TxLookup:          fuzzTxLookup,
+}
+
+type fuzzer struct {
+	r      *rand.Rand
+	schema schemaAdapter
+}
+
+func (f *fuzzer) bytes(n int) []byte {
+	b := make([]byte, n)
+	f.r.Read(b)
+	return b
+}
+
+func (f *fuzzer) hash() (h common.Hash) {
+	f.r.Read(h[:])
+	return h
+}
+
+func (f *fuzzer) address() (a common.Address) {
+	f.r.Read(a[:])
+	return a
+}
+
+// Returns a number that is small, large or at the edge of its range with
+// roughly equal odds, since decoders tend to break at the extremes.
+func (f *fuzzer) uint64() uint64 {
+	switch f.r.Intn(4) {
+	case 0:
+		return uint64(f.r.Intn(256))
+	case 1:
+		return ^uint64(0) - uint64(f.r.Intn(2))
+	default:
+		return f.r.Uint64()
+	}
+}
+
+func (f *fuzzer) uint256() *uint256.Int {
+	return new(uint256.Int).SetBytes(f.bytes(f.r.Intn(33)))
+}
+
+func (f *fuzzer) blockKey() []byte {
+	return dbutils.BlockBodyKey(f.uint64(), f.hash())
+}
+
+func fuzzRaw(f *fuzzer) ([]byte, []byte, error) {
+	return f.bytes(1 + f.r.Intn(64)), f.bytes(f.r.Intn(256)), nil
+}
+
+// Accounts keyed by address and storage slots keyed by address, incarnation
+// and slot, in equal parts.
+func fuzzPlainState(f *fuzzer) ([]byte, []byte, error) {
+	address := f.address()
+	if f.r.Intn(2) == 0 {
+		acct := accounts.NewAccount()
+		acct.Nonce = f.uint64()
+		acct.Balance.Set(f.uint256())
+		acct.Incarnation = uint64(f.r.Intn(4))
+		if f.r.Intn(2) == 0 {
+			acct.CodeHash = f.hash()
+		}
+		enc := make([]byte, acct.EncodingLengthForStorage())
+		acct.EncodeForStorage(enc)
+		return address.Bytes(), enc, nil
+	}
+	key := dbutils.PlainGenerateCompositeStorageKey(address.Bytes(), 1+uint64(f.r.Intn(3)), f.hash().Bytes())
+	// values are stored without leading zeros and never empty
+	value := f.bytes(1 + f.r.Intn(32))
+	value[0] |= 1
+	return key, value, nil
+}
+
+func fuzzContractCode(f *fuzzer) ([]byte, []byte, error) {
+	return dbutils.PlainGenerateStoragePrefix(f.address().Bytes(), 1+uint64(f.r.Intn(3))), f.hash().Bytes(), nil
+}
+
+func fuzzCode(f *fuzzer) ([]byte, []byte, error) {
+	code := f.bytes(f.r.Intn(1024))
+	return crypto.Keccak256(code), code, nil
+}
+
+func fuzzHeader(f *fuzzer) ([]byte, []byte, error) {
+	header := &types.Header{
+		ParentHash:  f.hash(),
+		UncleHash:   f.hash(),
+		Coinbase:    f.address(),
+		Root:        f.hash(),
+		TxHash:      f.hash(),
+		ReceiptHash: f.hash(),
+		Difficulty:  new(big.Int).SetBytes(f.bytes(f.r.Intn(33))),
+		Number:      new(big.Int).SetUint64(f.uint64()),
+		GasLimit:    f.uint64(),
+		GasUsed:     f.uint64(),
+		Time:        f.uint64(),
+		Extra:       f.bytes(f.r.Intn(97)),
+		MixDigest:   f.hash(),
+	}
+	f.r.Read(header.Bloom[:])
+	binary.BigEndian.PutUint64(header.Nonce[:], f.r.Uint64())
+	// pre- and post-London headers
+	if f.r.Intn(2) == 0 {
+		header.BaseFee = new(big.Int).SetBytes(f.bytes(f.r.Intn(33)))
+	}
+	enc, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dbutils.HeaderKey(header.Number.Uint64(), header.Hash()), enc, nil
+}
+
+func fuzzHeaderNumber(f *fuzzer) ([]byte, []byte, error) {
+	return f.hash().Bytes(), dbutils.EncodeBlockNumber(f.uint64()), nil
+}
+
+func fuzzCanonicalHash(f *fuzzer) ([]byte, []byte, error) {
+	return dbutils.EncodeBlockNumber(f.uint64()), f.hash().Bytes(), nil
+}
+
+func fuzzTd(f *fuzzer) ([]byte, []byte, error) {
+	enc, err := rlp.EncodeToBytes(new(big.Int).SetBytes(f.bytes(f.r.Intn(33))))
+	return f.blockKey(), enc, err
+}
+
+func fuzzBody(f *fuzzer) ([]byte, []byte, error) {
+	body := &types.BodyForStorage{
+		BaseTxId: f.uint64(),
+		TxAmount: uint32(f.uint64()),
+	}
+	for i := f.r.Intn(3); i > 0; i-- {
+		body.Uncles = append(body.Uncles, &types.Header{
+			ParentHash: f.hash(),
+			Difficulty: new(big.Int).SetBytes(f.bytes(f.r.Intn(33))),
+			Number:     new(big.Int).SetUint64(f.uint64()),
+			Extra:      f.bytes(f.r.Intn(33)),
+		})
+	}
+	enc, err := rlp.EncodeToBytes(body)
+	return f.blockKey(), enc, err
+}
+
+func fuzzSenders(f *fuzzer) ([]byte, []byte, error) {
+	return f.blockKey(), f.bytes(common.AddressLength * f.r.Intn(16)), nil
+}
+
+// Legacy, access list and dynamic fee transactions with random fields and
+// signature values, keyed by a tx id.
+func fuzzTx(f *fuzzer) ([]byte, []byte, error) {
+	var to *common.Address
+	if f.r.Intn(4) > 0 {
+		a := f.address()
+		to = &a
+	}
+	base := types.CommonTx{
+		Nonce: f.uint64(),
+		Gas:   f.uint64(),
+		To:    to,
+		Value: f.uint256(),
+		Data:  f.bytes(f.r.Intn(256)),
+	}
+	base.V.Set(f.uint256())
+	base.R.Set(f.uint256())
+	base.S.Set(f.uint256())
+
+	var txn types.Transaction
+	switch f.r.Intn(3) {
+	case 0:
+		txn = &types.LegacyTx{CommonTx: base, GasPrice: f.uint256()}
+	case 1:
+		base.ChainID = f.uint256()
+		txn = &types.AccessListTx{LegacyTx: types.LegacyTx{CommonTx: base, GasPrice: f.uint256()}, ChainID: base.ChainID}
+	default:
+		base.ChainID = f.uint256()
+		txn = &types.DynamicFeeTransaction{CommonTx: base, Tip: f.uint256(), FeeCap: f.uint256()}
+	}
+	enc, err := rlp.EncodeToBytes(txn)
+	return dbutils.EncodeBlockNumber(f.uint64()), enc, err
+}
+
+func fuzzTxLookup(f *fuzzer) ([]byte, []byte, error) {
+	return f.hash().Bytes(), f.schema.txLookupValue(f.uint64()), nil
+}
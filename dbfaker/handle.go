@@ -0,0 +1,248 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import "runtime/cgo"
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync"
+	"google.golang.org/grpc"
+)
+
+// The value behind every db pointer handed out by MdbxOpen. It embeds the
+// kv.RwDB so that exports which only need the db can keep asserting the
+// handle value to kv.RwDB, while state that belongs to an open db lives here.
+// Every MdbxOpen of a path gets a handle of its own, holding the modes and
+// servers of that caller, around the db shared by all handles on the path.
+type dbHandle struct {
+	*sharedDb
+	// Guards the servers and modes below up to testTx, which the Set* and
+	// Serve* exports change while jobs, queued writes and servers read them.
+	mu sync.Mutex
+	// Remote KV server started with ServeRemoteKV, if any.
+	kvServer *grpc.Server
+	// JSON-RPC server started with ServeRPC, if any.
+	rpcServer *http.Server
+	// Operation trace enabled with SetTrace, if any.
+	tracer *tracer
+	// Set with SetAudit to mirror writes into the audit table.
+	audit bool
+	// Set with SetHistory to record changesets at historyBlock.
+	withHistory  bool
+	historyBlock uint64
+	// Set with SetVerifySignatures to validate transactions before writing.
+	verifySignatures bool
+	// Set with SetCheckDuplicateTxs to reject remapped transaction hashes.
+	checkDuplicateTxs bool
+	// Set with SetPutStorageMode, one of the putStorage* modes.
+	putStorageMode int
+	// Set with SetInsertOnly to fail writes to existing keys by default.
+	insertOnly bool
+	// Test transaction begun with BeginTestTx, if any.
+	testTx kv.RwTx
+	// Error of the first export that failed in the test transaction, which
+	// fails every later use of it until the rollback. Only accessed from the
+	// thread of the test transaction.
+	testTxErr error
+
+	// Read transactions begun with ReadBegin and not yet ended, guarded by
+	// readersMu.
+	readersMu sync.Mutex
+	readers   map[*readTx]struct{}
+	// Queue of EnqueueWrite, started on first use and guarded by mu.
+	queueOnce sync.Once
+	queue     *writeQueue
+}
+
+// The part of a db shared by every handle opened on its path: the env and
+// what is attached to the data rather than to a caller.
+type sharedDb struct {
+	kv.RwDB
+	// Guards snapshots, retired and schema.
+	mu sync.Mutex
+	// Frozen block segments attached with OpenSnapshots, if any.
+	snapshots *snapshotsync.RoSnapshots
+	// Segments replaced by a later OpenSnapshots, kept open until the db is
+	// closed since block readers may still be using them.
+	retired []*snapshotsync.RoSnapshots
+	// Set for dbs opened with RemoteOpen, which only support reads.
+	readOnly bool
+	// Connection backing a remote db.
+	conn *grpc.ClientConn
+	// Encodings for the schema version of the db.
+	schema schemaAdapter
+	// Set with SetMapGrowth, accessed atomically.
+	mapFullRetries int64
+	mapGrowthStep  uint64
+
+	// Serializes write transactions. mdbx allows one at a time per env;
+	// writers from other host threads and jobs wait for their turn here
+	// rather than on the mdbx lock, which pins an OS thread while it waits.
+	writeMu sync.Mutex
+	// Handle holding the test transaction, if any, guarded by testTxMu. The
+	// test transaction holds writeMu until it is rolled back.
+	testTxMu    sync.Mutex
+	testTxOwner *dbHandle
+
+	// Subscriptions from Subscribe, guarded by subsMu.
+	subsMu sync.Mutex
+	subs   map[*subscription]struct{}
+
+	// Key of the db in openDbs, empty for dbs that are not shared.
+	path string
+	// Number of handles sharing the db, guarded by openDbs.
+	refs int
+}
+
+// Dbs opened with MdbxOpen, keyed by their canonical path. Opening the same
+// path twice shares the env instead of creating a second one that would
+// contend with the first for the mdbx lock. Dbs whose last handle is being
+// closed are in closing until their env is, which MdbxOpen of the path waits
+// for.
+var openDbs = struct {
+	sync.Mutex
+	byPath  map[string]*sharedDb
+	closing map[string]chan struct{}
+}{byPath: make(map[string]*sharedDb), closing: make(map[string]chan struct{})}
+
+// Whether the db at the canonical path key is open or being closed. Must be
+// called with openDbs held.
+func pathInUse(key string) bool {
+	_, open := openDbs.byPath[key]
+	_, closing := openDbs.closing[key]
+	return open || closing
+}
+
+// Returns the key two paths to the same db agree on.
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	// The db dir doesn't exist before the first open, so resolve its parent
+	// to agree with the key computed once it does.
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
+
+var errReadOnly = errors.New("db is read-only")
+
+func newDbHandle(db kv.RwDB) (*dbHandle, error) {
+	schema, err := detectSchema(db)
+	if err != nil {
+		return nil, err
+	}
+	return (&sharedDb{RwDB: db, schema: schema, refs: 1, mapFullRetries: defaultMapFullRetries}).newHandle(), nil
+}
+
+// Returns a new handle on the db. The caller accounts for it in refs.
+func (s *sharedDb) newHandle() *dbHandle {
+	return &dbHandle{sharedDb: s, readers: make(map[*readTx]struct{})}
+}
+
+func getDbHandle(dbPtr C.uintptr_t) *dbHandle {
+	return cgo.Handle(dbPtr).Value().(*dbHandle)
+}
+
+// Closes the handle along with everything attached to it, once its queued
+// writes have been committed, and then the db if no other handle shares it.
+// Read transactions the host left open are rolled back first, since closing
+// the env under them would leave their reader slots dangling.
+func (h *dbHandle) Close() {
+	h.mu.Lock()
+	q := h.queue
+	h.mu.Unlock()
+	if q != nil {
+		q.close()
+	}
+	if h.testTx != nil {
+		h.rollbackTestTx()
+	}
+	h.readersMu.Lock()
+	for tx := range h.readers {
+		tx.end()
+	}
+	h.readersMu.Unlock()
+	h.stopKvServer()
+	h.stopRPCServer()
+	h.setTrace("")
+	if h.release() {
+		h.sharedDb.close()
+		h.closed()
+	}
+}
+
+// Drops the reference of one handle to the db, reporting whether it was the
+// last one. The last one also forgets the path, so that the next MdbxOpen
+// opens it afresh.
+func (s *sharedDb) release() bool {
+	openDbs.Lock()
+	defer openDbs.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return false
+	}
+	if s.path != "" {
+		delete(openDbs.byPath, s.path)
+		openDbs.closing[s.path] = make(chan struct{})
+	}
+	return true
+}
+
+// Lets MdbxOpen reopen the path of the db once it has been closed.
+func (s *sharedDb) closed() {
+	if s.path == "" {
+		return
+	}
+	openDbs.Lock()
+	defer openDbs.Unlock()
+	close(openDbs.closing[s.path])
+	delete(openDbs.closing, s.path)
+}
+
+func (s *sharedDb) close() {
+	for _, snapshots := range append(s.retired, s.snapshots) {
+		if snapshots != nil {
+			snapshots.Close()
+		}
+	}
+	s.RwDB.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Returns the encodings for the current schema version of the db.
+func (s *sharedDb) currentSchema() schemaAdapter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.schema
+}
+
+func (s *sharedDb) setSchema(schema schemaAdapter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schema = schema
+}
+
+// Whether another handle on the db holds a test transaction, which keeps
+// this one from writing until it is rolled back.
+func (h *dbHandle) otherTestTx() bool {
+	h.testTxMu.Lock()
+	defer h.testTxMu.Unlock()
+	return h.testTxOwner != nil && h.testTxOwner != h
+}
@@ -0,0 +1,117 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"encoding/json"
+	"runtime/cgo"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every pointer handed to the host that it has not released yet, so that
+// leaked ones can be listed. A cgo handle keeps its value alive until it is
+// deleted, so a pointer the host forgets is never reclaimed.
+var liveHandles = struct {
+	sync.Mutex
+	byPtr map[C.uintptr_t]handleInfo
+}{byPtr: make(map[C.uintptr_t]handleInfo)}
+
+type handleInfo struct {
+	Ptr uint64 `json:"ptr"`
+	// "db", "tx", "cursor", "job", "region", "upload" or "subscription"
+	Kind string `json:"kind"`
+	// The export that created the pointer
+	Op string `json:"op"`
+	// The db of a transaction, job, upload or subscription, or the
+	// transaction of a cursor
+	Parent  uint64    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Wraps v in a new cgo handle and records it as a live pointer of kind,
+// created by op under parent (0 if none).
+func registerHandle(kind string, op string, parent C.uintptr_t, v interface{}) C.uintptr_t {
+	ptr := C.uintptr_t(cgo.NewHandle(v))
+	liveHandles.Lock()
+	defer liveHandles.Unlock()
+	liveHandles.byPtr[ptr] = handleInfo{
+		Ptr:     uint64(ptr),
+		Kind:    kind,
+		Op:      op,
+		Parent:  uint64(parent),
+		Created: time.Now(),
+	}
+	return ptr
+}
+
+// Deletes the cgo handle behind ptr and forgets it.
+func releaseHandle(ptr C.uintptr_t) {
+	liveHandles.Lock()
+	delete(liveHandles.byPtr, ptr)
+	liveHandles.Unlock()
+	cgo.Handle(ptr).Delete()
+}
+
+// Returns the live pointers created under ptr, and under those, oldest first.
+func childHandles(ptr C.uintptr_t) []handleInfo {
+	liveHandles.Lock()
+	defer liveHandles.Unlock()
+	var children []handleInfo
+	parents := map[uint64]bool{uint64(ptr): true}
+	// parents are always created before their children
+	for _, info := range sortedHandles() {
+		if parents[info.Parent] {
+			children = append(children, info)
+			parents[info.Ptr] = true
+		}
+	}
+	return children
+}
+
+// Must be called with liveHandles held.
+func sortedHandles() []handleInfo {
+	all := make([]handleInfo, 0, len(liveHandles.byPtr))
+	for _, info := range liveHandles.byPtr {
+		all = append(all, info)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Created.Before(all[j].Created)
+	})
+	return all
+}
+
+// Returns every pointer the library handed out and the host has not released
+// yet (dbs, read transactions, cursors, jobs, shared regions, code uploads
+// and subscriptions) as a JSON array of {"ptr", "kind", "op", "parent",
+// "created"} objects, oldest first, where op is the export that created the
+// pointer and parent the db or transaction it belongs to. Listing them at the
+// end of a test run shows which calls leaked their pointers. The result must
+// be released with FreeBytes.
+//export ListHandles
+func ListHandles() *C.char {
+	// the entries only have plain fields, so encoding cannot fail
+	enc, _ := json.Marshal(listHandles())
+	return C.CString(string(enc))
+}
+
+func listHandles() []handleInfo {
+	liveHandles.Lock()
+	defer liveHandles.Unlock()
+	return sortedHandles()
+}
+
+// Logs the pointers created under the db behind dbPtr that are still alive
+// and returns them.
+func warnLeakedHandles(dbPtr C.uintptr_t) []handleInfo {
+	leaked := childHandles(dbPtr)
+	for _, info := range leaked {
+		libLog.Warn("closing db with a live handle", "kind", info.Kind, "op", info.Op, "ptr", info.Ptr, "age", time.Since(info.Created))
+	}
+	return leaked
+}
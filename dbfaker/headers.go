@@ -0,0 +1,358 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Writes the RLP encoded headers as the canonical chain in one transaction.
+// For each header this writes the header, its HeaderNumber and
+// HeaderCanonical entries and its total difficulty, accumulated from its
+// parent's, then advances the head header hash to the last header. Headers
+// must be in ascending order and the parent of each must be in the db or
+// earlier in headersRlp. It does what PutHeader, PutHeaderNumber,
+// PutCanonicalHash and PutHeadHeaderHash do, plus the total difficulty, for a
+// whole chain at once.
+//export PutHeaders
+func PutHeaders(dbPtr C.uintptr_t, headersRlp [][]byte) (exit int) {
+	defer timeOp("PutHeaders", "headers", len(headersRlp))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutHeaders", retryMapFull(db, "PutHeaders", func() error {
+		return putHeaders(context.Background(), db, headersRlp)
+	}))
+}
+
+func putHeaders(ctx context.Context, db kv.RwDB, headersRlp [][]byte) (err error) {
+	headers := make([]*types.Header, len(headersRlp))
+	for i, enc := range headersRlp {
+		headers[i] = new(types.Header)
+		if err = rlp.DecodeBytes(enc, headers[i]); err != nil {
+			return fmt.Errorf("header %d: Header DecodeBytes: %w", i, err)
+		}
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeCanonicalHeaders(ctx, tx, headers)
+}
+
+func writeCanonicalHeaders(ctx context.Context, tx kv.RwTx, headers []*types.Header) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for i, header := range headers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		td, err := totalDifficulty(tx, header)
+		if err != nil {
+			return fmt.Errorf("header %d: %w", header.Number.Uint64(), err)
+		}
+		if err := writeCanonicalHeader(tx, buf, header, td); err != nil {
+			return err
+		}
+		reportProgress(ctx, uint64(i+1), uint64(len(headers)))
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return rawdb.WriteHeadHeaderHash(tx, headers[len(headers)-1].Hash())
+}
+
+// Writes the same entries as rawdb.WriteHeader, WriteTd and
+// WriteCanonicalHash, encoding into buf and a key on the stack instead of
+// allocating them per header.
+func writeCanonicalHeader(tx kv.RwTx, buf *bytes.Buffer, header *types.Header, td *big.Int) error {
+	hash, num := header.Hash(), header.Number.Uint64()
+	var key [8 + common.HashLength]byte
+	binary.BigEndian.PutUint64(key[:8], num)
+	copy(key[8:], hash[:])
+
+	if err := tx.Put(kv.HeaderNumber, hash[:], key[:8]); err != nil {
+		return fmt.Errorf("header %d: HeaderNumber: %w", num, err)
+	}
+	buf.Reset()
+	if err := rlp.Encode(buf, header); err != nil {
+		return fmt.Errorf("header %d: Header EncodeRLP: %w", num, err)
+	}
+	if err := tx.Put(kv.Headers, key[:], buf.Bytes()); err != nil {
+		return fmt.Errorf("header %d: Headers: %w", num, err)
+	}
+	buf.Reset()
+	if err := rlp.Encode(buf, td); err != nil {
+		return fmt.Errorf("header %d: td EncodeRLP: %w", num, err)
+	}
+	if err := tx.Put(kv.HeaderTD, key[:], buf.Bytes()); err != nil {
+		return fmt.Errorf("header %d: HeaderTD: %w", num, err)
+	}
+	if err := tx.Put(kv.HeaderCanonical, key[:8], hash[:]); err != nil {
+		return fmt.Errorf("header %d: HeaderCanonical: %w", num, err)
+	}
+	return nil
+}
+
+// Makes the headers of blocks from to to, which must already be in the db,
+// canonical in one transaction, writing the HeaderCanonical and HeaderNumber
+// entries one PutCanonicalHash and PutHeaderNumber per block would. The range
+// is walked back through the parent hashes from the header with toHash at
+// block to; with an empty toHash, block to must have exactly one stored
+// header. The head header hash is left as it is.
+//export CanonicalizeRange
+func CanonicalizeRange(dbPtr C.uintptr_t, from, to uint64, toHash []byte) (exit int) {
+	defer timeOp("CanonicalizeRange", "from", from, "to", to, "toHash", hexutil.Bytes(toHash))()
+	db := getDbHandle(dbPtr)
+	return exitCode("CanonicalizeRange", canonicalizeRange(context.Background(), db, from, to, toHash))
+}
+
+func canonicalizeRange(ctx context.Context, db kv.RwDB, from, to uint64, toHash []byte) (err error) {
+	if from > to {
+		return fmt.Errorf("from %d is after to %d", from, to)
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	hash := common.BytesToHash(toHash)
+	if len(toHash) == 0 {
+		if hash, err = onlyHeaderAt(tx, to); err != nil {
+			return err
+		}
+	}
+	for num := to; ; num-- {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		header := rawdb.ReadHeader(tx, hash, num)
+		if header == nil {
+			return fmt.Errorf("missing header %x at block %d", hash, num)
+		}
+		if err = rawdb.WriteCanonicalHash(tx, hash, num); err != nil {
+			return fmt.Errorf("header %d: HeaderCanonical: %w", num, err)
+		}
+		if err = rawdb.WriteHeaderNumber(tx, hash, num); err != nil {
+			return fmt.Errorf("header %d: HeaderNumber: %w", num, err)
+		}
+		reportProgress(ctx, to-num+1, to-from+1)
+		if num == from {
+			return nil
+		}
+		hash = header.ParentHash
+	}
+}
+
+// Returns the hash of the one header stored at block num.
+func onlyHeaderAt(tx kv.Tx, num uint64) (common.Hash, error) {
+	var hashes []common.Hash
+	err := tx.ForPrefix(kv.Headers, dbutils.EncodeBlockNumber(num), func(k, v []byte) error {
+		if len(k) == 8+common.HashLength {
+			hashes = append(hashes, common.BytesToHash(k[8:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	switch len(hashes) {
+	case 0:
+		return common.Hash{}, fmt.Errorf("no header at block %d", num)
+	case 1:
+		return hashes[0], nil
+	}
+	return common.Hash{}, fmt.Errorf("%d headers at block %d, pass the hash of the one to make canonical", len(hashes), num)
+}
+
+// Extends the canonical chain by one header per entry of the JSON array
+// overridesJson, filling in the fields that link the chain so that it is
+// structurally valid: parent hash, number, ommers hash, empty transaction and
+// receipt roots, and the parent's difficulty, state root and base fee. Each
+// entry may override the timestamp (by default seedBlockTime seconds after the
+// parent), gasLimit (by default the parent's), extraData and coinbase, e.g.
+// [{"timestamp": 1650000000, "extraData": "0x01"}, {}]. The chain starts at
+// the current head header, or with a genesis header if the db has none. The
+// headers are written as by PutHeaders, and their hashes are returned
+// concatenated. The result is malloc'd and must be released with FreeBytes.
+//export BuildHeaders
+func BuildHeaders(dbPtr C.uintptr_t, overridesJson string) (exit int, hashes unsafe.Pointer, hashesLen C.size_t) {
+	defer timeOp("BuildHeaders", "overrides", overridesJson)()
+	var overrides []headerOverrides
+	if err := json.Unmarshal([]byte(overridesJson), &overrides); err != nil {
+		return exitCode("BuildHeaders", fmt.Errorf("invalid overrides: %w", err)), nil, 0
+	}
+	db := getDbHandle(dbPtr)
+	var built []common.Hash
+	err := retryMapFull(db, "BuildHeaders", func() (err error) {
+		built, err = buildHeaders(context.Background(), db, overrides)
+		return err
+	})
+	if err != nil {
+		return exitCode("BuildHeaders", err), nil, 0
+	}
+	enc := make([]byte, 0, len(built)*common.HashLength)
+	for _, h := range built {
+		enc = append(enc, h.Bytes()...)
+	}
+	return 1, C.CBytes(enc), C.size_t(len(enc))
+}
+
+// The fields of a built header a caller may set. Unset fields are derived
+// from the parent.
+type headerOverrides struct {
+	Timestamp *uint64         `json:"timestamp"`
+	GasLimit  *uint64         `json:"gasLimit"`
+	ExtraData hexutil.Bytes   `json:"extraData"`
+	Coinbase  *common.Address `json:"coinbase"`
+}
+
+func buildHeaders(ctx context.Context, db kv.RwDB, overrides []headerOverrides) (hashes []common.Hash, err error) {
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer closer(&err)
+
+	parent := rawdb.ReadCurrentHeader(tx)
+	headers := make([]*types.Header, len(overrides))
+	for i, o := range overrides {
+		var header *types.Header
+		if parent == nil {
+			header = &types.Header{
+				UncleHash:   types.EmptyUncleHash,
+				TxHash:      types.EmptyRootHash,
+				ReceiptHash: types.EmptyRootHash,
+				Difficulty:  new(big.Int).Set(params.GenesisDifficulty),
+				Number:      new(big.Int),
+				GasLimit:    params.GenesisGasLimit,
+			}
+		} else {
+			header = childHeader(parent)
+		}
+		if o.Timestamp != nil {
+			header.Time = *o.Timestamp
+		}
+		if o.GasLimit != nil {
+			header.GasLimit = *o.GasLimit
+		}
+		if o.ExtraData != nil {
+			header.Extra = o.ExtraData
+		}
+		if o.Coinbase != nil {
+			header.Coinbase = *o.Coinbase
+		}
+		headers[i] = header
+		hashes = append(hashes, header.Hash())
+		parent = header
+	}
+
+	return hashes, writeCanonicalHeaders(ctx, tx, headers)
+}
+
+// Replaces the canonical header at the height of header with header, whose
+// hash differs from the stored one, and moves the body, senders and total
+// difficulty from the old hash to the new one. Descendants are re-linked to
+// the new hash, which changes their hashes in turn, up to the head. Returns
+// the new hash of header.
+func replaceCanonicalHeader(tx kv.RwTx, header *types.Header) (common.Hash, error) {
+	head := rawdb.ReadHeadHeaderHash(tx)
+	replaced := header.Hash()
+	for {
+		num, hash := header.Number.Uint64(), header.Hash()
+		old, err := rawdb.ReadCanonicalHash(tx, num)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if old == hash {
+			break
+		}
+		if err := moveBlock(tx, header, old); err != nil {
+			return common.Hash{}, fmt.Errorf("block %d: %w", num, err)
+		}
+		if old == head {
+			if err := rawdb.WriteHeadHeaderHash(tx, hash); err != nil {
+				return common.Hash{}, err
+			}
+		}
+
+		child := rawdb.ReadHeaderByNumber(tx, num+1)
+		if child == nil {
+			break
+		}
+		child.ParentHash = hash
+		header = child
+	}
+	return replaced, nil
+}
+
+// Writes header as the canonical header at its height in place of the block
+// old, moving what is keyed by the old hash to the new one.
+func moveBlock(tx kv.RwTx, header *types.Header, old common.Hash) error {
+	num, hash := header.Number.Uint64(), header.Hash()
+
+	rawdb.WriteHeader(tx, header)
+	td, err := rawdb.ReadTd(tx, old, num)
+	if err != nil {
+		return err
+	}
+	if td != nil {
+		if err := rawdb.WriteTd(tx, hash, num, td); err != nil {
+			return fmt.Errorf("WriteTd: %w", err)
+		}
+	}
+	for _, table := range []string{kv.BlockBody, kv.Senders} {
+		v, err := tx.GetOne(table, dbutils.BlockBodyKey(num, old))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		if err := tx.Put(table, dbutils.BlockBodyKey(num, hash), common.CopyBytes(v)); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		if err := tx.Delete(table, dbutils.BlockBodyKey(num, old), nil); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	if err := rawdb.WriteCanonicalHash(tx, hash, num); err != nil {
+		return fmt.Errorf("WriteCanonicalHash: %w", err)
+	}
+
+	for _, del := range []struct {
+		table string
+		key   []byte
+	}{
+		{kv.Headers, dbutils.HeaderKey(num, old)},
+		{kv.HeaderNumber, old.Bytes()},
+		{kv.HeaderTD, dbutils.HeaderKey(num, old)},
+	} {
+		if err := tx.Delete(del.table, del.key, nil); err != nil {
+			return fmt.Errorf("%s: %w", del.table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/state"
+)
+
+// Returns the account at address as of the end of block blockNum, i.e. with
+// every change up to and including that block applied, in the PlainState
+// storage encoding. Changes after blockNum are undone by looking up the
+// first history index entry past blockNum and taking the value recorded in
+// its changeset, falling back to the plain state if there is none. found is
+// false if the account did not exist at that block. The result is malloc'd
+// and must be released with FreeBytes.
+//export GetAccountAt
+func GetAccountAt(dbPtr C.uintptr_t, address []byte, blockNum uint64) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	defer timeOp("GetAccountAt", "address", hexutil.Bytes(address), "blockNum", blockNum)()
+	enc, err := getDbHandle(dbPtr).accountAt(common.BytesToAddress(address), blockNum)
+	return exportBytes("GetAccountAt", enc, err)
+}
+
+func (h *dbHandle) accountAt(address common.Address, blockNum uint64) (enc []byte, err error) {
+	err = h.View(context.Background(), func(tx kv.Tx) error {
+		acct, err := stateAt(tx, blockNum).ReadAccountData(address)
+		if err != nil || acct == nil {
+			return err
+		}
+		enc = make([]byte, acct.EncodingLengthForStorage())
+		acct.EncodeForStorage(enc)
+		return nil
+	})
+	return enc, err
+}
+
+// Returns the value of the storage slot key of the contract at address as of
+// the end of block blockNum, without leading zeros as it is stored. The slot
+// is read under the incarnation the account had at that block, so a
+// contract that self-destructs and is recreated later still reads the storage
+// of its earlier incarnation, and a contract that was destroyed by blockNum
+// has empty storage. found is false for an empty slot. The result is
+// malloc'd and must be released with FreeBytes.
+//export GetStorageAt
+func GetStorageAt(dbPtr C.uintptr_t, address []byte, key []byte, blockNum uint64) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	defer timeOp("GetStorageAt", "address", hexutil.Bytes(address), "key", hexutil.Bytes(key), "blockNum", blockNum)()
+	enc, err := getDbHandle(dbPtr).storageAt(common.BytesToAddress(address), common.BytesToHash(key), blockNum)
+	return exportBytes("GetStorageAt", enc, err)
+}
+
+func (h *dbHandle) storageAt(address common.Address, key common.Hash, blockNum uint64) (enc []byte, err error) {
+	err = h.View(context.Background(), func(tx kv.Tx) error {
+		enc, err = readStorage(stateAt(tx, blockNum), address, key)
+		return err
+	})
+	return enc, err
+}
+
+// Reads a storage slot under the incarnation the account has in st. The
+// storage of an account that does not exist in st is empty.
+func readStorage(st *state.PlainState, address common.Address, key common.Hash) ([]byte, error) {
+	acct, err := st.ReadAccountData(address)
+	if err != nil || acct == nil {
+		return nil, err
+	}
+	return st.ReadAccountStorage(address, acct.Incarnation, &key)
+}
+
+// Returns a reader of the state as of the end of blockNum. Erigon's readers
+// take the block whose state before execution to read, hence the +1.
+func stateAt(tx kv.Tx, blockNum uint64) *state.PlainState {
+	return state.NewPlainState(tx, blockNum+1)
+}
@@ -0,0 +1,140 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+)
+
+// Turns history mode on or off for the db. While enabled, PutAccount,
+// PutStorage and DeleteAccount also record the overwritten value in the
+// AccountChangeSet and StorageChangeSet at blockNum and add blockNum to the
+// account and storage history indices, so that archive readers see the state
+// change at that block. Only the first write to an account or slot within a
+// block records a changeset entry, matching what executing the block would
+// produce.
+//export SetHistory
+func SetHistory(dbPtr C.uintptr_t, enabled bool, blockNum uint64) (exit int) {
+	defer timeOp("SetHistory", "enabled", enabled, "blockNum", blockNum)()
+	getDbHandle(dbPtr).setHistory(enabled, blockNum)
+	return 1
+}
+
+func (h *dbHandle) setHistory(enabled bool, blockNum uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.withHistory = enabled
+	h.historyBlock = blockNum
+}
+
+// Returns the block that writes to db record history at, if history mode is
+// enabled.
+func historyBlock(db kv.RwDB) (uint64, bool) {
+	h, ok := db.(*dbHandle)
+	if !ok {
+		return 0, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.historyBlock, h.withHistory
+}
+
+func writeAccountWithHistory(tx kv.RwTx, block uint64, address common.Address, acct *accounts.Account) error {
+	// an account that doesn't exist yet is recorded with an empty value
+	original := new(accounts.Account)
+	if _, err := rawdb.ReadAccount(tx, address, original); err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+
+	recorded, err := changesetHas(tx, kv.AccountChangeSet, dbutils.EncodeBlockNumber(block), address.Bytes())
+	if err != nil {
+		return err
+	}
+	if recorded {
+		return state.NewPlainStateWriterNoHistory(tx).UpdateAccountData(address, original, acct)
+	}
+
+	w := state.NewPlainStateWriter(tx, tx, block)
+	if err := w.UpdateAccountData(address, original, acct); err != nil {
+		return err
+	}
+	return writeHistory(w)
+}
+
+func deleteAccountWithHistory(tx kv.RwTx, block uint64, address common.Address, original *accounts.Account) error {
+	recorded, err := changesetHas(tx, kv.AccountChangeSet, dbutils.EncodeBlockNumber(block), address.Bytes())
+	if err != nil {
+		return err
+	}
+	if recorded {
+		return state.NewPlainStateWriterNoHistory(tx).DeleteAccount(address, original)
+	}
+
+	w := state.NewPlainStateWriter(tx, tx, block)
+	if err := w.DeleteAccount(address, original); err != nil {
+		return err
+	}
+	return writeHistory(w)
+}
+
+func writeStorageWithHistory(tx kv.RwTx, block uint64, address common.Address, incarnation uint64, key *common.Hash, value *uint256.Int) error {
+	enc, err := tx.GetOne(kv.PlainState, dbutils.PlainGenerateCompositeStorageKey(address.Bytes(), incarnation, key.Bytes()))
+	if err != nil {
+		return err
+	}
+	original := new(uint256.Int).SetBytes(enc)
+
+	csKey := append(dbutils.EncodeBlockNumber(block), dbutils.PlainGenerateStoragePrefix(address.Bytes(), incarnation)...)
+	recorded, err := changesetHas(tx, kv.StorageChangeSet, csKey, key.Bytes())
+	if err != nil {
+		return err
+	}
+	if recorded {
+		return state.NewPlainStateWriterNoHistory(tx).WriteAccountStorage(address, incarnation, key, original, value)
+	}
+
+	w := state.NewPlainStateWriter(tx, tx, block)
+	if err := w.WriteAccountStorage(address, incarnation, key, original, value); err != nil {
+		return err
+	}
+	return writeHistory(w)
+}
+
+func writeHistory(w *state.PlainStateWriter) error {
+	if err := w.WriteChangeSets(); err != nil {
+		return fmt.Errorf("WriteChangeSets: %w", err)
+	}
+	if err := w.WriteHistory(); err != nil {
+		return fmt.Errorf("WriteHistory: %w", err)
+	}
+	return nil
+}
+
+// Reports whether the dupsort changeset table has an entry under key whose
+// value starts with subkey (the address or storage slot).
+func changesetHas(tx kv.RwTx, table string, key, subkey []byte) (bool, error) {
+	c, err := tx.RwCursorDupSort(table)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	v, err := c.SeekBothRange(key, subkey)
+	if err != nil {
+		return false, err
+	}
+	return v != nil && bytes.HasPrefix(v, subkey), nil
+}
@@ -0,0 +1,106 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+var errKeyExists = errors.New("key already exists")
+
+// Tables holding single pointers and counters, which writes move along as a
+// matter of course, so insert-only writes still overwrite them.
+var overwritableTables = map[string]bool{
+	kv.HeadHeaderKey:     true,
+	kv.HeadBlockKey:      true,
+	kv.LastForkchoice:    true,
+	kv.SyncStageProgress: true,
+	kv.Sequence:          true,
+	kv.DatabaseInfo:      true,
+}
+
+type insertOnlyKey struct{}
+
+// Returns ctx with writes of the operation running under it made insert-only,
+// or upserts if on is false, whatever the db is set to.
+func withInsertOnly(ctx context.Context, on bool) context.Context {
+	return context.WithValue(ctx, insertOnlyKey{}, on)
+}
+
+// Whether writes under ctx to h are insert-only: as set for the call with
+// withInsertOnly, or else as set on h with SetInsertOnly.
+func insertOnlyOf(ctx context.Context, h *dbHandle) bool {
+	if on, ok := ctx.Value(insertOnlyKey{}).(bool); ok {
+		return on
+	}
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.insertOnly
+}
+
+// Makes writes to the db insert-only: a write to a key that already exists
+// fails the operation, and its transaction is rolled back, instead of
+// silently overwriting the entry, so that a test re-seeding a block it
+// already wrote finds out. The default, with enabled false, is to overwrite.
+// Calls through Call and CallProto can choose for themselves with their
+// insertOnly flag. The Set*, AddBalance, SubBalance and IncrementNonce account
+// updates, PatchHeaderBloom and SwitchCanonicalChain change existing entries
+// by design, and always overwrite.
+//export SetInsertOnly
+func SetInsertOnly(dbPtr C.uintptr_t, enabled bool) (exit int) {
+	defer timeOp("SetInsertOnly", "enabled", enabled)()
+	getDbHandle(dbPtr).setInsertOnly(enabled)
+	return 1
+}
+
+func (h *dbHandle) setInsertOnly(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.insertOnly = enabled
+}
+
+// Reads the insertOnly flag every Call request may set next to the params of
+// its method. It is left unset, deferring to the db, if params has no such
+// field or is not an object.
+func callInsertOnly(ctx context.Context, params json.RawMessage) context.Context {
+	var p struct {
+		InsertOnly *bool `json:"insertOnly"`
+	}
+	if len(params) == 0 || json.Unmarshal(params, &p) != nil || p.InsertOnly == nil {
+		return ctx
+	}
+	return withInsertOnly(ctx, *p.InsertOnly)
+}
+
+// Fails an insert-only write of k to table if k already has a value. Values
+// of dupsort tables are only checked for tables that Erigon splits keys of
+// (PlainState, HashedStorage), where a full key names one entry; in other
+// dupsort tables another value under the same key is not an overwrite.
+func (tx instrumentedTx) checkInsert(table string, k []byte) error {
+	if !tx.insertOnly || overwritableTables[table] {
+		return nil
+	}
+	if cfg := kv.ChaindataTablesCfg[table]; cfg.Flags&kv.DupSort != 0 && !cfg.AutoDupSortKeysConversion {
+		return nil
+	}
+	v, err := tx.RwTx.GetOne(table, k)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return fmt.Errorf("%w: %s %x", errKeyExists, table, k)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+)
+
+// Writes up to limit entries of table to w as hex encoded "key value" lines,
+// in key order, starting after the entry the continuation token after names
+// (see DumpTablePage), or at the first entry if it is empty. A limit of 0
+// dumps the rest of the table. Returns the token to continue from if entries
+// remain.
+func dumpTable(ctx context.Context, db kv.RoDB, table, after string, limit uint64, w io.Writer) (next string, err error) {
+	if !isChaindataTable(table) {
+		return "", fmt.Errorf("unknown table %q", table)
+	}
+	err = db.View(ctx, func(tx kv.Tx) error {
+		var n uint64
+		var writeErr error
+		last, more, err := walkTable(ctx, tx, table, after, func(k, v []byte) bool {
+			if limit > 0 && n == limit {
+				return false
+			}
+			if _, writeErr = fmt.Fprintf(w, "%x %x\n", k, v); writeErr != nil {
+				return false
+			}
+			n++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+		if more {
+			next = last
+		}
+		return nil
+	})
+	return next, err
+}
+
+func isChaindataTable(table string) bool {
+	for _, t := range kv.ChaindataTables {
+		if t == table {
+			return true
+		}
+	}
+	_, ok := dbfakerTables[table]
+	return ok
+}
+
+// The tables every db is opened with: Erigon's chaindata tables and dbfaker's
+// own.
+func dbTables() []string {
+	tables := append([]string(nil), kv.ChaindataTables...)
+	for name := range dbfakerTables {
+		tables = append(tables, name)
+	}
+	return tables
+}
+
+// Checks that the canonical chain from genesis to the head header is
+// complete and consistent, the way a node's block reader expects it: every
+// height has a canonical hash whose header, header number, body and total
+// difficulty are present, and every header links to its parent. Returns one
+// description per problem found; state is not checked.
+func verifyChain(ctx context.Context, db kv.RoDB) (problems []string, err error) {
+	err = db.View(ctx, func(tx kv.Tx) error {
+		head := rawdb.ReadCurrentHeader(tx)
+		if head == nil {
+			problems = append(problems, "no head header")
+			return nil
+		}
+
+		var parent common.Hash
+		for n := uint64(0); n <= head.Number.Uint64(); n++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			report := func(format string, args ...interface{}) {
+				problems = append(problems, fmt.Sprintf("block %d: ", n)+fmt.Sprintf(format, args...))
+			}
+
+			hash, err := rawdb.ReadCanonicalHash(tx, n)
+			if err != nil {
+				return err
+			}
+			if hash == (common.Hash{}) {
+				report("no canonical hash")
+				parent = common.Hash{}
+				continue
+			}
+
+			header := rawdb.ReadHeader(tx, hash, n)
+			if header == nil {
+				report("no header for canonical hash %x", hash)
+			} else if n > 0 && parent != (common.Hash{}) && header.ParentHash != parent {
+				report("parent hash %x, expected %x", header.ParentHash, parent)
+			}
+			if num := rawdb.ReadHeaderNumber(tx, hash); num == nil {
+				report("no header number for %x", hash)
+			} else if *num != n {
+				report("header number of %x is %d", hash, *num)
+			}
+			if ok, err := tx.Has(kv.BlockBody, dbutils.BlockBodyKey(n, hash)); err != nil {
+				return err
+			} else if !ok {
+				report("no body for %x", hash)
+			}
+			if td, err := rawdb.ReadTd(tx, hash, n); err != nil {
+				return err
+			} else if td == nil {
+				report("no total difficulty for %x", hash)
+			}
+			parent = hash
+		}
+		return nil
+	})
+	return problems, err
+}
@@ -0,0 +1,179 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Begins a test transaction on the db: until RollbackTestTx, every export
+// called with dbPtr reads and writes through this one write transaction
+// instead of beginning and committing its own, so a test sees its own writes
+// and can then throw them all away, leaving the shared baseline db untouched.
+// Other pointers to the same db keep reading the committed data, and their
+// writes fail until the rollback.
+// mdbx ties write transactions to the thread that began them, so all calls
+// must come from the thread that called BeginTestTx, and jobs and servers
+// cannot be used meanwhile. An export that fails may have written part of
+// what it would have, which the test transaction cannot undo on its own, so
+// a failed write poisons it: every later export on dbPtr fails, naming the
+// first failure, until RollbackTestTx.
+//export BeginTestTx
+func BeginTestTx(dbPtr C.uintptr_t) (exit int) {
+	defer timeOp("BeginTestTx")()
+	return exitCode("BeginTestTx", getDbHandle(dbPtr).beginTestTx())
+}
+
+// Rolls back the test transaction begun with BeginTestTx, discarding every
+// write made since, and returns the db to committing each export on its own.
+//export RollbackTestTx
+func RollbackTestTx(dbPtr C.uintptr_t) (exit int) {
+	defer timeOp("RollbackTestTx")()
+	return exitCode("RollbackTestTx", getDbHandle(dbPtr).rollbackTestTx())
+}
+
+// Returned by the operations that would use the db from another thread while
+// a test transaction is open.
+var errTestTx = errors.New("not available while a test transaction is open")
+
+// Returned by writes through a handle while another handle on the same db
+// holds a test transaction, instead of blocking until it is rolled back.
+var errOtherTestTx = errors.New("another handle on the db holds a test transaction")
+
+func (h *dbHandle) beginTestTx() error {
+	if h.testTx != nil {
+		return errors.New("a test transaction is already open")
+	}
+	if h.otherTestTx() {
+		return errOtherTestTx
+	}
+	if h.readOnly {
+		return errReadOnly
+	}
+	h.mu.Lock()
+	busy := h.kvServer != nil || h.rpcServer != nil || h.queue != nil
+	h.mu.Unlock()
+	if busy {
+		return errors.New("servers and the write queue run on other threads and cannot share a test transaction")
+	}
+	// held until the rollback, so that the test transaction starts once
+	// writers from other threads are done
+	h.writeMu.Lock()
+	tx, err := h.RwDB.BeginRw(context.Background())
+	if err != nil {
+		h.writeMu.Unlock()
+		return err
+	}
+	h.testTx = tx
+	h.testTxMu.Lock()
+	h.testTxOwner = h
+	h.testTxMu.Unlock()
+	return nil
+}
+
+func (h *dbHandle) rollbackTestTx() error {
+	if h.testTx == nil {
+		return errors.New("no test transaction is open")
+	}
+	h.testTx.Rollback()
+	h.testTx = nil
+	h.testTxErr = nil
+	h.testTxMu.Lock()
+	h.testTxOwner = nil
+	h.testTxMu.Unlock()
+	h.writeMu.Unlock()
+	return nil
+}
+
+// The test transaction as handed to the code that would otherwise have begun
+// its own. Committing or rolling it back is left to RollbackTestTx, but a
+// write that is rolled back instead of committed poisons the test
+// transaction, since its partial writes stay in it.
+type sharedTx struct {
+	kv.RwTx
+	// nil for reads, which have nothing to undo
+	h         *dbHandle
+	committed bool
+}
+
+func (tx *sharedTx) Commit() error {
+	tx.committed = true
+	return nil
+}
+
+func (tx *sharedTx) Rollback() {
+	// rolling back after a commit is a no-op, as with mdbx transactions
+	if tx.h != nil && !tx.committed {
+		tx.h.poisonTestTx(errors.New("write rolled back"))
+	}
+}
+
+// Records the failure of a write in the test transaction, keeping the first.
+func (h *dbHandle) poisonTestTx(err error) {
+	if h.testTxErr == nil {
+		h.testTxErr = err
+	}
+}
+
+// Returns the error every use of a poisoned test transaction fails with.
+func (h *dbHandle) checkTestTx() error {
+	if h.testTxErr != nil {
+		return fmt.Errorf("an earlier export failed in the test transaction, which must be rolled back: %w", h.testTxErr)
+	}
+	return nil
+}
+
+// The methods below route every transaction begun on the handle through the
+// test transaction while one is open.
+
+func (h *dbHandle) BeginRw(ctx context.Context) (kv.RwTx, error) {
+	if h.testTx != nil {
+		if err := h.checkTestTx(); err != nil {
+			return nil, err
+		}
+		return &sharedTx{RwTx: h.testTx, h: h}, nil
+	}
+	return h.RwDB.BeginRw(ctx)
+}
+
+func (h *dbHandle) BeginRo(ctx context.Context) (kv.Tx, error) {
+	if h.testTx != nil {
+		if err := h.checkTestTx(); err != nil {
+			return nil, err
+		}
+		return &sharedTx{RwTx: h.testTx}, nil
+	}
+	return h.RwDB.BeginRo(ctx)
+}
+
+func (h *dbHandle) Update(ctx context.Context, f func(tx kv.RwTx) error) error {
+	if h.testTx != nil {
+		if err := h.checkTestTx(); err != nil {
+			return err
+		}
+		err := f(h.testTx)
+		if err != nil {
+			h.poisonTestTx(err)
+		}
+		return err
+	}
+	return h.RwDB.Update(ctx, f)
+}
+
+func (h *dbHandle) View(ctx context.Context, f func(tx kv.Tx) error) error {
+	if h.testTx != nil {
+		if err := h.checkTestTx(); err != nil {
+			return err
+		}
+		return f(h.testTx)
+	}
+	return h.RwDB.View(ctx, f)
+}
@@ -0,0 +1,175 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+
+typedef void (*dbfaker_progress_cb)(uintptr_t job, uint64_t done, uint64_t total, void *user_data);
+
+static inline void dbfaker_call_progress(dbfaker_progress_cb cb, uintptr_t job, uint64_t done, uint64_t total, void *user_data) {
+	cb(job, done, total, user_data);
+}
+*/
+import "C"
+import "runtime/cgo"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// States reported by JobStatus.
+const (
+	jobRunning = iota
+	jobDone
+	jobFailed
+	jobCancelled
+)
+
+// An operation started with JobStart, running on its own goroutine.
+type job struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	state     int
+	completed uint64
+	total     uint64
+	result    interface{}
+	err       error
+}
+
+// Call methods that may run as jobs: the long-running bulk operations. The
+// rest either return promptly or, like BeginTestTx, EnqueueWrite and the
+// servers, tie state to the calling thread or outlive the call, and would
+// misbehave on a job's goroutine.
+var jobMethods = map[string]bool{
+	"SeedChain":       true,
+	"ImportChain":     true,
+	"VerifyChain":     true,
+	"ImportFixture":   true,
+	"ExportFixture":   true,
+	"ImportStream":    true,
+	"ExportSQLite":    true,
+	"ExportStateCSV":  true,
+	"FuzzTable":       true,
+	"PutHeaders":      true,
+	"BuildHeaders":    true,
+	"CreateFork":      true,
+	"RunQueries":      true,
+	"MaterializeAt":   true,
+	"DumpSnapshots":   true,
+	"CompactTo":       true,
+	"CloneDb":         true,
+	"BackupTo":        true,
+	"ApplyMigrations": true,
+}
+
+type progressKey struct{}
+
+// Reports that done out of total units of work of the operation running
+// under ctx have completed. Operations that can take a while should call this
+// as they go; it is a no-op outside of a job.
+func reportProgress(ctx context.Context, done, total uint64) {
+	if report, ok := ctx.Value(progressKey{}).(func(done, total uint64)); ok {
+		report(done, total)
+	}
+}
+
+// Starts the Call method with the JSON encoded paramsJson in the background
+// and returns an ffi-safe pointer to the job. Only the long-running bulk
+// methods can run as jobs: imports, exports, seeding, fuzzing, forks,
+// snapshots, compaction, copies and migrations. If cb is not NULL it is invoked
+// with userData whenever the operation reports progress; it runs on a Go
+// thread, so it must be thread-safe and must not call back into the job.
+// The job pointer must be released with JobFree once the job has finished.
+//export JobStart
+func JobStart(dbPtr C.uintptr_t, method string, paramsJson string, cb C.dbfaker_progress_cb, userData unsafe.Pointer) (exit int, ptr C.uintptr_t) {
+	db := getDbHandle(dbPtr)
+	if db.testTx != nil {
+		return exitCode("JobStart", errTestTx), *new(C.uintptr_t)
+	}
+	if !jobMethods[method] {
+		return exitCode("JobStart", fmt.Errorf("method %q cannot run as a job", method)), *new(C.uintptr_t)
+	}
+	// the strings are only valid for the duration of this call
+	method = string([]byte(method))
+	params := json.RawMessage(paramsJson)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{done: make(chan struct{}), cancel: cancel}
+	ptr = registerHandle("job", "JobStart", dbPtr, j)
+
+	report := func(done, total uint64) {
+		j.mu.Lock()
+		j.completed, j.total = done, total
+		j.mu.Unlock()
+		if cb != nil {
+			C.dbfaker_call_progress(cb, ptr, C.uint64_t(done), C.uint64_t(total), userData)
+		}
+	}
+	ctx = context.WithValue(ctx, progressKey{}, report)
+
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		result, err := call(ctx, db, method, params)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.result, j.err = result, err
+		switch {
+		case err != nil && ctx.Err() != nil:
+			j.state = jobCancelled
+		case err != nil:
+			j.state = jobFailed
+		default:
+			j.state = jobDone
+		}
+	}()
+
+	return 1, ptr
+}
+
+// Returns the state of the job (0 running, 1 done, 2 failed, 3 cancelled) and
+// its last reported progress.
+//export JobStatus
+func JobStatus(jobPtr C.uintptr_t) (state int, done uint64, total uint64) {
+	j := cgo.Handle(jobPtr).Value().(*job)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state, j.completed, j.total
+}
+
+// Blocks until the job has finished and returns its response in the same
+// JSON format as Call. The response must be released with FreeBytes.
+//export JobWait
+func JobWait(jobPtr C.uintptr_t) *C.char {
+	j := cgo.Handle(jobPtr).Value().(*job)
+	<-j.done
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return C.CString(string(encodeResponse(j.result, j.err)))
+}
+
+// Cancels the context of the job. Writes still in progress are rolled back
+// rather than committed, and the job finishes as cancelled (unless it already
+// completed). Use JobWait to wait for the job to wind down.
+//export JobCancel
+func JobCancel(jobPtr C.uintptr_t) {
+	j := cgo.Handle(jobPtr).Value().(*job)
+	j.cancel()
+}
+
+// Takes a pointer to a finished job and deletes the pointer handle. Freeing a
+// running job waits for it to finish first.
+//export JobFree
+func JobFree(jobPtr C.uintptr_t) {
+	j := cgo.Handle(jobPtr).Value().(*job)
+	<-j.done
+	releaseHandle(jobPtr)
+}
@@ -0,0 +1,182 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// Sets the balance of holder in the ERC-20 token contract at token to the
+// big-endian amount, by writing the slot of holder in the balances mapping
+// declared at storage slot slotIndex (0 for OpenZeppelin's ERC20, 3 for
+// WETH9). The token's total supply is left alone. Like SetStorageAt, the
+// token account is created as an empty contract if it does not exist.
+//export SeedERC20Balance
+func SeedERC20Balance(dbPtr C.uintptr_t, token []byte, holder []byte, slotIndex uint64, amount []byte) (exit int) {
+	defer timeOp("SeedERC20Balance", "token", hexutil.Bytes(token), "holder", hexutil.Bytes(holder), "slot", slotIndex)()
+	return exitCode("SeedERC20Balance", seedERC20Balance(getDbHandle(dbPtr), token, holder, slotIndex, amount))
+}
+
+func seedERC20Balance(db *dbHandle, token []byte, holder []byte, slotIndex uint64, amount []byte) error {
+	if len(holder) != common.AddressLength {
+		return fmt.Errorf("holder is %d bytes", len(holder))
+	}
+	slot := mappingSlot(holder, slotHash(slotIndex))
+	return setStorageAt(db, token, slot.Bytes(), amount)
+}
+
+// Returns the slot of the value at key in a Solidity mapping declared at
+// base: keccak256(key . base), with key left-padded to 32 bytes as value
+// types are.
+func mappingSlot(key []byte, base common.Hash) common.Hash {
+	return crypto.Keccak256Hash(common.LeftPadBytes(key, common.HashLength), base.Bytes())
+}
+
+// Returns a slot index as a 32-byte slot.
+func slotHash(index uint64) common.Hash {
+	var h common.Hash
+	binary.BigEndian.PutUint64(h[common.HashLength-8:], index)
+	return h
+}
+
+// Returns the slot of a value in a mapping, or in nested mappings, declared
+// at the 32-byte slot base: keys are applied outermost first, so
+// balances[a][b] is MappingSlot(base, [a, b]). Keys are value types (address,
+// uintN, bytesN, bool) of at most 32 bytes, given as big-endian bytes and
+// left-padded to 32 bytes like Solidity does; negative intN keys must be
+// passed as their 32-byte two's complement. Use BytesMappingSlot for string
+// and bytes keys. The result is malloc'd and must be released with
+// FreeBytes.
+//export MappingSlot
+func MappingSlot(base []byte, keys [][]byte) (exit int, slot unsafe.Pointer, slotLen C.size_t) {
+	s, err := nestedMappingSlot(base, keys)
+	return exportSlot("MappingSlot", s, err)
+}
+
+// Returns the slot of the value at a string or bytes key in a mapping
+// declared at the 32-byte slot base: keccak256(key . base), with the key
+// unpadded. The result is malloc'd and must be released with FreeBytes.
+//export BytesMappingSlot
+func BytesMappingSlot(base []byte, key []byte) (exit int, slot unsafe.Pointer, slotLen C.size_t) {
+	s, err := bytesMappingSlot(base, key)
+	return exportSlot("BytesMappingSlot", s, err)
+}
+
+// Returns the slot holding element index of a dynamic array declared at the
+// 32-byte slot base, whose elements are elemSize bytes each, and the byte
+// offset of the element in it, counted from the low-order end as Solidity
+// packs. Elements start at keccak256(base); elements of less than 32 bytes
+// share slots, larger ones take elemSize/32 slots each, so elemSize must
+// divide 32 or be a multiple of it. The array length itself is stored at
+// base. The slot is malloc'd and must be released with FreeBytes.
+//export ArraySlot
+func ArraySlot(base []byte, index uint64, elemSize uint64) (exit int, slot unsafe.Pointer, slotLen C.size_t, offset uint64) {
+	s, offset, err := arraySlot(base, index, elemSize)
+	exit, slot, slotLen = exportSlot("ArraySlot", s, err)
+	return exit, slot, slotLen, offset
+}
+
+// Packs the big-endian fields, declared in this order and each as wide as
+// its byte length, into one 32-byte slot value the way Solidity packs
+// consecutive small state variables: the first field takes the low-order
+// bytes, and the next ones follow towards the high-order end. The widths
+// must add up to at most 32 bytes. The result is malloc'd and must be
+// released with FreeBytes.
+//export PackSlot
+func PackSlot(fields [][]byte) (exit int, value unsafe.Pointer, valueLen C.size_t) {
+	v, err := packSlot(fields)
+	return exportSlot("PackSlot", v, err)
+}
+
+func exportSlot(op string, slot common.Hash, err error) (int, unsafe.Pointer, C.size_t) {
+	if err != nil {
+		return exitCode(op, err), nil, 0
+	}
+	return 1, C.CBytes(slot.Bytes()), C.size_t(common.HashLength)
+}
+
+func baseSlot(base []byte) (common.Hash, error) {
+	if len(base) > common.HashLength {
+		return common.Hash{}, fmt.Errorf("base slot is %d bytes", len(base))
+	}
+	return common.BytesToHash(base), nil
+}
+
+func nestedMappingSlot(base []byte, keys [][]byte) (common.Hash, error) {
+	slot, err := baseSlot(base)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(keys) == 0 {
+		return common.Hash{}, errors.New("no mapping keys")
+	}
+	for i, key := range keys {
+		if len(key) > common.HashLength {
+			return common.Hash{}, fmt.Errorf("key %d is %d bytes; use BytesMappingSlot for string and bytes keys", i, len(key))
+		}
+		slot = mappingSlot(key, slot)
+	}
+	return slot, nil
+}
+
+func bytesMappingSlot(base []byte, key []byte) (common.Hash, error) {
+	slot, err := baseSlot(base)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(key, slot.Bytes()), nil
+}
+
+func arraySlot(base []byte, index uint64, elemSize uint64) (common.Hash, uint64, error) {
+	slot, err := baseSlot(base)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	var slots uint256.Int
+	var offset uint64
+	switch {
+	case elemSize == 0:
+		return common.Hash{}, 0, errors.New("element size must be positive")
+	case elemSize < common.HashLength && common.HashLength%elemSize == 0:
+		perSlot := common.HashLength / elemSize
+		slots.SetUint64(index / perSlot)
+		offset = index % perSlot * elemSize
+	case elemSize%common.HashLength == 0:
+		slots.SetUint64(index)
+		slots.Mul(&slots, uint256.NewInt(elemSize/common.HashLength))
+	default:
+		return common.Hash{}, 0, fmt.Errorf("element size %d neither divides 32 nor is a multiple of it", elemSize)
+	}
+	// slot arithmetic wraps around modulo 2^256, as in the EVM
+	start := new(uint256.Int).SetBytes(crypto.Keccak256(slot.Bytes()))
+	start.Add(start, &slots)
+	return start.Bytes32(), offset, nil
+}
+
+func packSlot(fields [][]byte) (common.Hash, error) {
+	var value common.Hash
+	end := common.HashLength
+	for i, f := range fields {
+		if len(f) == 0 {
+			return common.Hash{}, fmt.Errorf("field %d is empty", i)
+		}
+		if len(f) > end {
+			return common.Hash{}, fmt.Errorf("fields do not fit in a slot from field %d", i)
+		}
+		copy(value[end-len(f):end], f)
+		end -= len(f)
+	}
+	return value, nil
+}
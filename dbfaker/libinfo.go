@@ -0,0 +1,306 @@
+package main
+
+/*
+#include <stdlib.h>     // for free
+*/
+import "C"
+import (
+	"encoding/json"
+	"runtime/debug"
+	"strings"
+	"unsafe"
+)
+
+// Version of the exported C ABI. Bumped once per release whose exports differ
+// in signature or semantics from the previous release, however many of them
+// changed; adding exports only adds features. 0.3.0 covers the strict and
+// lenient flags of PutCanonicalHash and PutTxLookupEntries and PutStorage
+// creating missing accounts.
+const libraryVersion = "0.3.0"
+
+const erigonModule = "github.com/ledgerwatch/erigon"
+
+// Features reported by GetLibraryInfo. Each covers a group of exports, so a
+// host can check for them before calling into the library.
+const (
+	// MdbxOpen, MdbxClose and the original Put* exports
+	featureCoreWrites = "coreWrites"
+	// ReadBegin, ReadGet and the ReadCursor* exports, including zero-copy mode
+	featureReads = "reads"
+	// GrowMap, SetFastSeed, Sync and CompactTo
+	featureEnvControl = "envControl"
+	// DumpSnapshots, OpenSnapshots and the block Get* exports
+	featureSnapshots = "snapshots"
+	// ServeRemoteKV, StopRemoteKV and RemoteOpen
+	featureRemoteKV = "remoteKV"
+	// Call, the JSON dispatcher
+	featureCall = "call"
+	// CallProto, the protobuf dispatcher
+	featureProto = "proto"
+	// JobStart, JobStatus, JobWait, JobCancel and JobFree
+	featureJobs = "jobs"
+	// ServeRPC and StopRPC, the eth_* JSON-RPC server
+	featureRPC = "rpc"
+	// GetMetrics, ServeMetrics and StopMetrics
+	featureMetrics = "metrics"
+	// SetTrace
+	featureTrace = "trace"
+	// SetSlowThreshold
+	featureSlowLog = "slowLog"
+	// SetAudit and the DbfakerAudit table
+	featureAudit = "audit"
+	// SetHistory
+	featureHistory = "history"
+	// GetAccountAt and GetStorageAt
+	featureHistoricalReads = "historicalReads"
+	// MaterializeAt
+	featureMaterialize = "materialize"
+	// PutAccountFields and PutAccountJSON
+	featureAccountSetters = "accountSetters"
+	// SetBalance, SetNonce, SetCode and SetStorageAt
+	featureStateSetters = "stateSetters"
+	// IncrementNonce
+	featureIncrementNonce = "incrementNonce"
+	// AddBalance and SubBalance
+	featureBalanceDeltas = "balanceDeltas"
+	// PutHeaders and BuildHeaders
+	featureHeaderChains = "headerChains"
+	// CreateFork and SwitchCanonicalChain
+	featureReorgs = "reorgs"
+	// PutBlockWithReceipts and PutReceipts
+	featureReceipts = "receipts"
+	// PutBodyWithTransactions
+	featureBodies = "bodies"
+	// SetVerifySignatures
+	featureVerifySignatures = "verifySignatures"
+	// PatchHeaderBloom
+	featureBloomPatching = "bloomPatching"
+	// FuzzTable
+	featureFuzz = "fuzz"
+	// ExportFixture and ImportFixture
+	featureFixtures = "fixtures"
+	// CloneDb
+	featureClone = "clone"
+	// BeginTestTx and RollbackTestTx
+	featureTestTx = "testTx"
+	// AssertAccount and AssertStorage
+	featureAssertions = "assertions"
+	// EnqueueWrite and WaitTicket
+	featureWriteQueue = "writeQueue"
+	// BuildCliqueHeaders and PutCliqueSnapshot
+	featureClique = "clique"
+	// PutBorSpan and PutBorStateSyncEvents
+	featureBor = "bor"
+	// RunQueries
+	featureQueries = "queries"
+	// SelfTest
+	featureSelfTest = "selfTest"
+	// ExportSQLite
+	featureSQLite = "sqlite"
+	// ExportStateCSV
+	featureStateCSV = "stateCSV"
+	// SeedERC20Balance
+	featureERC20 = "erc20"
+	// MappingSlot, BytesMappingSlot, ArraySlot and PackSlot
+	featureStorageLayout = "storageLayout"
+	// SeedWETH and SeedUniswapV2Pair
+	featureDeFiPresets = "defiPresets"
+	// BatchRead
+	featureBatchRead = "batchRead"
+	// ConfigureLogging
+	featureLogging = "logging"
+	// ImportStream
+	featureStream = "stream"
+	// SharedRegionCreate, SharedRegionFree, SetCodeShared and PutShared
+	featureSharedRegions = "sharedRegions"
+	// SetMapGrowth
+	featureMapGrowth = "mapGrowth"
+	// SetPutStorageMode
+	featurePutStorageMode = "putStorageMode"
+	// SetInsertOnly, and the insertOnly flag of Call and CallProto
+	featureInsertOnly = "insertOnly"
+	// SetCheckDuplicateTxs
+	featureDuplicateTxs = "duplicateTxs"
+	// BackupTo
+	featureBackup = "backup"
+	// RestoreFrom and RestoreInPlace
+	featureRestore = "restore"
+	// SpaceReport and ReclaimSpace
+	featureSpace = "space"
+	// ApplyMigrations
+	featureMigrations = "migrations"
+	// SetStampOnOpen and StampDatabaseInfo
+	featureStamp = "stamp"
+	// ListHandles, MdbxCloseStrict and the leak warnings of MdbxClose
+	featureHandles = "handles"
+	// SetReadTxTimeout
+	featureReadTxTimeout = "readTxTimeout"
+	// OpenChain, GetChainHandle, CloseChain and ListChains
+	featureChains = "chains"
+	// InitPreset
+	featurePresetNetworks = "presetNetworks"
+	// PutCodeBegin, PutCodeChunk, PutCodeEnd and PutCodeAbort
+	featureCodeUpload = "codeUpload"
+	// Subscribe and Unsubscribe
+	featureSubscriptions = "subscriptions"
+	// GetLogs and eth_getLogs
+	featureLogs = "logs"
+	// TraceCall
+	featureCallTraces = "callTraces"
+	// TraceStructLogs and debug_traceTransaction
+	featureStructLogs = "structLogs"
+	// StateDiff
+	featureStateDiff = "stateDiff"
+	// PutBody
+	featureBodiesWithSenders = "bodiesWithSenders"
+	// CanonicalizeRange
+	featureCanonicalizeRange = "canonicalizeRange"
+	// SetChainHead
+	featureChainHead = "chainHead"
+	// PutAlloc
+	featureAlloc = "alloc"
+	// PutHeaderJSON
+	featureRPCHeaders = "rpcHeaders"
+	// PutTransactionJSON
+	featureRPCTransactions = "rpcTransactions"
+	// PutReceiptsJSON
+	featureRPCReceipts = "rpcReceipts"
+	// DumpTablePage
+	featureTablePages = "tablePages"
+)
+
+// Features in the order of their bit in the features bitmap, which
+// GetLibraryInfo still reports for hosts that read it. The bitmap has no room
+// for many more, so it is frozen: features added since are only listed by
+// name.
+var featureBits = []string{
+	featureCoreWrites,
+	featureReads,
+	featureEnvControl,
+	featureSnapshots,
+	featureRemoteKV,
+	featureCall,
+	featureProto,
+	featureJobs,
+	featureRPC,
+	featureMetrics,
+	featureTrace,
+	featureSlowLog,
+	featureAudit,
+	featureHistory,
+	featureHistoricalReads,
+	featureMaterialize,
+	featureAccountSetters,
+	featureStateSetters,
+	featureIncrementNonce,
+	featureBalanceDeltas,
+	featureHeaderChains,
+	featureReorgs,
+	featureReceipts,
+	featureBodies,
+	featureVerifySignatures,
+	featureBloomPatching,
+	featureFuzz,
+	featureFixtures,
+	featureClone,
+	featureTestTx,
+	featureAssertions,
+	featureWriteQueue,
+	featureClique,
+	featureBor,
+	featureQueries,
+	featureSelfTest,
+	featureSQLite,
+	featureStateCSV,
+	featureERC20,
+	featureStorageLayout,
+	featureDeFiPresets,
+	featureBatchRead,
+	featureLogging,
+	featureStream,
+	featureSharedRegions,
+	featureMapGrowth,
+	featurePutStorageMode,
+	featureInsertOnly,
+	featureDuplicateTxs,
+	featureBackup,
+	featureRestore,
+	featureSpace,
+	featureMigrations,
+	featureStamp,
+}
+
+type libraryInfo struct {
+	Version string `json:"version"`
+	// Erigon db schema versions the writers produce
+	SchemaVersions []string `json:"schemaVersions"`
+	// Commit of the Erigon module compiled in, empty for the slim build
+	ErigonCommit string `json:"erigonCommit"`
+	// Bitmap of the supported features of featureBits
+	Features uint64 `json:"features"`
+	// Names of all the supported features
+	FeatureNames []string `json:"featureNames"`
+	Slim         bool     `json:"slim"`
+}
+
+// Returns a JSON document describing this build of the library: its version,
+// the schema versions it writes, the Erigon commit it was compiled against and
+// the names of the supported feature groups, along with the frozen bitmap of
+// the older ones. Hosts should call this at load time and only use exports
+// whose feature is listed. The result must be released with FreeBytes.
+//export GetLibraryInfo
+func GetLibraryInfo() *C.char {
+	// info only has plain fields, so encoding cannot fail
+	enc, _ := json.Marshal(getLibraryInfo())
+	return C.CString(string(enc))
+}
+
+func getLibraryInfo() libraryInfo {
+	return libraryInfo{
+		Version:        libraryVersion,
+		SchemaVersions: schemaVersions(),
+		ErigonCommit:   erigonCommit(),
+		Features:       featureBitmap(buildFeatures),
+		FeatureNames:   buildFeatures,
+		Slim:           slimBuild,
+	}
+}
+
+func featureBitmap(features []string) uint64 {
+	var bits uint64
+	for i, f := range featureBits {
+		for _, g := range features {
+			if f == g {
+				bits |= 1 << i
+			}
+		}
+	}
+	return bits
+}
+
+// Frees memory the library allocated for the host, such as non-zero-copy
+// reads and returned strings.
+//export FreeBytes
+func FreeBytes(ptr unsafe.Pointer) {
+	C.free(ptr)
+}
+
+// Extracts the commit from the pseudo-version of the Erigon module in the
+// build info, e.g. v1.9.7-0.20220413165103-280204bcc9c4.
+func erigonCommit() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path != erigonModule {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		parts := strings.Split(dep.Version, "-")
+		return parts[len(parts)-1]
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// The logger every export reports through. Its level, format and
+// destination default to DBFAKER_LOG_LEVEL, DBFAKER_LOG_FORMAT and
+// DBFAKER_LOG_FILE, and ConfigureLogging changes them at runtime. Until it is
+// configured it logs like the root Erigon logger.
+var libLog = log.New()
+
+func init() {
+	level, format, dest := os.Getenv("DBFAKER_LOG_LEVEL"), os.Getenv("DBFAKER_LOG_FORMAT"), os.Getenv("DBFAKER_LOG_FILE")
+	if level == "" && format == "" && dest == "" {
+		return
+	}
+	if err := configureLogging(level, format, dest); err != nil {
+		libLog.Error("log config", "err", err)
+	}
+}
+
+// Configures the library logger. level is one of "crit", "error", "warn",
+// "info", "debug" or "trace" and defaults to "info". format is "terminal",
+// "logfmt" or "json" and defaults to "terminal". dest is "stderr" (the
+// default), "stdout" or the path of a file to append to. Every message
+// carries the operation it comes from and its context as key/value pairs,
+// e.g. an error as "err".
+//export ConfigureLogging
+func ConfigureLogging(level string, format string, dest string) (exit int) {
+	defer timeOp("ConfigureLogging", "level", level, "format", format, "dest", dest)()
+	return exitCode("ConfigureLogging", configureLogging(level, format, dest))
+}
+
+func configureLogging(level string, format string, dest string) error {
+	lvl := log.LvlInfo
+	if level != "" {
+		var err error
+		if lvl, err = log.LvlFromString(strings.ToLower(level)); err != nil {
+			return err
+		}
+	}
+
+	var fmtr log.Format
+	switch strings.ToLower(format) {
+	case "", "terminal":
+		fmtr = log.TerminalFormat()
+	case "logfmt":
+		fmtr = log.LogfmtFormat()
+	case "json":
+		fmtr = log.JsonFormat()
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	var h log.Handler
+	switch dest {
+	case "", "stderr":
+		h = log.StreamHandler(os.Stderr, fmtr)
+	case "stdout":
+		h = log.StreamHandler(os.Stdout, fmtr)
+	default:
+		var err error
+		if h, err = log.FileHandler(dest, fmtr); err != nil {
+			return fmt.Errorf("log file: %w", err)
+		}
+	}
+	libLog.SetHandler(log.LvlFilterHandler(lvl, h))
+	return nil
+}
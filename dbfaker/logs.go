@@ -0,0 +1,283 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/ethdb/bitmapdb"
+)
+
+// A standard log filter, as taken by eth_getLogs. Addresses match if any
+// matches; each topic position matches if it is empty or any of its topics
+// matches, and all positions must match.
+type logFilter struct {
+	FromBlock string       `json:"fromBlock"`
+	ToBlock   string       `json:"toBlock"`
+	BlockHash *common.Hash `json:"blockHash"`
+	Address   addressList  `json:"address"`
+	Topics    []hashList   `json:"topics"`
+}
+
+// A JSON address or array of addresses.
+type addressList []common.Address
+
+func (l *addressList) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]common.Address)(l))
+	}
+	var addr *common.Address
+	if err := json.Unmarshal(data, &addr); err != nil {
+		return err
+	}
+	if addr != nil {
+		*l = addressList{*addr}
+	}
+	return nil
+}
+
+// A JSON topic, array of alternative topics, or null for any topic.
+type hashList []common.Hash
+
+func (l *hashList) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]common.Hash)(l))
+	}
+	var hash *common.Hash
+	if err := json.Unmarshal(data, &hash); err != nil {
+		return err
+	}
+	if hash != nil {
+		*l = hashList{*hash}
+	}
+	return nil
+}
+
+// Returns the logs of the canonical chain matching the JSON log filter
+// filterJson, as for eth_getLogs: a "fromBlock" and "toBlock" (block tags,
+// both "latest" if omitted) or a "blockHash", an "address" or array of
+// addresses, and "topics", an array of topic positions that are each null, a
+// topic, or an array of alternatives. Candidate blocks are found with the
+// LogAddressIndex and LogTopicIndex bitmaps and their logs are then matched
+// against the filter, which is how Erigon answers it too. The result is a JSON
+// array of logs in the eth_getLogs format, in chain order, and must be
+// released with FreeBytes.
+//export GetLogs
+func GetLogs(dbPtr C.uintptr_t, filterJson string) (exit int, logs *C.char) {
+	defer timeOp("GetLogs", "size", len(filterJson))()
+	var f logFilter
+	if err := json.Unmarshal([]byte(filterJson), &f); err != nil {
+		return exitCode("GetLogs", fmt.Errorf("invalid filter: %w", err)), nil
+	}
+	found, err := getLogs(context.Background(), getDbHandle(dbPtr), &f)
+	if err != nil {
+		return exitCode("GetLogs", err), nil
+	}
+	enc, err := json.Marshal(found)
+	if err != nil {
+		return exitCode("GetLogs", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func getLogs(ctx context.Context, h *dbHandle, f *logFilter) (logs []*types.Log, err error) {
+	err = h.View(ctx, func(tx kv.Tx) error {
+		logs, err = getLogsTx(ctx, h, tx, f)
+		return err
+	})
+	return logs, err
+}
+
+func rpcGetLogs(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var f logFilter
+	if err := rpcParam(params, 0, &f, false); err != nil {
+		return nil, err
+	}
+	return getLogsTx(ctx, h, tx, &f)
+}
+
+func getLogsTx(ctx context.Context, h *dbHandle, tx kv.Tx, f *logFilter) ([]*types.Log, error) {
+	from, to, err := f.blockRange(tx)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := f.candidateBlocks(tx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty array rather than null when nothing matches, as nodes return
+	logs := []*types.Log{}
+	br := h.blockReader()
+	for it := blocks.Iterator(); it.HasNext(); {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		num := uint64(it.Next())
+		receipts, err := h.currentSchema().readReceipts(tx, num)
+		if err != nil {
+			return nil, err
+		}
+		if len(receipts) == 0 {
+			continue
+		}
+		block, err := readCanonicalBlock(ctx, br, tx, num)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			continue
+		}
+		txs := block.Transactions()
+		if len(txs) != len(receipts) {
+			return nil, fmt.Errorf("block %d has %d transactions but %d receipts", num, len(txs), len(receipts))
+		}
+
+		var index uint
+		for i, receipt := range receipts {
+			for _, l := range receipt.Logs {
+				l.BlockNumber, l.BlockHash = num, block.Hash()
+				l.TxHash, l.TxIndex, l.Index = txs[i].Hash(), uint(i), index
+				index++
+				if f.matches(l) {
+					logs = append(logs, l)
+				}
+			}
+		}
+	}
+	return logs, nil
+}
+
+// Resolves the blocks the filter covers.
+func (f *logFilter) blockRange(tx kv.Tx) (from, to uint64, err error) {
+	if f.BlockHash != nil {
+		if f.FromBlock != "" || f.ToBlock != "" {
+			return 0, 0, invalidParams("blockHash cannot be combined with fromBlock or toBlock")
+		}
+		num := rawdb.ReadHeaderNumber(tx, *f.BlockHash)
+		if num == nil {
+			return 0, 0, fmt.Errorf("unknown block %x", *f.BlockHash)
+		}
+		canonical, err := rawdb.ReadCanonicalHash(tx, *num)
+		if err != nil {
+			return 0, 0, err
+		}
+		if canonical != *f.BlockHash {
+			return 0, 0, fmt.Errorf("block %x is not canonical", *f.BlockHash)
+		}
+		return *num, *num, nil
+	}
+
+	tags := []string{f.FromBlock, f.ToBlock}
+	nums := make([]uint64, 2)
+	for i, tag := range tags {
+		if tag == "" {
+			tag = "latest"
+		}
+		if nums[i], err = resolveBlockTag(tx, tag); err != nil {
+			return 0, 0, err
+		}
+	}
+	from, to = nums[0], nums[1]
+	if from > to {
+		return 0, 0, invalidParams("fromBlock %d is after toBlock %d", from, to)
+	}
+	// the log indices store 32-bit block numbers
+	if to > 0xffffffff {
+		return 0, 0, invalidParams("toBlock %d is beyond the log indices", to)
+	}
+	return from, to, nil
+}
+
+// Returns the blocks in [from, to] whose logs may match the filter according
+// to the log indices.
+func (f *logFilter) candidateBlocks(tx kv.Tx, from, to uint64) (*roaring.Bitmap, error) {
+	blocks := roaring.New()
+	blocks.AddRange(from, to+1)
+
+	if len(f.Address) > 0 {
+		keys := make([][]byte, len(f.Address))
+		for i := range f.Address {
+			keys[i] = f.Address[i].Bytes()
+		}
+		matching, err := indexUnion(tx, kv.LogAddressIndex, keys, from, to)
+		if err != nil {
+			return nil, err
+		}
+		blocks.And(matching)
+	}
+	for _, position := range f.Topics {
+		if len(position) == 0 {
+			continue
+		}
+		keys := make([][]byte, len(position))
+		for i := range position {
+			keys[i] = position[i].Bytes()
+		}
+		matching, err := indexUnion(tx, kv.LogTopicIndex, keys, from, to)
+		if err != nil {
+			return nil, err
+		}
+		blocks.And(matching)
+	}
+	return blocks, nil
+}
+
+// Returns the blocks in [from, to] the log index table lists for any of keys.
+func indexUnion(tx kv.Tx, table string, keys [][]byte, from, to uint64) (*roaring.Bitmap, error) {
+	union := roaring.New()
+	for _, key := range keys {
+		bm, err := bitmapdb.Get(tx, table, key, uint32(from), uint32(to))
+		if err != nil {
+			return nil, fmt.Errorf("%s bitmap of %x: %w", table, key, err)
+		}
+		union.Or(bm)
+	}
+	return union, nil
+}
+
+// Whether l itself matches the filter; the indices only narrow down blocks.
+func (f *logFilter) matches(l *types.Log) bool {
+	if len(f.Address) > 0 && !containsAddress(f.Address, l.Address) {
+		return false
+	}
+	if len(f.Topics) > len(l.Topics) {
+		return false
+	}
+	for i, position := range f.Topics {
+		if len(position) > 0 && !containsHash(position, l.Topics[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddress(list []common.Address, a common.Address) bool {
+	for _, b := range list {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHash(list []common.Hash, h common.Hash) bool {
+	for _, g := range list {
+		if g == h {
+			return true
+		}
+	}
+	return false
+}
@@ -1,3 +1,5 @@
+//go:build !slim
+
 package main
 
 /*
@@ -7,129 +9,295 @@ import "C"
 import "runtime/cgo"
 import (
 	"context"
+	"fmt"
+	"math/big"
+	"runtime"
+	"time"
 	// llog "log"
 
 	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon-lib/kv"
-	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
 	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
 	"github.com/ledgerwatch/erigon/core/rawdb"
 	"github.com/ledgerwatch/erigon/core/state"
 	"github.com/ledgerwatch/erigon/core/types"
 	"github.com/ledgerwatch/erigon/core/types/accounts"
 	"github.com/ledgerwatch/erigon/rlp"
-	"github.com/ledgerwatch/log/v3"
 )
 
-func main() {}
-
 // Opens a new mdbx instance at the provided path, returning an ffi-safe
 // pointer the kv.RwDB struct. This pointer should be tracked by the caller
 // and passed into the other methods that wish to interact with the same db
 // instance. The pointer (or, the cgo.Handle that keeps the pointer alive)
 // consumes resources and must be deleted in order for the garbage collector
 // to clean it up (call MdbxClose).
+//
+// Opening a path that is already open shares its db: the pointer returned is
+// a new one, with modes (SetInsertOnly, SetTrace, BeginTestTx and the like),
+// servers and queued writes of its own, but the data, snapshots and map
+// settings are those of the db. Every MdbxOpen must be paired with an
+// MdbxClose, and only the last MdbxClose closes the db.
 //export MdbxOpen
 func MdbxOpen(path string) (exit int, ptr C.uintptr_t) {
-	logger := log.New("Erigon mdbx", path)
-	db, err := mdbx.NewMDBX(logger).Path(path).Open()
+	defer timeOp("MdbxOpen", "path", path)()
+	ptr, err := mdbxOpen(path)
 	if err != nil {
-		log.Error("mdbx open", err)
+		libLog.Error("mdbx open", "path", path, "err", err)
 		return -1, *new(C.uintptr_t)
 	}
-	ptr = C.uintptr_t(cgo.NewHandle(db))
 	return 1, ptr
 }
 
-// Takes a pointer to a kv.RwDB instance. Closes the db and deletes the pointer handle.
+func mdbxOpen(path string) (C.uintptr_t, error) {
+	ptr, fresh, err := openShared(path)
+	if err != nil {
+		return 0, err
+	}
+	// stamped outside openDbs, which a write transaction must not hold up;
+	// another MdbxOpen of the path may see the db before it is stamped
+	if chain, ok := stampOnOpen(); ok && fresh {
+		if err = stampDatabaseInfo(context.Background(), getDbHandle(ptr), chain); err != nil {
+			MdbxClose(ptr)
+			return 0, fmt.Errorf("stamping %s: %w", chain, err)
+		}
+	}
+	return ptr, nil
+}
+
+// Returns a new handle on the db at path, opening it unless it is open
+// already, in which case its reference count is bumped and fresh is false.
+func openShared(path string) (ptr C.uintptr_t, fresh bool, err error) {
+	key := canonicalPath(path)
+
+	openDbs.Lock()
+	defer openDbs.Unlock()
+
+	for {
+		done, ok := openDbs.closing[key]
+		if !ok {
+			break
+		}
+		openDbs.Unlock()
+		<-done
+		openDbs.Lock()
+	}
+	if s, ok := openDbs.byPath[key]; ok {
+		s.refs++
+		return registerHandle("db", "MdbxOpen", 0, s.newHandle()), false, nil
+	}
+
+	db, err := openEnv(libLog.New("db", path), path)
+	if err != nil {
+		return 0, false, err
+	}
+	h, err := newDbHandle(db)
+	if err != nil {
+		db.Close()
+		return 0, false, err
+	}
+	h.path = key
+	openDbs.byPath[key] = h.sharedDb
+	return registerHandle("db", "MdbxOpen", 0, h), true, nil
+}
+
+// Takes a pointer to a kv.RwDB instance. Closes the pointer and deletes its
+// handle, and drops its reference to the db; the last reference closes the
+// db. Pointers created under it that are still alive (read transactions,
+// cursors, jobs, uploads and subscriptions) are logged as leaks (see
+// ListHandles); the transactions are rolled back.
 //export MdbxClose
 func MdbxClose(dbPtr C.uintptr_t) {
-	handle := cgo.Handle(dbPtr)
-	db := handle.Value().(kv.RwDB)
-	db.Close()
-	handle.Delete()
+	warnLeakedHandles(dbPtr)
+	closeDb(dbPtr)
+}
+
+// Like MdbxClose, but fails, leaving everything open, if pointers created
+// under the pointer are still alive, so that a test suite can fail on leaked
+// handles instead of only logging them.
+//export MdbxCloseStrict
+func MdbxCloseStrict(dbPtr C.uintptr_t) (exit int) {
+	if leaked := childHandles(dbPtr); len(leaked) > 0 {
+		return exitCode("MdbxCloseStrict", fmt.Errorf("%d handles of the db are still alive, the oldest a %s from %s", len(leaked), leaked[0].Kind, leaked[0].Op))
+	}
+	closeDb(dbPtr)
+	return 1
 }
 
+func closeDb(dbPtr C.uintptr_t) {
+	h := getDbHandle(dbPtr)
+	releaseHandle(dbPtr)
+	// not under openDbs: closing waits for queued writes and servers
+	h.Close()
+}
+
+// Writes the account at address, RLP-encoded the way Erigon hashes it, with
+// the given incarnation. Unless replace is set, the account is merged into
+// the stored one: an empty code hash keeps the stored code hash and
+// incarnation 0 keeps the stored incarnation, so that rewriting the balance
+// or nonce of a contract does not orphan its code and storage. With replace
+// the account is written exactly as given, as before.
 //export PutAccount
-func PutAccount(dbPtr C.uintptr_t, address []byte, rlpAccount []byte, incarnation uint64) (exit int) {
+func PutAccount(dbPtr C.uintptr_t, address []byte, rlpAccount []byte, incarnation uint64, replace bool) (exit int) {
+	defer timeOp("PutAccount", "address", hexutil.Bytes(address), "incarnation", incarnation, "replace", replace)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutAccount", putAccount(context.Background(), db, address, rlpAccount, incarnation, replace))
+}
 
+func putAccount(ctx context.Context, db kv.RwDB, address []byte, rlpAccount []byte, incarnation uint64, replace bool) (err error) {
 	var acct accounts.Account
-	if err := acct.DecodeForHashing(rlpAccount); err != nil {
-		log.Error("account DecodeForHashing", err)
-		return -1
+	if err = acct.DecodeForHashing(rlpAccount); err != nil {
+		return fmt.Errorf("account DecodeForHashing: %w", err)
 	}
 	acct.Incarnation = incarnation
 
-	tx, closer, err := begin(db)
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
+	who := common.BytesToAddress(address)
+	if !replace {
+		var stored accounts.Account
+		exists, err := rawdb.ReadAccount(tx, who, &stored)
+		if err != nil {
+			return fmt.Errorf("ReadAccount: %w", err)
+		}
+		if exists {
+			mergeAccount(&acct, &stored)
+		}
+	}
+	return writeAccount(db, tx, who, &acct)
+}
+
+// Fills the fields of acct that were left empty from the stored account.
+func mergeAccount(acct *accounts.Account, stored *accounts.Account) {
+	if acct.IsEmptyCodeHash() && !stored.IsEmptyCodeHash() {
+		acct.CodeHash = stored.CodeHash
+	}
+	if acct.Incarnation == 0 {
+		acct.Incarnation = stored.Incarnation
+	}
+}
+
+// Replaces the account at who, recording history if it is enabled on db.
+// The stored account is passed on as the original of the update.
+func writeAccount(db kv.RwDB, tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+	if block, ok := historyBlock(db); ok {
+		return writeAccountWithHistory(tx, block, who, acct)
+	}
+	original := new(accounts.Account)
+	if _, err := rawdb.ReadAccount(tx, who, original); err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
 	w := state.NewPlainStateWriterNoHistory(tx)
-	err = w.UpdateAccountData(common.BytesToAddress(address), new(accounts.Account), &acct)
+	return w.UpdateAccountData(who, original, acct)
+}
+
+// Deletes the account at address as a self-destruct does: it is removed from
+// the plain state and, if it is a contract, its incarnation is recorded in the
+// IncarnationMap so that a contract recreated at the address can take the
+// next one. Its storage stays under the old incarnation, where only
+// historical reads (see GetStorageAt) find it. With history mode on (see
+// SetHistory), the deleted account is recorded at the history block.
+//export DeleteAccount
+func DeleteAccount(dbPtr C.uintptr_t, address []byte) (exit int) {
+	defer timeOp("DeleteAccount", "address", hexutil.Bytes(address))()
+	db := getDbHandle(dbPtr)
+	return exitCode("DeleteAccount", deleteAccount(context.Background(), db, common.BytesToAddress(address)))
+}
+
+func deleteAccount(ctx context.Context, db kv.RwDB, who common.Address) (err error) {
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("UpdateAccountData", err)
-		return -1
+		return err
 	}
+	defer closer(&err)
 
-	return 1
+	original := new(accounts.Account)
+	exists, err := rawdb.ReadAccount(tx, who, original)
+	if err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("no account at %x", who)
+	}
+	if block, ok := historyBlock(db); ok {
+		return deleteAccountWithHistory(tx, block, who, original)
+	}
+	return state.NewPlainStateWriterNoHistory(tx).DeleteAccount(who, original)
 }
 
 //export PutRawTransactions
 func PutRawTransactions(dbPtr C.uintptr_t, txs [][]byte, baseTxId uint64) (exit int) {
+	defer timeOp("PutRawTransactions", "txs", len(txs), "baseTxId", baseTxId)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutRawTransactions", retryMapFull(db, "PutRawTransactions", func() error {
+		return putRawTransactions(context.Background(), db, txs, baseTxId)
+	}))
+}
 
-	dbtx, closer, err := begin(db)
+func putRawTransactions(ctx context.Context, db kv.RwDB, txs [][]byte, baseTxId uint64) (err error) {
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	// skip 1 system tx at beginning of write
-	err = rawdb.WriteRawTransactions(dbtx, txs, baseTxId+1)
-	if err != nil {
-		log.Error("WriteRawTransactions", err)
-		return -1
-	}
-
-	return 1
+	// skip the system tx at the beginning of the block, if the schema has one
+	return rawdb.WriteRawTransactions(dbtx, txs, schemaOf(db).firstTxId(baseTxId))
 }
 
 //export PutTransactions
 func PutTransactions(dbPtr C.uintptr_t, rlpTxs [][]byte, baseTxId uint64) (exit int) {
+	defer timeOp("PutTransactions", "txs", len(rlpTxs), "baseTxId", baseTxId)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutTransactions", retryMapFull(db, "PutTransactions", func() error {
+		return putTransactions(context.Background(), db, rlpTxs, baseTxId)
+	}))
+}
 
+func putTransactions(ctx context.Context, db kv.RwDB, rlpTxs [][]byte, baseTxId uint64) (err error) {
 	txs, err := types.DecodeTransactions(rlpTxs)
 	if err != nil {
-		log.Error("DecodeTransactions", err)
-		return -1
+		return fmt.Errorf("DecodeTransactions: %w", err)
 	}
+	return writeTransactions(ctx, db, txs, baseTxId)
+}
 
-	dbtx, closer, err := begin(db)
+// Writes txs from tx id baseTxId+1 on, checking them first as the db is set
+// to (see SetVerifySignatures and SetCheckDuplicateTxs).
+func writeTransactions(ctx context.Context, db kv.RwDB, txs []types.Transaction, baseTxId uint64) (err error) {
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	// skip 1 system tx at beginning of write
-	err = rawdb.WriteTransactions(dbtx, txs, baseTxId+1)
-	if err != nil {
-		log.Error("WriteTransactions", err)
-		return -1
+	if verifiesSignatures(db) {
+		if err = verifyTransactions(dbtx, txs); err != nil {
+			return err
+		}
 	}
-
-	return 1
+	schema := schemaOf(db)
+	if _, ok := duplicateTxChecker(db); ok {
+		if err = checkTransactionDuplicates(dbtx, schema, txs, schema.firstTxId(baseTxId)); err != nil {
+			return err
+		}
+	}
+	// skip the system tx at the beginning of the block, if the schema has one
+	return rawdb.WriteTransactions(dbtx, txs, schema.firstTxId(baseTxId))
 }
 
 //export PutSenders
 func PutSenders(dbPtr C.uintptr_t, hash []byte, num uint64, senders [][]byte) (exit int) {
+	defer timeOp("PutSenders", "hash", hexutil.Bytes(hash), "num", num, "senders", len(senders))()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutSenders", putSenders(context.Background(), db, hash, num, senders))
+}
 
+func putSenders(ctx context.Context, db kv.RwDB, hash []byte, num uint64, senders [][]byte) (err error) {
 	h := common.BytesToHash(hash)
 
 	addresses := make([]common.Address, len(senders))
@@ -138,210 +306,404 @@ func PutSenders(dbPtr C.uintptr_t, hash []byte, num uint64, senders [][]byte) (e
 		addresses[i] = a
 	}
 
-	dbtx, closer, err := begin(db)
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	err = rawdb.WriteSenders(dbtx, h, num, addresses)
-	if err != nil {
-		log.Error("WriteSenders", err)
-		return -1
-	}
-
-	return 1
+	return rawdb.WriteSenders(dbtx, h, num, addresses)
 }
 
 //export PutBodyForStorage
 func PutBodyForStorage(dbPtr C.uintptr_t, hash []byte, num uint64, bodyRlp []byte) (exit int) {
+	defer timeOp("PutBodyForStorage", "hash", hexutil.Bytes(hash), "num", num)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutBodyForStorage", putBodyForStorage(context.Background(), db, hash, num, bodyRlp))
+}
 
+func putBodyForStorage(ctx context.Context, db kv.RwDB, hash []byte, num uint64, bodyRlp []byte) (err error) {
 	h := common.BytesToHash(hash)
 	body := new(types.BodyForStorage)
-	if err := rlp.DecodeBytes(bodyRlp, body); err != nil {
-		log.Error("BodyForStorage DecodeBytes", err)
-		return -1
+	if err = rlp.DecodeBytes(bodyRlp, body); err != nil {
+		return fmt.Errorf("BodyForStorage DecodeBytes: %w", err)
 	}
 
-	dbtx, closer, err := begin(db)
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	err = rawdb.WriteBodyForStorage(dbtx, h, num, body)
+	return rawdb.WriteBodyForStorage(dbtx, h, num, body)
+}
+
+// Writes a consensus RLP encoded body (transactions and uncles) without any
+// BaseTxId math on the caller's side: ids for the transactions and the two
+// system txs around them (which dbs of schema 5 lack) are allocated from the
+// EthTx sequence, the BodyForStorage is written with the resulting BaseTxId
+// and TxAmount, and the transactions are written after the leading system tx,
+// all in one transaction.
+//export PutBodyWithTransactions
+func PutBodyWithTransactions(dbPtr C.uintptr_t, hash []byte, num uint64, bodyRlp []byte) (exit int) {
+	defer timeOp("PutBodyWithTransactions", "hash", hexutil.Bytes(hash), "num", num)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutBodyWithTransactions", retryMapFull(db, "PutBodyWithTransactions", func() error {
+		return putBodyWithTransactions(context.Background(), db, hash, num, bodyRlp)
+	}))
+}
+
+func putBodyWithTransactions(ctx context.Context, db kv.RwDB, hash []byte, num uint64, bodyRlp []byte) (err error) {
+	h := common.BytesToHash(hash)
+	body := new(types.Body)
+	if err = rlp.DecodeBytes(bodyRlp, body); err != nil {
+		return fmt.Errorf("Body DecodeBytes: %w", err)
+	}
+
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("WriteBodyForStorage", err)
-		return -1
+		return err
 	}
+	defer closer(&err)
 
-	return 1
+	// the schema allocates the tx ids from the sequence
+	return schemaOf(db).writeBody(dbtx, h, num, body)
 }
 
-// blockNum is a big.Int
-//export PutTxLookupEntries
-func PutTxLookupEntries(dbPtr C.uintptr_t, blockNum []byte, txHashes [][]byte) (exit int) {
+// Writes a consensus RLP encoded body the way PutBodyWithTransactions does,
+// together with the senders of its transactions, one address per transaction
+// in order, so that a block needs one call rather than a PutBodyForStorage,
+// PutTransactions and PutSenders with the tx ids worked out by hand. Nothing
+// is written if the number of senders does not match.
+//export PutBody
+func PutBody(dbPtr C.uintptr_t, hash []byte, num uint64, bodyRlp []byte, senders [][]byte) (exit int) {
+	defer timeOp("PutBody", "hash", hexutil.Bytes(hash), "num", num, "senders", len(senders))()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutBody", retryMapFull(db, "PutBody", func() error {
+		return putBody(context.Background(), db, hash, num, bodyRlp, senders)
+	}))
+}
+
+func putBody(ctx context.Context, db kv.RwDB, hash []byte, num uint64, bodyRlp []byte, senders [][]byte) (err error) {
+	h := common.BytesToHash(hash)
+	body := new(types.Body)
+	if err = rlp.DecodeBytes(bodyRlp, body); err != nil {
+		return fmt.Errorf("Body DecodeBytes: %w", err)
+	}
+	if len(senders) != len(body.Transactions) {
+		return fmt.Errorf("%d senders for %d transactions", len(senders), len(body.Transactions))
+	}
+	addresses := make([]common.Address, len(senders))
+	for i, sender := range senders {
+		addresses[i] = common.BytesToAddress(sender)
+	}
 
-	dbtx, closer, err := begin(db)
+	dbtx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	for _, hash := range txHashes {
-		if err = dbtx.Put(kv.TxLookup, hash, blockNum); err != nil {
-			log.Error("failed to store TxLookup entry", "err", err)
+	if err = schemaOf(db).writeBody(dbtx, h, num, body); err != nil {
+		return err
+	}
+	return rawdb.WriteSenders(dbtx, h, num, addresses)
+}
+
+// blockNum is a big.Int. It is stored in the TxLookup format of the db's
+// schema version. The first entry that fails to be written fails the call,
+// naming its index and hash, and nothing is written. With lenient, failing
+// entries are logged and skipped instead, and the others are written.
+//export PutTxLookupEntries
+func PutTxLookupEntries(dbPtr C.uintptr_t, blockNum []byte, txHashes [][]byte, lenient bool) (exit int) {
+	defer timeOp("PutTxLookupEntries", "blockNum", hexutil.Bytes(blockNum), "txHashes", len(txHashes), "lenient", lenient)()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutTxLookupEntries", putTxLookupEntries(context.Background(), db, blockNum, txHashes, lenient))
+}
+
+func putTxLookupEntries(ctx context.Context, db *dbHandle, blockNum []byte, txHashes [][]byte, lenient bool) (err error) {
+	num := new(big.Int).SetBytes(blockNum)
+	if !num.IsUint64() {
+		return fmt.Errorf("block number %v overflows uint64", num)
+	}
+	schema := db.currentSchema()
+	val := schema.txLookupValue(num.Uint64())
+	_, checkDuplicates := duplicateTxChecker(db)
+
+	dbtx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	for i, hash := range txHashes {
+		var err error
+		if checkDuplicates {
+			err = checkTxLookupDuplicate(dbtx, schema, hash, num.Uint64())
+		}
+		if err == nil {
+			err = dbtx.Put(kv.TxLookup, hash, val)
+		}
+		if err != nil {
+			if !lenient {
+				return fmt.Errorf("TxLookup entry %d (%x): %w", i, hash, err)
+			}
+			libLog.Error("failed to store TxLookup entry", "index", i, "hash", hexutil.Bytes(hash), "err", err)
 		}
 	}
 
-	return 1
+	return nil
 }
 
 //export PutStorage
 func PutStorage(dbPtr C.uintptr_t, address []byte, key []byte, val []byte) (exit int) {
+	defer timeOp("PutStorage", "address", hexutil.Bytes(address), "key", hexutil.Bytes(key))()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutStorage", putStorage(context.Background(), db, address, key, val))
+}
 
+func putStorage(ctx context.Context, db kv.RwDB, address []byte, key []byte, val []byte) (err error) {
 	who := common.BytesToAddress(address)
 	k := common.BytesToHash(key)
 	v, overflow := uint256.FromBig(common.BytesToHash(val).Big())
 	if overflow {
-		log.Error("Overflowed int conversion %x\n", val)
-		return -1
+		return fmt.Errorf("overflowed int conversion %x", val)
 	}
 
-	tx, closer, err := begin(db)
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	var acct accounts.Account
+	acct := accounts.NewAccount()
 	exists, err := rawdb.ReadAccount(tx, who, &acct)
 	if err != nil {
-		log.Error("ReadAccounts", err)
-		return -1
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+	if !exists {
+		switch putStorageModeOf(db) {
+		case putStorageStrict:
+			return fmt.Errorf("no account at %x", who)
+		case putStorageOrphan:
+			acct.Incarnation = state.FirstContractIncarnation
+		default:
+			acct.Incarnation = state.FirstContractIncarnation
+			if err := writeAccount(db, tx, who, &acct); err != nil {
+				return err
+			}
+		}
 	}
 
-	var incarnation uint64 = 0
-	if exists {
-		incarnation = acct.Incarnation
-	}
+	return writeStorage(db, tx, who, acct.Incarnation, &k, v)
+}
 
-	w := state.NewPlainStateWriterNoHistory(tx)
-	err = w.WriteAccountStorage(who, incarnation, &k, new(uint256.Int), v)
-	if err != nil {
-		log.Error("WriteAccountStorage", err)
-		return -1
+// Writes a storage slot of the given incarnation of who, recording history if
+// it is enabled on db.
+func writeStorage(db kv.RwDB, tx kv.RwTx, who common.Address, incarnation uint64, key *common.Hash, value *uint256.Int) error {
+	if block, ok := historyBlock(db); ok {
+		return writeStorageWithHistory(tx, block, who, incarnation, key, value)
 	}
-
-	return 1
+	w := state.NewPlainStateWriterNoHistory(tx)
+	return w.WriteAccountStorage(who, incarnation, key, new(uint256.Int), value)
 }
 
 //export PutHeadHeaderHash
 func PutHeadHeaderHash(dbPtr C.uintptr_t, hash []byte) (exit int) {
+	defer timeOp("PutHeadHeaderHash", "hash", hexutil.Bytes(hash))()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutHeadHeaderHash", putHeadHeaderHash(db, hash))
+}
+
+func putHeadHeaderHash(db kv.RwDB, hash []byte) (err error) {
 	h := common.BytesToHash(hash)
 
 	tx, closer, err := begin(db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	err = rawdb.WriteHeadHeaderHash(tx, h)
-	if err != nil {
-		log.Error("WriteHeadHeaderHash", err)
-		return -1
-	}
-
-	return 1
+	return rawdb.WriteHeadHeaderHash(tx, h)
 }
 
 //export PutHeaderNumber
 func PutHeaderNumber(dbPtr C.uintptr_t, hash []byte, num uint64) (exit int) {
+	defer timeOp("PutHeaderNumber", "hash", hexutil.Bytes(hash), "num", num)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutHeaderNumber", putHeaderNumber(context.Background(), db, hash, num))
+}
+
+func putHeaderNumber(ctx context.Context, db kv.RwDB, hash []byte, num uint64) (err error) {
 	h := common.BytesToHash(hash)
 
-	tx, closer, err := begin(db)
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	err = rawdb.WriteHeaderNumber(tx, h, num)
-	if err != nil {
-		log.Error("WriteHeaderNumber", err)
-		return -1
-	}
-
-	return 1
+	return rawdb.WriteHeaderNumber(tx, h, num)
 }
 
 //export PutHeader
 func PutHeader(dbPtr C.uintptr_t, headerRlp []byte) (exit int) {
+	defer timeOp("PutHeader", "size", len(headerRlp))()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutHeader", putHeader(context.Background(), db, headerRlp))
+}
 
+func putHeader(ctx context.Context, db kv.RwDB, headerRlp []byte) (err error) {
 	header := new(types.Header)
-	if err := rlp.DecodeBytes(headerRlp, header); err != nil {
-		log.Error("Header DecodeBytes", err)
-		return -1
+	if err = rlp.DecodeBytes(headerRlp, header); err != nil {
+		return fmt.Errorf("Header DecodeBytes: %w", err)
 	}
 
-	tx, closer, err := begin(db)
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
 	// WriteHeader just log.Crits any errors
 	rawdb.WriteHeader(tx, header)
 
-	return 1
+	return nil
 }
 
+// With strict, the header with hash must already be stored as block num, and
+// the call fails without writing anything otherwise, instead of leaving a
+// canonical entry that points nowhere.
 //export PutCanonicalHash
-func PutCanonicalHash(dbPtr C.uintptr_t, hash []byte, num uint64) (exit int) {
+func PutCanonicalHash(dbPtr C.uintptr_t, hash []byte, num uint64, strict bool) (exit int) {
+	defer timeOp("PutCanonicalHash", "hash", hexutil.Bytes(hash), "num", num, "strict", strict)()
 	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("PutCanonicalHash", putCanonicalHash(context.Background(), db, hash, num, strict))
+}
+
+func putCanonicalHash(ctx context.Context, db kv.RwDB, hash []byte, num uint64, strict bool) (err error) {
 	h := common.BytesToHash(hash)
 
-	tx, closer, err := begin(db)
+	tx, closer, err := beginCtx(ctx, db)
 	if err != nil {
-		log.Error("tx begin", err)
-		return -1
+		return err
 	}
 	defer closer(&err)
 
-	err = rawdb.WriteCanonicalHash(tx, h, num)
+	if strict {
+		if err = checkCanonicalHeader(tx, h, num); err != nil {
+			return err
+		}
+	}
+	return rawdb.WriteCanonicalHash(tx, h, num)
+}
+
+// Returns why the header with hash cannot be canonical at num, if it can't.
+func checkCanonicalHeader(tx kv.Tx, hash common.Hash, num uint64) error {
+	if rawdb.ReadHeader(tx, hash, num) != nil {
+		return nil
+	}
+	if n := rawdb.ReadHeaderNumber(tx, hash); n != nil && *n != num {
+		return fmt.Errorf("cannot make header %x canonical at block %d, it is block %d", hash, num, *n)
+	}
+	return fmt.Errorf("cannot make header %x canonical at block %d, no such header is stored", hash, num)
+}
+
+// Logs a failed operation and converts its error into an export exit code.
+func exitCode(op string, err error) (exit int) {
 	if err != nil {
-		log.Error("WriteCanonicalHash", err)
+		metrics.opError(op)
+		libLog.Error(op, "err", err)
 		return -1
 	}
-
 	return 1
 }
 
 func begin(db kv.RwDB) (tx kv.RwTx, closer func(*error), err error) {
-	ctx := context.Background()
-	tx, err = db.BeginRw(ctx)
+	return beginCtx(context.Background(), db)
+}
+
+// Like begin, but the transaction is rolled back instead of committed if ctx
+// is cancelled before the closer runs.
+func beginCtx(ctx context.Context, db kv.RwDB) (tx kv.RwTx, closer func(*error), err error) {
+	h, _ := db.(*dbHandle)
+	if h != nil && h.readOnly {
+		return nil, nil, errReadOnly
+	}
+	if h != nil {
+		if err := checkWritableSchema(h.currentSchema()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if h != nil && h.otherTestTx() {
+		return nil, nil, errOtherTestTx
+	}
+	var trace *tracer
+	// the test transaction is already exclusive to its thread
+	serialize := h != nil && h.testTx == nil
+	if h != nil {
+		trace = h.currentTracer()
+	}
+	if serialize {
+		h.writeMu.Lock()
+	}
+	// mdbx write transactions must end on the OS thread that began them.
+	// Goroutines of jobs and the write queue are not tied to a thread, so the
+	// goroutine is pinned until the closer runs instead of relying on the
+	// kv implementation to do it.
+	runtime.LockOSThread()
+
+	start := time.Now()
+	rwTx, err := db.BeginRw(ctx)
 	if err != nil {
+		runtime.UnlockOSThread()
+		if serialize {
+			h.writeMu.Unlock()
+		}
 		return nil, nil, err
 	}
+	id := trace.beginTx()
+	itx := instrumentedTx{RwTx: rwTx, trace: trace, id: id, insertOnly: insertOnlyOf(ctx, h)}
+	if h != nil {
+		itx.audit = h.newAuditor(rwTx)
+	}
+	// writes in the test transaction never commit
+	if serialize {
+		itx.changes = h.newChangeSet()
+	}
+	tx = itx
 
 	closer = func(e *error) {
 		if *e == nil {
+			*e = ctx.Err()
+		}
+		var commit time.Duration
+		if *e == nil {
+			commitStart := time.Now()
 			*e = tx.Commit()
+			commit = time.Since(commitStart)
+			trace.record(id, "commit", "", nil, 0, commitStart, *e)
 		}
 		if *e != nil {
+			if h != nil && h.testTx != nil {
+				// before the rollback, so that the poison names the failure
+				h.poisonTestTx(*e)
+			}
+			rollbackStart := time.Now()
 			tx.Rollback()
+			trace.record(id, "rollback", "", nil, 0, rollbackStart, nil)
+			if serialize && isMapFull(*e) {
+				*e = h.growAfterMapFull(*e)
+			}
+		}
+		metrics.txDone(time.Since(start), commit, *e == nil)
+		runtime.UnlockOSThread()
+		if serialize {
+			h.writeMu.Unlock()
+		}
+		// after unlocking, so that subscribers may read the db
+		if *e == nil && itx.changes != nil {
+			h.notifyCommit(itx.changes)
 		}
 	}
 	return tx, closer, nil
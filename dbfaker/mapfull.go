@@ -0,0 +1,131 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	mdbxgo "github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// Retries of a bulk write whose transaction filled the map, unless changed
+// with SetMapGrowth.
+const defaultMapFullRetries = 3
+
+// Bulk writes that run in a single transaction from inputs they can read
+// again, so that they can be rerun as a whole once the map has grown. Writes
+// spread over several transactions, or consuming a stream, fail instead.
+var mapFullRetryable = map[string]bool{
+	"PutHeaders":              true,
+	"BuildHeaders":            true,
+	"PutTransactions":         true,
+	"PutTransactionJSON":      true,
+	"PutRawTransactions":      true,
+	"PutBodyWithTransactions": true,
+	"PutBody":                 true,
+	"PutBlockWithReceipts":    true,
+	"PutReceipts":             true,
+	"PutReceiptsJSON":         true,
+	"PutAlloc":                true,
+	"ImportFixture":           true,
+	"FuzzTable":               true,
+}
+
+// Sets how the db copes with write transactions that fill the mdbx map
+// (MDBX_MAP_FULL): the upper bound of the map is raised by step bytes, or
+// doubled if step is 0, and bulk writes such as PutHeaders, PutTransactions,
+// PutBlockWithReceipts and ImportFixture are rerun up to retries times.
+// Other writes fail, but the next attempt has the grown map. 0 retries turns
+// growth off, so that map-full errors surface as they are. Growth is logged
+// and counted in the metrics. As envs are opened with NoTLS, mdbx cannot move
+// the map, so it only grows where the address space after it is free; where
+// it is not, the failed growth is logged and the map-full error surfaces as
+// it is.
+//export SetMapGrowth
+func SetMapGrowth(dbPtr C.uintptr_t, retries uint64, step uint64) {
+	getDbHandle(dbPtr).setMapGrowth(retries, step)
+}
+
+func (h *dbHandle) setMapGrowth(retries uint64, step uint64) {
+	atomic.StoreInt64(&h.mapFullRetries, int64(retries))
+	atomic.StoreUint64(&h.mapGrowthStep, step)
+}
+
+// Returned in place of the error of a write transaction that filled the map,
+// once the map has been grown for the next attempt.
+type mapFullError struct {
+	err   error
+	upper uint64
+}
+
+func (e *mapFullError) Error() string {
+	return fmt.Sprintf("%v (map grown to %d bytes)", e.err, e.upper)
+}
+
+func (e *mapFullError) Unwrap() error {
+	return e.err
+}
+
+func isMapFull(err error) bool {
+	var opErr *mdbxgo.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Errno == mdbxgo.MapFull
+	}
+	return errors.Is(err, mdbxgo.MapFull)
+}
+
+// Raises the upper bound of the map after a write transaction failed with
+// err because it filled the map, and returns the error to report instead.
+// Must be called with the write lock held and no transaction open.
+func (h *dbHandle) growAfterMapFull(err error) error {
+	if atomic.LoadInt64(&h.mapFullRetries) == 0 {
+		return err
+	}
+	env, e := mdbxEnv(h)
+	if e != nil {
+		return err
+	}
+	info, e := env.Info(nil)
+	if e != nil {
+		libLog.Error("map growth", "err", e)
+		return err
+	}
+	step := atomic.LoadUint64(&h.mapGrowthStep)
+	if step == 0 {
+		step = info.Geo.Upper
+	}
+	upper := info.Geo.Upper + step
+	// only the upper bound moves, the file grows as pages are used
+	if e := env.SetGeometry(-1, -1, int(upper), -1, -1, -1); e != nil {
+		libLog.Error("map growth", "upper", upper, "err", e)
+		return err
+	}
+	metrics.mapGrown(upper)
+	libLog.Warn("map full, raised its upper bound", "from", info.Geo.Upper, "to", upper)
+	return &mapFullError{err: err, upper: upper}
+}
+
+// Runs fn, the whole of op, and runs it again as long as it fails because
+// its transaction filled the map and op may be rerun, up to the retries
+// configured on db.
+func retryMapFull(db kv.RwDB, op string, fn func() error) error {
+	h, ok := db.(*dbHandle)
+	if !ok || !mapFullRetryable[op] {
+		return fn()
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var full *mapFullError
+		if int64(attempt) >= atomic.LoadInt64(&h.mapFullRetries) || !errors.As(err, &full) {
+			return err
+		}
+		libLog.Info("retrying after map growth", "op", op, "attempt", attempt+1)
+	}
+}
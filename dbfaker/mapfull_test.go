@@ -0,0 +1,80 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Opens a temporary db whose map holds at most upper bytes, which MdbxOpen
+// offers no way to get.
+func openSmallMap(t *testing.T, upper datasize.ByteSize) *dbHandle {
+	t.Helper()
+	db, err := mdbx.NewMDBX(log.New()).InMem().MapSize(upper).Flags(envFlags).RoTxsLimiter(newRoTxsLimiter()).WithTablessCfg(withDbfakerTables).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newDbHandle(db)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func TestRetryMapFull(t *testing.T) {
+	h := openSmallMap(t, 2*datasize.MB)
+	// several times what fits in the map, in one transaction
+	fuzz := func() error {
+		return retryMapFull(h, "FuzzTable", func() error {
+			return fuzzTable(context.Background(), h, kv.Headers, 1, 10_000)
+		})
+	}
+
+	h.setMapGrowth(0, 0)
+	var grown *mapFullError
+	if err := fuzz(); !isMapFull(err) || errors.As(err, &grown) {
+		t.Fatalf("without growth, got %v, want the plain map full error", err)
+	}
+
+	h.setMapGrowth(8, 0)
+	if err := fuzz(); isMapFull(err) && !errors.As(err, &grown) {
+		// growth failed, which is logged: the map cannot move under NoTLS
+		t.Skip("the address space after the map is taken, so it cannot grow")
+	} else if err != nil {
+		t.Fatalf("with growth: %v", err)
+	}
+	env, err := mdbxEnv(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := env.Info(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Geo.Upper <= uint64(2*datasize.MB) {
+		t.Fatalf("map upper bound is still %d", info.Geo.Upper)
+	}
+}
+
+func TestRetryMapFullOnlyRetriesBulkWrites(t *testing.T) {
+	h := openSmallMap(t, 2*datasize.MB)
+	h.setMapGrowth(8, 0)
+
+	runs := 0
+	err := retryMapFull(h, "PutStorage", func() error {
+		runs++
+		return fuzzTable(context.Background(), h, kv.Headers, 1, 10_000)
+	})
+	if !isMapFull(err) || runs != 1 {
+		t.Fatalf("got %v after %d runs, want a map full error after 1", err, runs)
+	}
+}
@@ -0,0 +1,238 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/ethdb/bitmapdb"
+)
+
+// Writes a copy of the db into the directory destPath with everything after
+// block blockNum undone: the plain state is rolled back to the end of
+// blockNum by applying the changesets of the later blocks in reverse, those
+// changesets and their history index entries are removed, and blockNum
+// becomes the head of the canonical chain. The headers and bodies of the
+// dropped blocks are kept as non-canonical blocks. destPath is created if
+// needed and must not already contain a database; the source db is not
+// modified. Use it to cut "the chain as of block N" fixtures from a longer
+// history.
+//export MaterializeAt
+func MaterializeAt(dbPtr C.uintptr_t, blockNum uint64, destPath string) (exit int) {
+	defer timeOp("MaterializeAt", "blockNum", blockNum, "destPath", destPath)()
+	return exitCode("MaterializeAt", materializeAt(context.Background(), getDbHandle(dbPtr), blockNum, destPath))
+}
+
+func materializeAt(ctx context.Context, db *dbHandle, blockNum uint64, destPath string) error {
+	// copying, rewinding the state and truncating the chain are one step each
+	const steps = 3
+	reportProgress(ctx, 0, steps)
+
+	if err := copyEnv(db, destPath); err != nil {
+		return err
+	}
+	reportProgress(ctx, 1, steps)
+
+	dest, err := openEnv(libLog.New("db", destPath), destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	return dest.Update(ctx, func(tx kv.RwTx) error {
+		if err := rewindState(tx, blockNum); err != nil {
+			return err
+		}
+		reportProgress(ctx, 2, steps)
+		if err := truncateChain(tx, db.currentSchema(), blockNum); err != nil {
+			return err
+		}
+		reportProgress(ctx, 3, steps)
+		return nil
+	})
+}
+
+// Rolls the plain state back to the end of blockNum. The value an account or
+// slot had then is the one recorded in the first changeset after blockNum
+// that touches it; accounts and slots no later changeset touches are
+// unchanged since.
+func rewindState(tx kv.RwTx, blockNum uint64) error {
+	from := dbutils.EncodeBlockNumber(blockNum + 1)
+
+	// AccountChangeSet: block => address + account before the block
+	originalAccounts := make(map[string][]byte)
+	err := tx.ForEach(kv.AccountChangeSet, from, func(k, v []byte) error {
+		if len(v) < common.AddressLength {
+			return fmt.Errorf("malformed account changeset entry %x", k)
+		}
+		address := string(v[:common.AddressLength])
+		if _, ok := originalAccounts[address]; !ok {
+			originalAccounts[address] = common.CopyBytes(v[common.AddressLength:])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// StorageChangeSet: block + address + incarnation => slot + value before the block
+	originalSlots := make(map[string][]byte)
+	err = tx.ForEach(kv.StorageChangeSet, from, func(k, v []byte) error {
+		if len(k) != 8+common.AddressLength+8 || len(v) < common.HashLength {
+			return fmt.Errorf("malformed storage changeset entry %x", k)
+		}
+		key := string(append(common.CopyBytes(k[8:]), v[:common.HashLength]...))
+		if _, ok := originalSlots[key]; !ok {
+			originalSlots[key] = common.CopyBytes(v[common.HashLength:])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for address, enc := range originalAccounts {
+		if err := restoreAccount(tx, []byte(address), enc); err != nil {
+			return fmt.Errorf("restore account %x: %w", address, err)
+		}
+		if err := bitmapdb.TruncateRange64(tx, kv.AccountsHistory, []byte(address), blockNum+1); err != nil {
+			return fmt.Errorf("truncate account history: %w", err)
+		}
+	}
+	for key, v := range originalSlots {
+		if len(v) == 0 {
+			err = tx.Delete(kv.PlainState, []byte(key), nil)
+		} else {
+			err = tx.Put(kv.PlainState, []byte(key), v)
+		}
+		if err != nil {
+			return fmt.Errorf("restore storage %x: %w", key, err)
+		}
+		// the storage history is keyed by address and slot, without incarnation
+		historyKey := []byte(key[:common.AddressLength] + key[common.AddressLength+8:])
+		if err := bitmapdb.TruncateRange64(tx, kv.StorageHistory, historyKey, blockNum+1); err != nil {
+			return fmt.Errorf("truncate storage history: %w", err)
+		}
+	}
+
+	if err := truncateDupSort(tx, kv.AccountChangeSet, from); err != nil {
+		return err
+	}
+	return truncateDupSort(tx, kv.StorageChangeSet, from)
+}
+
+// Writes the account encoded as in a changeset back to the plain state. An
+// empty encoding means the account did not exist.
+func restoreAccount(tx kv.RwTx, address, enc []byte) error {
+	if len(enc) == 0 {
+		return tx.Delete(kv.PlainState, address, nil)
+	}
+
+	var acct accounts.Account
+	if err := acct.DecodeForStorage(enc); err != nil {
+		return err
+	}
+	// changesets omit the code hash of contracts, which is kept per
+	// incarnation in PlainContractCode
+	if acct.Incarnation > 0 && acct.IsEmptyCodeHash() {
+		codeHash, err := tx.GetOne(kv.PlainContractCode, dbutils.PlainGenerateStoragePrefix(address, acct.Incarnation))
+		if err != nil {
+			return err
+		}
+		if len(codeHash) > 0 {
+			acct.CodeHash = common.BytesToHash(codeHash)
+			enc = make([]byte, acct.EncodingLengthForStorage())
+			acct.EncodeForStorage(enc)
+		}
+	}
+	return tx.Put(kv.PlainState, address, enc)
+}
+
+// Makes blockNum the head of the canonical chain, dropping the canonical
+// hashes, transaction lookups, receipts and logs of the blocks after it.
+// Dbs whose chain does not reach past blockNum are left as they are.
+func truncateChain(tx kv.RwTx, schema schemaAdapter, blockNum uint64) error {
+	head := rawdb.ReadCurrentHeader(tx)
+	if head == nil || head.Number.Uint64() <= blockNum {
+		return nil
+	}
+	hash, err := rawdb.ReadCanonicalHash(tx, blockNum)
+	if err != nil {
+		return err
+	}
+	if hash == (common.Hash{}) {
+		return fmt.Errorf("no canonical block %d", blockNum)
+	}
+
+	var lookups [][]byte
+	err = tx.ForEach(kv.TxLookup, nil, func(k, v []byte) error {
+		if schema.txLookupBlock(v) > blockNum {
+			lookups = append(lookups, common.CopyBytes(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range lookups {
+		if err := tx.Delete(kv.TxLookup, k, nil); err != nil {
+			return err
+		}
+	}
+
+	from := dbutils.EncodeBlockNumber(blockNum + 1)
+	for _, table := range []string{kv.HeaderCanonical, kv.Receipts, kv.Log} {
+		if err := truncateTable(tx, table, from); err != nil {
+			return err
+		}
+	}
+	return rawdb.WriteHeadHeaderHash(tx, hash)
+}
+
+// Deletes the entries of table with a key from from onwards.
+func truncateTable(tx kv.RwTx, table string, from []byte) error {
+	var keys [][]byte
+	err := tx.ForEach(table, from, func(k, _ []byte) error {
+		keys = append(keys, common.CopyBytes(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := tx.Delete(table, k, nil); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Deletes the keys of the dupsort table from from onwards with all their
+// values.
+func truncateDupSort(tx kv.RwTx, table string, from []byte) error {
+	c, err := tx.RwCursorDupSort(table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for k, _, err := c.Seek(from); k != nil; k, _, err = c.Seek(from) {
+		if err != nil {
+			return err
+		}
+		if err := c.DeleteCurrentDuplicates(); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
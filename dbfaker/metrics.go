@@ -0,0 +1,334 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the latency histogram buckets.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Process-wide metrics, shared by every open db.
+var metrics = &registry{
+	ops:    make(map[string]*opStats),
+	tables: make(map[string]*tableStats),
+}
+
+type registry struct {
+	sync.Mutex
+	ops    map[string]*opStats
+	tables map[string]*tableStats
+	tx     txStats
+	maps   mapStats
+}
+
+type opStats struct {
+	Calls   uint64    `json:"calls"`
+	Errors  uint64    `json:"errors"`
+	Latency histogram `json:"latency"`
+}
+
+type tableStats struct {
+	Puts         uint64 `json:"puts"`
+	Deletes      uint64 `json:"deletes"`
+	Reads        uint64 `json:"reads"`
+	BytesWritten uint64 `json:"bytesWritten"`
+	BytesRead    uint64 `json:"bytesRead"`
+}
+
+// Write transactions opened by the exports, from begin to commit or rollback.
+type txStats struct {
+	Commits   uint64    `json:"commits"`
+	Rollbacks uint64    `json:"rollbacks"`
+	Duration  histogram `json:"duration"`
+	Commit    histogram `json:"commitLatency"`
+}
+
+// Growth of mdbx maps after write transactions filled them, see SetMapGrowth.
+type mapStats struct {
+	Growths uint64 `json:"growths"`
+	// Upper bound of the map after the last growth, in bytes.
+	Upper uint64 `json:"upper"`
+}
+
+// A cumulative histogram over latencyBuckets, as Prometheus expects it.
+type histogram struct {
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+	Buckets []uint64 `json:"buckets"`
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.Buckets == nil {
+		h.Buckets = make([]uint64, len(latencyBuckets))
+	}
+	s := d.Seconds()
+	h.Count++
+	h.Sum += s
+	for i, le := range latencyBuckets {
+		if s <= le {
+			h.Buckets[i]++
+		}
+	}
+}
+
+// Copies h so that it can be read without holding the registry lock.
+func (h histogram) copy() histogram {
+	h.Buckets = append([]uint64(nil), h.Buckets...)
+	return h
+}
+
+func (r *registry) op(name string) *opStats {
+	s, ok := r.ops[name]
+	if !ok {
+		s = new(opStats)
+		r.ops[name] = s
+	}
+	return s
+}
+
+// Records a call of op that took d, see timeOp.
+func (r *registry) latency(op string, d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	s := r.op(op)
+	s.Calls++
+	s.Latency.observe(d)
+}
+
+func (r *registry) opError(op string) {
+	r.Lock()
+	defer r.Unlock()
+	r.op(op).Errors++
+}
+
+func (r *registry) table(name string) *tableStats {
+	s, ok := r.tables[name]
+	if !ok {
+		s = new(tableStats)
+		r.tables[name] = s
+	}
+	return s
+}
+
+func (r *registry) put(table string, n int) {
+	r.Lock()
+	defer r.Unlock()
+	s := r.table(table)
+	s.Puts++
+	s.BytesWritten += uint64(n)
+}
+
+func (r *registry) delete(table string) {
+	r.Lock()
+	defer r.Unlock()
+	r.table(table).Deletes++
+}
+
+func (r *registry) read(table string, n int) {
+	r.Lock()
+	defer r.Unlock()
+	s := r.table(table)
+	s.Reads++
+	s.BytesRead += uint64(n)
+}
+
+func (r *registry) txDone(d, commit time.Duration, committed bool) {
+	r.Lock()
+	defer r.Unlock()
+	if committed {
+		r.tx.Commits++
+		r.tx.Commit.observe(commit)
+	} else {
+		r.tx.Rollbacks++
+	}
+	r.tx.Duration.observe(d)
+}
+
+func (r *registry) mapGrown(upper uint64) {
+	r.Lock()
+	defer r.Unlock()
+	r.maps.Growths++
+	r.maps.Upper = upper
+}
+
+type metricsSnapshot struct {
+	// Upper bounds of the histogram buckets, in seconds.
+	LatencyBuckets []float64             `json:"latencyBuckets"`
+	Ops            map[string]opStats    `json:"ops"`
+	Tables         map[string]tableStats `json:"tables"`
+	Tx             txStats               `json:"writeTx"`
+	Maps           mapStats              `json:"mapGrowth"`
+}
+
+func (r *registry) snapshot() metricsSnapshot {
+	r.Lock()
+	defer r.Unlock()
+	s := metricsSnapshot{
+		LatencyBuckets: latencyBuckets,
+		Ops:            make(map[string]opStats, len(r.ops)),
+		Tables:         make(map[string]tableStats, len(r.tables)),
+		Tx:             r.tx,
+		Maps:           r.maps,
+	}
+	s.Tx.Duration = r.tx.Duration.copy()
+	s.Tx.Commit = r.tx.Commit.copy()
+	for name, op := range r.ops {
+		s.Ops[name] = opStats{Calls: op.Calls, Errors: op.Errors, Latency: op.Latency.copy()}
+	}
+	for name, t := range r.tables {
+		s.Tables[name] = *t
+	}
+	return s
+}
+
+// Returns a JSON document with the metrics collected since the library was
+// loaded: calls, errors and latencies per operation, entries and bytes
+// written and read per table, and the duration and commit latency of write
+// transactions. The result must be released with FreeBytes.
+//export GetMetrics
+func GetMetrics() *C.char {
+	// the snapshot only has plain fields, so encoding cannot fail
+	enc, _ := json.Marshal(metrics.snapshot())
+	return C.CString(string(enc))
+}
+
+var metricsServer struct {
+	sync.Mutex
+	srv *http.Server
+}
+
+// Serves the metrics in the Prometheus text format on addr (e.g.
+// "127.0.0.1:6060") under /metrics, until StopMetrics is called.
+//export ServeMetrics
+func ServeMetrics(addr string) (exit int) {
+	defer timeOp("ServeMetrics", "addr", addr)()
+	return exitCode("ServeMetrics", serveMetrics(addr))
+}
+
+func serveMetrics(addr string) error {
+	metricsServer.Lock()
+	defer metricsServer.Unlock()
+	if metricsServer.srv != nil {
+		return errors.New("already serving metrics")
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, metrics.snapshot())
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			libLog.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+
+	metricsServer.srv = srv
+	return nil
+}
+
+// Stops the metrics endpoint started with ServeMetrics.
+//export StopMetrics
+func StopMetrics() {
+	metricsServer.Lock()
+	defer metricsServer.Unlock()
+	if metricsServer.srv != nil {
+		metricsServer.srv.Shutdown(context.Background())
+		metricsServer.srv = nil
+	}
+}
+
+func writePrometheus(w io.Writer, s metricsSnapshot) {
+	ops := sortedKeys(s.Ops)
+	fmt.Fprintln(w, "# TYPE dbfaker_op_calls_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "dbfaker_op_calls_total{op=%q} %d\n", op, s.Ops[op].Calls)
+	}
+	fmt.Fprintln(w, "# TYPE dbfaker_op_errors_total counter")
+	for _, op := range ops {
+		fmt.Fprintf(w, "dbfaker_op_errors_total{op=%q} %d\n", op, s.Ops[op].Errors)
+	}
+	fmt.Fprintln(w, "# TYPE dbfaker_op_duration_seconds histogram")
+	for _, op := range ops {
+		writeHistogram(w, "dbfaker_op_duration_seconds", fmt.Sprintf("op=%q,", op), s.Ops[op].Latency)
+	}
+
+	tables := sortedKeys(s.Tables)
+	counters := []struct {
+		name  string
+		value func(tableStats) uint64
+	}{
+		{"dbfaker_table_puts_total", func(t tableStats) uint64 { return t.Puts }},
+		{"dbfaker_table_deletes_total", func(t tableStats) uint64 { return t.Deletes }},
+		{"dbfaker_table_reads_total", func(t tableStats) uint64 { return t.Reads }},
+		{"dbfaker_table_written_bytes_total", func(t tableStats) uint64 { return t.BytesWritten }},
+		{"dbfaker_table_read_bytes_total", func(t tableStats) uint64 { return t.BytesRead }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		for _, table := range tables {
+			fmt.Fprintf(w, "%s{table=%q} %d\n", c.name, table, c.value(s.Tables[table]))
+		}
+	}
+
+	fmt.Fprintln(w, "# TYPE dbfaker_tx_commits_total counter")
+	fmt.Fprintf(w, "dbfaker_tx_commits_total %d\n", s.Tx.Commits)
+	fmt.Fprintln(w, "# TYPE dbfaker_tx_rollbacks_total counter")
+	fmt.Fprintf(w, "dbfaker_tx_rollbacks_total %d\n", s.Tx.Rollbacks)
+	fmt.Fprintln(w, "# TYPE dbfaker_tx_duration_seconds histogram")
+	writeHistogram(w, "dbfaker_tx_duration_seconds", "", s.Tx.Duration)
+	fmt.Fprintln(w, "# TYPE dbfaker_tx_commit_seconds histogram")
+	writeHistogram(w, "dbfaker_tx_commit_seconds", "", s.Tx.Commit)
+
+	fmt.Fprintln(w, "# TYPE dbfaker_map_growths_total counter")
+	fmt.Fprintf(w, "dbfaker_map_growths_total %d\n", s.Maps.Growths)
+	fmt.Fprintln(w, "# TYPE dbfaker_map_upper_bytes gauge")
+	fmt.Fprintf(w, "dbfaker_map_upper_bytes %d\n", s.Maps.Upper)
+}
+
+// labels is either empty or a comma terminated list of labels.
+func writeHistogram(w io.Writer, name, labels string, h histogram) {
+	for i, le := range latencyBuckets {
+		var n uint64
+		if h.Buckets != nil {
+			n = h.Buckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.Count)
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
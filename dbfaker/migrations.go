@@ -0,0 +1,124 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/migrations"
+)
+
+// Brings the migration records of the db up to date with the compiled Erigon
+// version, so that a seeded db opens in a real node without being rejected or
+// migrated again. By default the pending migrations run as Erigon runs them
+// on open, which rewrites data written in an older format. With fake, they are
+// only recorded as applied, along with the schema version, which is what a
+// db seeded in the current format needs and is instant. Returns the JSON
+// array of the names of the migrations that were pending, which must be
+// released with FreeBytes.
+//export ApplyMigrations
+func ApplyMigrations(dbPtr C.uintptr_t, fake bool) (exit int, applied *C.char) {
+	defer timeOp("ApplyMigrations", "fake", fake)()
+	names, err := applyMigrations(context.Background(), getDbHandle(dbPtr), fake)
+	if err != nil {
+		return exitCode("ApplyMigrations", err), nil
+	}
+	// a slice of strings always encodes
+	enc, _ := json.Marshal(names)
+	return 1, C.CString(string(enc))
+}
+
+func applyMigrations(ctx context.Context, db *dbHandle, fake bool) ([]string, error) {
+	m := migrations.NewMigrator(kv.ChainDB)
+
+	var done map[string][]byte
+	if err := db.View(ctx, func(tx kv.Tx) (err error) {
+		done, err = migrations.AppliedMigrations(tx, false)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	pending := []string{}
+	for _, mig := range m.Migrations {
+		if _, ok := done[mig.Name]; !ok {
+			pending = append(pending, mig.Name)
+		}
+	}
+
+	if fake {
+		// the records would claim data in an older format had been migrated
+		if v := db.currentSchema().version(); v.Major != kv.DBSchemaVersion.Major {
+			return nil, fmt.Errorf("db has schema version %d.%d.%d, run the migrations instead of faking them", v.Major, v.Minor, v.Patch)
+		}
+		return pending, fakeMigrations(ctx, db, pending)
+	}
+	return pending, runMigrations(db, m)
+}
+
+// Records the migrations in names as applied, with the payload Erigon stores
+// for them, and stamps the schema version they lead to.
+func fakeMigrations(ctx context.Context, db *dbHandle, names []string) (err error) {
+	tx, closer, err := beginCtx(withInsertOnly(ctx, false), db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	if err = putMigrationRecords(tx, names); err != nil {
+		return err
+	}
+	return writeSchemaVersion(tx, erigonSchema{}.version())
+}
+
+func putMigrationRecords(tx kv.RwTx, names []string) error {
+	for _, name := range names {
+		payload, err := migrations.MarshalMigrationPayload(tx)
+		if err != nil {
+			return err
+		}
+		if err = tx.Put(kv.Migrations, []byte(name), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the pending migrations with Erigon's migrator, which commits each in
+// transactions of its own.
+func runMigrations(db *dbHandle, m *migrations.Migrator) error {
+	if db.readOnly {
+		return errReadOnly
+	}
+	if db.otherTestTx() {
+		return errOtherTestTx
+	}
+	tmpdir, err := os.MkdirTemp("", "dbfaker-migrations")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// the migrator begins write transactions of its own, which must end on
+	// the thread that began them and wait for other writers like ours do
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if db.testTx == nil {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	}
+	if err = m.Apply(db, tmpdir); err != nil {
+		return err
+	}
+	// the migrated data is in the format of the compiled version now
+	db.setSchema(schemaAdapters[kv.DBSchemaVersion.Major])
+	return nil
+}
@@ -0,0 +1,135 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// A well-known network InitPreset can start an empty db as.
+type networkPreset struct {
+	genesis common.Hash
+	write   func(tx kv.RwTx, schema schemaAdapter) error
+}
+
+// The networks of InitPreset, by name.
+var networkPresets = map[string]networkPreset{
+	"mainnet": {params.MainnetGenesisHash, writeGenesis(core.DefaultGenesisBlock)},
+	"sepolia": {params.SepoliaGenesisHash, writeGenesis(core.DefaultSepoliaGenesisBlock)},
+	"holesky": {holeskyGenesisHash, writeHoleskyGenesis},
+}
+
+func presetNetworks() []string {
+	names := make([]string, 0, len(networkPresets))
+	for name := range networkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Writes the genesis block, chain config, canonical hash and head pointers of
+// network ("mainnet", "sepolia" or "holesky") into an empty db, so that it
+// looks like a node of that network that has not synced yet. A db that
+// already has the genesis of network is left alone; one with another genesis
+// fails. Mainnet and sepolia get their allocations too; the pinned Erigon
+// predates holesky and does not ship its allocations, so a holesky db has the
+// genesis header, with its real hash and state root, and an empty state.
+//export InitPreset
+func InitPreset(dbPtr C.uintptr_t, network string) (exit int) {
+	defer timeOp("InitPreset", "network", network)()
+	return exitCode("InitPreset", initPreset(context.Background(), getDbHandle(dbPtr), network))
+}
+
+func initPreset(ctx context.Context, db *dbHandle, network string) (err error) {
+	preset, ok := networkPresets[network]
+	if !ok {
+		return fmt.Errorf("unknown network %q, expected one of %v", network, presetNetworks())
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	genesis, err := rawdb.ReadCanonicalHash(tx, 0)
+	if err != nil || genesis == preset.genesis {
+		return err
+	}
+	if genesis != (common.Hash{}) {
+		return fmt.Errorf("db has genesis %x, not the %s genesis %x", genesis, network, preset.genesis)
+	}
+	return preset.write(tx, db.currentSchema())
+}
+
+func writeGenesis(genesis func() *core.Genesis) func(tx kv.RwTx, schema schemaAdapter) error {
+	return func(tx kv.RwTx, schema schemaAdapter) error {
+		_, _, err := core.WriteGenesisBlock(tx, genesis())
+		return err
+	}
+}
+
+var holeskyGenesisHash = common.HexToHash("0xb5f7f912443c940f21fd611f12828d75b534364ed9e95ca4e307729a4661bde4")
+
+// The forks of holesky up to the merge, which are all the pinned Erigon
+// knows of; it launched with them active from genesis.
+var holeskyChainConfig = &params.ChainConfig{
+	ChainName:               "holesky",
+	ChainID:                 big.NewInt(17000),
+	Consensus:               params.EtHashConsensus,
+	HomesteadBlock:          common.Big0,
+	EIP150Block:             common.Big0,
+	EIP155Block:             common.Big0,
+	EIP158Block:             common.Big0,
+	ByzantiumBlock:          common.Big0,
+	ConstantinopleBlock:     common.Big0,
+	PetersburgBlock:         common.Big0,
+	IstanbulBlock:           common.Big0,
+	BerlinBlock:             common.Big0,
+	LondonBlock:             common.Big0,
+	TerminalTotalDifficulty: common.Big0,
+	Ethash:                  &params.EthashConfig{},
+}
+
+// Writes the holesky genesis header as the canonical head, with its chain
+// config, but without allocations.
+func writeHoleskyGenesis(tx kv.RwTx, schema schemaAdapter) error {
+	header := &types.Header{
+		UncleHash:   types.EmptyUncleHash,
+		Root:        common.HexToHash("0x69d8c9d72f6fa4ad42d4702b433707212f90db395eb54dc20bc85de253788783"),
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  big.NewInt(1),
+		Number:      new(big.Int),
+		GasLimit:    25_000_000,
+		Time:        1695902100,
+		Nonce:       types.EncodeNonce(0x1234),
+		BaseFee:     big.NewInt(params.InitialBaseFee),
+	}
+	block := types.NewBlockWithHeader(header)
+	hash := block.Hash()
+	// a change in the header encoding of Erigon must not go unnoticed
+	if hash != holeskyGenesisHash {
+		return fmt.Errorf("holesky genesis encodes to %x instead of %x", hash, holeskyGenesisHash)
+	}
+	if err := writeCanonicalBlock(tx, schema, block, nil, header.Difficulty); err != nil {
+		return err
+	}
+	rawdb.WriteHeadBlockHash(tx, hash)
+	return rawdb.WriteChainConfig(tx, hash, holeskyChainConfig)
+}
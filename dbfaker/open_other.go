@@ -0,0 +1,17 @@
+//go:build !windows && !slim
+
+package main
+
+import (
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/log/v3"
+)
+
+func openEnv(logger log.Logger, path string) (kv.RwDB, error) {
+	return mdbx.NewMDBX(logger).Path(path).Flags(envFlags).RoTxsLimiter(newRoTxsLimiter()).WithTablessCfg(withDbfakerTables).Open()
+}
+
+func platformPath(path string) (string, error) {
+	return path, nil
+}
@@ -0,0 +1,79 @@
+//go:build windows && !slim
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/log/v3"
+	mdbxgo "github.com/torquem-ch/mdbx-go/mdbx"
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// Paths longer than this need the extended-length prefix, leaving room
+	// for the file names mdbx appends.
+	maxShortPath = 248
+	openRetries  = 10
+	openBackoff  = 50 * time.Millisecond
+)
+
+// Opens the env at path. Windows needs two things the other platforms don't:
+// paths are made absolute and extended-length, since temp dirs nested under
+// %TEMP% easily exceed MAX_PATH, and opens that fail with a sharing or lock
+// violation are retried, because virus scanners and the search indexer
+// briefly hold freshly created db files open.
+func openEnv(logger log.Logger, path string) (kv.RwDB, error) {
+	path, err := platformPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := openBackoff
+	for i := 0; ; i++ {
+		db, err := mdbx.NewMDBX(logger).Path(path).Flags(envFlags).RoTxsLimiter(newRoTxsLimiter()).WithTablessCfg(withDbfakerTables).Open()
+		if err == nil || i == openRetries-1 || !isSharingViolation(err) {
+			return db, err
+		}
+		logger.Debug("mdbx open: file in use, retrying", "path", path, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Converts path to an absolute, extended-length path when needed.
+func platformPath(path string) (string, error) {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if len(abs) < maxShortPath {
+		return abs, nil
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path: \\server\share -> \\?\UNC\server\share
+		return `\\?\UNC\` + abs[2:], nil
+	}
+	return `\\?\` + abs, nil
+}
+
+func isSharingViolation(err error) bool {
+	var opErr *mdbxgo.OpError
+	if errors.As(err, &opErr) {
+		err = opErr.Errno
+	}
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == windows.ERROR_SHARING_VIOLATION || errno == windows.ERROR_LOCK_VIOLATION
+}
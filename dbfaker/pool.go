@@ -0,0 +1,44 @@
+//go:build !slim
+
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Scratch buffers of the bulk writers, for the RLP encodings and entries they
+// build and read per item. Allocating a fresh one per header or fixture entry
+// makes the GC dominate large imports. A buffer is only borrowed for one
+// write: mdbx copies keys and values on Put, so it can be reused as soon as
+// Put returns.
+var bufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Buffers grown past this are dropped instead of pooled, so that one huge
+// entry does not keep its memory alive.
+const maxPooledBuffer = 1 << 20
+
+// Returns an empty buffer from the pool. It must be given back with
+// putBuffer once nothing refers to its contents.
+func getBuffer() *bytes.Buffer {
+	b := bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	bufPool.Put(b)
+}
+
+// Returns a slice of n bytes backed by b, growing b as needed. The slice is
+// only valid until b is used again.
+func bufferBytes(b *bytes.Buffer, n int) []byte {
+	b.Reset()
+	b.Grow(n)
+	return b.Bytes()[:n]
+}
@@ -0,0 +1,301 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// WETH9 on mainnet, the default address of the WETH preset.
+var wethMainnet = common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2")
+
+// Storage slots of WETH9: name, symbol and decimals, then the balanceOf and
+// allowance mappings.
+const (
+	wethNameSlot     = 0
+	wethSymbolSlot   = 1
+	wethDecimalsSlot = 2
+	wethBalancesSlot = 3
+)
+
+// Storage slots of UniswapV2Pair, after those of UniswapV2ERC20. The reserves
+// and the timestamp of the last update are packed into one slot.
+const (
+	uniTotalSupplySlot = 0
+	uniBalancesSlot    = 1
+	uniDomainSlot      = 3
+	uniFactorySlot     = 5
+	uniToken0Slot      = 6
+	uniToken1Slot      = 7
+	uniReservesSlot    = 8
+	uniUnlockedSlot    = 12
+)
+
+// Liquidity a pair locks at the zero address when it is first minted.
+const uniMinimumLiquidity = 1000
+
+// Seeds a WETH9 contract from the JSON object wethJson, e.g.
+// {"deposits": {"0xholder": "1000000000000000000"}}: its name, symbol and
+// decimals, the WETH balance of each depositor, and an ether balance of the
+// contract equal to the sum of the deposits, which WETH9 reports as its total
+// supply. "address" defaults to the mainnet WETH9 address. dbfaker does not
+// ship contract bytecode; pass the runtime code as "code" (e.g. from
+// eth_getCode on mainnet) for readers that look at it, otherwise any code
+// already at the address is kept. The contract's other storage is left alone.
+//export SeedWETH
+func SeedWETH(dbPtr C.uintptr_t, wethJson string) (exit int) {
+	defer timeOp("SeedWETH", "weth", wethJson)()
+	var p wethPreset
+	if err := json.Unmarshal([]byte(wethJson), &p); err != nil {
+		return exitCode("SeedWETH", fmt.Errorf("invalid preset: %w", err))
+	}
+	return exitCode("SeedWETH", seedWETH(context.Background(), getDbHandle(dbPtr), &p))
+}
+
+// Seeds a Uniswap V2 pair from the JSON object pairJson, e.g.
+// {"address": "0x...", "factory": "0x...", "token0": "0x...",
+// "token1": "0x...", "reserve0": "1000000", "reserve1": "2000000",
+// "blockTimestampLast": "1650000000", "balances": {"0xlp": "1413213"}}:
+// the pair's factory, tokens, packed reserves and timestamp, its unlocked
+// reentrancy guard, its EIP-712 domain separator for the db's chain id, and
+// its liquidity tokens, with the minimum liquidity of 1000 locked at the zero
+// address and the total supply derived from the balances. token0 must sort
+// below token1, as the factory orders them. If "token0BalanceSlot" or
+// "token1BalanceSlot" is set, the pair's balance in that token is set to
+// its reserve in the token's balances mapping at that slot, so the reserves
+// and the token balances agree. Code is handled as in SeedWETH.
+//export SeedUniswapV2Pair
+func SeedUniswapV2Pair(dbPtr C.uintptr_t, pairJson string) (exit int) {
+	defer timeOp("SeedUniswapV2Pair", "pair", pairJson)()
+	var p uniswapV2Preset
+	if err := json.Unmarshal([]byte(pairJson), &p); err != nil {
+		return exitCode("SeedUniswapV2Pair", fmt.Errorf("invalid preset: %w", err))
+	}
+	return exitCode("SeedUniswapV2Pair", seedUniswapV2Pair(context.Background(), getDbHandle(dbPtr), &p))
+}
+
+type wethPreset struct {
+	Address  *common.Address                          `json:"address"`
+	Code     hexutil.Bytes                            `json:"code"`
+	Deposits map[common.Address]*math.HexOrDecimal256 `json:"deposits"`
+}
+
+type uniswapV2Preset struct {
+	Address            common.Address                           `json:"address"`
+	Code               hexutil.Bytes                            `json:"code"`
+	Factory            common.Address                           `json:"factory"`
+	Token0             common.Address                           `json:"token0"`
+	Token1             common.Address                           `json:"token1"`
+	Reserve0           *math.HexOrDecimal256                    `json:"reserve0"`
+	Reserve1           *math.HexOrDecimal256                    `json:"reserve1"`
+	BlockTimestampLast math.HexOrDecimal64                      `json:"blockTimestampLast"`
+	Balances           map[common.Address]*math.HexOrDecimal256 `json:"balances"`
+	Token0BalanceSlot  *uint64                                  `json:"token0BalanceSlot"`
+	Token1BalanceSlot  *uint64                                  `json:"token1BalanceSlot"`
+}
+
+func seedWETH(ctx context.Context, db kv.RwDB, p *wethPreset) (err error) {
+	addr := wethMainnet
+	if p.Address != nil {
+		addr = *p.Address
+	}
+	slots := map[common.Hash]*uint256.Int{
+		slotHash(wethNameSlot):     solidityShortString("Wrapped Ether"),
+		slotHash(wethSymbolSlot):   solidityShortString("WETH"),
+		slotHash(wethDecimalsSlot): uint256.NewInt(18),
+	}
+	total := new(uint256.Int)
+	for holder, amount := range p.Deposits {
+		v, err := presetAmount(amount, "deposit of "+holder.Hex())
+		if err != nil {
+			return err
+		}
+		if _, overflow := total.AddOverflow(total, v); overflow {
+			return errors.New("deposits overflow 256 bits")
+		}
+		slots[mappingSlot(holder.Bytes(), slotHash(wethBalancesSlot))] = v
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeContract(db, tx, addr, p.Code, total, slots)
+}
+
+func seedUniswapV2Pair(ctx context.Context, db *dbHandle, p *uniswapV2Preset) (err error) {
+	if bytes.Compare(p.Token0.Bytes(), p.Token1.Bytes()) >= 0 {
+		return fmt.Errorf("token0 %s must sort below token1 %s", p.Token0, p.Token1)
+	}
+	reserve0, err := presetAmount(p.Reserve0, "reserve0")
+	if err != nil {
+		return err
+	}
+	reserve1, err := presetAmount(p.Reserve1, "reserve1")
+	if err != nil {
+		return err
+	}
+	if reserve0.BitLen() > 112 || reserve1.BitLen() > 112 {
+		return errors.New("reserves must fit in 112 bits")
+	}
+	if p.BlockTimestampLast > 0xffffffff {
+		return errors.New("blockTimestampLast must fit in 32 bits")
+	}
+	// reserve0 | reserve1 << 112 | blockTimestampLast << 224
+	reserves := new(uint256.Int).Lsh(uint256.NewInt(uint64(p.BlockTimestampLast)), 224)
+	reserves.Or(reserves, new(uint256.Int).Lsh(reserve1, 112))
+	reserves.Or(reserves, reserve0)
+
+	slots := map[common.Hash]*uint256.Int{
+		slotHash(uniFactorySlot):  new(uint256.Int).SetBytes(p.Factory.Bytes()),
+		slotHash(uniToken0Slot):   new(uint256.Int).SetBytes(p.Token0.Bytes()),
+		slotHash(uniToken1Slot):   new(uint256.Int).SetBytes(p.Token1.Bytes()),
+		slotHash(uniReservesSlot): reserves,
+		slotHash(uniUnlockedSlot): uint256.NewInt(1),
+	}
+	supply := uint256.NewInt(uniMinimumLiquidity)
+	slots[mappingSlot(common.Address{}.Bytes(), slotHash(uniBalancesSlot))] = uint256.NewInt(uniMinimumLiquidity)
+	for holder, amount := range p.Balances {
+		if holder == (common.Address{}) {
+			return errors.New("the zero address holds the locked minimum liquidity")
+		}
+		v, err := presetAmount(amount, "balance of "+holder.Hex())
+		if err != nil {
+			return err
+		}
+		if _, overflow := supply.AddOverflow(supply, v); overflow {
+			return errors.New("balances overflow 256 bits")
+		}
+		slots[mappingSlot(holder.Bytes(), slotHash(uniBalancesSlot))] = v
+	}
+	slots[slotHash(uniTotalSupplySlot)] = supply
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.ChainID == nil {
+		return errors.New("the domain separator needs a chain config stored for the genesis block")
+	}
+	slots[slotHash(uniDomainSlot)] = new(uint256.Int).SetBytes(uniswapV2DomainSeparator(config.ChainID, p.Address).Bytes())
+
+	if err = writeContract(db, tx, p.Address, p.Code, nil, slots); err != nil {
+		return err
+	}
+	for _, t := range []struct {
+		token   common.Address
+		slot    *uint64
+		reserve *uint256.Int
+	}{{p.Token0, p.Token0BalanceSlot, reserve0}, {p.Token1, p.Token1BalanceSlot, reserve1}} {
+		if t.slot == nil {
+			continue
+		}
+		balance := map[common.Hash]*uint256.Int{mappingSlot(p.Address.Bytes(), slotHash(*t.slot)): t.reserve}
+		if err = writeContract(db, tx, t.token, nil, nil, balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The EIP-712 domain separator a UniswapV2ERC20 computes in its constructor.
+func uniswapV2DomainSeparator(chainID *big.Int, pair common.Address) common.Hash {
+	typeHash := crypto.Keccak256([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+	return crypto.Keccak256Hash(
+		typeHash,
+		crypto.Keccak256([]byte("Uniswap V2")),
+		crypto.Keccak256([]byte("1")),
+		common.BigToHash(chainID).Bytes(),
+		common.LeftPadBytes(pair.Bytes(), common.HashLength),
+	)
+}
+
+func presetAmount(v *math.HexOrDecimal256, what string) (*uint256.Int, error) {
+	if v == nil {
+		return new(uint256.Int), nil
+	}
+	b := (*big.Int)(v)
+	if b.Sign() < 0 {
+		return nil, fmt.Errorf("%s is negative", what)
+	}
+	u, overflow := uint256.FromBig(b)
+	if overflow {
+		return nil, fmt.Errorf("%s overflows 256 bits", what)
+	}
+	return u, nil
+}
+
+// Returns a string of at most 31 bytes as Solidity stores it in a single
+// slot: left-aligned, with twice its length in the lowest-order byte.
+func solidityShortString(s string) *uint256.Int {
+	var h common.Hash
+	copy(h[:], s)
+	h[common.HashLength-1] = byte(2 * len(s))
+	return new(uint256.Int).SetBytes(h.Bytes())
+}
+
+// Makes who a contract if it is not one yet, sets its code if code is not
+// empty and its balance if balance is not nil, and writes the storage slots,
+// in slot order.
+func writeContract(db kv.RwDB, tx kv.RwTx, who common.Address, code []byte, balance *uint256.Int, slots map[common.Hash]*uint256.Int) error {
+	acct := accounts.NewAccount()
+	if _, err := rawdb.ReadAccount(tx, who, &acct); err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+	if acct.Incarnation == 0 {
+		acct.Incarnation = 1
+	}
+	if len(code) > 0 {
+		acct.CodeHash = crypto.Keccak256Hash(code)
+		w := state.NewPlainStateWriterNoHistory(tx)
+		if err := w.UpdateAccountCode(who, acct.Incarnation, acct.CodeHash, code); err != nil {
+			return err
+		}
+	}
+	if balance != nil {
+		acct.Balance.Set(balance)
+	}
+	if err := writeAccount(db, tx, who, &acct); err != nil {
+		return err
+	}
+
+	keys := make([]common.Hash, 0, len(slots))
+	for k := range slots {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	for i := range keys {
+		if err := writeStorage(db, tx, who, acct.Incarnation, &keys[i], slots[keys[i]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Number of writes that may wait in a queue before EnqueueWrite blocks.
+const writeQueueSize = 4096
+
+// The writes of a handle waiting for its single writer, which runs them one
+// at a time in the order they were enqueued.
+type writeQueue struct {
+	pending chan *queuedWrite
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	next    uint64
+	tickets map[uint64]*queuedWrite
+	closed  bool
+}
+
+// Call methods that may be enqueued: those that only write to the db. Reads,
+// settings, servers and the methods that manage the queue or the test
+// transaction themselves would deadlock the writer or break its one-thread
+// rule.
+var queueableWrites = map[string]bool{
+	"PutAccount":              true,
+	"PutAccountFields":        true,
+	"PutAccountJSON":          true,
+	"SetBalance":              true,
+	"SetNonce":                true,
+	"IncrementNonce":          true,
+	"AddBalance":              true,
+	"SubBalance":              true,
+	"SetCode":                 true,
+	"SetStorageAt":            true,
+	"PutAlloc":                true,
+	"SeedERC20Balance":        true,
+	"SeedWETH":                true,
+	"SeedUniswapV2Pair":       true,
+	"PutRawTransactions":      true,
+	"PutTransactions":         true,
+	"PutTransactionJSON":      true,
+	"PutSenders":              true,
+	"PutBodyForStorage":       true,
+	"PutBodyWithTransactions": true,
+	"PutBody":                 true,
+	"PutTxLookupEntries":      true,
+	"PutStorage":              true,
+	"PutHeadHeaderHash":       true,
+	"PutHeaderNumber":         true,
+	"PutHeader":               true,
+	"PutHeaderJSON":           true,
+	"PutHeaders":              true,
+	"BuildHeaders":            true,
+	"BuildCliqueHeaders":      true,
+	"PutCliqueSnapshot":       true,
+	"PutBorSpan":              true,
+	"PutBorStateSyncEvents":   true,
+	"PutCanonicalHash":        true,
+	"CanonicalizeRange":       true,
+	"SetChainHead":            true,
+	"CreateFork":              true,
+	"SwitchCanonicalChain":    true,
+	"PutBlockWithReceipts":    true,
+	"PutReceipts":             true,
+	"PutReceiptsJSON":         true,
+	"PatchHeaderBloom":        true,
+	"FuzzTable":               true,
+	"SeedChain":               true,
+	"InitPreset":              true,
+	"ImportChain":             true,
+	"ImportFixture":           true,
+	"StampDatabaseInfo":       true,
+}
+
+// A write enqueued with EnqueueWrite, identified by its ticket.
+type queuedWrite struct {
+	method string
+	params json.RawMessage
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// Enqueues the Call write method with the JSON encoded paramsJson for the
+// single writer of dbPtr and returns a ticket for it without waiting. Writes
+// run one at a time in the order they were enqueued, from whichever host
+// threads, so concurrent writers get a well-defined order instead of
+// contending for the one mdbx write transaction. Pass the ticket to WaitTicket for the outcome;
+// every ticket must be waited on once. Blocks only while 4096 writes are
+// already queued.
+//export EnqueueWrite
+func EnqueueWrite(dbPtr C.uintptr_t, method string, paramsJson string) (exit int, ticket uint64) {
+	defer timeOp("EnqueueWrite", "method", method)()
+	// the strings are only valid for the duration of this call
+	ticket, err := getDbHandle(dbPtr).enqueueWrite(string([]byte(method)), json.RawMessage(paramsJson))
+	if err != nil {
+		return exitCode("EnqueueWrite", err), 0
+	}
+	return 1, ticket
+}
+
+// Blocks until the write with the given ticket has run and returns its
+// response in the same JSON format as Call, after which the ticket is
+// forgotten. The response must be released with FreeBytes.
+//export WaitTicket
+func WaitTicket(dbPtr C.uintptr_t, ticket uint64) *C.char {
+	result, err := getDbHandle(dbPtr).waitTicket(ticket)
+	return C.CString(string(encodeResponse(result, err)))
+}
+
+func (h *dbHandle) enqueueWrite(method string, params json.RawMessage) (uint64, error) {
+	if !queueableWrites[method] {
+		return 0, fmt.Errorf("method %q is not a write that can be queued", method)
+	}
+	if h.testTx != nil {
+		return 0, errTestTx
+	}
+	q := h.writeQueue()
+
+	// sending under the lock keeps close from closing pending under us; a
+	// full queue holds the lock only until the writer takes the next write
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, errors.New("db is closed")
+	}
+	q.next++
+	w := &queuedWrite{method: method, params: params, done: make(chan struct{})}
+	q.tickets[q.next] = w
+	q.pending <- w
+	return q.next, nil
+}
+
+func (h *dbHandle) waitTicket(ticket uint64) (interface{}, error) {
+	q := h.writeQueue()
+	q.mu.Lock()
+	w, ok := q.tickets[ticket]
+	delete(q.tickets, ticket)
+	q.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown ticket %d", ticket)
+	}
+
+	<-w.done
+	return w.result, w.err
+}
+
+// Returns the queue of the db, starting its writer on first use.
+func (h *dbHandle) writeQueue() *writeQueue {
+	h.queueOnce.Do(func() {
+		q := &writeQueue{
+			pending: make(chan *queuedWrite, writeQueueSize),
+			stopped: make(chan struct{}),
+			tickets: make(map[uint64]*queuedWrite),
+		}
+		go func() {
+			// the writer owns one OS thread for its lifetime, so every
+			// queued write begins and commits on the same thread
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			defer close(q.stopped)
+			for w := range q.pending {
+				w.result, w.err = call(context.Background(), h, w.method, w.params)
+				close(w.done)
+			}
+		}()
+		h.mu.Lock()
+		h.queue = q
+		h.mu.Unlock()
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.queue
+}
+
+// Stops accepting writes and waits for the queued ones to be committed.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	<-q.stopped
+}
@@ -0,0 +1,255 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import "runtime/cgo"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// How long ReadBegin waits for a read transaction slot to free up.
+const readBeginWait = time.Second
+
+// A read-only transaction that is kept open across calls from the host.
+// Different read transactions may be used from different host threads at the
+// same time; calls on one transaction and its cursors are serialized by mu.
+type readTx struct {
+	kv.Tx
+	mu    sync.Mutex
+	db    *dbHandle
+	ended bool
+	// Set once the transaction was reported as stale (see SetReadTxTimeout).
+	stale bool
+	// When set, values handed to the host point directly into the mdbx
+	// memory map instead of being copied into malloc'd memory.
+	zeroCopy bool
+	// Trace of the db and id of the transaction within it, if tracing.
+	trace *tracer
+	id    uint64
+}
+
+// Wraps an open cursor along with the transaction it belongs to.
+type readCursor struct {
+	kv.Cursor
+	tx    *readTx
+	table string
+}
+
+// Begins a read-only transaction on the db, returning an ffi-safe pointer to
+// it. If zeroCopy is set, every value returned through this transaction points
+// into the mdbx memory map and is valid only until ReadEnd is called; such
+// values must not be freed. Otherwise values are copied into malloc'd memory
+// owned by the caller, which must release them with FreeBytes.
+// At most kv.ReadersLimit (32000) read transactions can be open on a db at
+// once, counting those of every handle on it and those exports open
+// internally. Once they are all taken, ReadBegin waits readBeginWait for one
+// to end and then fails, rather than blocking the calling thread.
+//export ReadBegin
+func ReadBegin(dbPtr C.uintptr_t, zeroCopy bool) (exit int, ptr C.uintptr_t) {
+	defer timeOp("ReadBegin", "zeroCopy", zeroCopy)()
+	db := getDbHandle(dbPtr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), readBeginWait)
+	defer cancel()
+	tx, err := db.BeginRo(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("all %d read transaction slots are taken", kv.ReadersLimit)
+		}
+		libLog.Error("tx begin ro", "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+
+	trace := db.currentTracer()
+	rtx := &readTx{Tx: tx, db: db, zeroCopy: zeroCopy, trace: trace, id: trace.beginTx()}
+	db.readersMu.Lock()
+	db.readers[rtx] = struct{}{}
+	db.readersMu.Unlock()
+	return 1, registerHandle("tx", "ReadBegin", dbPtr, rtx)
+}
+
+// Takes a pointer to a read transaction. Rolls back the transaction and
+// deletes the pointer handle. Any zero-copy values obtained through the
+// transaction are invalid after this returns.
+//export ReadEnd
+func ReadEnd(txPtr C.uintptr_t) {
+	tx := cgo.Handle(txPtr).Value().(*readTx)
+	tx.db.readersMu.Lock()
+	delete(tx.db.readers, tx)
+	tx.db.readersMu.Unlock()
+	tx.end()
+	releaseHandle(txPtr)
+}
+
+// Rolls back the transaction, releasing its reader slot. Ending a transaction
+// twice is a no-op, as happens when the db was closed first.
+func (tx *readTx) end() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if !tx.ended {
+		tx.Rollback()
+		tx.ended = true
+	}
+}
+
+// Marks the transaction as stale, returning false if it already was or has
+// been ended.
+func (tx *readTx) markStale() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.ended || tx.stale {
+		return false
+	}
+	tx.stale = true
+	return true
+}
+
+// Fails the calls on a transaction that was rolled back before ReadEnd, by
+// closing the db or by SetReadTxTimeout. Must be called with mu held.
+func (tx *readTx) checkLive(op string) bool {
+	if tx.ended {
+		libLog.Error(op+" on a rolled back read transaction", "stale", tx.stale)
+		return false
+	}
+	return true
+}
+
+// Looks up key in table. found is false if the key does not exist.
+//export ReadGet
+func ReadGet(txPtr C.uintptr_t, table string, key []byte) (exit int, found bool, val unsafe.Pointer, valLen C.size_t) {
+	defer timeOp("ReadGet", "table", table, "key", hexutil.Bytes(key))()
+	tx := cgo.Handle(txPtr).Value().(*readTx)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if !tx.checkLive("ReadGet") {
+		return -1, false, nil, 0
+	}
+
+	start := time.Now()
+	v, err := tx.GetOne(table, key)
+	tx.trace.record(tx.id, "get", table, key, len(v), start, err)
+	if err != nil {
+		libLog.Error("GetOne", "table", table, "err", err)
+		return -1, false, nil, 0
+	}
+	if v == nil {
+		return 1, false, nil, 0
+	}
+	metrics.read(table, len(key)+len(v))
+
+	val, valLen = tx.export(v)
+	return 1, true, val, valLen
+}
+
+// Opens a cursor over table, returning an ffi-safe pointer to it. The cursor
+// must be closed with ReadCursorClose before the transaction is ended.
+//export ReadCursorOpen
+func ReadCursorOpen(txPtr C.uintptr_t, table string) (exit int, ptr C.uintptr_t) {
+	tx := cgo.Handle(txPtr).Value().(*readTx)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if !tx.checkLive("ReadCursorOpen") {
+		return -1, *new(C.uintptr_t)
+	}
+
+	c, err := tx.Cursor(table)
+	if err != nil {
+		libLog.Error("Cursor", "table", table, "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+
+	return 1, registerHandle("cursor", "ReadCursorOpen", txPtr, &readCursor{Cursor: c, tx: tx, table: table})
+}
+
+// Positions the cursor at the first key greater than or equal to key. An
+// empty key seeks to the start of the table. found is false once the cursor
+// is exhausted.
+//export ReadCursorSeek
+func ReadCursorSeek(curPtr C.uintptr_t, key []byte) (exit int, found bool, k unsafe.Pointer, kLen C.size_t, v unsafe.Pointer, vLen C.size_t) {
+	defer timeOp("ReadCursorSeek", "key", hexutil.Bytes(key))()
+	c := cgo.Handle(curPtr).Value().(*readCursor)
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	if !c.tx.checkLive("ReadCursorSeek") {
+		return -1, false, nil, 0, nil, 0
+	}
+
+	start := time.Now()
+	var kb, vb []byte
+	var err error
+	if len(key) == 0 {
+		kb, vb, err = c.First()
+	} else {
+		kb, vb, err = c.Seek(key)
+	}
+	c.tx.trace.record(c.tx.id, "seek", c.table, key, len(vb), start, err)
+	return c.export(kb, vb, err)
+}
+
+// Advances the cursor to the next entry. found is false once the cursor is
+// exhausted.
+//export ReadCursorNext
+func ReadCursorNext(curPtr C.uintptr_t) (exit int, found bool, k unsafe.Pointer, kLen C.size_t, v unsafe.Pointer, vLen C.size_t) {
+	defer timeOp("ReadCursorNext")()
+	c := cgo.Handle(curPtr).Value().(*readCursor)
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	if !c.tx.checkLive("ReadCursorNext") {
+		return -1, false, nil, 0, nil, 0
+	}
+	start := time.Now()
+	kb, vb, err := c.Next()
+	c.tx.trace.record(c.tx.id, "next", c.table, kb, len(vb), start, err)
+	return c.export(kb, vb, err)
+}
+
+// Takes a pointer to a cursor. Closes the cursor and deletes the pointer handle.
+//export ReadCursorClose
+func ReadCursorClose(curPtr C.uintptr_t) {
+	c := cgo.Handle(curPtr).Value().(*readCursor)
+	c.tx.mu.Lock()
+	// rolling back the transaction closed its cursors already
+	if !c.tx.ended {
+		c.Close()
+	}
+	c.tx.mu.Unlock()
+	releaseHandle(curPtr)
+}
+
+func (c *readCursor) export(kb, vb []byte, err error) (exit int, found bool, k unsafe.Pointer, kLen C.size_t, v unsafe.Pointer, vLen C.size_t) {
+	if err != nil {
+		libLog.Error("cursor", "err", err)
+		return -1, false, nil, 0, nil, 0
+	}
+	if kb == nil {
+		return 1, false, nil, 0, nil, 0
+	}
+	metrics.read(c.table, len(kb)+len(vb))
+	k, kLen = c.tx.export(kb)
+	v, vLen = c.tx.export(vb)
+	return 1, true, k, kLen, v, vLen
+}
+
+// Hands b to the host, either by pointing into the memory map or by copying
+// it into malloc'd memory, depending on the mode of the transaction.
+func (tx *readTx) export(b []byte) (unsafe.Pointer, C.size_t) {
+	if len(b) == 0 {
+		return nil, 0
+	}
+	if tx.zeroCopy {
+		return unsafe.Pointer(&b[0]), C.size_t(len(b))
+	}
+	return C.CBytes(b), C.size_t(len(b))
+}
@@ -0,0 +1,277 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Writes a block together with its receipts in one transaction, making the
+// block canonical and the head: its header, body, total difficulty, senders
+// (recovered when the db has a chain config), receipts and logs, the log
+// address and topic indices Erigon filters logs with in place of blooms, and
+// the tx lookup entries of its transactions. receiptsRlp is the consensus RLP
+// list of the block's receipts, as in the eth wire protocol, with typed
+// receipts as RLP strings holding their envelope. Nothing is
+// written unless there is exactly one receipt per transaction.
+//export PutBlockWithReceipts
+func PutBlockWithReceipts(dbPtr C.uintptr_t, blockRlp []byte, receiptsRlp []byte) (exit int) {
+	defer timeOp("PutBlockWithReceipts", "size", len(blockRlp)+len(receiptsRlp))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutBlockWithReceipts", retryMapFull(db, "PutBlockWithReceipts", func() error {
+		return putBlockWithReceipts(context.Background(), db, blockRlp, receiptsRlp)
+	}))
+}
+
+func putBlockWithReceipts(ctx context.Context, db *dbHandle, blockRlp []byte, receiptsRlp []byte) (err error) {
+	block := new(types.Block)
+	if err = rlp.DecodeBytes(blockRlp, block); err != nil {
+		return fmt.Errorf("Block DecodeBytes: %w", err)
+	}
+	var receipts types.Receipts
+	if err = rlp.DecodeBytes(receiptsRlp, &receipts); err != nil {
+		return fmt.Errorf("Receipts DecodeBytes: %w", err)
+	}
+	return writeBlockWithReceipts(ctx, db, block, receipts)
+}
+
+func writeBlockWithReceipts(ctx context.Context, db *dbHandle, block *types.Block, receipts types.Receipts) (err error) {
+	if len(receipts) != len(block.Transactions()) {
+		return fmt.Errorf("block %d has %d transactions but %d receipts", block.NumberU64(), len(block.Transactions()), len(receipts))
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+	senders, err := recoverSenders(config, block)
+	if err != nil {
+		return err
+	}
+	td, err := totalDifficulty(tx, block.Header())
+	if err != nil {
+		return err
+	}
+	if err = writeCanonicalBlock(tx, db.currentSchema(), block, senders, td); err != nil {
+		return err
+	}
+	// the consensus encoding carries no log indices, so they are numbered here
+	return writeBlockReceipts(tx, db.currentSchema(), block.NumberU64(), receipts, true)
+}
+
+// Writes the receipts of the canonical block num, converting them from their
+// consensus encoding to Erigon's storage format: each receipt is either an RLP
+// list for legacy receipts or a typed receipt envelope (the type byte followed
+// by the RLP payload), as returned by eth_getRawReceipts. The logs are written
+// alongside and indexed as by PutBlockWithReceipts. receipts must be in
+// transaction order. If the db has a chain config, receipts of blocks before
+// Byzantium must carry a post-state root in place of the status, and later
+// ones a status.
+//export PutReceipts
+func PutReceipts(dbPtr C.uintptr_t, num uint64, receipts [][]byte) (exit int) {
+	defer timeOp("PutReceipts", "num", num, "receipts", len(receipts))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutReceipts", retryMapFull(db, "PutReceipts", func() error {
+		return putReceipts(context.Background(), db, num, receipts)
+	}))
+}
+
+func putReceipts(ctx context.Context, db *dbHandle, num uint64, encoded [][]byte) (err error) {
+	receipts := make(types.Receipts, len(encoded))
+	for i, enc := range encoded {
+		if receipts[i], err = decodeReceipt(enc); err != nil {
+			return fmt.Errorf("receipt %d: %w", i, err)
+		}
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeBlockReceipts(tx, db.currentSchema(), num, receipts, true)
+}
+
+// Decodes the consensus encoding of a single receipt, legacy or typed.
+func decodeReceipt(enc []byte) (*types.Receipt, error) {
+	if len(enc) == 0 {
+		return nil, errors.New("empty receipt")
+	}
+	// inside a list of receipts, typed envelopes are RLP strings, which is
+	// the form the receipt decoder understands
+	if enc[0] < 0xc0 {
+		var err error
+		if enc, err = rlp.EncodeToBytes(enc); err != nil {
+			return nil, err
+		}
+	}
+	receipt := new(types.Receipt)
+	if err := rlp.DecodeBytes(enc, receipt); err != nil {
+		return nil, fmt.Errorf("Receipt DecodeBytes: %w", err)
+	}
+	return receipt, nil
+}
+
+// Writes the receipts and logs of block num and adds the block to the log
+// indices of the addresses and topics of its logs. If autoNumber is set the
+// logs are numbered in order, otherwise the indices they carry must already
+// be. If the db has a chain config, the receipts must be in the format of
+// their fork (see checkReceiptFormat).
+func writeBlockReceipts(tx kv.RwTx, schema schemaAdapter, num uint64, receipts types.Receipts, autoNumber bool) error {
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+	if err := checkReceiptFormat(config, num, receipts); err != nil {
+		return fmt.Errorf("block %d: %w", num, err)
+	}
+	if err := numberLogs(receipts, autoNumber); err != nil {
+		return fmt.Errorf("block %d: %w", num, err)
+	}
+	if err := schema.writeReceipts(tx, num, receipts); err != nil {
+		return fmt.Errorf("writeReceipts: %w", err)
+	}
+	for _, receipt := range receipts {
+		for _, l := range receipt.Logs {
+			if err := addToLogIndex(tx, kv.LogAddressIndex, l.Address.Bytes(), num); err != nil {
+				return err
+			}
+			for _, topic := range l.Topics {
+				if err := addToLogIndex(tx, kv.LogTopicIndex, topic.Bytes(), num); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Computes the logs bloom of the canonical block num from its stored receipts
+// and writes it into the stored header, so that the header agrees with the
+// receipts. Setting the bloom changes the hash of the block: the body,
+// senders and total difficulty move to the new hash, which becomes canonical,
+// and the descendants of the block are re-linked and rehashed up to the head.
+// Returns the new hash of the block. The result is malloc'd and must be
+// released with FreeBytes.
+//export PatchHeaderBloom
+func PatchHeaderBloom(dbPtr C.uintptr_t, num uint64) (exit int, hash unsafe.Pointer, hashLen C.size_t) {
+	defer timeOp("PatchHeaderBloom", "num", num)()
+	h, err := patchHeaderBloom(getDbHandle(dbPtr), num)
+	if err != nil {
+		return exitCode("PatchHeaderBloom", err), nil, 0
+	}
+	return 1, C.CBytes(h.Bytes()), C.size_t(common.HashLength)
+}
+
+func patchHeaderBloom(db *dbHandle, num uint64) (hash common.Hash, err error) {
+	tx, closer, err := beginCtx(withInsertOnly(context.Background(), false), db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer closer(&err)
+
+	header := rawdb.ReadHeaderByNumber(tx, num)
+	if header == nil {
+		return common.Hash{}, fmt.Errorf("no canonical header %d", num)
+	}
+	receipts, err := db.currentSchema().readReceipts(tx, num)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	header.Bloom = types.CreateBloom(receipts)
+	return replaceCanonicalHeader(tx, header)
+}
+
+// Checks that the receipts of block num have the outcome field of their fork:
+// a 32-byte post-state root before Byzantium (EIP-658), a status after. Both
+// are stored as they are, and the consensus encoding picks the field that is
+// set, so a receipt of the wrong kind would be read back as one that never
+// existed on the chain. Without a chain config, either is accepted.
+func checkReceiptFormat(config *params.ChainConfig, num uint64, receipts types.Receipts) error {
+	if config == nil {
+		return nil
+	}
+	byzantium := config.IsByzantium(num)
+	for i, r := range receipts {
+		switch {
+		case byzantium && len(r.PostState) > 0:
+			return fmt.Errorf("receipt %d has a post-state root, but the block is past Byzantium and needs a status", i)
+		case !byzantium && len(r.PostState) != common.HashLength:
+			return fmt.Errorf("receipt %d has no post-state root, which blocks before Byzantium need instead of a status", i)
+		}
+	}
+	return nil
+}
+
+// Numbers the logs of a block's receipts, or checks their numbering: log
+// indices run from 0 across the whole block, in receipt order, and each log
+// carries the index of its transaction. Readers derive the indices from the
+// position of the logs, so receipts whose logs are numbered any other way
+// would be read back with different indices than they were written with.
+func numberLogs(receipts types.Receipts, autoNumber bool) error {
+	var next uint
+	for i, receipt := range receipts {
+		for j, l := range receipt.Logs {
+			if autoNumber {
+				l.Index, l.TxIndex = next, uint(i)
+			} else if l.Index != next || l.TxIndex != uint(i) {
+				return fmt.Errorf("receipt %d log %d: index %d of tx %d, expected index %d of tx %d", i, j, l.Index, l.TxIndex, next, i)
+			}
+			next++
+		}
+	}
+	return nil
+}
+
+// Adds block num to the roaring bitmap of key in a log index table. The
+// bitmaps are stored in chunks keyed by key and the big-endian last block of
+// the chunk, with the open chunk at 0xffffffff; new blocks go to the open
+// chunk.
+func addToLogIndex(tx kv.RwTx, table string, key []byte, num uint64) error {
+	if num > 0xffffffff {
+		return fmt.Errorf("block %d does not fit in the 32-bit %s", num, table)
+	}
+	chunkKey := make([]byte, len(key)+4)
+	copy(chunkKey, key)
+	binary.BigEndian.PutUint32(chunkKey[len(key):], 0xffffffff)
+
+	bm := roaring.New()
+	v, err := tx.GetOne(table, chunkKey)
+	if err != nil {
+		return err
+	}
+	if len(v) > 0 {
+		if err := bm.UnmarshalBinary(v); err != nil {
+			return fmt.Errorf("%s bitmap of %x: %w", table, key, err)
+		}
+	}
+	bm.Add(uint32(num))
+	enc, err := bm.ToBytes()
+	if err != nil {
+		return err
+	}
+	return tx.Put(table, chunkKey, enc)
+}
@@ -0,0 +1,109 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/ledgerwatch/erigon-lib/gointerfaces"
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/remote"
+	"github.com/ledgerwatch/erigon-lib/kv/remotedb"
+	"github.com/ledgerwatch/erigon-lib/kv/remotedbserver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Connects to the remote KV endpoint of a running Erigon node (or of another
+// dbfaker serving with ServeRemoteKV) at url, e.g. "127.0.0.1:9090". The
+// returned pointer is used like one from MdbxOpen, but the db is read-only:
+// every write export fails on it. Release it with MdbxClose.
+//export RemoteOpen
+func RemoteOpen(url string) (exit int, ptr C.uintptr_t) {
+	defer timeOp("RemoteOpen", "url", url)()
+	conn, err := grpc.Dial(url, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		libLog.Error("remote kv dial", "url", url, "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+
+	logger := libLog.New("remote", url)
+	version := gointerfaces.VersionFromProto(remotedbserver.KvServiceAPIVersion)
+	db, err := remotedb.NewRemote(version, logger, remote.NewKVClient(conn)).Open()
+	if err != nil {
+		conn.Close()
+		libLog.Error("remote kv open", "url", url, "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+
+	h, err := newDbHandle(db)
+	if err != nil {
+		db.Close()
+		conn.Close()
+		libLog.Error("remote kv open", "url", url, "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+	h.readOnly = true
+	h.conn = conn
+	return 1, registerHandle("db", "RemoteOpen", 0, h)
+}
+
+// Starts Erigon's remote KV gRPC service for the db on addr (e.g.
+// "127.0.0.1:9090"), so any remote-kv client, including rpcdaemon, can read
+// the faked data over a socket. The server runs until StopRemoteKV is called
+// or the db is closed.
+//export ServeRemoteKV
+func ServeRemoteKV(dbPtr C.uintptr_t, addr string) (exit int) {
+	defer timeOp("ServeRemoteKV", "addr", addr)()
+	return exitCode("ServeRemoteKV", getDbHandle(dbPtr).serveRemoteKV(addr))
+}
+
+func (h *dbHandle) serveRemoteKV(addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.kvServer != nil {
+		return errors.New("already serving remote kv")
+	}
+	if h.testTx != nil {
+		return errTestTx
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer()
+	remote.RegisterKVServer(srv, remotedbserver.NewKvServer(context.Background(), h.RwDB))
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			libLog.Error("remote kv server stopped", "addr", addr, "err", err)
+		}
+	}()
+
+	h.kvServer = srv
+	return nil
+}
+
+// Stops the remote KV service started with ServeRemoteKV, waiting for
+// in-flight requests to finish.
+//export StopRemoteKV
+func StopRemoteKV(dbPtr C.uintptr_t) {
+	getDbHandle(dbPtr).stopKvServer()
+}
+
+func (h *dbHandle) stopKvServer() {
+	h.mu.Lock()
+	srv := h.kvServer
+	h.kvServer = nil
+	h.mu.Unlock()
+	// not under mu, in-flight requests may need it
+	if srv != nil {
+		srv.GracefulStop()
+	}
+}
@@ -0,0 +1,168 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// Extra data of the headers CreateFork builds, so that they never collide
+// with the canonical blocks they compete with.
+var forkExtra = []byte("dbfaker fork")
+
+// Builds a side chain of numBlocks empty blocks on top of the canonical block
+// fromBlock and returns the hash of its tip. The blocks are written with
+// their headers, bodies and total difficulties but are not made canonical;
+// pass the tip to SwitchCanonicalChain to reorg to them. The result is
+// malloc'd and must be released with FreeBytes.
+//export CreateFork
+func CreateFork(dbPtr C.uintptr_t, fromBlock uint64, numBlocks uint64) (exit int, tip unsafe.Pointer, tipLen C.size_t) {
+	defer timeOp("CreateFork", "fromBlock", fromBlock, "numBlocks", numBlocks)()
+	hash, err := createFork(context.Background(), getDbHandle(dbPtr), fromBlock, numBlocks)
+	if err != nil {
+		return exitCode("CreateFork", err), nil, 0
+	}
+	return 1, C.CBytes(hash.Bytes()), C.size_t(common.HashLength)
+}
+
+func createFork(ctx context.Context, db kv.RwDB, fromBlock uint64, numBlocks uint64) (tip common.Hash, err error) {
+	if numBlocks == 0 {
+		return common.Hash{}, errors.New("a fork needs at least one block")
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer closer(&err)
+
+	parent := rawdb.ReadHeaderByNumber(tx, fromBlock)
+	if parent == nil {
+		return common.Hash{}, fmt.Errorf("no canonical block %d", fromBlock)
+	}
+	for i := uint64(0); i < numBlocks; i++ {
+		if err = ctx.Err(); err != nil {
+			return common.Hash{}, err
+		}
+		header := childHeader(parent)
+		header.Extra = forkExtra
+		td, err := totalDifficulty(tx, header)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if err = writeBlock(tx, schemaOf(db), types.NewBlockWithHeader(header), nil, td); err != nil {
+			return common.Hash{}, err
+		}
+		parent = header
+		reportProgress(ctx, i+1, numBlocks)
+	}
+	return parent.Hash(), nil
+}
+
+// Reorgs the canonical chain to end at the block newTipHash, in one
+// transaction: the canonical hashes from the common ancestor up are rewritten
+// to the new chain, canonical hashes above the new tip are removed, the tx
+// lookup entries of the blocks leaving the chain are deleted and those of the
+// blocks joining it are written, and the head header hash is moved to the new
+// tip. Every block of the new chain must be in the db with its header; the
+// state is not touched.
+//export SwitchCanonicalChain
+func SwitchCanonicalChain(dbPtr C.uintptr_t, newTipHash []byte) (exit int) {
+	defer timeOp("SwitchCanonicalChain", "newTipHash", hexutil.Bytes(newTipHash))()
+	db := getDbHandle(dbPtr)
+	return exitCode("SwitchCanonicalChain", switchCanonicalChain(context.Background(), db, db.currentSchema(), common.BytesToHash(newTipHash)))
+}
+
+func switchCanonicalChain(ctx context.Context, db kv.RwDB, schema schemaAdapter, newTip common.Hash) (err error) {
+	// moving the canonical chain rewrites its entries by design
+	tx, closer, err := beginCtx(withInsertOnly(ctx, false), db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	tipNum := rawdb.ReadHeaderNumber(tx, newTip)
+	if tipNum == nil {
+		return fmt.Errorf("unknown block %x", newTip)
+	}
+	oldHead := rawdb.ReadCurrentHeader(tx)
+	if oldHead == nil {
+		return errors.New("no head header")
+	}
+
+	// walk back from the new tip to the first block that is already canonical
+	var joining []*types.Header
+	for hash, num := newTip, *tipNum; ; {
+		canonical, err := rawdb.ReadCanonicalHash(tx, num)
+		if err != nil {
+			return err
+		}
+		if canonical == hash {
+			break
+		}
+		header := rawdb.ReadHeader(tx, hash, num)
+		if header == nil {
+			return fmt.Errorf("missing header %x at %d", hash, num)
+		}
+		joining = append(joining, header)
+		if num == 0 {
+			return errors.New("new chain has a different genesis")
+		}
+		hash, num = header.ParentHash, num-1
+	}
+	ancestor := *tipNum - uint64(len(joining))
+
+	// blocks leaving the canonical chain
+	for num := ancestor + 1; num <= oldHead.Number.Uint64(); num++ {
+		hash, err := rawdb.ReadCanonicalHash(tx, num)
+		if err != nil {
+			return err
+		}
+		block, err := schema.readBlock(tx, hash, num)
+		if err != nil {
+			return err
+		}
+		if block != nil {
+			for _, txn := range block.Transactions() {
+				if err := tx.Delete(kv.TxLookup, txn.Hash().Bytes(), nil); err != nil {
+					return fmt.Errorf("TxLookup: %w", err)
+				}
+			}
+		}
+		if num > *tipNum {
+			if err := tx.Delete(kv.HeaderCanonical, dbutils.EncodeBlockNumber(num), nil); err != nil {
+				return fmt.Errorf("HeaderCanonical: %w", err)
+			}
+		}
+	}
+
+	// blocks joining it, from the ancestor up
+	for i := len(joining) - 1; i >= 0; i-- {
+		header := joining[i]
+		block, err := schema.readBlock(tx, header.Hash(), header.Number.Uint64())
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			block = types.NewBlockWithHeader(header)
+		}
+		if err := makeCanonical(tx, schema, block); err != nil {
+			return err
+		}
+	}
+	return rawdb.WriteHeadHeaderHash(tx, newTip)
+}
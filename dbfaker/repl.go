@@ -0,0 +1,363 @@
+//go:build !slim
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Default number of entries printed by the seek command.
+const replSeekLimit = 10
+
+// A command of the interactive inspector. args are the whitespace separated
+// words after the command name.
+type replCommand struct {
+	usage string
+	run   func(r *repl, args []string) error
+}
+
+var replCommands map[string]replCommand
+
+func init() {
+	// assigned here since help refers back to replCommands
+	replCommands = map[string]replCommand{
+		"help": {
+			usage: "help",
+			run:   (*repl).help,
+		},
+		"tables": {
+			usage: "tables",
+			run:   (*repl).tables,
+		},
+		"get": {
+			usage: "get TABLE KEY",
+			run:   (*repl).get,
+		},
+		"seek": {
+			usage: "seek TABLE [KEY] [N]",
+			run:   (*repl).seek,
+		},
+		"decode": {
+			usage: "decode account|header|body VALUE",
+			run:   (*repl).decode,
+		},
+		"put": {
+			usage: "put TABLE KEY VALUE",
+			run:   (*repl).put,
+		},
+		"delete": {
+			usage: "delete TABLE KEY",
+			run:   (*repl).delete,
+		},
+		"call": {
+			usage: "call METHOD [PARAMS_JSON]",
+			run:   (*repl).call,
+		},
+	}
+}
+
+// An interactive session on an open db. Keys and values are read and
+// printed as hex.
+type repl struct {
+	db  *dbHandle
+	out io.Writer
+}
+
+// Reads commands from in until EOF or "quit", printing results to out.
+// Errors are printed and do not end the session.
+func runRepl(db *dbHandle, in io.Reader, out io.Writer) error {
+	r := &repl{db: db, out: out}
+	scanner := bufio.NewScanner(in)
+	// values such as bodies and bytecode easily exceed the default 64KiB
+	scanner.Buffer(nil, 16<<20)
+
+	for {
+		fmt.Fprint(out, "dbfaker> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "quit" || words[0] == "exit" {
+			return nil
+		}
+
+		cmd, ok := replCommands[words[0]]
+		if !ok {
+			fmt.Fprintf(out, "unknown command %q, try help\n", words[0])
+			continue
+		}
+		if err := cmd.run(r, words[1:]); errors.Is(err, errUsage) {
+			fmt.Fprintf(out, "usage: %s\n", cmd.usage)
+		} else if err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+		}
+	}
+}
+
+func (r *repl) help(args []string) error {
+	names := make([]string, 0, len(replCommands))
+	for name := range replCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(r.out, "  %s\n", replCommands[name].usage)
+	}
+	fmt.Fprintln(r.out, "  quit")
+	return nil
+}
+
+func (r *repl) tables(args []string) error {
+	return r.db.View(context.Background(), func(tx kv.Tx) error {
+		for _, table := range kv.ChaindataTables {
+			c, err := tx.Cursor(table)
+			if err != nil {
+				return err
+			}
+			n, err := c.Count()
+			c.Close()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				fmt.Fprintf(r.out, "%-32s %d\n", table, n)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *repl) get(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	table, key, err := tableKey(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return r.db.View(context.Background(), func(tx kv.Tx) error {
+		v, err := tx.GetOne(table, key)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			fmt.Fprintln(r.out, "not found")
+			return nil
+		}
+		r.printEntry(table, key, v)
+		return nil
+	})
+}
+
+func (r *repl) seek(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return errUsage
+	}
+	var seek []byte
+	if len(args) > 1 {
+		var err error
+		if seek, err = decodeHex(args[1]); err != nil {
+			return err
+		}
+	}
+	limit := uint64(replSeekLimit)
+	if len(args) > 2 {
+		var err error
+		if limit, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+			return err
+		}
+	}
+	table, _, err := tableKey(args[0], "")
+	if err != nil {
+		return err
+	}
+
+	return r.db.View(context.Background(), func(tx kv.Tx) error {
+		c, err := tx.Cursor(table)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		var n uint64
+		for k, v, err := c.Seek(seek); k != nil && n < limit; k, v, err = c.Next() {
+			if err != nil {
+				return err
+			}
+			r.printEntry(table, k, v)
+			n++
+		}
+		return nil
+	})
+}
+
+func (r *repl) decode(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	v, err := decodeHex(args[1])
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeValue(args[0], v)
+	if err != nil {
+		return err
+	}
+	return r.printJSON(decoded)
+}
+
+func (r *repl) put(args []string) (err error) {
+	if len(args) != 3 {
+		return errUsage
+	}
+	table, key, err := tableKey(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	v, err := decodeHex(args[2])
+	if err != nil {
+		return err
+	}
+
+	tx, closer, err := begin(r.db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+	return tx.Put(table, key, v)
+}
+
+func (r *repl) delete(args []string) (err error) {
+	if len(args) != 2 {
+		return errUsage
+	}
+	table, key, err := tableKey(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	tx, closer, err := begin(r.db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+	return tx.Delete(table, key, nil)
+}
+
+// Runs a Call method, so that the typed writers (PutAccount, PutHeader, ...)
+// are available without hand encoding values.
+func (r *repl) call(args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	params := strings.Join(args[1:], " ")
+	result, err := call(context.Background(), r.db, args[0], json.RawMessage(params))
+	if err != nil {
+		return err
+	}
+	return r.printJSON(result)
+}
+
+// Prints an entry, followed by its decoded value for tables whose format is
+// known.
+func (r *repl) printEntry(table string, k, v []byte) {
+	fmt.Fprintf(r.out, "%x %x\n", k, v)
+
+	var kind string
+	switch {
+	case table == kv.PlainState && len(k) == 20:
+		kind = "account"
+	case table == kv.Headers:
+		kind = "header"
+	case table == kv.BlockBody:
+		kind = "body"
+	default:
+		return
+	}
+	decoded, err := decodeValue(kind, v)
+	if err != nil {
+		fmt.Fprintf(r.out, "  (not a valid %s: %v)\n", kind, err)
+		return
+	}
+	r.printJSON(decoded)
+}
+
+func (r *repl) printJSON(v interface{}) error {
+	enc, err := json.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "  %s\n", enc)
+	return nil
+}
+
+// Decodes a value in one of the known db formats into something that prints
+// readably as JSON.
+func decodeValue(kind string, v []byte) (interface{}, error) {
+	switch kind {
+	case "account":
+		var acct accounts.Account
+		if err := acct.DecodeForStorage(v); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"nonce":       hexutil.Uint64(acct.Nonce),
+			"balance":     (*hexutil.Big)(acct.Balance.ToBig()),
+			"codeHash":    acct.CodeHash,
+			"incarnation": hexutil.Uint64(acct.Incarnation),
+		}, nil
+	case "header":
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(v, header); err != nil {
+			return nil, err
+		}
+		return header, nil
+	case "body":
+		body := new(types.BodyForStorage)
+		if err := rlp.DecodeBytes(v, body); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"baseTxId": hexutil.Uint64(body.BaseTxId),
+			"txAmount": hexutil.Uint64(body.TxAmount),
+			"uncles":   body.Uncles,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected account, header or body", kind)
+}
+
+func tableKey(table, key string) (string, []byte, error) {
+	if !isChaindataTable(table) {
+		return "", nil, fmt.Errorf("unknown table %q", table)
+	}
+	k, err := decodeHex(key)
+	return table, k, err
+}
+
+// Decodes hex with or without a 0x prefix.
+func decodeHex(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex %q: %w", s, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,266 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/vm"
+)
+
+// A stored transaction re-executed on top of the state before it.
+type replayed struct {
+	block  *types.Block
+	index  int
+	msg    types.Message
+	result *core.ExecutionResult
+}
+
+// Re-executes the transaction with hash txHash in its canonical block, with
+// tracer attached to it alone. The state is read as of the start of the
+// block, from the history tables where the block has history (see
+// SetHistory), and the transactions before it in the block are executed
+// first, the way a node replays a transaction for debug_traceTransaction.
+// Executing needs the chain config of the db.
+func replayTx(ctx context.Context, h *dbHandle, tx kv.Tx, txHash common.Hash, tracer vm.Tracer) (*replayed, error) {
+	num, found, err := h.blockReader().TxnLookup(ctx, tx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown transaction %x", txHash)
+	}
+	block, senders, err := readBlockWithSenders(ctx, h, tx, num)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("no canonical block %d for transaction %x", num, txHash)
+	}
+	index := -1
+	for i, txn := range block.Transactions() {
+		if txn.Hash() == txHash {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transaction %x is not in block %d", txHash, num)
+	}
+
+	var r *replayed
+	err = replayBlock(ctx, tx, block, senders, index, func(i int) vm.Config {
+		if i == index {
+			return vm.Config{Debug: tracer != nil, Tracer: tracer}
+		}
+		return vm.Config{}
+	}, func(i int, msg types.Message, result *core.ExecutionResult) error {
+		if i == index {
+			r = &replayed{block: block, index: i, msg: msg, result: result}
+		}
+		return nil
+	}, state.NewNoopWriter())
+	return r, err
+}
+
+// Executes the transactions of block up to and including the one at last
+// (all of them if last is negative) on the state as of the start of the
+// block, with the vm config vmConfig returns for each. done is called after
+// each transaction, before its changes are written to writer.
+func replayBlock(ctx context.Context, tx kv.Tx, block *types.Block, senders []common.Address, last int, vmConfig func(i int) vm.Config, done func(i int, msg types.Message, result *core.ExecutionResult) error, writer state.StateWriter) error {
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return errors.New("the db has no chain config to execute transactions with")
+	}
+
+	header := block.Header()
+	num := block.NumberU64()
+	getHeader := func(hash common.Hash, n uint64) *types.Header {
+		return rawdb.ReadHeader(tx, hash, n)
+	}
+	contractHasTEVM := func(common.Hash) (bool, error) { return false, nil }
+	blockCtx := core.NewEVMBlockContext(header, getHeader, nil, &header.Coinbase, contractHasTEVM)
+	signer := types.MakeSigner(config, num)
+	rules := config.Rules(num)
+	ibs := state.New(state.NewPlainState(tx, num))
+
+	for i, txn := range block.Transactions() {
+		if last >= 0 && i > last {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		txn.SetSender(senders[i])
+		msg, err := txn.AsMessage(*signer, header.BaseFee)
+		if err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+		ibs.Prepare(txn.Hash(), block.Hash(), i)
+		evm := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), ibs, config, vmConfig(i))
+		result, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(msg.Gas()), true, false)
+		if err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+		if err := done(i, msg, result); err != nil {
+			return err
+		}
+		if err := ibs.FinalizeTx(rules, writer); err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// One call frame of a call trace, in the format of geth's callTracer.
+type callFrame struct {
+	Type    string         `json:"type"`
+	From    common.Address `json:"from"`
+	To      common.Address `json:"to"`
+	Value   *hexutil.Big   `json:"value,omitempty"`
+	Gas     hexutil.Uint64 `json:"gas"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Input   hexutil.Bytes  `json:"input"`
+	Output  hexutil.Bytes  `json:"output,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Calls   []*callFrame   `json:"calls,omitempty"`
+}
+
+// Builds the tree of call frames of a transaction. Erigon reports the start
+// and end of every frame, at every depth, to the tracer.
+type callTracer struct {
+	stack []*callFrame
+	root  *callFrame
+}
+
+var callTypes = map[vm.CallType]string{
+	vm.CALLT:         "CALL",
+	vm.CALLCODET:     "CALLCODE",
+	vm.DELEGATECALLT: "DELEGATECALL",
+	vm.STATICCALLT:   "STATICCALL",
+	vm.CREATET:       "CREATE",
+	vm.CREATE2T:      "CREATE2",
+}
+
+func (t *callTracer) CaptureStart(env *vm.EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType vm.CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	frame := &callFrame{
+		Type:  callTypes[callType],
+		From:  from,
+		To:    to,
+		Gas:   hexutil.Uint64(gas),
+		Input: append(hexutil.Bytes(nil), input...),
+	}
+	if frame.Type == "" {
+		frame.Type = "CALL"
+	}
+	if value != nil && callType != vm.DELEGATECALLT && callType != vm.STATICCALLT {
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	t.stack = append(t.stack, frame)
+}
+
+func (t *callTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if len(t.stack) == 0 {
+		return
+	}
+	frame := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	frame.GasUsed = hexutil.Uint64(startGas - endGas)
+	frame.Output = append(hexutil.Bytes(nil), output...)
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	if len(t.stack) == 0 {
+		t.root = frame
+	} else {
+		parent := t.stack[len(t.stack)-1]
+		parent.Calls = append(parent.Calls, frame)
+	}
+}
+
+func (t *callTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+	if len(t.stack) == 0 {
+		return
+	}
+	parent := t.stack[len(t.stack)-1]
+	parent.Calls = append(parent.Calls, &callFrame{
+		Type:  "SELFDESTRUCT",
+		From:  from,
+		To:    to,
+		Value: (*hexutil.Big)(new(big.Int).Set(value)),
+	})
+}
+
+func (t *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+}
+
+func (t *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+func (t *callTracer) CaptureAccountRead(account common.Address) error  { return nil }
+func (t *callTracer) CaptureAccountWrite(account common.Address) error { return nil }
+
+// Re-executes the stored transaction with hash txHash (see SetHistory for the
+// state it runs on) and returns its call tree as JSON in the format of geth's
+// callTracer: nested {"type", "from", "to", "value", "gas", "gasUsed",
+// "input", "output", "error", "calls"} frames, with the top frame carrying
+// the gas limit and gas used of the whole transaction. The db needs a chain
+// config. The result must be released with FreeBytes.
+//export TraceCall
+func TraceCall(dbPtr C.uintptr_t, txHash []byte) (exit int, trace *C.char) {
+	defer timeOp("TraceCall", "txHash", hexutil.Bytes(txHash))()
+	frame, err := traceCall(context.Background(), getDbHandle(dbPtr), common.BytesToHash(txHash))
+	if err != nil {
+		return exitCode("TraceCall", err), nil
+	}
+	enc, err := json.Marshal(frame)
+	if err != nil {
+		return exitCode("TraceCall", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func traceCall(ctx context.Context, h *dbHandle, txHash common.Hash) (frame *callFrame, err error) {
+	err = h.View(ctx, func(tx kv.Tx) error {
+		frame, err = traceCallTx(ctx, h, tx, txHash)
+		return err
+	})
+	return frame, err
+}
+
+func traceCallTx(ctx context.Context, h *dbHandle, tx kv.Tx, txHash common.Hash) (*callFrame, error) {
+	tracer := &callTracer{}
+	r, err := replayTx(ctx, h, tx, txHash, tracer)
+	if err != nil {
+		return nil, err
+	}
+	if tracer.root == nil {
+		return nil, fmt.Errorf("transaction %x made no call", txHash)
+	}
+	frame := tracer.root
+	// the frame only sees the gas left after the intrinsic gas
+	frame.Gas, frame.GasUsed = hexutil.Uint64(r.msg.Gas()), hexutil.Uint64(r.result.UsedGas)
+	if r.result.Err != nil {
+		frame.Error = r.result.Err.Error()
+	}
+	return frame, nil
+}
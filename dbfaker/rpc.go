@@ -0,0 +1,534 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// Starts a minimal eth_* JSON-RPC server for the db on addr (e.g.
+// "127.0.0.1:8545"), answering straight from the Go readers. It serves
+// eth_chainId, eth_getBalance, eth_getStorageAt, eth_getCode,
+// eth_getBlockByNumber, eth_getTransactionByHash, eth_getLogs and
+// debug_traceTransaction, and is meant as a reference to test other readers
+// of the same db against. The server runs
+// until StopRPC is called or the db is closed.
+//export ServeRPC
+func ServeRPC(dbPtr C.uintptr_t, addr string) (exit int) {
+	defer timeOp("ServeRPC", "addr", addr)()
+	return exitCode("ServeRPC", getDbHandle(dbPtr).serveRPC(addr))
+}
+
+func (h *dbHandle) serveRPC(addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rpcServer != nil {
+		return errors.New("already serving rpc")
+	}
+	if h.testTx != nil {
+		return errTestTx
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: &rpcHandler{db: h}}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			libLog.Error("rpc server stopped", "addr", addr, "err", err)
+		}
+	}()
+
+	h.rpcServer = srv
+	return nil
+}
+
+// Stops the JSON-RPC server started with ServeRPC, waiting for in-flight
+// requests to finish.
+//export StopRPC
+func StopRPC(dbPtr C.uintptr_t) {
+	getDbHandle(dbPtr).stopRPCServer()
+}
+
+func (h *dbHandle) stopRPCServer() {
+	h.mu.Lock()
+	srv := h.rpcServer
+	h.rpcServer = nil
+	h.mu.Unlock()
+	// not under mu, in-flight requests may need it
+	if srv != nil {
+		srv.Shutdown(context.Background())
+	}
+}
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func invalidParams(format string, args ...interface{}) error {
+	return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handles one eth_* method inside a read transaction on the db.
+type rpcMethod func(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"eth_chainId":              rpcChainID,
+	"eth_getBalance":           rpcGetBalance,
+	"eth_getStorageAt":         rpcGetStorageAt,
+	"eth_getCode":              rpcGetCode,
+	"eth_getBlockByNumber":     rpcGetBlockByNumber,
+	"eth_getTransactionByHash": rpcGetTransactionByHash,
+	"eth_getLogs":              rpcGetLogs,
+	"debug_traceTransaction":   rpcTraceTransaction,
+}
+
+type rpcHandler struct {
+	db *dbHandle
+}
+
+func (s *rpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeRPC(w, newRPCResponse(nil, &rpcError{Code: rpcParseError, Message: err.Error()}))
+		return
+	}
+
+	// batches are arrays of requests answered with an array of responses
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var reqs []json.RawMessage
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			writeRPC(w, newRPCResponse(nil, &rpcError{Code: rpcParseError, Message: err.Error()}))
+			return
+		}
+		resps := make([]rpcResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = s.handle(r.Context(), req)
+		}
+		writeRPC(w, resps)
+		return
+	}
+	writeRPC(w, s.handle(r.Context(), body))
+}
+
+func (s *rpcHandler) handle(ctx context.Context, raw json.RawMessage) rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return newRPCResponse(nil, &rpcError{Code: rpcInvalidRequest, Message: err.Error()})
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		msg := fmt.Sprintf("the method %s does not exist/is not available", req.Method)
+		return newRPCResponse(req.ID, &rpcError{Code: rpcMethodNotFound, Message: msg})
+	}
+
+	var result interface{}
+	err := s.db.View(ctx, func(tx kv.Tx) (err error) {
+		result, err = method(ctx, s.db, tx, req.Params)
+		return err
+	})
+	var enc json.RawMessage
+	if err == nil {
+		enc, err = json.Marshal(result)
+	}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcServerError, Message: err.Error()}
+		}
+		return newRPCResponse(req.ID, rpcErr)
+	}
+	resp := newRPCResponse(req.ID, nil)
+	resp.Result = enc
+	return resp
+}
+
+func newRPCResponse(id json.RawMessage, err *rpcError) rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{Version: "2.0", ID: id, Error: err}
+}
+
+func writeRPC(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		libLog.Error("rpc write", "err", err)
+	}
+}
+
+// Decodes the i-th positional param into v. Missing optional params leave v
+// untouched.
+func rpcParam(params []json.RawMessage, i int, v interface{}, optional bool) error {
+	if i >= len(params) || string(params[i]) == "null" {
+		if optional {
+			return nil
+		}
+		return invalidParams("missing value for required argument %d", i)
+	}
+	if err := json.Unmarshal(params[i], v); err != nil {
+		return invalidParams("invalid argument %d: %v", i, err)
+	}
+	return nil
+}
+
+// Resolves a block number param ("latest", "pending", "earliest" or a hex
+// number) to a height. A missing param means latest.
+func rpcBlockNumber(tx kv.Tx, params []json.RawMessage, i int) (uint64, error) {
+	tag := "latest"
+	if err := rpcParam(params, i, &tag, true); err != nil {
+		return 0, err
+	}
+	return resolveBlockTag(tx, tag)
+}
+
+// Resolves a block tag ("latest", "pending", "earliest" or a hex number) to a
+// height.
+func resolveBlockTag(tx kv.Tx, tag string) (uint64, error) {
+	switch tag {
+	case "latest", "pending":
+		head := rawdb.ReadCurrentHeader(tx)
+		if head == nil {
+			return 0, errors.New("no head header")
+		}
+		return head.Number.Uint64(), nil
+	case "earliest":
+		return 0, nil
+	}
+	num, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return 0, invalidParams("invalid block number %q: %v", tag, err)
+	}
+	return num, nil
+}
+
+// Reads the state as of the end of the block selected by the i-th param.
+func rpcState(tx kv.Tx, params []json.RawMessage, i int) (*state.PlainState, error) {
+	num, err := rpcBlockNumber(tx, params, i)
+	if err != nil {
+		return nil, err
+	}
+	return stateAt(tx, num), nil
+}
+
+func rpcChainID(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	chainID, err := readChainIDTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(chainID.ToBig()), nil
+}
+
+func rpcGetBalance(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var address common.Address
+	if err := rpcParam(params, 0, &address, false); err != nil {
+		return nil, err
+	}
+	st, err := rpcState(tx, params, 1)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := st.ReadAccountData(address)
+	if err != nil || acct == nil {
+		return (*hexutil.Big)(new(big.Int)), err
+	}
+	return (*hexutil.Big)(acct.Balance.ToBig()), nil
+}
+
+func rpcGetStorageAt(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var address common.Address
+	if err := rpcParam(params, 0, &address, false); err != nil {
+		return nil, err
+	}
+	var slot string
+	if err := rpcParam(params, 1, &slot, false); err != nil {
+		return nil, err
+	}
+	key, err := decodeSlot(slot)
+	if err != nil {
+		return nil, err
+	}
+	st, err := rpcState(tx, params, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := readStorage(st, address, key)
+	if err != nil {
+		return nil, err
+	}
+	return common.BytesToHash(enc), nil
+}
+
+// Decodes a storage slot given as hex of any length up to 32 bytes, with or
+// without leading zeros.
+func decodeSlot(slot string) (common.Hash, error) {
+	s := strings.TrimPrefix(slot, "0x")
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) > common.HashLength {
+		return common.Hash{}, invalidParams("invalid storage slot %q", slot)
+	}
+	return common.BytesToHash(b), nil
+}
+
+func rpcGetCode(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var address common.Address
+	if err := rpcParam(params, 0, &address, false); err != nil {
+		return nil, err
+	}
+	st, err := rpcState(tx, params, 1)
+	if err != nil {
+		return nil, err
+	}
+	acct, err := st.ReadAccountData(address)
+	if err != nil || acct == nil {
+		return hexutil.Bytes{}, err
+	}
+	code, err := st.ReadAccountCode(address, acct.Incarnation, acct.CodeHash)
+	return hexutil.Bytes(code), err
+}
+
+func rpcGetBlockByNumber(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	num, err := rpcBlockNumber(tx, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	var fullTx bool
+	if err := rpcParam(params, 1, &fullTx, true); err != nil {
+		return nil, err
+	}
+
+	block, senders, err := readBlockWithSenders(ctx, h, tx, num)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	td, err := rawdb.ReadTd(tx, block.Hash(), num)
+	if err != nil {
+		return nil, err
+	}
+	return marshalRPCBlock(block, senders, td, fullTx), nil
+}
+
+func rpcGetTransactionByHash(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var hash common.Hash
+	if err := rpcParam(params, 0, &hash, false); err != nil {
+		return nil, err
+	}
+
+	num, found, err := h.blockReader().TxnLookup(ctx, tx, hash)
+	if err != nil || !found {
+		return nil, err
+	}
+	block, senders, err := readBlockWithSenders(ctx, h, tx, num)
+	if err != nil || block == nil {
+		return nil, err
+	}
+	for i, txn := range block.Transactions() {
+		if txn.Hash() == hash {
+			return marshalRPCTransaction(block, txn, senders[i], i), nil
+		}
+	}
+	return nil, nil
+}
+
+// Reads the canonical block at num with the sender of every transaction,
+// recovering senders that were not stored.
+func readBlockWithSenders(ctx context.Context, h *dbHandle, tx kv.Tx, num uint64) (*types.Block, []common.Address, error) {
+	br := h.blockReader()
+	header, err := br.HeaderByNumber(ctx, tx, num)
+	if err != nil || header == nil {
+		return nil, nil, err
+	}
+	block, senders, err := br.BlockWithSenders(ctx, tx, header.Hash(), num)
+	if err != nil || block == nil {
+		return nil, nil, err
+	}
+	if len(senders) == len(block.Transactions()) {
+		return block, senders, nil
+	}
+
+	genesis, err := rawdb.ReadCanonicalHash(tx, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := rawdb.ReadChainConfig(tx, genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config == nil {
+		return nil, nil, fmt.Errorf("block %d has no senders and there is no chain config to recover them", num)
+	}
+	signer := types.MakeSigner(config, num)
+	senders = make([]common.Address, len(block.Transactions()))
+	for i, txn := range block.Transactions() {
+		if senders[i], err = txn.Sender(*signer); err != nil {
+			return nil, nil, fmt.Errorf("recovering sender of tx %d: %w", i, err)
+		}
+	}
+	return block, senders, nil
+}
+
+func marshalRPCBlock(block *types.Block, senders []common.Address, td *big.Int, fullTx bool) map[string]interface{} {
+	head := block.Header()
+	fields := map[string]interface{}{
+		"number":           (*hexutil.Big)(head.Number),
+		"hash":             block.Hash(),
+		"parentHash":       head.ParentHash,
+		"nonce":            head.Nonce,
+		"mixHash":          head.MixDigest,
+		"sha3Uncles":       head.UncleHash,
+		"logsBloom":        head.Bloom,
+		"stateRoot":        head.Root,
+		"miner":            head.Coinbase,
+		"difficulty":       (*hexutil.Big)(head.Difficulty),
+		"extraData":        hexutil.Bytes(head.Extra),
+		"size":             hexutil.Uint64(block.Size()),
+		"gasLimit":         hexutil.Uint64(head.GasLimit),
+		"gasUsed":          hexutil.Uint64(head.GasUsed),
+		"timestamp":        hexutil.Uint64(head.Time),
+		"transactionsRoot": head.TxHash,
+		"receiptsRoot":     head.ReceiptHash,
+	}
+	if head.BaseFee != nil {
+		fields["baseFeePerGas"] = (*hexutil.Big)(head.BaseFee)
+	}
+	if td != nil {
+		fields["totalDifficulty"] = (*hexutil.Big)(td)
+	}
+
+	txs := make([]interface{}, len(block.Transactions()))
+	for i, txn := range block.Transactions() {
+		if fullTx {
+			txs[i] = marshalRPCTransaction(block, txn, senders[i], i)
+		} else {
+			txs[i] = txn.Hash()
+		}
+	}
+	fields["transactions"] = txs
+
+	uncles := make([]common.Hash, len(block.Uncles()))
+	for i, uncle := range block.Uncles() {
+		uncles[i] = uncle.Hash()
+	}
+	fields["uncles"] = uncles
+	return fields
+}
+
+type rpcTransaction struct {
+	BlockHash            common.Hash     `json:"blockHash"`
+	BlockNumber          *hexutil.Big    `json:"blockNumber"`
+	From                 common.Address  `json:"from"`
+	Gas                  hexutil.Uint64  `json:"gas"`
+	GasPrice             *hexutil.Big    `json:"gasPrice"`
+	MaxFeePerGas         *hexutil.Big    `json:"maxFeePerGas,omitempty"`
+	MaxPriorityFeePerGas *hexutil.Big    `json:"maxPriorityFeePerGas,omitempty"`
+	Hash                 common.Hash     `json:"hash"`
+	Input                hexutil.Bytes   `json:"input"`
+	Nonce                hexutil.Uint64  `json:"nonce"`
+	To                   *common.Address `json:"to"`
+	TransactionIndex     hexutil.Uint64  `json:"transactionIndex"`
+	Value                *hexutil.Big    `json:"value"`
+	Type                 hexutil.Uint64  `json:"type"`
+	ChainID              *hexutil.Big    `json:"chainId,omitempty"`
+	V                    *hexutil.Big    `json:"v"`
+	R                    *hexutil.Big    `json:"r"`
+	S                    *hexutil.Big    `json:"s"`
+}
+
+func marshalRPCTransaction(block *types.Block, txn types.Transaction, sender common.Address, index int) *rpcTransaction {
+	v, r, s := txn.RawSignatureValues()
+	result := &rpcTransaction{
+		BlockHash:        block.Hash(),
+		BlockNumber:      (*hexutil.Big)(block.Number()),
+		From:             sender,
+		Gas:              hexutil.Uint64(txn.GetGas()),
+		GasPrice:         (*hexutil.Big)(txn.GetPrice().ToBig()),
+		Hash:             txn.Hash(),
+		Input:            hexutil.Bytes(txn.GetData()),
+		Nonce:            hexutil.Uint64(txn.GetNonce()),
+		To:               txn.GetTo(),
+		TransactionIndex: hexutil.Uint64(index),
+		Value:            (*hexutil.Big)(txn.GetValue().ToBig()),
+		Type:             hexutil.Uint64(txn.Type()),
+		V:                (*hexutil.Big)(v.ToBig()),
+		R:                (*hexutil.Big)(r.ToBig()),
+		S:                (*hexutil.Big)(s.ToBig()),
+	}
+	if chainID := txn.GetChainID(); chainID != nil && !chainID.IsZero() {
+		result.ChainID = (*hexutil.Big)(chainID.ToBig())
+	}
+
+	if txn.Type() == types.DynamicFeeTxType {
+		tip, feeCap := txn.GetTip(), txn.GetFeeCap()
+		result.MaxFeePerGas = (*hexutil.Big)(feeCap.ToBig())
+		result.MaxPriorityFeePerGas = (*hexutil.Big)(tip.ToBig())
+		// the price paid is the base fee plus the tip, capped at the fee cap
+		if baseFee := block.BaseFee(); baseFee != nil {
+			price, _ := uint256.FromBig(baseFee)
+			price.Add(price, tip)
+			if price.Gt(feeCap) {
+				price = feeCap
+			}
+			result.GasPrice = (*hexutil.Big)(price.ToBig())
+		}
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// Writes a header given as the JSON object eth_getBlockByNumber returns, as
+// PutHeader does with an RLP encoded one, so that fixtures can be built from
+// RPC responses as they are. Fields of the block that are not part of the
+// header, such as "transactions" and "totalDifficulty", are ignored. If the
+// object has a "hash", the header must hash to it, which catches fields the
+// pinned Erigon does not know, such as those of forks after London.
+//export PutHeaderJSON
+func PutHeaderJSON(dbPtr C.uintptr_t, headerJson string) (exit int) {
+	defer timeOp("PutHeaderJSON", "size", len(headerJson))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutHeaderJSON", putHeaderJSON(context.Background(), db, []byte(headerJson)))
+}
+
+func putHeaderJSON(ctx context.Context, db kv.RwDB, headerJson []byte) (err error) {
+	header, err := decodeRPCHeader(headerJson)
+	if err != nil {
+		return err
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	// WriteHeader just log.Crits any errors
+	rawdb.WriteHeader(tx, header)
+	return nil
+}
+
+// Writes transactions given as the JSON objects eth_getTransactionByHash
+// returns, as PutTransactions does with RLP encoded ones: txsJson is one
+// object or an array of them, written from tx id baseTxId+1 on. Legacy,
+// access list (with "accessList") and dynamic fee transactions (with
+// "maxFeePerGas" and "maxPriorityFeePerGas") are rebuilt with their signature
+// from "v", "r" and "s", and each must hash to its "hash" if it has one, so a
+// transaction that does not survive the conversion is not written. Block
+// fields such as "blockHash" and "from" are ignored.
+//export PutTransactionJSON
+func PutTransactionJSON(dbPtr C.uintptr_t, txsJson string, baseTxId uint64) (exit int) {
+	defer timeOp("PutTransactionJSON", "size", len(txsJson), "baseTxId", baseTxId)()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutTransactionJSON", retryMapFull(db, "PutTransactionJSON", func() error {
+		return putTransactionJSON(context.Background(), db, []byte(txsJson), baseTxId)
+	}))
+}
+
+func putTransactionJSON(ctx context.Context, db kv.RwDB, txsJson []byte, baseTxId uint64) error {
+	objects := []json.RawMessage{txsJson}
+	if bytes.HasPrefix(bytes.TrimSpace(txsJson), []byte("[")) {
+		if err := json.Unmarshal(txsJson, &objects); err != nil {
+			return fmt.Errorf("invalid transactions: %w", err)
+		}
+	}
+	txs := make([]types.Transaction, len(objects))
+	for i, obj := range objects {
+		txn, err := decodeRPCTransaction(obj)
+		if err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+		txs[i] = txn
+	}
+	return writeTransactions(ctx, db, txs, baseTxId)
+}
+
+func decodeRPCTransaction(enc []byte) (types.Transaction, error) {
+	txn, err := types.UnmarshalTransactionFromJSON(enc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	var named rpcHash
+	if err := json.Unmarshal(enc, &named); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	}
+	if named.Hash != nil && txn.Hash() != *named.Hash {
+		return nil, fmt.Errorf("transaction hashes to %x, not to its hash %x", txn.Hash(), *named.Hash)
+	}
+	return txn, nil
+}
+
+// Writes the receipts of the canonical block num given as the JSON array of
+// the objects eth_getTransactionReceipt returns for its transactions, in
+// order, as PutReceipts does with consensus encoded ones. The logs are
+// written with the "logIndex" they carry, which must number them from 0
+// across the block, and the "blockNumber" and "transactionIndex" of the
+// receipts, where given, must match num and their position.
+//export PutReceiptsJSON
+func PutReceiptsJSON(dbPtr C.uintptr_t, num uint64, receiptsJson string) (exit int) {
+	defer timeOp("PutReceiptsJSON", "num", num, "size", len(receiptsJson))()
+	db := getDbHandle(dbPtr)
+	return exitCode("PutReceiptsJSON", retryMapFull(db, "PutReceiptsJSON", func() error {
+		return putReceiptsJSON(context.Background(), db, num, []byte(receiptsJson))
+	}))
+}
+
+func putReceiptsJSON(ctx context.Context, db *dbHandle, num uint64, receiptsJson []byte) (err error) {
+	receipts, err := decodeRPCReceipts(num, receiptsJson)
+	if err != nil {
+		return err
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeBlockReceipts(tx, db.currentSchema(), num, receipts, false)
+}
+
+func decodeRPCReceipts(num uint64, enc []byte) (types.Receipts, error) {
+	var receipts types.Receipts
+	if err := json.Unmarshal(enc, &receipts); err != nil {
+		return nil, fmt.Errorf("invalid receipts: %w", err)
+	}
+	for i, r := range receipts {
+		if r.BlockNumber != nil && r.BlockNumber.Sign() != 0 && r.BlockNumber.Uint64() != num {
+			return nil, fmt.Errorf("receipt %d is of block %v, not %d", i, r.BlockNumber, num)
+		}
+		if r.TransactionIndex != 0 && r.TransactionIndex != uint(i) {
+			return nil, fmt.Errorf("receipt %d has transaction index %d", i, r.TransactionIndex)
+		}
+	}
+	return receipts, nil
+}
+
+// The hash an RPC response gives for the object it describes.
+type rpcHash struct {
+	Hash *common.Hash `json:"hash"`
+}
+
+func decodeRPCHeader(enc []byte) (*types.Header, error) {
+	header := new(types.Header)
+	if err := json.Unmarshal(enc, header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	var named rpcHash
+	if err := json.Unmarshal(enc, &named); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if named.Hash != nil && header.Hash() != *named.Hash {
+		return nil, fmt.Errorf("header %v hashes to %x, not to its hash %x", header.Number, header.Hash(), *named.Hash)
+	}
+	return header, nil
+}
@@ -0,0 +1,215 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/erigon-lib/gointerfaces/types"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	ctypes "github.com/ledgerwatch/erigon/core/types"
+)
+
+// Encodes the tables whose format differs between Erigon releases. Writers
+// go through the adapter of the db they write to instead of hardcoding the
+// format of the compiled Erigon version.
+type schemaAdapter interface {
+	// Version of the schema this adapter reads and writes.
+	version() *types.VersionReply
+	// Value stored in TxLookup for a tx included in block num.
+	txLookupValue(num uint64) []byte
+	// Decodes a TxLookup value back into a block number.
+	txLookupBlock(v []byte) uint64
+	// Writes the receipts (and their logs) of block num.
+	writeReceipts(tx kv.RwTx, num uint64, receipts ctypes.Receipts) error
+	// Reads the receipts of block num without deriving their fields.
+	readReceipts(tx kv.Tx, num uint64) (ctypes.Receipts, error)
+	// Id in EthTx of the first transaction of a block whose body has
+	// BaseTxId baseTxId.
+	firstTxId(baseTxId uint64) uint64
+	// Writes the body of block num, allocating the ids of its transactions
+	// from the EthTx sequence.
+	writeBody(tx kv.RwTx, hash common.Hash, num uint64, body *ctypes.Body) error
+	// Reads block num with its transactions, nil if its header or body is
+	// missing.
+	readBlock(tx kv.Tx, hash common.Hash, num uint64) (*ctypes.Block, error)
+}
+
+// Adapters keyed by the major version of the schema they handle. Schema
+// versions only change format on major bumps.
+var schemaAdapters = map[uint32]schemaAdapter{
+	kv.DBSchemaVersion.Major: erigonSchema{},
+	5:                        schemaV5{},
+}
+
+// The schema of the compiled Erigon version.
+type erigonSchema struct{}
+
+func (erigonSchema) version() *types.VersionReply {
+	v := &kv.DBSchemaVersion
+	return &types.VersionReply{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+}
+
+// TxLookup values are the block number as a big-endian big.Int.
+func (erigonSchema) txLookupValue(num uint64) []byte {
+	return new(big.Int).SetUint64(num).Bytes()
+}
+
+func (erigonSchema) txLookupBlock(v []byte) uint64 {
+	return new(big.Int).SetBytes(v).Uint64()
+}
+
+func (erigonSchema) writeReceipts(tx kv.RwTx, num uint64, receipts ctypes.Receipts) error {
+	return rawdb.AppendReceipts(tx, num, receipts)
+}
+
+func (erigonSchema) readReceipts(tx kv.Tx, num uint64) (ctypes.Receipts, error) {
+	return rawdb.ReadRawReceipts(tx, num), nil
+}
+
+// Bodies reserve a system tx before and after their transactions.
+func (erigonSchema) firstTxId(baseTxId uint64) uint64 {
+	return baseTxId + 1
+}
+
+func (erigonSchema) writeBody(tx kv.RwTx, hash common.Hash, num uint64, body *ctypes.Body) error {
+	return rawdb.WriteBody(tx, hash, num, body)
+}
+
+func (erigonSchema) readBlock(tx kv.Tx, hash common.Hash, num uint64) (*ctypes.Block, error) {
+	return rawdb.ReadBlock(tx, hash, num), nil
+}
+
+// Schema 5, from before Erigon reserved system tx slots around the
+// transactions of each block (the txsBeginEnd migration to 6.0): a body's
+// BaseTxId is the id of its first transaction and TxAmount their number.
+// TxLookup and receipts are encoded as in the compiled schema.
+type schemaV5 struct {
+	erigonSchema
+}
+
+func (schemaV5) version() *types.VersionReply {
+	return &types.VersionReply{Major: 5}
+}
+
+func (schemaV5) firstTxId(baseTxId uint64) uint64 {
+	return baseTxId
+}
+
+func (schemaV5) writeBody(tx kv.RwTx, hash common.Hash, num uint64, body *ctypes.Body) error {
+	baseTxId, err := tx.IncrementSequence(kv.EthTx, uint64(len(body.Transactions)))
+	if err != nil {
+		return err
+	}
+	stored := &ctypes.BodyForStorage{
+		BaseTxId: baseTxId,
+		TxAmount: uint32(len(body.Transactions)),
+		Uncles:   body.Uncles,
+	}
+	if err = rawdb.WriteBodyForStorage(tx, hash, num, stored); err != nil {
+		return fmt.Errorf("failed to write body: %w", err)
+	}
+	return rawdb.WriteTransactions(tx, body.Transactions, baseTxId)
+}
+
+func (schemaV5) readBlock(tx kv.Tx, hash common.Hash, num uint64) (*ctypes.Block, error) {
+	header := rawdb.ReadHeader(tx, hash, num)
+	if header == nil {
+		return nil, nil
+	}
+	stored, err := readBodyForStorage(tx, hash, num)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	txs, err := rawdb.CanonicalTransactions(tx, stored.BaseTxId, stored.TxAmount)
+	if err != nil {
+		return nil, fmt.Errorf("block %d transactions: %w", num, err)
+	}
+	return ctypes.NewBlockFromStorage(hash, header, txs, stored.Uncles), nil
+}
+
+// Picks the adapter for the schema version stamped into the db. Dbs that were
+// never stamped (e.g. fresh ones) use the schema of the compiled Erigon
+// version. Dbs stamped with a version there is no adapter for still open,
+// with a warning, so that they can be read and migrated, but every write to
+// them fails (see unsupportedSchema).
+func detectSchema(db kv.RoDB) (schemaAdapter, error) {
+	compiled := schemaAdapters[kv.DBSchemaVersion.Major]
+	var adapter schemaAdapter
+	err := db.View(context.Background(), func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.DatabaseInfo, kv.DBSchemaVersionKey)
+		if err != nil {
+			return err
+		}
+		if len(v) == 0 {
+			adapter = compiled
+			return nil
+		}
+		if len(v) != 12 {
+			libLog.Warn("malformed db schema version, using the compiled schema", "version", fmt.Sprintf("%x", v))
+			adapter = compiled
+			return nil
+		}
+
+		stamped := &types.VersionReply{
+			Major: binary.BigEndian.Uint32(v),
+			Minor: binary.BigEndian.Uint32(v[4:]),
+			Patch: binary.BigEndian.Uint32(v[8:]),
+		}
+		a, ok := schemaAdapters[stamped.Major]
+		if !ok {
+			libLog.Warn("unsupported db schema version, writes will fail",
+				"version", fmt.Sprintf("%d.%d.%d", stamped.Major, stamped.Minor, stamped.Patch))
+			a = unsupportedSchema{schemaAdapter: compiled, stamped: stamped}
+		}
+		adapter = a
+		return nil
+	})
+	return adapter, err
+}
+
+// Stands in for the adapter of a schema version dbfaker cannot encode. It
+// reports the version the db is stamped with, and beginCtx refuses to write
+// through it; the compiled encodings it embeds are only used to read.
+type unsupportedSchema struct {
+	schemaAdapter
+	stamped *types.VersionReply
+}
+
+func (s unsupportedSchema) version() *types.VersionReply {
+	return s.stamped
+}
+
+// Returns the error writes to a db of schema fail with, nil if dbfaker can
+// write the schema.
+func checkWritableSchema(schema schemaAdapter) error {
+	u, ok := schema.(unsupportedSchema)
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("db has schema version %d.%d.%d, which dbfaker cannot write", u.stamped.Major, u.stamped.Minor, u.stamped.Patch)
+}
+
+// Returns the encodings for the schema of db, which are those of the compiled
+// Erigon version unless db is a handle.
+func schemaOf(db kv.RwDB) schemaAdapter {
+	if h, ok := db.(*dbHandle); ok {
+		return h.currentSchema()
+	}
+	return schemaAdapters[kv.DBSchemaVersion.Major]
+}
+
+// Stamps v into the db as its schema version, in the format Erigon writes and
+// detectSchema reads.
+func writeSchemaVersion(tx kv.RwTx, v *types.VersionReply) error {
+	var enc [12]byte
+	binary.BigEndian.PutUint32(enc[:], v.Major)
+	binary.BigEndian.PutUint32(enc[4:], v.Minor)
+	binary.BigEndian.PutUint32(enc[8:], v.Patch)
+	return tx.Put(kv.DatabaseInfo, kv.DBSchemaVersionKey, enc[:])
+}
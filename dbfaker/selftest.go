@@ -0,0 +1,440 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// A round trip of SelfTest that read back something other than it wrote.
+type selfTestFailure struct {
+	Check string `json:"check"`
+	Error string `json:"error"`
+}
+
+// Writes a fixed fixture through every Put* path, reads it back through the
+// Get* paths and returns the round trips that did not match as a JSON array
+// of {"check", "error"} objects, empty if all did. It runs inside a test
+// transaction that is rolled back at the end, so the db is left as it was.
+// Run it after bumping the Erigon version to catch encodings that changed
+// under the writers. The result must be released with FreeBytes.
+//export SelfTest
+func SelfTest(dbPtr C.uintptr_t) (exit int, report *C.char) {
+	defer timeOp("SelfTest")()
+	failures, err := getDbHandle(dbPtr).selfTest(context.Background())
+	if err != nil {
+		return exitCode("SelfTest", err), nil
+	}
+	enc, err := json.Marshal(failures)
+	if err != nil {
+		return exitCode("SelfTest", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+// The round trips of SelfTest, run in order. Each writes its part of the
+// fixture and returns an error if reading it back disagrees.
+var selfTestChecks = []struct {
+	name string
+	run  func(ctx context.Context, h *dbHandle) error
+}{
+	{"PutAccount", selfTestPutAccount},
+	{"PutAccountFields", selfTestPutAccountFields},
+	{"SetCode", selfTestSetCode},
+	{"PutStorage", selfTestPutStorage},
+	{"SetStorageAt", selfTestSetStorageAt},
+	{"PutHeader", selfTestPutHeader},
+	{"PutBodyWithTransactions", selfTestPutBody},
+	{"PutTxLookupEntries", selfTestPutTxLookup},
+	{"PutReceipts", selfTestPutReceipts},
+}
+
+// Height of the fixture block, far above any real chain so that it does not
+// collide with blocks already in the db, but within the 32-bit block numbers
+// of the log indices.
+const selfTestBlock = 0xffff0000
+
+// Key the fixture transaction is signed with.
+const selfTestKey = "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+
+var (
+	selfTestAddress  = common.HexToAddress("0x5e1f7e5700000000000000000000000000000001")
+	selfTestContract = common.HexToAddress("0x5e1f7e5700000000000000000000000000000002")
+)
+
+func (h *dbHandle) selfTest(ctx context.Context) (failures []selfTestFailure, err error) {
+	// the checks write the same entries over and over
+	ctx = withInsertOnly(ctx, false)
+	// the test transaction belongs to the thread that begins it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err = h.beginTestTx(); err != nil {
+		return nil, err
+	}
+	defer h.rollbackTestTx()
+
+	failures = []selfTestFailure{}
+	for _, c := range selfTestChecks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := c.run(ctx, h); err != nil {
+			failures = append(failures, selfTestFailure{c.name, err.Error()})
+		}
+	}
+	return failures, nil
+}
+
+func selfTestMismatch(what string, wrote, read interface{}) error {
+	return fmt.Errorf("wrote %s %v, read back %v", what, wrote, read)
+}
+
+// Reads back the latest state of the account at address through
+// GetAccountAt.
+func selfTestReadAccount(h *dbHandle, address common.Address) (*accounts.Account, error) {
+	enc, err := h.accountAt(address, selfTestBlock)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return nil, errors.New("account not found")
+	}
+	var acct accounts.Account
+	if err := acct.DecodeForStorage(enc); err != nil {
+		return nil, fmt.Errorf("DecodeForStorage: %w", err)
+	}
+	return &acct, nil
+}
+
+func selfTestCompareAccount(wrote, read *accounts.Account) error {
+	switch {
+	case wrote.Nonce != read.Nonce:
+		return selfTestMismatch("nonce", wrote.Nonce, read.Nonce)
+	case !wrote.Balance.Eq(&read.Balance):
+		return selfTestMismatch("balance", wrote.Balance.ToBig(), read.Balance.ToBig())
+	case wrote.Incarnation != read.Incarnation:
+		return selfTestMismatch("incarnation", wrote.Incarnation, read.Incarnation)
+	case wrote.CodeHash != read.CodeHash:
+		return selfTestMismatch("code hash", wrote.CodeHash.Hex(), read.CodeHash.Hex())
+	}
+	return nil
+}
+
+func selfTestPutAccount(ctx context.Context, h *dbHandle) error {
+	acct := accounts.NewAccount()
+	acct.Nonce = 7
+	acct.Balance.SetUint64(1e18)
+	acct.CodeHash = crypto.Keccak256Hash([]byte{0x60, 0x00})
+	enc := make([]byte, acct.EncodingLengthForHashing())
+	acct.EncodeForHashing(enc)
+
+	if err := putAccount(ctx, h, selfTestAddress.Bytes(), enc, 3, true); err != nil {
+		return err
+	}
+	acct.Incarnation = 3
+	read, err := selfTestReadAccount(h, selfTestAddress)
+	if err != nil {
+		return err
+	}
+	return selfTestCompareAccount(&acct, read)
+}
+
+func selfTestPutAccountFields(ctx context.Context, h *dbHandle) error {
+	acct, err := newAccount(1, []byte{0x12, 0x34}, nil, 0)
+	if err != nil {
+		return err
+	}
+	if err = putAccountFields(ctx, h, selfTestAddress.Bytes(), acct); err != nil {
+		return err
+	}
+	read, err := selfTestReadAccount(h, selfTestAddress)
+	if err != nil {
+		return err
+	}
+	return selfTestCompareAccount(acct, read)
+}
+
+func selfTestSetCode(ctx context.Context, h *dbHandle) error {
+	code := []byte{0x60, 0x2a, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3}
+	if err := setCode(h, selfTestContract.Bytes(), code); err != nil {
+		return err
+	}
+	acct, err := selfTestReadAccount(h, selfTestContract)
+	if err != nil {
+		return err
+	}
+	if want := crypto.Keccak256Hash(code); acct.CodeHash != want {
+		return selfTestMismatch("code hash", want.Hex(), acct.CodeHash.Hex())
+	}
+	var read []byte
+	err = h.View(ctx, func(tx kv.Tx) (err error) {
+		read, err = state.NewPlainStateReader(tx).ReadAccountCode(selfTestContract, acct.Incarnation, acct.CodeHash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, code) {
+		return selfTestMismatch("code", common.Bytes2Hex(code), common.Bytes2Hex(read))
+	}
+	return nil
+}
+
+// Reads back a slot through GetStorageAt and compares it with value.
+func selfTestCheckSlot(h *dbHandle, address common.Address, key common.Hash, value []byte) error {
+	read, err := h.storageAt(address, key, selfTestBlock)
+	if err != nil {
+		return err
+	}
+	want, got := new(uint256.Int).SetBytes(value), new(uint256.Int).SetBytes(read)
+	if !want.Eq(got) {
+		return selfTestMismatch("slot "+key.Hex(), want.Hex(), got.Hex())
+	}
+	return nil
+}
+
+func selfTestPutStorage(ctx context.Context, h *dbHandle) error {
+	key := common.HexToHash("0x01")
+	value := common.HexToHash("0x2a")
+	// the contract written by SetCode, so the slot has an incarnation
+	if err := putStorage(ctx, h, selfTestContract.Bytes(), key.Bytes(), value.Bytes()); err != nil {
+		return err
+	}
+	return selfTestCheckSlot(h, selfTestContract, key, value.Bytes())
+}
+
+func selfTestSetStorageAt(ctx context.Context, h *dbHandle) error {
+	key := common.HexToHash("0xff")
+	value := []byte{0xde, 0xad, 0xbe, 0xef}
+	if err := setStorageAt(h, selfTestContract.Bytes(), key.Bytes(), value); err != nil {
+		return err
+	}
+	return selfTestCheckSlot(h, selfTestContract, key, value)
+}
+
+// The header of the fixture block.
+func selfTestHeader() *types.Header {
+	return &types.Header{
+		ParentHash:  common.HexToHash("0x5e1f7e57"),
+		UncleHash:   types.EmptyUncleHash,
+		Coinbase:    selfTestAddress,
+		Root:        types.EmptyRootHash,
+		TxHash:      types.EmptyRootHash,
+		ReceiptHash: types.EmptyRootHash,
+		Difficulty:  big.NewInt(131072),
+		Number:      new(big.Int).SetUint64(selfTestBlock),
+		GasLimit:    30_000_000,
+		GasUsed:     21_000,
+		Time:        1_600_000_000,
+		Extra:       []byte("dbfaker self-test"),
+		BaseFee:     big.NewInt(7),
+	}
+}
+
+func selfTestPutHeader(ctx context.Context, h *dbHandle) error {
+	header := selfTestHeader()
+	hash := header.Hash()
+	enc, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return err
+	}
+	if err = putHeader(ctx, h, enc); err != nil {
+		return err
+	}
+	if err = putCanonicalHash(ctx, h, hash.Bytes(), selfTestBlock, true); err != nil {
+		return err
+	}
+	if err = putHeaderNumber(ctx, h, hash.Bytes(), selfTestBlock); err != nil {
+		return err
+	}
+	if err = putHeadHeaderHash(h, hash.Bytes()); err != nil {
+		return err
+	}
+
+	read, err := h.headerByNumber(selfTestBlock)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, enc) {
+		return selfTestMismatch("header", common.Bytes2Hex(enc), common.Bytes2Hex(read))
+	}
+	return h.View(ctx, func(tx kv.Tx) error {
+		if head := rawdb.ReadHeadHeaderHash(tx); head != hash {
+			return selfTestMismatch("head header hash", hash.Hex(), head.Hex())
+		}
+		if num := rawdb.ReadHeaderNumber(tx, hash); num == nil || *num != selfTestBlock {
+			return selfTestMismatch("header number", uint64(selfTestBlock), num)
+		}
+		return nil
+	})
+}
+
+// The transaction of the fixture block and its sender.
+func selfTestTransaction() (types.Transaction, common.Address, error) {
+	key, err := crypto.HexToECDSA(selfTestKey)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	to := selfTestContract
+	txn := &types.LegacyTx{
+		CommonTx: types.CommonTx{
+			Nonce: 7,
+			Gas:   21_000,
+			To:    &to,
+			Value: uint256.NewInt(1),
+			Data:  []byte{0xca, 0xfe},
+		},
+		GasPrice: uint256.NewInt(10),
+	}
+	signed, err := types.SignTx(txn, *types.LatestSignerForChainID(big.NewInt(1)), key)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return signed, crypto.PubkeyToAddress(key.PublicKey), nil
+}
+
+func selfTestPutBody(ctx context.Context, h *dbHandle) error {
+	// the body belongs to the canonical header written by PutHeader
+	hash := selfTestHeader().Hash()
+	txn, sender, err := selfTestTransaction()
+	if err != nil {
+		return err
+	}
+	enc, err := rlp.EncodeToBytes(&types.Body{Transactions: []types.Transaction{txn}})
+	if err != nil {
+		return err
+	}
+	if err = putBodyWithTransactions(ctx, h, hash.Bytes(), selfTestBlock, enc); err != nil {
+		return err
+	}
+	if err = putSenders(ctx, h, hash.Bytes(), selfTestBlock, [][]byte{sender.Bytes()}); err != nil {
+		return err
+	}
+
+	read, err := h.blockByNumber(selfTestBlock)
+	if err != nil {
+		return err
+	}
+	if read == nil {
+		return errors.New("block not found")
+	}
+	block := new(types.Block)
+	if err = rlp.DecodeBytes(read, block); err != nil {
+		return fmt.Errorf("Block DecodeBytes: %w", err)
+	}
+	if block.Hash() != hash {
+		return selfTestMismatch("block hash", hash.Hex(), block.Hash().Hex())
+	}
+	if txs := block.Transactions(); len(txs) != 1 {
+		return selfTestMismatch("transaction count", 1, len(txs))
+	} else if txs[0].Hash() != txn.Hash() {
+		return selfTestMismatch("transaction hash", txn.Hash().Hex(), txs[0].Hash().Hex())
+	}
+	return nil
+}
+
+func selfTestPutTxLookup(ctx context.Context, h *dbHandle) error {
+	txn, _, err := selfTestTransaction()
+	if err != nil {
+		return err
+	}
+	hash := txn.Hash()
+	num := new(big.Int).SetUint64(selfTestBlock).Bytes()
+	if err = putTxLookupEntries(ctx, h, num, [][]byte{hash.Bytes()}, false); err != nil {
+		return err
+	}
+	read, found, err := h.txBlockNumber(hash.Bytes())
+	if err != nil {
+		return err
+	}
+	if !found || read != selfTestBlock {
+		return selfTestMismatch("block number of "+hash.Hex(), uint64(selfTestBlock), read)
+	}
+	return nil
+}
+
+func selfTestPutReceipts(ctx context.Context, h *dbHandle) error {
+	receipt := &types.Receipt{
+		Status:            types.ReceiptStatusSuccessful,
+		CumulativeGasUsed: 21_000,
+		Logs: []*types.Log{{
+			Address: selfTestContract,
+			Topics:  []common.Hash{crypto.Keccak256Hash([]byte("SelfTest(uint256)"))},
+			Data:    common.LeftPadBytes([]byte{0x2a}, 32),
+		}},
+	}
+	// the receipt takes the form of the fork the chain config puts the block in
+	var config *params.ChainConfig
+	err := h.View(ctx, func(tx kv.Tx) (err error) {
+		config, err = readChainConfig(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if config != nil && !config.IsByzantium(selfTestBlock) {
+		receipt.Status, receipt.PostState = 0, common.HexToHash("0x5e1f7e57").Bytes()
+	}
+	receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+	enc, err := rlp.EncodeToBytes(receipt)
+	if err != nil {
+		return err
+	}
+	if err = putReceipts(ctx, h, selfTestBlock, [][]byte{enc}); err != nil {
+		return err
+	}
+
+	var read types.Receipts
+	err = h.View(ctx, func(tx kv.Tx) (err error) {
+		read, err = h.currentSchema().readReceipts(tx, selfTestBlock)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(read) != 1 {
+		return selfTestMismatch("receipt count", 1, len(read))
+	}
+	got := read[0]
+	switch {
+	case got.Status != receipt.Status:
+		return selfTestMismatch("status", receipt.Status, got.Status)
+	case !bytes.Equal(got.PostState, receipt.PostState):
+		return selfTestMismatch("post-state root", common.Bytes2Hex(receipt.PostState), common.Bytes2Hex(got.PostState))
+	case got.CumulativeGasUsed != receipt.CumulativeGasUsed:
+		return selfTestMismatch("cumulative gas used", receipt.CumulativeGasUsed, got.CumulativeGasUsed)
+	case len(got.Logs) != 1:
+		return selfTestMismatch("log count", 1, len(got.Logs))
+	}
+	want, l := receipt.Logs[0], got.Logs[0]
+	switch {
+	case l.Address != want.Address:
+		return selfTestMismatch("log address", want.Address.Hex(), l.Address.Hex())
+	case len(l.Topics) != 1 || l.Topics[0] != want.Topics[0]:
+		return selfTestMismatch("log topics", want.Topics, l.Topics)
+	case !bytes.Equal(l.Data, want.Data):
+		return selfTestMismatch("log data", common.Bytes2Hex(want.Data), common.Bytes2Hex(l.Data))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build !slim
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The dbfaker.v1.Faker gRPC service of proto/dbfaker.proto, which exposes
+// the library to hosts that drive dbfaker as a child process instead of
+// linking it. Messages are encoded by hand like CallProto's, so the service
+// is described here rather than generated.
+var fakerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dbfaker.v1.Faker",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Call", Handler: fakerCall},
+		{MethodName: "Do", Handler: fakerDo},
+	},
+	Metadata: "proto/dbfaker.proto",
+}
+
+// Passes messages through as their encoded bytes, which the handlers decode
+// with protowire.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// Named like the default codec, so clients generated from the .proto file
+// talk to the service as usual.
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// Serves the Faker service for db on the unix socket at path until stop is
+// closed, then waits for in-flight requests to finish.
+func serveFaker(db *dbHandle, path string, stop <-chan struct{}) error {
+	// a socket left behind by a previous run would make Listen fail
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	srv.RegisterService(&fakerServiceDesc, db)
+	go func() {
+		<-stop
+		srv.GracefulStop()
+	}()
+	return srv.Serve(lis)
+}
+
+// Runs a CallRequest{method, params_json} through the Call handlers and
+// returns a CallResponse whose response_json is what the Call export returns.
+func fakerCall(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req []byte
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	m, err := parseProto(req)
+	if err != nil {
+		return nil, err
+	}
+	result, err := call(ctx, srv.(*dbHandle), string(m.bytes(1)), m.bytes(2))
+
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	resp = protowire.AppendBytes(resp, encodeResponse(result, err))
+	return &resp, nil
+}
+
+// Runs a Request like the CallProto export and returns its Response.
+func fakerDo(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req []byte
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	r, err := callProto(ctx, srv.(*dbHandle), req)
+	if err != nil {
+		r = protoResponse{err: err.Error()}
+	}
+	resp := r.encode()
+	return &resp, nil
+}
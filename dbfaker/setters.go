@@ -0,0 +1,329 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// Like PutAccount, but takes the fields of the account instead of its RLP
+// encoding. balance is big-endian and at most 32 bytes. An empty codeHash
+// means the account has no code.
+//export PutAccountFields
+func PutAccountFields(dbPtr C.uintptr_t, address []byte, nonce uint64, balance []byte, codeHash []byte, incarnation uint64) (exit int) {
+	defer timeOp("PutAccountFields", "address", hexutil.Bytes(address), "nonce", nonce, "incarnation", incarnation)()
+	acct, err := newAccount(nonce, balance, codeHash, incarnation)
+	if err != nil {
+		return exitCode("PutAccountFields", err)
+	}
+	return exitCode("PutAccountFields", putAccountFields(context.Background(), getDbHandle(dbPtr), address, acct))
+}
+
+func newAccount(nonce uint64, balance []byte, codeHash []byte, incarnation uint64) (*accounts.Account, error) {
+	if len(balance) > 32 {
+		return nil, fmt.Errorf("balance is %d bytes", len(balance))
+	}
+	acct := accounts.NewAccount()
+	acct.Nonce = nonce
+	acct.Balance.SetBytes(balance)
+	acct.Incarnation = incarnation
+	switch len(codeHash) {
+	case 0:
+	case common.HashLength:
+		acct.CodeHash = common.BytesToHash(codeHash)
+	default:
+		return nil, fmt.Errorf("code hash is %d bytes", len(codeHash))
+	}
+	return &acct, nil
+}
+
+func putAccountFields(ctx context.Context, db kv.RwDB, address []byte, acct *accounts.Account) (err error) {
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return writeAccount(db, tx, common.BytesToAddress(address), acct)
+}
+
+// Like PutAccountFields, but takes the account as a JSON document such as
+// {"balance": "0xde0b6b3a7640000", "nonce": "1"}. The numeric fields
+// balance, nonce and incarnation are strings in hex or decimal, codeHash is a
+// 0x-prefixed hash; missing fields are zero and a missing codeHash means no
+// code.
+//export PutAccountJSON
+func PutAccountJSON(dbPtr C.uintptr_t, address []byte, accountJson string) (exit int) {
+	defer timeOp("PutAccountJSON", "address", hexutil.Bytes(address), "account", accountJson)()
+	var a accountJSON
+	if err := json.Unmarshal([]byte(accountJson), &a); err != nil {
+		return exitCode("PutAccountJSON", fmt.Errorf("invalid account: %w", err))
+	}
+	acct, err := a.account()
+	if err != nil {
+		return exitCode("PutAccountJSON", err)
+	}
+	return exitCode("PutAccountJSON", putAccountFields(context.Background(), getDbHandle(dbPtr), address, acct))
+}
+
+type accountJSON struct {
+	Balance     *math.HexOrDecimal256 `json:"balance"`
+	Nonce       math.HexOrDecimal64   `json:"nonce"`
+	CodeHash    *common.Hash          `json:"codeHash"`
+	Incarnation math.HexOrDecimal64   `json:"incarnation"`
+}
+
+func (a *accountJSON) account() (*accounts.Account, error) {
+	var balance []byte
+	if a.Balance != nil {
+		b := (*big.Int)(a.Balance)
+		if b.Sign() < 0 || b.BitLen() > 256 {
+			return nil, fmt.Errorf("balance %v out of range", b)
+		}
+		balance = b.Bytes()
+	}
+	var codeHash []byte
+	if a.CodeHash != nil {
+		codeHash = a.CodeHash.Bytes()
+	}
+	return newAccount(uint64(a.Nonce), balance, codeHash, uint64(a.Incarnation))
+}
+
+// Sets the balance of the account at address, keeping its other fields, like
+// anvil_setBalance. balance is big-endian and at most 32 bytes. The account
+// is created if it does not exist.
+//export SetBalance
+func SetBalance(dbPtr C.uintptr_t, address []byte, balance []byte) (exit int) {
+	defer timeOp("SetBalance", "address", hexutil.Bytes(address), "balance", hexutil.Bytes(balance))()
+	return exitCode("SetBalance", setBalance(getDbHandle(dbPtr), address, balance))
+}
+
+func setBalance(db kv.RwDB, address []byte, balance []byte) error {
+	if len(balance) > 32 {
+		return fmt.Errorf("balance is %d bytes", len(balance))
+	}
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		acct.Balance.SetBytes(balance)
+		return nil
+	})
+}
+
+// Sets the nonce of the account at address, keeping its other fields, like
+// anvil_setNonce. The account is created if it does not exist.
+//export SetNonce
+func SetNonce(dbPtr C.uintptr_t, address []byte, nonce uint64) (exit int) {
+	defer timeOp("SetNonce", "address", hexutil.Bytes(address), "nonce", nonce)()
+	return exitCode("SetNonce", setNonce(getDbHandle(dbPtr), address, nonce))
+}
+
+func setNonce(db kv.RwDB, address []byte, nonce uint64) error {
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		acct.Nonce = nonce
+		return nil
+	})
+}
+
+// Increments the nonce of the account at address by one and returns the new
+// nonce. The read and the write happen in one write transaction, which mdbx
+// serializes, so concurrent callers never lose an increment. The account is
+// created if it does not exist.
+//export IncrementNonce
+func IncrementNonce(dbPtr C.uintptr_t, address []byte) (exit int, nonce uint64) {
+	defer timeOp("IncrementNonce", "address", hexutil.Bytes(address))()
+	nonce, err := incrementNonce(getDbHandle(dbPtr), address)
+	return exitCode("IncrementNonce", err), nonce
+}
+
+func incrementNonce(db kv.RwDB, address []byte) (nonce uint64, err error) {
+	err = updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		next, overflow := math.SafeAdd(acct.Nonce, 1)
+		if overflow {
+			return fmt.Errorf("nonce of %x overflows", who)
+		}
+		acct.Nonce, nonce = next, next
+		return nil
+	})
+	return nonce, err
+}
+
+// Adds delta to the balance of the account at address, failing instead of
+// wrapping around if the result does not fit in 256 bits. delta is
+// big-endian and at most 32 bytes. The account is created if it does not
+// exist.
+//export AddBalance
+func AddBalance(dbPtr C.uintptr_t, address []byte, delta []byte) (exit int) {
+	defer timeOp("AddBalance", "address", hexutil.Bytes(address), "delta", hexutil.Bytes(delta))()
+	return exitCode("AddBalance", addBalance(getDbHandle(dbPtr), address, delta))
+}
+
+func addBalance(db kv.RwDB, address []byte, delta []byte) error {
+	if len(delta) > 32 {
+		return fmt.Errorf("delta is %d bytes", len(delta))
+	}
+	d := new(uint256.Int).SetBytes(delta)
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		sum := new(uint256.Int).Add(&acct.Balance, d)
+		if sum.Lt(d) {
+			return fmt.Errorf("balance of %x overflows", who)
+		}
+		acct.Balance.Set(sum)
+		return nil
+	})
+}
+
+// Subtracts delta from the balance of the account at address, failing if the
+// balance is smaller than delta. delta is big-endian and at most 32 bytes.
+//export SubBalance
+func SubBalance(dbPtr C.uintptr_t, address []byte, delta []byte) (exit int) {
+	defer timeOp("SubBalance", "address", hexutil.Bytes(address), "delta", hexutil.Bytes(delta))()
+	return exitCode("SubBalance", subBalance(getDbHandle(dbPtr), address, delta))
+}
+
+func subBalance(db kv.RwDB, address []byte, delta []byte) error {
+	if len(delta) > 32 {
+		return fmt.Errorf("delta is %d bytes", len(delta))
+	}
+	d := new(uint256.Int).SetBytes(delta)
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		if acct.Balance.Lt(d) {
+			return fmt.Errorf("balance of %x is %s, cannot subtract %s", who, acct.Balance.ToBig(), d.ToBig())
+		}
+		acct.Balance.Sub(&acct.Balance, d)
+		return nil
+	})
+}
+
+// Sets the code of the account at address, keeping its other fields, like
+// anvil_setCode. The code is stored under its hash and linked to the current
+// incarnation of the account; an account that is not a contract yet becomes
+// incarnation 1. Empty code removes the code hash. The account is created if
+// it does not exist.
+//export SetCode
+func SetCode(dbPtr C.uintptr_t, address []byte, code []byte) (exit int) {
+	defer timeOp("SetCode", "address", hexutil.Bytes(address), "code", len(code))()
+	return exitCode("SetCode", setCode(getDbHandle(dbPtr), address, code))
+}
+
+func setCode(db kv.RwDB, address []byte, code []byte) error {
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		if acct.Incarnation == 0 {
+			acct.Incarnation = 1
+		}
+		acct.CodeHash = crypto.Keccak256Hash(code)
+		if len(code) == 0 {
+			return nil
+		}
+		w := state.NewPlainStateWriterNoHistory(tx)
+		return w.UpdateAccountCode(who, acct.Incarnation, acct.CodeHash, code)
+	})
+}
+
+// Sets a storage slot of the account at address, like anvil_setStorageAt.
+// key and value are big-endian and at most 32 bytes. Unlike PutStorage, the
+// slot is always written under a contract incarnation: an account that does
+// not exist is created, and one that is not a contract yet becomes
+// incarnation 1.
+//export SetStorageAt
+func SetStorageAt(dbPtr C.uintptr_t, address []byte, key []byte, value []byte) (exit int) {
+	defer timeOp("SetStorageAt", "address", hexutil.Bytes(address), "key", hexutil.Bytes(key))()
+	return exitCode("SetStorageAt", setStorageAt(getDbHandle(dbPtr), address, key, value))
+}
+
+func setStorageAt(db kv.RwDB, address []byte, key []byte, value []byte) error {
+	if len(key) > 32 || len(value) > 32 {
+		return fmt.Errorf("storage key and value must be at most 32 bytes, got %d and %d", len(key), len(value))
+	}
+	k := common.BytesToHash(key)
+	v := new(uint256.Int).SetBytes(value)
+	return updateAccount(db, address, func(tx kv.RwTx, who common.Address, acct *accounts.Account) error {
+		if acct.Incarnation == 0 {
+			acct.Incarnation = 1
+		}
+		return writeStorage(db, tx, who, acct.Incarnation, &k, v)
+	})
+}
+
+// Reads the account at address, or a new empty account if there is none,
+// lets modify change it and writes it back, all in one transaction. Updates
+// overwrite even on insert-only dbs, as that is what they are for.
+func updateAccount(db kv.RwDB, address []byte, modify func(tx kv.RwTx, who common.Address, acct *accounts.Account) error) (err error) {
+	tx, closer, err := beginCtx(withInsertOnly(context.Background(), false), db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	who := common.BytesToAddress(address)
+	acct := accounts.NewAccount()
+	if _, err := rawdb.ReadAccount(tx, who, &acct); err != nil {
+		return fmt.Errorf("ReadAccount: %w", err)
+	}
+	if err := modify(tx, who, &acct); err != nil {
+		return err
+	}
+	return writeAccount(db, tx, who, &acct)
+}
+
+// How PutStorage treats a slot of an account that does not exist.
+const (
+	// create the account as an empty contract of incarnation 1
+	putStorageCreate = iota
+	// write the slot under incarnation 1 and leave the account missing
+	putStorageOrphan
+	// fail the write
+	putStorageStrict
+)
+
+// Sets what PutStorage does when the account of the slot does not exist:
+// "create" (the default) creates the account as an empty contract of the
+// first contract incarnation and writes the slot under it, so that readers see
+// the slot right away, "orphan" writes the slot under that incarnation but
+// leaves the account missing, as raw Erigon writers would, and "strict" fails
+// the write.
+//export SetPutStorageMode
+func SetPutStorageMode(dbPtr C.uintptr_t, mode string) (exit int) {
+	defer timeOp("SetPutStorageMode", "mode", mode)()
+	return exitCode("SetPutStorageMode", getDbHandle(dbPtr).setPutStorageMode(mode))
+}
+
+func (h *dbHandle) setPutStorageMode(mode string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch mode {
+	case "", "default", "create":
+		h.putStorageMode = putStorageCreate
+	case "orphan":
+		h.putStorageMode = putStorageOrphan
+	case "strict":
+		h.putStorageMode = putStorageStrict
+	default:
+		return fmt.Errorf("unknown PutStorage mode %q", mode)
+	}
+	return nil
+}
+
+func putStorageModeOf(db kv.RwDB) int {
+	if h, ok := db.(*dbHandle); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.putStorageMode
+	}
+	return putStorageCreate
+}
@@ -0,0 +1,105 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+#include <stdlib.h>     // for malloc, free
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// A buffer the library allocates for the host to write large values into
+// once. Exports taking a region read their values from it by offset and pass
+// them on to mdbx in place, so a value is copied into the db and nowhere
+// else.
+type sharedRegion struct {
+	ptr  unsafe.Pointer
+	size uint64
+}
+
+// Allocates a shared region of size bytes and returns an ffi-safe pointer to
+// it along with the address of its memory, which the host may write to
+// directly. Values written there are passed to SetCodeShared and PutShared
+// as an offset and a length. The region must be released with
+// SharedRegionFree once no call using it is running.
+//export SharedRegionCreate
+func SharedRegionCreate(size uint64) (exit int, region C.uintptr_t, data unsafe.Pointer) {
+	defer timeOp("SharedRegionCreate", "size", size)()
+	if size == 0 {
+		return exitCode("SharedRegionCreate", errors.New("empty shared region")), 0, nil
+	}
+	ptr := C.malloc(C.size_t(size))
+	if ptr == nil {
+		return exitCode("SharedRegionCreate", fmt.Errorf("cannot allocate %d bytes", size)), 0, nil
+	}
+	r := &sharedRegion{ptr: ptr, size: size}
+	return 1, registerHandle("region", "SharedRegionCreate", 0, r), ptr
+}
+
+// Releases a region from SharedRegionCreate and its memory.
+//export SharedRegionFree
+func SharedRegionFree(region C.uintptr_t) {
+	C.free(getSharedRegion(region).ptr)
+	releaseHandle(region)
+}
+
+// Returns the length bytes at offset in the region, without copying them.
+func (r *sharedRegion) slice(offset, length uint64) ([]byte, error) {
+	if offset > r.size || length > r.size-offset {
+		return nil, fmt.Errorf("range [%d, %d) is out of the %d-byte shared region", offset, offset+length, r.size)
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(r.ptr, offset)), length), nil
+}
+
+func getSharedRegion(region C.uintptr_t) *sharedRegion {
+	return cgo.Handle(region).Value().(*sharedRegion)
+}
+
+// Like SetCode, with the code read from length bytes at offset in a shared
+// region.
+//export SetCodeShared
+func SetCodeShared(dbPtr C.uintptr_t, region C.uintptr_t, address []byte, offset uint64, length uint64) (exit int) {
+	defer timeOp("SetCodeShared", "address", hexutil.Bytes(address), "offset", offset, "code", length)()
+	code, err := getSharedRegion(region).slice(offset, length)
+	if err != nil {
+		return exitCode("SetCodeShared", err)
+	}
+	return exitCode("SetCodeShared", setCode(getDbHandle(dbPtr), address, code))
+}
+
+// Puts one raw entry into a chaindata table, with the value read from
+// valueLength bytes at valueOffset in a shared region, for large values such
+// as code or bodies that are already encoded in the table's format.
+//export PutShared
+func PutShared(dbPtr C.uintptr_t, region C.uintptr_t, table string, key []byte, valueOffset uint64, valueLength uint64) (exit int) {
+	defer timeOp("PutShared", "table", table, "key", hexutil.Bytes(key), "offset", valueOffset, "size", valueLength)()
+	value, err := getSharedRegion(region).slice(valueOffset, valueLength)
+	if err != nil {
+		return exitCode("PutShared", err)
+	}
+	return exitCode("PutShared", putShared(context.Background(), getDbHandle(dbPtr), table, key, value))
+}
+
+func putShared(ctx context.Context, db kv.RwDB, table string, key []byte, value []byte) (err error) {
+	if !isChaindataTable(table) {
+		return fmt.Errorf("unknown table %q", table)
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	return tx.Put(table, key, value)
+}
@@ -0,0 +1,66 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// Turns signature validation on or off for the db. While enabled,
+// PutTransactions checks every decoded transaction before writing anything:
+// its chain id must match the chain config stored for the genesis block and
+// its signature must recover a sender. A bad fixture then fails at write time
+// with the index of the offending transaction instead of at read time.
+//export SetVerifySignatures
+func SetVerifySignatures(dbPtr C.uintptr_t, enabled bool) (exit int) {
+	defer timeOp("SetVerifySignatures", "enabled", enabled)()
+	getDbHandle(dbPtr).setVerifySignatures(enabled)
+	return 1
+}
+
+func (h *dbHandle) setVerifySignatures(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.verifySignatures = enabled
+}
+
+// Reports whether writes to db validate transaction signatures.
+func verifiesSignatures(db kv.RwDB) bool {
+	h, ok := db.(*dbHandle)
+	if !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.verifySignatures
+}
+
+func verifyTransactions(tx kv.Tx, txs []types.Transaction) error {
+	config, err := readChainConfig(tx)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.ChainID == nil {
+		return errors.New("verifying signatures needs a chain config stored for the genesis block")
+	}
+
+	signer := types.LatestSignerForChainID(config.ChainID)
+	for i, txn := range txs {
+		// unprotected legacy transactions have no chain id
+		if id := txn.GetChainID(); !id.IsZero() && id.ToBig().Cmp(config.ChainID) != 0 {
+			return fmt.Errorf("tx %d (%x): chain id %d, expected %d", i, txn.Hash(), id.ToBig(), config.ChainID)
+		}
+		if _, err := txn.Sender(*signer); err != nil {
+			return fmt.Errorf("tx %d (%x): invalid signature: %w", i, txn.Hash(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+//go:build slim
+
+// The slim build implements the core writers on top of mdbx-go alone, with
+// small local encoders in place of Erigon's, so the library builds without
+// the Erigon module. It writes the same tables and encodings as the full
+// build for the exports it provides. Build it with `-tags slim`.
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/cgo"
+
+	"github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+func main() {}
+
+const slimBuild = true
+
+var buildFeatures = []string{featureCoreWrites, featureLogging}
+
+// The slim encoders write the same layout as the full build, but without
+// Erigon there is no schema version to report.
+func schemaVersions() []string {
+	return nil
+}
+
+// Erigon table names, as defined in erigon-lib/kv/tables.go.
+const (
+	tablePlainState      = "PlainState"
+	tableHeaders         = "Header"
+	tableHeaderNumber    = "HeaderNumber"
+	tableHeaderCanonical = "CanonicalHeader"
+	tableHeadHeader      = "LastHeader"
+	tableBlockBody       = "BlockBody"
+	tableEthTx           = "BlockTransaction"
+	tableSenders         = "TxSender"
+	tableTxLookup        = "BlockTransactionLookup"
+)
+
+// Tables that need flags other than the defaults when created.
+var slimTableFlags = map[string]uint{
+	tablePlainState: mdbx.DupSort,
+}
+
+const (
+	slimMaxDBs    = 128
+	slimMapUpper  = 1 << 40
+	slimGrowStep  = 2 << 20
+	slimPageSize  = 4096
+	addressLength = 20
+	hashLength    = 32
+)
+
+// Opens a new mdbx instance at the provided path. See the full build for the
+// ownership rules of the returned pointer.
+//export MdbxOpen
+func MdbxOpen(path string) (exit int, ptr C.uintptr_t) {
+	env, err := openSlimEnv(path)
+	if err != nil {
+		libLog.Error("MdbxOpen", "err", err)
+		return -1, *new(C.uintptr_t)
+	}
+	ptr = C.uintptr_t(cgo.NewHandle(env))
+	return 1, ptr
+}
+
+// Takes a pointer to an mdbx env. Closes the env and deletes the pointer handle.
+//export MdbxClose
+func MdbxClose(dbPtr C.uintptr_t) {
+	handle := cgo.Handle(dbPtr)
+	env := handle.Value().(*mdbx.Env)
+	env.Close()
+	handle.Delete()
+}
+
+//export PutAccount
+func PutAccount(dbPtr C.uintptr_t, address []byte, rlpAccount []byte, incarnation uint64, replace bool) (exit int) {
+	acct, err := decodeAccountForHashing(rlpAccount)
+	if err != nil {
+		return exitCode("PutAccount", fmt.Errorf("account decode: %w", err))
+	}
+	acct.incarnation = incarnation
+
+	return slimUpdate(dbPtr, "PutAccount", func(txn *mdbx.Txn) error {
+		dbi, err := openTable(txn, tablePlainState)
+		if err != nil {
+			return err
+		}
+		if !replace {
+			// merged like in the full build
+			enc, err := txn.Get(dbi, address)
+			if err != nil && !mdbx.IsNotFound(err) {
+				return err
+			}
+			if err == nil {
+				stored, err := decodeAccountForStorage(enc)
+				if err != nil {
+					return err
+				}
+				if isEmptyCodeHash(acct.codeHash) && !isEmptyCodeHash(stored.codeHash) {
+					// the stored value is about to be deleted under it
+					acct.codeHash = append([]byte(nil), stored.codeHash...)
+				}
+				if acct.incarnation == 0 {
+					acct.incarnation = stored.incarnation
+				}
+			}
+		}
+		// PlainState is dupsorted, so the old value has to go before the
+		// new one is put.
+		if err = txn.Del(dbi, address, nil); err != nil && !mdbx.IsNotFound(err) {
+			return err
+		}
+		return txn.Put(dbi, address, acct.encodeForStorage(), 0)
+	})
+}
+
+//export PutRawTransactions
+func PutRawTransactions(dbPtr C.uintptr_t, txs [][]byte, baseTxId uint64) (exit int) {
+	return slimUpdate(dbPtr, "PutRawTransactions", func(txn *mdbx.Txn) error {
+		// skip 1 system tx at beginning of write
+		return putTransactions(txn, txs, baseTxId+1)
+	})
+}
+
+//export PutTransactions
+func PutTransactions(dbPtr C.uintptr_t, rlpTxs [][]byte, baseTxId uint64) (exit int) {
+	txs := make([][]byte, len(rlpTxs))
+	for i, rlpTx := range rlpTxs {
+		tx, err := txBinary(rlpTx)
+		if err != nil {
+			return exitCode("PutTransactions", fmt.Errorf("tx %d decode: %w", i, err))
+		}
+		txs[i] = tx
+	}
+
+	return slimUpdate(dbPtr, "PutTransactions", func(txn *mdbx.Txn) error {
+		// skip 1 system tx at beginning of write
+		return putTransactions(txn, txs, baseTxId+1)
+	})
+}
+
+//export PutSenders
+func PutSenders(dbPtr C.uintptr_t, hash []byte, num uint64, senders [][]byte) (exit int) {
+	val := make([]byte, 0, len(senders)*addressLength)
+	for _, sender := range senders {
+		val = append(val, leftPad(sender, addressLength)...)
+	}
+
+	return slimUpdate(dbPtr, "PutSenders", func(txn *mdbx.Txn) error {
+		return putTo(txn, tableSenders, blockKey(num, hash), val)
+	})
+}
+
+//export PutBodyForStorage
+func PutBodyForStorage(dbPtr C.uintptr_t, hash []byte, num uint64, bodyRlp []byte) (exit int) {
+	if _, err := rlpListItems(bodyRlp); err != nil {
+		return exitCode("PutBodyForStorage", fmt.Errorf("BodyForStorage decode: %w", err))
+	}
+
+	return slimUpdate(dbPtr, "PutBodyForStorage", func(txn *mdbx.Txn) error {
+		return putTo(txn, tableBlockBody, blockKey(num, hash), bodyRlp)
+	})
+}
+
+// blockNum is a big.Int
+//export PutTxLookupEntries
+func PutTxLookupEntries(dbPtr C.uintptr_t, blockNum []byte, txHashes [][]byte, lenient bool) (exit int) {
+	return slimUpdate(dbPtr, "PutTxLookupEntries", func(txn *mdbx.Txn) error {
+		for i, hash := range txHashes {
+			if err := putTo(txn, tableTxLookup, hash, blockNum); err != nil {
+				if !lenient {
+					return fmt.Errorf("TxLookup entry %d (%x): %w", i, hash, err)
+				}
+				libLog.Error("failed to store TxLookup entry", "index", i, "hash", fmt.Sprintf("%#x", hash), "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+//export PutStorage
+func PutStorage(dbPtr C.uintptr_t, address []byte, key []byte, val []byte) (exit int) {
+	slot := leftPad(key, hashLength)
+	v := bytes.TrimLeft(val, "\x00")
+
+	return slimUpdate(dbPtr, "PutStorage", func(txn *mdbx.Txn) error {
+		dbi, err := openTable(txn, tablePlainState)
+		if err != nil {
+			return err
+		}
+
+		// a missing account is created as an empty contract of the first
+		// contract incarnation, like in the full build
+		incarnation := uint64(1)
+		enc, err := txn.Get(dbi, address)
+		if mdbx.IsNotFound(err) {
+			stub := &slimAccount{incarnation: incarnation}
+			if err = txn.Put(dbi, address, stub.encodeForStorage(), 0); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			acct, err := decodeAccountForStorage(enc)
+			if err != nil {
+				return err
+			}
+			incarnation = acct.incarnation
+		}
+
+		// Storage lives under address|incarnation with the slot as the
+		// prefix of the dupsorted value.
+		k := make([]byte, addressLength+8)
+		copy(k, address)
+		binary.BigEndian.PutUint64(k[addressLength:], incarnation)
+
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		_, old, err := cur.Get(k, slot, mdbx.GetBothRange)
+		if err != nil && !mdbx.IsNotFound(err) {
+			return err
+		}
+		if err == nil && bytes.HasPrefix(old, slot) {
+			if err = cur.Del(0); err != nil {
+				return err
+			}
+		}
+
+		if len(v) == 0 {
+			return nil
+		}
+		return txn.Put(dbi, k, append(append([]byte{}, slot...), v...), 0)
+	})
+}
+
+//export PutHeadHeaderHash
+func PutHeadHeaderHash(dbPtr C.uintptr_t, hash []byte) (exit int) {
+	return slimUpdate(dbPtr, "PutHeadHeaderHash", func(txn *mdbx.Txn) error {
+		return putTo(txn, tableHeadHeader, []byte(tableHeadHeader), leftPad(hash, hashLength))
+	})
+}
+
+//export PutHeaderNumber
+func PutHeaderNumber(dbPtr C.uintptr_t, hash []byte, num uint64) (exit int) {
+	return slimUpdate(dbPtr, "PutHeaderNumber", func(txn *mdbx.Txn) error {
+		return putTo(txn, tableHeaderNumber, leftPad(hash, hashLength), encodeBlockNumber(num))
+	})
+}
+
+//export PutHeader
+func PutHeader(dbPtr C.uintptr_t, headerRlp []byte) (exit int) {
+	num, err := headerNumber(headerRlp)
+	if err != nil {
+		return exitCode("PutHeader", fmt.Errorf("Header decode: %w", err))
+	}
+	hash := keccak256(headerRlp)
+
+	return slimUpdate(dbPtr, "PutHeader", func(txn *mdbx.Txn) error {
+		if err := putTo(txn, tableHeaderNumber, hash, encodeBlockNumber(num)); err != nil {
+			return err
+		}
+		return putTo(txn, tableHeaders, blockKey(num, hash), headerRlp)
+	})
+}
+
+//export PutCanonicalHash
+func PutCanonicalHash(dbPtr C.uintptr_t, hash []byte, num uint64, strict bool) (exit int) {
+	return slimUpdate(dbPtr, "PutCanonicalHash", func(txn *mdbx.Txn) error {
+		hash = leftPad(hash, hashLength)
+		if strict {
+			dbi, err := openTable(txn, tableHeaders)
+			if err != nil {
+				return err
+			}
+			if _, err = txn.Get(dbi, blockKey(num, hash)); mdbx.IsNotFound(err) {
+				return fmt.Errorf("cannot make header %x canonical at block %d, no such header is stored", hash, num)
+			} else if err != nil {
+				return err
+			}
+		}
+		return putTo(txn, tableHeaderCanonical, encodeBlockNumber(num), hash)
+	})
+}
+
+func openSlimEnv(path string) (*mdbx.Env, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	env, err := mdbx.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err = env.SetOption(mdbx.OptMaxDB, slimMaxDBs); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if err = env.SetGeometry(-1, -1, slimMapUpper, slimGrowStep, -1, slimPageSize); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if err = env.Open(path, mdbx.NoReadahead|mdbx.Coalesce|mdbx.Durable, 0644); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+// Runs fn in a write transaction on the env behind dbPtr, returning the
+// export exit code.
+func slimUpdate(dbPtr C.uintptr_t, op string, fn func(txn *mdbx.Txn) error) (exit int) {
+	env := cgo.Handle(dbPtr).Value().(*mdbx.Env)
+
+	// write transactions must begin and end on the same thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return exitCode(op, env.Update(fn))
+}
+
+// Logs a failed export like the full build, which also counts the failure.
+func exitCode(op string, err error) (exit int) {
+	if err != nil {
+		libLog.Error(op, "err", err)
+		return -1
+	}
+	return 1
+}
+
+// The slim build has no metrics or slow operation log, so exports are not
+// timed.
+func timeOp(op string, args ...interface{}) func() {
+	return func() {}
+}
+
+func openTable(txn *mdbx.Txn, table string) (mdbx.DBI, error) {
+	return txn.OpenDBISimple(table, mdbx.Create|slimTableFlags[table])
+}
+
+func putTo(txn *mdbx.Txn, table string, k, v []byte) error {
+	dbi, err := openTable(txn, table)
+	if err != nil {
+		return err
+	}
+	return txn.Put(dbi, k, v, 0)
+}
+
+func putTransactions(txn *mdbx.Txn, txs [][]byte, firstTxId uint64) error {
+	dbi, err := openTable(txn, tableEthTx)
+	if err != nil {
+		return err
+	}
+	// ids only grow, so the transactions are appended, as
+	// rawdb.WriteTransactions does, which fails on an id already taken
+	for i, tx := range txs {
+		if err = txn.Put(dbi, encodeBlockNumber(firstTxId+uint64(i)), tx, mdbx.Append); err != nil {
+			return fmt.Errorf("tx %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Key of the per-block tables: block number followed by block hash.
+func blockKey(num uint64, hash []byte) []byte {
+	k := make([]byte, 8+hashLength)
+	binary.BigEndian.PutUint64(k, num)
+	copy(k[8:], leftPad(hash, hashLength))
+	return k
+}
+
+func encodeBlockNumber(num uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, num)
+	return enc
+}
+
+var errShortInput = errors.New("input too short")
@@ -0,0 +1,306 @@
+//go:build slim
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// keccak256("")
+var emptyCodeHash = []byte{
+	0xc5, 0xd2, 0x46, 0x01, 0x86, 0xf7, 0x23, 0x3c, 0x92, 0x7e, 0x7d, 0xb2, 0xdc, 0xc7, 0x03, 0xc0,
+	0xe5, 0x00, 0xb6, 0x53, 0xca, 0x82, 0x27, 0x3b, 0x7b, 0xfa, 0xd8, 0x04, 0x5d, 0x85, 0xa4, 0x70,
+}
+
+type slimAccount struct {
+	nonce       uint64
+	balance     []byte // big endian, no leading zeros
+	incarnation uint64
+	codeHash    []byte
+}
+
+// Reports whether codeHash is that of an account without code, as Erigon
+// treats it: missing, the hash of empty code, or zero.
+func isEmptyCodeHash(codeHash []byte) bool {
+	return len(codeHash) == 0 || bytes.Equal(codeHash, emptyCodeHash) || isZero(codeHash)
+}
+
+// Decodes an account in the RLP format Erigon uses for hashing:
+// [nonce, balance, storageRoot, codeHash].
+func decodeAccountForHashing(enc []byte) (*slimAccount, error) {
+	items, err := rlpListItems(enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != 4 {
+		return nil, fmt.Errorf("account has %d fields, want 4", len(items))
+	}
+	nonce, err := rlpUint64(items[0])
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+	if len(items[1]) > 32 {
+		return nil, fmt.Errorf("balance is %d bytes", len(items[1]))
+	}
+	if len(items[3]) != hashLength {
+		return nil, fmt.Errorf("code hash is %d bytes", len(items[3]))
+	}
+	return &slimAccount{
+		nonce:    nonce,
+		balance:  bytes.TrimLeft(items[1], "\x00"),
+		codeHash: items[3],
+	}, nil
+}
+
+// Encodes the account the way Erigon's accounts.Account.EncodeForStorage
+// does: a bitmap of the present fields followed by each field prefixed with
+// its length.
+func (a *slimAccount) encodeForStorage() []byte {
+	var fieldSet byte
+	enc := []byte{0}
+	if a.nonce > 0 {
+		fieldSet |= 1
+		enc = appendUint64WithLen(enc, a.nonce)
+	}
+	if len(a.balance) > 0 {
+		fieldSet |= 2
+		enc = append(enc, byte(len(a.balance)))
+		enc = append(enc, a.balance...)
+	}
+	if a.incarnation > 0 {
+		fieldSet |= 4
+		enc = appendUint64WithLen(enc, a.incarnation)
+	}
+	if !isEmptyCodeHash(a.codeHash) {
+		fieldSet |= 8
+		enc = append(enc, hashLength)
+		enc = append(enc, a.codeHash...)
+	}
+	enc[0] = fieldSet
+	return enc
+}
+
+func decodeAccountForStorage(enc []byte) (*slimAccount, error) {
+	a := new(slimAccount)
+	if len(enc) == 0 {
+		return a, nil
+	}
+	fieldSet := enc[0]
+	pos := 1
+	field := func() ([]byte, error) {
+		if pos >= len(enc) {
+			return nil, errShortInput
+		}
+		n := int(enc[pos])
+		if pos+1+n > len(enc) {
+			return nil, errShortInput
+		}
+		f := enc[pos+1 : pos+1+n]
+		pos += 1 + n
+		return f, nil
+	}
+	var err error
+	var f []byte
+	if fieldSet&1 > 0 {
+		if f, err = field(); err != nil {
+			return nil, err
+		}
+		a.nonce = bytesToUint64(f)
+	}
+	if fieldSet&2 > 0 {
+		if a.balance, err = field(); err != nil {
+			return nil, err
+		}
+	}
+	if fieldSet&4 > 0 {
+		if f, err = field(); err != nil {
+			return nil, err
+		}
+		a.incarnation = bytesToUint64(f)
+	}
+	if fieldSet&8 > 0 {
+		if a.codeHash, err = field(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Returns the number of an RLP encoded header, its 9th field.
+func headerNumber(headerRlp []byte) (uint64, error) {
+	items, err := rlpListItems(headerRlp)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) < 9 {
+		return 0, fmt.Errorf("header has %d fields", len(items))
+	}
+	return rlpUint64(items[8])
+}
+
+// Checks an RLP encoded transaction and returns the form Erigon stores, which
+// is the encoding itself: rawdb.WriteTransactions stores rlp.Encode(tx), so
+// legacy transactions are stored as their RLP list and typed ones as the
+// type||payload envelope wrapped in an RLP string. A bare envelope is not
+// RLP, and is rejected as the full build's decoder rejects it.
+func txBinary(enc []byte) ([]byte, error) {
+	if len(enc) == 0 {
+		return nil, errShortInput
+	}
+	switch {
+	case enc[0] >= 0xc0:
+		_, err := rlpListItems(enc)
+		return enc, err
+	case enc[0] >= 0x80:
+		envelope, rest, err := rlpSplitString(enc)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("%d trailing bytes", len(rest))
+		}
+		if len(envelope) == 0 {
+			return nil, errShortInput
+		}
+		if t := envelope[0]; t != accessListTxType && t != dynamicFeeTxType {
+			return nil, fmt.Errorf("unknown transaction type %d", t)
+		}
+		if _, err := rlpListItems(envelope[1:]); err != nil {
+			return nil, err
+		}
+		return enc, nil
+	default:
+		return nil, fmt.Errorf("not an RLP encoded transaction: 0x%x", enc[0])
+	}
+}
+
+// EIP-2718 types of the typed transactions the pinned Erigon knows.
+const (
+	accessListTxType = 1
+	dynamicFeeTxType = 2
+)
+
+// Splits an RLP list into the contents of its items. Nested lists are
+// returned with their headers.
+func rlpListItems(enc []byte) ([][]byte, error) {
+	content, rest, err := rlpSplit(enc, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(rest))
+	}
+	var items [][]byte
+	for len(content) > 0 {
+		var item []byte
+		if content[0] >= 0xc0 {
+			_, r, err := rlpSplit(content, true)
+			if err != nil {
+				return nil, err
+			}
+			item = content[:len(content)-len(r)]
+			content = r
+		} else {
+			item, content, err = rlpSplitString(content)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func rlpSplitString(enc []byte) (content, rest []byte, err error) {
+	return rlpSplit(enc, false)
+}
+
+// Splits off the first RLP item of enc, which must be a list if list is set
+// and a string otherwise.
+func rlpSplit(enc []byte, list bool) (content, rest []byte, err error) {
+	if len(enc) == 0 {
+		return nil, nil, errShortInput
+	}
+	b := enc[0]
+	if (b >= 0xc0) != list {
+		return nil, nil, fmt.Errorf("unexpected rlp kind 0x%x", b)
+	}
+	var offset, size int
+	switch {
+	case b < 0x80:
+		return enc[:1], enc[1:], nil
+	case b < 0xb8:
+		offset, size = 1, int(b-0x80)
+	case b < 0xc0:
+		n := int(b - 0xb7)
+		if len(enc) < 1+n {
+			return nil, nil, errShortInput
+		}
+		offset, size = 1+n, int(bytesToUint64(enc[1:1+n]))
+	case b < 0xf8:
+		offset, size = 1, int(b-0xc0)
+	default:
+		n := int(b - 0xf7)
+		if len(enc) < 1+n {
+			return nil, nil, errShortInput
+		}
+		offset, size = 1+n, int(bytesToUint64(enc[1:1+n]))
+	}
+	if size < 0 || len(enc) < offset+size {
+		return nil, nil, errShortInput
+	}
+	return enc[offset : offset+size], enc[offset+size:], nil
+}
+
+func rlpUint64(b []byte) (uint64, error) {
+	if len(b) > 8 {
+		return 0, fmt.Errorf("integer of %d bytes overflows uint64", len(b))
+	}
+	return bytesToUint64(b), nil
+}
+
+func appendUint64WithLen(enc []byte, v uint64) []byte {
+	n := (bits.Len64(v) + 7) / 8
+	enc = append(enc, byte(n))
+	for i := n - 1; i >= 0; i-- {
+		enc = append(enc, byte(v>>(8*i)))
+	}
+	return enc
+}
+
+func bytesToUint64(b []byte) (v uint64) {
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v
+}
+
+// Left pads b with zeros to n bytes, keeping only the last n bytes if it is
+// longer.
+func leftPad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b[len(b)-n:]
+	}
+	out := make([]byte, n)
+	copy(out[n-len(b):], b)
+	return out
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func keccak256(b []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(b)
+	return h.Sum(nil)
+}
@@ -0,0 +1,47 @@
+//go:build !slim
+
+package main
+
+import "C"
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Operations taking at least this long (in nanoseconds) log a warning; 0
+// disables the warning. Defaults to DBFAKER_SLOW_MS.
+var slowOpThreshold int64
+
+func init() {
+	if ms, err := strconv.ParseUint(os.Getenv("DBFAKER_SLOW_MS"), 10, 32); err == nil {
+		atomic.StoreInt64(&slowOpThreshold, int64(time.Duration(ms)*time.Millisecond))
+	}
+}
+
+// Sets the duration in milliseconds above which any exported operation logs
+// a warning with its arguments and timing, to surface mdbx stalls such as map
+// growth or dirty page spills. 0 disables the warning.
+//export SetSlowThreshold
+func SetSlowThreshold(ms uint64) {
+	atomic.StoreInt64(&slowOpThreshold, int64(time.Duration(ms)*time.Millisecond))
+}
+
+// Starts timing op and returns the func to defer at its end, which records
+// the latency in the metrics and warns if op was slow. args are logged as
+// key/value pairs with the warning; byte strings are best passed as
+// hexutil.Bytes and lists as their length.
+func timeOp(op string, args ...interface{}) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		metrics.latency(op, d)
+
+		threshold := time.Duration(atomic.LoadInt64(&slowOpThreshold))
+		if threshold > 0 && d >= threshold {
+			ctx := append([]interface{}{"op", op, "elapsed", d}, args...)
+			libLog.Warn("slow operation", ctx...)
+		}
+	}
+}
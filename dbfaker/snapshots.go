@@ -0,0 +1,173 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import "runtime/cgo"
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/eth/ethconfig"
+	"github.com/ledgerwatch/erigon/turbo/snapshotsync"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Freezes the blocks in [blockFrom, blockTo) into headers, bodies and
+// transactions .seg files plus their indices in snapshotDir, exactly as
+// Erigon's block retirement does. Erigon names and aligns segments in
+// thousands of blocks, so both ends of the range must be multiples of 1000.
+// If prune is set, the frozen blocks are then deleted from the db so that,
+// like a real datadir, only the tip lives in mdbx. Pruning is refused if the
+// db still holds blocks below blockFrom (other than genesis), which Erigon's
+// pruning would delete along with the range.
+//
+// The transactions index needs the chain id, so a chain config must have been
+// written for the genesis block before calling this.
+//export DumpSnapshots
+func DumpSnapshots(dbPtr C.uintptr_t, snapshotDir string, blockFrom uint64, blockTo uint64, prune bool) (exit int) {
+	defer timeOp("DumpSnapshots", "snapshotDir", snapshotDir, "blockFrom", blockFrom, "blockTo", blockTo, "prune", prune)()
+	db := cgo.Handle(dbPtr).Value().(kv.RwDB)
+	return exitCode("DumpSnapshots", dumpSnapshots(context.Background(), db, snapshotDir, blockFrom, blockTo, prune))
+}
+
+func dumpSnapshots(ctx context.Context, db kv.RwDB, snapshotDir string, blockFrom, blockTo uint64, prune bool) (err error) {
+	if blockTo <= blockFrom {
+		return fmt.Errorf("empty block range [%d, %d)", blockFrom, blockTo)
+	}
+	if blockFrom%segmentStep != 0 || blockTo%segmentStep != 0 {
+		return fmt.Errorf("block range [%d, %d) is not aligned to segments of %d blocks", blockFrom, blockTo, segmentStep)
+	}
+
+	chainID, err := readChainID(db)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(snapshotDir, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "dbfaker-snapshots")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// dumping, indexing and (optionally) pruning are one step each
+	steps := uint64(2)
+	if prune {
+		steps++
+	}
+	reportProgress(ctx, 0, steps)
+
+	err = snapshotsync.DumpBlocks(ctx, blockFrom, blockTo, blockTo-blockFrom, tmpDir, snapshotDir, db, 1, log.LvlDebug)
+	if err != nil {
+		return fmt.Errorf("DumpBlocks: %w", err)
+	}
+	reportProgress(ctx, 1, steps)
+
+	snapshots := snapshotsync.NewRoSnapshots(snapshotsConfig(), snapshotDir)
+	defer snapshots.Close()
+	if err = snapshots.ReopenSegments(); err != nil {
+		return fmt.Errorf("ReopenSegments: %w", err)
+	}
+	rwDir, err := dir.OpenRw(snapshotDir)
+	if err != nil {
+		return err
+	}
+	defer rwDir.Close()
+	err = snapshotsync.BuildIndices(ctx, snapshots, rwDir, *chainID, tmpDir, blockFrom, log.LvlDebug)
+	if err != nil {
+		return fmt.Errorf("BuildIndices: %w", err)
+	}
+	reportProgress(ctx, 2, steps)
+
+	if !prune {
+		return nil
+	}
+
+	// only prune blocks the segments were opened with
+	if frozen := snapshots.BlocksAvailable(); frozen+1 < blockTo {
+		return fmt.Errorf("segments only cover blocks up to %d, not pruning [%d, %d)", frozen, blockFrom, blockTo)
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	// DeleteAncientBlocks deletes from the first block in the db on
+	first, ok, err := firstStoredBlock(tx)
+	if err != nil {
+		return err
+	}
+	if ok && first < blockFrom {
+		return fmt.Errorf("db holds block %d below the frozen range [%d, %d), not pruning", first, blockFrom, blockTo)
+	}
+	if err = rawdb.DeleteAncientBlocks(tx, blockTo, int(blockTo-blockFrom)); err != nil {
+		return err
+	}
+	reportProgress(ctx, 3, steps)
+	return nil
+}
+
+// Blocks per segment step, which Erigon names segment files by.
+const segmentStep = 1000
+
+// Returns the number of the lowest block with a stored header, not counting
+// genesis, which pruning always keeps.
+func firstStoredBlock(tx kv.Tx) (num uint64, ok bool, err error) {
+	c, err := tx.Cursor(kv.Headers)
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.Close()
+	k, _, err := c.First()
+	if err == nil && k != nil && binary.BigEndian.Uint64(k) == 0 {
+		k, _, err = c.Next()
+	}
+	if err != nil || k == nil {
+		return 0, false, err
+	}
+	return binary.BigEndian.Uint64(k), true, nil
+}
+
+// Snapshot settings of a node that keeps frozen blocks in snapshot files.
+func snapshotsConfig() ethconfig.Snapshot {
+	return ethconfig.Snapshot{Enabled: true, KeepBlocks: true}
+}
+
+// Reads the chain id from the chain config stored for the genesis block.
+func readChainID(db kv.RoDB) (chainID *uint256.Int, err error) {
+	err = db.View(context.Background(), func(tx kv.Tx) error {
+		chainID, err = readChainIDTx(tx)
+		return err
+	})
+	return chainID, err
+}
+
+func readChainIDTx(tx kv.Tx) (*uint256.Int, error) {
+	genesis, err := rawdb.ReadCanonicalHash(tx, 0)
+	if err != nil {
+		return nil, err
+	}
+	config, err := rawdb.ReadChainConfig(tx, genesis)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.ChainID == nil {
+		return nil, fmt.Errorf("no chain config stored for genesis %x", genesis)
+	}
+	chainID, _ := uint256.FromBig(config.ChainID)
+	return chainID, nil
+}
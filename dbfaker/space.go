@@ -0,0 +1,211 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	mdbxgo "github.com/torquem-ch/mdbx-go/mdbx"
+)
+
+// How the pages of a db are used. The file holds TotalPages pages, of which
+// the first UsedPages have been allocated at some point; FreePages of those
+// are on the freelist (mdbx's GC table), waiting to be reused. The rest of the
+// allocated pages hold the tables, listed largest first.
+type spaceReport struct {
+	PageSize   uint64       `json:"pageSize"`
+	FileSize   uint64       `json:"fileSize"`
+	MapUpper   uint64       `json:"mapUpper"`
+	TotalPages uint64       `json:"totalPages"`
+	UsedPages  uint64       `json:"usedPages"`
+	FreePages  uint64       `json:"freePages"`
+	Tables     []tableSpace `json:"tables"`
+}
+
+type tableSpace struct {
+	Name    string `json:"name"`
+	Entries uint64 `json:"entries"`
+	Pages   uint64 `json:"pages"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Returns a JSON document describing how the space of the db is used: its
+// page size, file size and map upper bound, the number of pages in the file,
+// allocated and on the freelist, and the limit largest tables (all of them if
+// limit is 0) with their entries, pages and bytes. A large freelist means
+// ReclaimSpace would shrink the file. The report must be released with
+// FreeBytes.
+//export SpaceReport
+func SpaceReport(dbPtr C.uintptr_t, limit uint64) (exit int, report *C.char) {
+	defer timeOp("SpaceReport", "limit", limit)()
+	r, err := reportSpace(getDbHandle(dbPtr), limit)
+	if err != nil {
+		return exitCode("SpaceReport", err), nil
+	}
+	enc, err := json.Marshal(r)
+	if err != nil {
+		return exitCode("SpaceReport", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func reportSpace(db kv.RwDB, limit uint64) (*spaceReport, error) {
+	env, err := mdbxEnv(db)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &spaceReport{}
+	err = env.View(func(txn *mdbxgo.Txn) error {
+		info, err := env.Info(txn)
+		if err != nil {
+			return fmt.Errorf("env info: %w", err)
+		}
+		st, err := env.Stat()
+		if err != nil {
+			return fmt.Errorf("env stat: %w", err)
+		}
+		r.PageSize = uint64(st.PSize)
+		r.FileSize = info.Geo.Current
+		r.MapUpper = info.Geo.Upper
+		r.TotalPages = info.Geo.Current / r.PageSize
+		r.UsedPages = uint64(info.LastPNO) + 1
+
+		if r.FreePages, err = freelistPages(txn); err != nil {
+			return fmt.Errorf("freelist: %w", err)
+		}
+		r.Tables, err = tableSpaces(txn, r.PageSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(r.Tables, func(i, j int) bool {
+		return r.Tables[i].Pages > r.Tables[j].Pages
+	})
+	if limit > 0 && uint64(len(r.Tables)) > limit {
+		r.Tables = r.Tables[:limit]
+	}
+	return r, nil
+}
+
+// The table mdbx keeps freed pages in until no reader can see them.
+const gcDBI mdbxgo.DBI = 0
+
+// Counts the pages on the freelist. Each GC record is a list of page numbers
+// prefixed with its length, all native (little) endian 32-bit integers.
+func freelistPages(txn *mdbxgo.Txn) (uint64, error) {
+	c, err := txn.OpenCursor(gcDBI)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var n uint64
+	for _, v, err := c.Get(nil, nil, mdbxgo.First); ; _, v, err = c.Get(nil, nil, mdbxgo.Next) {
+		if mdbxgo.IsNotFound(err) {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(v) >= 4 {
+			n += uint64(binary.LittleEndian.Uint32(v))
+		}
+	}
+}
+
+func tableSpaces(txn *mdbxgo.Txn, pageSize uint64) ([]tableSpace, error) {
+	var out []tableSpace
+	for _, name := range dbTables() {
+		dbi, err := txn.OpenDBISimple(name, 0)
+		if mdbxgo.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		st, err := txn.StatDBI(dbi)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		pages := st.BranchPages + st.LeafPages + st.OverflowPages
+		out = append(out, tableSpace{Name: name, Entries: st.Entries, Pages: pages, Bytes: pages * pageSize})
+	}
+	return out, nil
+}
+
+// Shrinks the closed db in the directory path to the size of its data by
+// rewriting it with a compacting copy, which drops the freelist that heavily
+// rewritten fixture dbs accumulate, and returns the number of bytes the file
+// shrank by. The copy replaces the data file only once complete. The db must
+// not be open, in this process or another.
+//export ReclaimSpace
+func ReclaimSpace(path string) (exit int, freed uint64) {
+	defer timeOp("ReclaimSpace", "path", path)()
+	freed, err := reclaimSpace(path)
+	return exitCode("ReclaimSpace", err), freed
+}
+
+func reclaimSpace(path string) (freed uint64, err error) {
+	// keeps MdbxOpen from opening path while it is being replaced
+	openDbs.Lock()
+	defer openDbs.Unlock()
+	if pathInUse(canonicalPath(path)) {
+		return 0, fmt.Errorf("db %s is open", path)
+	}
+
+	if path, err = platformPath(path); err != nil {
+		return 0, err
+	}
+	datFile := filepath.Join(path, mdbxDataFile)
+	before, err := os.Stat(datFile)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.MkdirTemp(path, "reclaim-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	db, err := openEnv(libLog.New("db", path), path)
+	if err != nil {
+		return 0, err
+	}
+	err = copyEnv(db, tmp)
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := filepath.Join(tmp, mdbxDataFile)
+	after, err := os.Stat(compacted)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Rename(compacted, datFile); err != nil {
+		return 0, err
+	}
+	// the lock file tracks the readers of the replaced data
+	if err = os.Remove(filepath.Join(path, mdbxLockFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	if after.Size() >= before.Size() {
+		return 0, nil
+	}
+	return uint64(before.Size() - after.Size()), nil
+}
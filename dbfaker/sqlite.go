@@ -0,0 +1,291 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+// Dumps the tables in the comma-separated list tables, or the decoded tables
+// below if tables is empty, into a SQLite database at path, replacing any
+// SQL tables of the same names. PlainState, Code, HeaderCanonical, Headers,
+// BlockBody and TxLookup are decoded into typed columns (see sqlDecoders);
+// any other table is dumped as raw key and value blobs. Hashes and addresses
+// are 0x-prefixed hex, amounts that may not fit in 64 bits are decimal text.
+// The SQL is streamed to the sqlite3 command-line shell, which must be on the
+// PATH; if path ends in ".sql", the SQL script is written there instead, to be
+// loaded with sqlite3 later.
+//export ExportSQLite
+func ExportSQLite(dbPtr C.uintptr_t, path string, tables string) (exit int) {
+	defer timeOp("ExportSQLite", "path", path, "tables", tables)()
+	return exitCode("ExportSQLite", exportSQLite(context.Background(), getDbHandle(dbPtr), path, splitTables(tables)))
+}
+
+// Writes the SQL tables for the entries of one chaindata table: create
+// statements, then one call of insert per entry.
+type sqlDecoder struct {
+	schema []string
+	insert func(w *sqlWriter, k, v []byte) error
+}
+
+// Chaindata tables with typed SQL tables, in the order they are exported by
+// default.
+var sqlTables = []string{kv.PlainState, kv.Code, kv.HeaderCanonical, kv.Headers, kv.BlockBody, kv.TxLookup}
+
+var sqlDecoders = map[string]sqlDecoder{
+	kv.PlainState: {
+		schema: []string{
+			"CREATE TABLE accounts (address TEXT PRIMARY KEY, nonce INTEGER, balance TEXT, incarnation INTEGER, code_hash TEXT)",
+			"CREATE TABLE storage (address TEXT, incarnation INTEGER, slot TEXT, value TEXT, PRIMARY KEY (address, incarnation, slot))",
+		},
+		insert: sqlPlainState,
+	},
+	kv.Code: {
+		schema: []string{"CREATE TABLE code (code_hash TEXT PRIMARY KEY, code BLOB)"},
+		insert: func(w *sqlWriter, k, v []byte) error {
+			return w.insert("code", sqlHex(k), sqlBlob(v))
+		},
+	},
+	kv.HeaderCanonical: {
+		schema: []string{"CREATE TABLE canonical (number INTEGER PRIMARY KEY, hash TEXT)"},
+		insert: func(w *sqlWriter, k, v []byte) error {
+			if len(k) != 8 {
+				return fmt.Errorf("key %x is not a block number", k)
+			}
+			return w.insert("canonical", sqlUint(binary.BigEndian.Uint64(k)), sqlHex(v))
+		},
+	},
+	kv.Headers: {
+		schema: []string{
+			"CREATE TABLE headers (number INTEGER, hash TEXT PRIMARY KEY, parent_hash TEXT, miner TEXT, state_root TEXT, " +
+				"tx_root TEXT, receipt_root TEXT, difficulty TEXT, gas_limit INTEGER, gas_used INTEGER, timestamp INTEGER, " +
+				"base_fee TEXT, extra BLOB)",
+			"CREATE INDEX headers_number ON headers (number)",
+		},
+		insert: sqlHeader,
+	},
+	kv.BlockBody: {
+		schema: []string{"CREATE TABLE bodies (number INTEGER, hash TEXT PRIMARY KEY, base_tx_id INTEGER, tx_count INTEGER, uncle_count INTEGER)"},
+		insert: sqlBody,
+	},
+	kv.TxLookup: {
+		schema: []string{"CREATE TABLE tx_lookup (tx_hash TEXT PRIMARY KEY, block_number INTEGER)"},
+		insert: func(w *sqlWriter, k, v []byte) error {
+			// the value format depends on the schema of the db
+			return w.insert("tx_lookup", sqlHex(k), sqlUint(w.schema.txLookupBlock(v)))
+		},
+	},
+}
+
+func exportSQLite(ctx context.Context, db *dbHandle, path string, tables []string) (err error) {
+	for _, table := range tables {
+		if !isChaindataTable(table) {
+			return fmt.Errorf("unknown table %q", table)
+		}
+	}
+	if len(tables) == 0 {
+		tables = sqlTables
+	}
+
+	if strings.HasSuffix(path, ".sql") {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err = writeSQLDump(ctx, db, tables, f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	shell, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return errors.New("the sqlite3 shell is not on the PATH; export to a .sql file and load it with sqlite3 instead")
+	}
+	cmd := exec.CommandContext(ctx, shell, "-bail", path)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	werr := writeSQLDump(ctx, db, tables, stdin)
+	stdin.Close()
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("sqlite3: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return werr
+}
+
+// Streams the SQL for tables to w in a single SQL transaction, reading them
+// in one read transaction.
+func writeSQLDump(ctx context.Context, db *dbHandle, tables []string, out io.Writer) error {
+	w := &sqlWriter{w: bufio.NewWriter(out), schema: db.currentSchema()}
+	w.exec("PRAGMA journal_mode = OFF")
+	w.exec("PRAGMA synchronous = OFF")
+	w.exec("BEGIN")
+	err := db.View(ctx, func(tx kv.Tx) error {
+		for i, table := range tables {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := w.table(tx, table); err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			reportProgress(ctx, uint64(i+1), uint64(len(tables)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.exec("COMMIT")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Writes SQL statements, keeping the first write error.
+type sqlWriter struct {
+	w      *bufio.Writer
+	schema schemaAdapter
+	err    error
+}
+
+func (w *sqlWriter) exec(stmt string) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, "%s;\n", stmt)
+	}
+}
+
+func (w *sqlWriter) insert(table string, values ...string) error {
+	w.exec(fmt.Sprintf("INSERT INTO %s VALUES (%s)", sqlIdent(table), strings.Join(values, ", ")))
+	return w.err
+}
+
+func (w *sqlWriter) table(tx kv.Tx, table string) error {
+	dec, ok := sqlDecoders[table]
+	if !ok {
+		dec = sqlDecoder{
+			schema: []string{fmt.Sprintf("CREATE TABLE %s (key BLOB, value BLOB)", sqlIdent(table))},
+			insert: func(w *sqlWriter, k, v []byte) error {
+				return w.insert(table, sqlBlob(k), sqlBlob(v))
+			},
+		}
+	}
+	for _, stmt := range dec.schema {
+		if strings.HasPrefix(stmt, "CREATE TABLE ") {
+			name := strings.Fields(stmt)[2]
+			w.exec("DROP TABLE IF EXISTS " + name)
+		}
+		w.exec(stmt)
+	}
+
+	c, err := tx.Cursor(table)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		if err := dec.insert(w, k, v); err != nil {
+			return fmt.Errorf("%x: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func sqlPlainState(w *sqlWriter, k, v []byte) error {
+	switch len(k) {
+	case common.AddressLength:
+		var acct accounts.Account
+		if err := acct.DecodeForStorage(v); err != nil {
+			return fmt.Errorf("DecodeForStorage: %w", err)
+		}
+		return w.insert("accounts", sqlHex(k), sqlUint(acct.Nonce), sqlText(acct.Balance.ToBig().String()),
+			sqlUint(acct.Incarnation), sqlHex(acct.CodeHash.Bytes()))
+	case common.AddressLength + 8 + common.HashLength:
+		addr, inc, slot := k[:common.AddressLength], k[common.AddressLength:common.AddressLength+8], k[common.AddressLength+8:]
+		return w.insert("storage", sqlHex(addr), sqlUint(binary.BigEndian.Uint64(inc)), sqlHex(slot), sqlHex(v))
+	}
+	return fmt.Errorf("unexpected key length %d", len(k))
+}
+
+func sqlHeader(w *sqlWriter, k, v []byte) error {
+	var h types.Header
+	if err := rlp.DecodeBytes(v, &h); err != nil {
+		return fmt.Errorf("Header DecodeBytes: %w", err)
+	}
+	baseFee := "NULL"
+	if h.BaseFee != nil {
+		baseFee = sqlText(h.BaseFee.String())
+	}
+	return w.insert("headers", sqlUint(h.Number.Uint64()), sqlHex(h.Hash().Bytes()), sqlHex(h.ParentHash.Bytes()),
+		sqlHex(h.Coinbase.Bytes()), sqlHex(h.Root.Bytes()), sqlHex(h.TxHash.Bytes()), sqlHex(h.ReceiptHash.Bytes()),
+		sqlText(h.Difficulty.String()), sqlUint(h.GasLimit), sqlUint(h.GasUsed), sqlUint(h.Time), baseFee, sqlBlob(h.Extra))
+}
+
+func sqlBody(w *sqlWriter, k, v []byte) error {
+	if len(k) != 8+common.HashLength {
+		return fmt.Errorf("unexpected key length %d", len(k))
+	}
+	var body types.BodyForStorage
+	if err := rlp.DecodeBytes(v, &body); err != nil {
+		return fmt.Errorf("BodyForStorage DecodeBytes: %w", err)
+	}
+	return w.insert("bodies", sqlUint(binary.BigEndian.Uint64(k[:8])), sqlHex(k[8:]), sqlUint(body.BaseTxId),
+		sqlUint(uint64(body.TxAmount)), sqlUint(uint64(len(body.Uncles))))
+}
+
+// SQL literals. SQLite integers are signed 64-bit, so larger numbers are
+// stored as decimal text.
+
+func sqlUint(n uint64) string {
+	if n > math.MaxInt64 {
+		return sqlText(strconv.FormatUint(n, 10))
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+func sqlText(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlHex(b []byte) string {
+	return sqlText("0x" + common.Bytes2Hex(b))
+}
+
+func sqlBlob(b []byte) string {
+	return "X'" + common.Bytes2Hex(b) + "'"
+}
+
+func sqlIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,114 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"os"
+	"runtime/cgo"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A cgo handle keeps its value reachable until the host deletes it, so a
+// finalizer on a read transaction the host forgot would never run. Instead,
+// read transactions are swept by age: one open for longer than the timeout
+// is logged once, and rolled back if so configured, so that a leaked reader
+// cannot pin old pages of the db forever. Defaults to
+// DBFAKER_READ_TX_TIMEOUT_MS, which only logs, and is changed with
+// SetReadTxTimeout.
+var staleReads = struct {
+	sync.Mutex
+	timeout  time.Duration
+	rollback bool
+	stop     chan struct{}
+}{}
+
+func init() {
+	if ms, err := strconv.ParseUint(os.Getenv("DBFAKER_READ_TX_TIMEOUT_MS"), 10, 32); err == nil {
+		setReadTxTimeout(time.Duration(ms)*time.Millisecond, false)
+	}
+}
+
+// Sets the age in milliseconds above which a read transaction from ReadBegin
+// that has not been ended is logged as leaked, with the age and pointer, and,
+// if rollback is set, rolled back to release its reader slot and the pages it
+// pins. Reads through a rolled back transaction fail; it must still be ended
+// with ReadEnd. 0 disables the sweep.
+//export SetReadTxTimeout
+func SetReadTxTimeout(ms uint64, rollback bool) {
+	setReadTxTimeout(time.Duration(ms)*time.Millisecond, rollback)
+}
+
+func setReadTxTimeout(timeout time.Duration, rollback bool) {
+	staleReads.Lock()
+	defer staleReads.Unlock()
+	if staleReads.stop != nil {
+		close(staleReads.stop)
+		staleReads.stop = nil
+	}
+	staleReads.timeout, staleReads.rollback = timeout, rollback
+	if timeout <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	staleReads.stop = stop
+	go sweepStaleReads(timeout, rollback, stop)
+}
+
+// Checks the live read transactions a few times per timeout until stopped.
+func sweepStaleReads(timeout time.Duration, rollback bool, stop chan struct{}) {
+	interval := timeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reapStaleReads(timeout, rollback)
+		}
+	}
+}
+
+func reapStaleReads(timeout time.Duration, rollback bool) {
+	var stale []handleInfo
+	liveHandles.Lock()
+	for _, info := range liveHandles.byPtr {
+		if info.Kind == "tx" && time.Since(info.Created) >= timeout {
+			stale = append(stale, info)
+		}
+	}
+	liveHandles.Unlock()
+
+	for _, info := range stale {
+		// ReadEnd may have released the handle since it was listed
+		liveHandles.Lock()
+		_, live := liveHandles.byPtr[C.uintptr_t(info.Ptr)]
+		var tx *readTx
+		if live {
+			tx = cgo.Handle(info.Ptr).Value().(*readTx)
+		}
+		liveHandles.Unlock()
+		if !live || !tx.markStale() {
+			continue
+		}
+		libLog.Warn("read transaction outlived its timeout", "ptr", info.Ptr, "age", time.Since(info.Created), "rollback", rollback)
+		if rollback {
+			tx.db.readersMu.Lock()
+			delete(tx.db.readers, tx)
+			tx.db.readersMu.Unlock()
+			tx.end()
+		}
+	}
+}
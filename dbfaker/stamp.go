@@ -0,0 +1,118 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/ethdb/prune"
+	"github.com/ledgerwatch/erigon/migrations"
+)
+
+// Whether MdbxOpen stamps the dbs it opens, and the chain whose genesis it
+// writes into empty ones. Defaults to DBFAKER_STAMP_CHAIN, which turns
+// stamping on when set, and is changed with SetStampOnOpen.
+var openStamp = struct {
+	sync.Mutex
+	enabled bool
+	chain   string
+}{}
+
+func init() {
+	if chain, ok := os.LookupEnv("DBFAKER_STAMP_CHAIN"); ok {
+		openStamp.enabled, openStamp.chain = true, chain
+	}
+}
+
+// Makes MdbxOpen stamp every db it opens from now on with the keys Erigon
+// writes when it first opens a db, as StampDatabaseInfo does, so that tooling
+// checking them accepts faked dbs. chain is passed on to StampDatabaseInfo.
+// Dbs that are already open are left alone.
+//export SetStampOnOpen
+func SetStampOnOpen(enabled bool, chain string) (exit int) {
+	defer timeOp("SetStampOnOpen", "enabled", enabled, "chain", chain)()
+	if _, ok := seedGenesis[chain]; chain != "" && !ok {
+		return exitCode("SetStampOnOpen", fmt.Errorf("unknown chain %q, expected one of %v", chain, seedChains()))
+	}
+	openStamp.Lock()
+	defer openStamp.Unlock()
+	// the string is only valid for the duration of this call
+	openStamp.enabled, openStamp.chain = enabled, string([]byte(chain))
+	return 1
+}
+
+// Returns the chain to stamp opened dbs for, if stamping is on.
+func stampOnOpen() (chain string, ok bool) {
+	openStamp.Lock()
+	defer openStamp.Unlock()
+	return openStamp.chain, openStamp.enabled
+}
+
+// Writes the keys Erigon stamps a db with when it first opens it, where they
+// are missing: the schema version, the migrations of the compiled Erigon
+// version as applied, and the default prune mode. If chain is not empty and
+// the db has no genesis yet, the genesis block and chain config of chain
+// (one of the chains of `seed`) are written too, which is what identifies
+// the chain of a db to Erigon. Existing keys are kept, so stamping twice is
+// harmless.
+//export StampDatabaseInfo
+func StampDatabaseInfo(dbPtr C.uintptr_t, chain string) (exit int) {
+	defer timeOp("StampDatabaseInfo", "chain", chain)()
+	return exitCode("StampDatabaseInfo", stampDatabaseInfo(context.Background(), getDbHandle(dbPtr), chain))
+}
+
+func stampDatabaseInfo(ctx context.Context, db *dbHandle, chain string) (err error) {
+	// the keys of an older schema would be stamped with the wrong meaning
+	if v := db.currentSchema().version(); v.Major != kv.DBSchemaVersion.Major {
+		return fmt.Errorf("db has schema version %d.%d.%d, which stamping does not cover", v.Major, v.Minor, v.Patch)
+	}
+
+	tx, closer, err := beginCtx(withInsertOnly(ctx, false), db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	if chain != "" {
+		if err = ensureGenesis(tx, chain); err != nil {
+			return err
+		}
+	}
+
+	done, err := migrations.AppliedMigrations(tx, false)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, mig := range migrations.NewMigrator(kv.ChainDB).Migrations {
+		if _, ok := done[mig.Name]; !ok {
+			pending = append(pending, mig.Name)
+		}
+	}
+	if err = putMigrationRecords(tx, pending); err != nil {
+		return err
+	}
+
+	v, err := tx.GetOne(kv.DatabaseInfo, kv.DBSchemaVersionKey)
+	if err != nil {
+		return err
+	}
+	if len(v) == 0 {
+		if err = writeSchemaVersion(tx, db.currentSchema().version()); err != nil {
+			return err
+		}
+	}
+
+	// an uninitialised mode writes the default where the db has none, and
+	// keeps whatever mode it has
+	_, err = prune.EnsureNotChanged(tx, prune.Mode{})
+	return err
+}
@@ -0,0 +1,339 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/core/vm"
+)
+
+// The change of one value across a block. Balances, nonces and code are null
+// on a side where the account does not exist.
+type valueDiff struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// The changes a block made to one account, listing only what changed.
+type accountDiff struct {
+	Balance *valueDiff                 `json:"balance,omitempty"`
+	Nonce   *valueDiff                 `json:"nonce,omitempty"`
+	Code    *valueDiff                 `json:"code,omitempty"`
+	Storage map[common.Hash]*valueDiff `json:"storage,omitempty"`
+}
+
+// An account on one side of a block, with the slots the block touched. acct
+// is nil if the account does not exist.
+type accountState struct {
+	acct    *accounts.Account
+	code    []byte
+	storage map[common.Hash]common.Hash
+}
+
+// The slots of each account a block touched.
+type touchedState map[common.Address]map[common.Hash]struct{}
+
+func (t touchedState) touch(address common.Address) map[common.Hash]struct{} {
+	if t[address] == nil {
+		t[address] = make(map[common.Hash]struct{})
+	}
+	return t[address]
+}
+
+// Returns the state diff of the canonical block blockNum as JSON: an object
+// keyed by address of the accounts the block changed, each with the
+// "balance", "nonce", "code" and "storage" (keyed by slot) that changed, as
+// {"from", "to"} pairs of their values before and after the block. Balances,
+// nonces and code are null where the account does not exist. By default the
+// accounts are those the block's changesets list, with their values read
+// from the history tables, so the diff is exactly what SetHistory recorded
+// for a seeded block. With execute, the block is instead re-executed on the
+// state before it, as TraceCall does, which needs a chain config and leaves
+// out the block reward, since no consensus engine runs; storage an account
+// had before it self-destructed is only listed where the block wrote to it.
+// The result must be released with FreeBytes.
+//export StateDiff
+func StateDiff(dbPtr C.uintptr_t, blockNum uint64, execute bool) (exit int, diff *C.char) {
+	defer timeOp("StateDiff", "blockNum", blockNum, "execute", execute)()
+	d, err := stateDiff(context.Background(), getDbHandle(dbPtr), blockNum, execute)
+	if err != nil {
+		return exitCode("StateDiff", err), nil
+	}
+	enc, err := json.Marshal(d)
+	if err != nil {
+		return exitCode("StateDiff", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func stateDiff(ctx context.Context, h *dbHandle, blockNum uint64, execute bool) (d map[common.Address]*accountDiff, err error) {
+	err = h.View(ctx, func(tx kv.Tx) error {
+		d, err = stateDiffTx(ctx, h, tx, blockNum, execute)
+		return err
+	})
+	return d, err
+}
+
+func stateDiffTx(ctx context.Context, h *dbHandle, tx kv.Tx, blockNum uint64, execute bool) (map[common.Address]*accountDiff, error) {
+	hash, err := rawdb.ReadCanonicalHash(tx, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if hash == (common.Hash{}) {
+		return nil, fmt.Errorf("no canonical block %d", blockNum)
+	}
+
+	before := state.NewPlainState(tx, blockNum)
+	var touched touchedState
+	var after func(address common.Address, slots map[common.Hash]struct{}, prev *accountState) (*accountState, error)
+	if execute {
+		block, senders, err := readBlockWithSenders(ctx, h, tx, blockNum)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			return nil, fmt.Errorf("no canonical block %d", blockNum)
+		}
+		w := newDiffWriter()
+		noVmConfig := func(int) vm.Config { return vm.Config{} }
+		ignore := func(int, types.Message, *core.ExecutionResult) error { return nil }
+		if err := replayBlock(ctx, tx, block, senders, -1, noVmConfig, ignore, w); err != nil {
+			return nil, err
+		}
+		touched = w.touched
+		after = func(address common.Address, _ map[common.Hash]struct{}, prev *accountState) (*accountState, error) {
+			return w.accountState(before, address, prev)
+		}
+	} else {
+		if touched, err = changesetTouched(tx, blockNum); err != nil {
+			return nil, err
+		}
+		afterReader := stateAt(tx, blockNum)
+		after = func(address common.Address, slots map[common.Hash]struct{}, _ *accountState) (*accountState, error) {
+			return readAccountState(afterReader, address, slots)
+		}
+	}
+
+	diff := make(map[common.Address]*accountDiff)
+	for address, slots := range touched {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b, err := readAccountState(before, address, slots)
+		if err != nil {
+			return nil, fmt.Errorf("account %x before: %w", address, err)
+		}
+		a, err := after(address, slots, b)
+		if err != nil {
+			return nil, fmt.Errorf("account %x after: %w", address, err)
+		}
+		if d := diffAccount(b, a); d != nil {
+			diff[address] = d
+		}
+	}
+	return diff, nil
+}
+
+// Returns the accounts and slots the changesets of blockNum list.
+func changesetTouched(tx kv.Tx, blockNum uint64) (touchedState, error) {
+	touched := make(touchedState)
+	key := dbutils.EncodeBlockNumber(blockNum)
+	// AccountChangeSet: block => address + account before the block
+	err := tx.ForPrefix(kv.AccountChangeSet, key, func(k, v []byte) error {
+		if len(v) < common.AddressLength {
+			return fmt.Errorf("malformed account changeset entry %x", k)
+		}
+		touched.touch(common.BytesToAddress(v[:common.AddressLength]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// StorageChangeSet: block + address + incarnation => slot + value before the block
+	err = tx.ForPrefix(kv.StorageChangeSet, key, func(k, v []byte) error {
+		if len(k) != 8+common.AddressLength+8 || len(v) < common.HashLength {
+			return fmt.Errorf("malformed storage changeset entry %x", k)
+		}
+		slots := touched.touch(common.BytesToAddress(k[8 : 8+common.AddressLength]))
+		slots[common.BytesToHash(v[:common.HashLength])] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return touched, nil
+}
+
+// Reads an account and the given slots of it from r.
+func readAccountState(r state.StateReader, address common.Address, slots map[common.Hash]struct{}) (*accountState, error) {
+	acct, err := r.ReadAccountData(address)
+	if err != nil {
+		return nil, err
+	}
+	s := &accountState{acct: acct, storage: make(map[common.Hash]common.Hash, len(slots))}
+	if acct == nil {
+		return s, nil
+	}
+	if !acct.IsEmptyCodeHash() {
+		if s.code, err = r.ReadAccountCode(address, acct.Incarnation, acct.CodeHash); err != nil {
+			return nil, err
+		}
+	}
+	for slot := range slots {
+		slot := slot
+		v, err := r.ReadAccountStorage(address, acct.Incarnation, &slot)
+		if err != nil {
+			return nil, err
+		}
+		s.storage[slot] = common.BytesToHash(v)
+	}
+	return s, nil
+}
+
+// The balance, nonce and code of an account as JSON values, nil if it does
+// not exist, so that they compare with ==.
+type accountFields struct {
+	balance, nonce, code interface{}
+}
+
+func (s *accountState) fields() accountFields {
+	if s.acct == nil {
+		return accountFields{}
+	}
+	return accountFields{
+		balance: hexutil.EncodeBig(s.acct.Balance.ToBig()),
+		nonce:   hexutil.EncodeUint64(s.acct.Nonce),
+		code:    hexutil.Encode(s.code),
+	}
+}
+
+// Returns what changed between before and after, nil if nothing did.
+func diffAccount(before, after *accountState) *accountDiff {
+	from, to := before.fields(), after.fields()
+	d := &accountDiff{
+		Balance: diffValues(from.balance, to.balance),
+		Nonce:   diffValues(from.nonce, to.nonce),
+		Code:    diffValues(from.code, to.code),
+	}
+	slots := make(map[common.Hash]struct{})
+	for slot := range before.storage {
+		slots[slot] = struct{}{}
+	}
+	for slot := range after.storage {
+		slots[slot] = struct{}{}
+	}
+	for slot := range slots {
+		if v := diffValues(before.storage[slot], after.storage[slot]); v != nil {
+			if d.Storage == nil {
+				d.Storage = make(map[common.Hash]*valueDiff)
+			}
+			d.Storage[slot] = v
+		}
+	}
+	if d.Balance == nil && d.Nonce == nil && d.Code == nil && d.Storage == nil {
+		return nil
+	}
+	return d
+}
+
+func diffValues(from, to interface{}) *valueDiff {
+	if from == to {
+		return nil
+	}
+	return &valueDiff{From: from, To: to}
+}
+
+// A state writer that keeps the last value a block wrote to each account and
+// slot, for re-executed blocks.
+type diffWriter struct {
+	touched  touchedState
+	accounts map[common.Address]*accounts.Account
+	code     map[common.Hash][]byte
+	storage  map[common.Address]map[common.Hash]common.Hash
+}
+
+func newDiffWriter() *diffWriter {
+	return &diffWriter{
+		touched:  make(touchedState),
+		accounts: make(map[common.Address]*accounts.Account),
+		code:     make(map[common.Hash][]byte),
+		storage:  make(map[common.Address]map[common.Hash]common.Hash),
+	}
+}
+
+func (w *diffWriter) UpdateAccountData(address common.Address, original, account *accounts.Account) error {
+	w.touched.touch(address)
+	w.accounts[address] = account.SelfCopy()
+	return nil
+}
+
+func (w *diffWriter) UpdateAccountCode(address common.Address, incarnation uint64, codeHash common.Hash, code []byte) error {
+	w.code[codeHash] = common.CopyBytes(code)
+	return nil
+}
+
+func (w *diffWriter) DeleteAccount(address common.Address, original *accounts.Account) error {
+	w.touched.touch(address)
+	w.accounts[address] = nil
+	// the storage of the account goes with it
+	for slot := range w.storage[address] {
+		w.storage[address][slot] = common.Hash{}
+	}
+	return nil
+}
+
+func (w *diffWriter) WriteAccountStorage(address common.Address, incarnation uint64, key *common.Hash, original, value *uint256.Int) error {
+	w.touched.touch(address)[*key] = struct{}{}
+	if w.storage[address] == nil {
+		w.storage[address] = make(map[common.Hash]common.Hash)
+	}
+	w.storage[address][*key] = common.Hash(value.Bytes32())
+	return nil
+}
+
+func (w *diffWriter) CreateContract(address common.Address) error {
+	return nil
+}
+
+// Returns an account as the block left it, given its state before the block
+// in prev. Code the block did not deploy is read from r.
+func (w *diffWriter) accountState(r state.StateReader, address common.Address, prev *accountState) (*accountState, error) {
+	acct, written := w.accounts[address]
+	if !written {
+		acct = prev.acct
+	}
+	s := &accountState{acct: acct, storage: make(map[common.Hash]common.Hash, len(w.storage[address]))}
+	for slot, v := range w.storage[address] {
+		s.storage[slot] = v
+	}
+	if acct == nil || acct.IsEmptyCodeHash() {
+		return s, nil
+	}
+	if code, ok := w.code[acct.CodeHash]; ok {
+		s.code = code
+		return s, nil
+	}
+	code, err := r.ReadAccountCode(address, acct.Incarnation, acct.CodeHash)
+	if err != nil {
+		return nil, err
+	}
+	s.code = code
+	return s, nil
+}
@@ -0,0 +1,124 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Imports a stream of table entries read from a file descriptor (e.g. the
+// read end of a pipe) or, if fd is negative, from the file or named pipe at
+// path, instead of marshaling them through cgo. Each record is the length of
+// the table name, the name, the length of the key, the key, the length of the
+// value and the value, with lengths as uvarints like in fixtures; the stream
+// ends at EOF or with an empty table name. Records are sorted on disk as they
+// arrive, Erigon ETL style, so memory use does not grow with the stream, and
+// are written in one transaction once the stream has ended. Entries are put
+// over existing ones; tables are not cleared. The descriptor is closed when
+// the import finishes.
+//export ImportStream
+func ImportStream(dbPtr C.uintptr_t, fd int, path string) (exit int) {
+	defer timeOp("ImportStream", "fd", fd, "path", path)()
+	return exitCode("ImportStream", importStreamFrom(context.Background(), getDbHandle(dbPtr), fd, path))
+}
+
+func importStreamFrom(ctx context.Context, db kv.RwDB, fd int, path string) error {
+	var f *os.File
+	if fd >= 0 {
+		if f = os.NewFile(uintptr(fd), "import stream"); f == nil {
+			return fmt.Errorf("invalid file descriptor %d", fd)
+		}
+	} else {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	return importStream(ctx, db, f)
+}
+
+// Records between progress reports; the total is unknown until the end.
+const streamProgressEvery = 1 << 16
+
+func importStream(ctx context.Context, db kv.RwDB, r io.Reader) (err error) {
+	tmpdir, err := os.MkdirTemp("", "dbfaker-stream")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	collectors := make(map[string]*etl.Collector)
+	defer func() {
+		for _, c := range collectors {
+			c.Close()
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	var n uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name, err := readFixtureBytes(br)
+		if err == io.EOF || err == nil && len(name) == 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		table := string(name)
+		c, ok := collectors[table]
+		if !ok {
+			if !isChaindataTable(table) {
+				return fmt.Errorf("record %d: unknown table %q", n, table)
+			}
+			c = etl.NewCollector("ImportStream", tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize))
+			collectors[table] = c
+		}
+
+		// the collector keeps the slices until it flushes, so they are not
+		// pooled
+		k, err := readFixtureBytes(br)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		v, err := readFixtureBytes(br)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if err := c.Collect(k, v); err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		n++
+		if n%streamProgressEvery == 0 {
+			reportProgress(ctx, n, 0)
+		}
+	}
+
+	tx, closer, err := beginCtx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer closer(&err)
+
+	for table, c := range collectors {
+		if err := c.Load(tx, table, etl.IdentityLoadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	reportProgress(ctx, n, n)
+	return nil
+}
@@ -0,0 +1,234 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/vm"
+)
+
+// Options of a struct log trace, named as for debug_traceTransaction.
+type structLogConfig struct {
+	DisableStack     bool `json:"disableStack"`
+	DisableStorage   bool `json:"disableStorage"`
+	EnableMemory     bool `json:"enableMemory"`
+	EnableReturnData bool `json:"enableReturnData"`
+	// Maximum number of steps to record, 0 for no limit.
+	Limit int `json:"limit"`
+}
+
+// A struct log trace in the format of debug_traceTransaction.
+type structLogTrace struct {
+	Gas         uint64       `json:"gas"`
+	Failed      bool         `json:"failed"`
+	ReturnValue string       `json:"returnValue"`
+	StructLogs  []*structLog `json:"structLogs"`
+}
+
+// One executed opcode.
+type structLog struct {
+	Pc         uint64            `json:"pc"`
+	Op         string            `json:"op"`
+	Gas        uint64            `json:"gas"`
+	GasCost    uint64            `json:"gasCost"`
+	Depth      int               `json:"depth"`
+	Error      string            `json:"error,omitempty"`
+	Stack      []string          `json:"stack,omitempty"`
+	Memory     []string          `json:"memory,omitempty"`
+	ReturnData hexutil.Bytes     `json:"returnData,omitempty"`
+	Storage    map[string]string `json:"storage,omitempty"`
+}
+
+// Records a struct log of every opcode executed, at every depth. The storage
+// of a step is that of the executing contract as far as the transaction has
+// loaded or stored it, and is only recorded on SLOAD and SSTORE, as geth does.
+type structLogger struct {
+	cfg     structLogConfig
+	logs    []*structLog
+	storage map[common.Address]map[string]string
+	// SLOAD whose value is only on the stack at the next step.
+	load *pendingLoad
+}
+
+type pendingLoad struct {
+	log      *structLog
+	contract common.Address
+	slot     string
+	depth    int
+}
+
+func (l *structLogger) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	stack := scope.Stack.Data
+	if load := l.load; load != nil {
+		l.load = nil
+		if depth == load.depth && len(stack) > 0 {
+			l.store(load.contract, load.slot, stack[len(stack)-1].Bytes32())
+			load.log.Storage = l.storageOf(load.contract)
+		}
+	}
+	if l.cfg.Limit > 0 && len(l.logs) >= l.cfg.Limit {
+		return
+	}
+
+	log := &structLog{Pc: pc, Op: op.String(), Gas: gas, GasCost: cost, Depth: depth}
+	if err != nil {
+		log.Error = err.Error()
+	}
+	if !l.cfg.DisableStack {
+		log.Stack = make([]string, len(stack))
+		for i := range stack {
+			log.Stack[i] = stack[i].Hex()
+		}
+	}
+	if l.cfg.EnableMemory {
+		mem := scope.Memory.Data()
+		for i := 0; i+32 <= len(mem); i += 32 {
+			log.Memory = append(log.Memory, hex.EncodeToString(mem[i:i+32]))
+		}
+	}
+	if l.cfg.EnableReturnData && len(rData) > 0 {
+		log.ReturnData = append(hexutil.Bytes(nil), rData...)
+	}
+	if !l.cfg.DisableStorage && err == nil {
+		contract := scope.Contract.Address()
+		switch {
+		case op == vm.SSTORE && len(stack) >= 2:
+			l.store(contract, slotKey(stack[len(stack)-1].Bytes32()), stack[len(stack)-2].Bytes32())
+			log.Storage = l.storageOf(contract)
+		case op == vm.SLOAD && len(stack) >= 1:
+			l.load = &pendingLoad{log: log, contract: contract, slot: slotKey(stack[len(stack)-1].Bytes32()), depth: depth}
+		}
+	}
+	l.logs = append(l.logs, log)
+}
+
+func slotKey(b [32]byte) string {
+	return hex.EncodeToString(b[:])
+}
+
+func (l *structLogger) store(contract common.Address, slot string, value [32]byte) {
+	if l.storage == nil {
+		l.storage = make(map[common.Address]map[string]string)
+	}
+	if l.storage[contract] == nil {
+		l.storage[contract] = make(map[string]string)
+	}
+	l.storage[contract][slot] = hex.EncodeToString(value[:])
+}
+
+// Returns a copy of the storage seen so far of contract.
+func (l *structLogger) storageOf(contract common.Address) map[string]string {
+	cp := make(map[string]string, len(l.storage[contract]))
+	for k, v := range l.storage[contract] {
+		cp[k] = v
+	}
+	return cp
+}
+
+func (l *structLogger) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+func (l *structLogger) CaptureStart(env *vm.EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType vm.CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+}
+
+func (l *structLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+}
+
+func (l *structLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {}
+
+func (l *structLogger) CaptureAccountRead(account common.Address) error  { return nil }
+func (l *structLogger) CaptureAccountWrite(account common.Address) error { return nil }
+
+// Re-executes the stored transaction with hash txHash, as TraceCall does, and
+// returns its struct logs as JSON in the format of debug_traceTransaction:
+// {"gas", "failed", "returnValue", "structLogs"}, with the pc, op, gas,
+// gasCost, depth and error of every executed opcode. configJson takes the
+// options of debug_traceTransaction: "disableStack", "disableStorage",
+// "enableMemory", "enableReturnData" and "limit", the maximum number of steps
+// to record; an empty string is the defaults, with the stack and storage but
+// no memory and no limit. Traces of long transactions are large, so memory is
+// best left off and a limit set. The result must be released with FreeBytes.
+//export TraceStructLogs
+func TraceStructLogs(dbPtr C.uintptr_t, txHash []byte, configJson string) (exit int, trace *C.char) {
+	defer timeOp("TraceStructLogs", "txHash", hexutil.Bytes(txHash))()
+	var cfg structLogConfig
+	if configJson != "" {
+		if err := json.Unmarshal([]byte(configJson), &cfg); err != nil {
+			return exitCode("TraceStructLogs", fmt.Errorf("invalid config: %w", err)), nil
+		}
+	}
+	out, err := traceStructLogs(context.Background(), getDbHandle(dbPtr), common.BytesToHash(txHash), cfg)
+	if err != nil {
+		return exitCode("TraceStructLogs", err), nil
+	}
+	enc, err := json.Marshal(out)
+	if err != nil {
+		return exitCode("TraceStructLogs", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func traceStructLogs(ctx context.Context, h *dbHandle, txHash common.Hash, cfg structLogConfig) (out *structLogTrace, err error) {
+	err = h.View(ctx, func(tx kv.Tx) error {
+		out, err = traceStructLogsTx(ctx, h, tx, txHash, cfg)
+		return err
+	})
+	return out, err
+}
+
+func traceStructLogsTx(ctx context.Context, h *dbHandle, tx kv.Tx, txHash common.Hash, cfg structLogConfig) (*structLogTrace, error) {
+	if cfg.Limit < 0 {
+		return nil, fmt.Errorf("negative limit %d", cfg.Limit)
+	}
+	logger := &structLogger{cfg: cfg}
+	r, err := replayTx(ctx, h, tx, txHash, logger)
+	if err != nil {
+		return nil, err
+	}
+	logs := logger.logs
+	if logs == nil {
+		logs = []*structLog{}
+	}
+	return &structLogTrace{
+		Gas:         r.result.UsedGas,
+		Failed:      r.result.Failed(),
+		ReturnValue: hex.EncodeToString(r.result.Return()),
+		StructLogs:  logs,
+	}, nil
+}
+
+// Answers debug_traceTransaction with struct logs, or with the call tree for
+// {"tracer": "callTracer"}.
+func rpcTraceTransaction(ctx context.Context, h *dbHandle, tx kv.Tx, params []json.RawMessage) (interface{}, error) {
+	var hash common.Hash
+	if err := rpcParam(params, 0, &hash, false); err != nil {
+		return nil, err
+	}
+	var opts struct {
+		structLogConfig
+		Tracer string `json:"tracer"`
+	}
+	if err := rpcParam(params, 1, &opts, true); err != nil {
+		return nil, err
+	}
+	switch opts.Tracer {
+	case "":
+		return traceStructLogsTx(ctx, h, tx, hash, opts.structLogConfig)
+	case "callTracer":
+		return traceCallTx(ctx, h, tx, hash)
+	}
+	return nil, invalidParams("unsupported tracer %q", opts.Tracer)
+}
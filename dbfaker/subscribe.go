@@ -0,0 +1,208 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+#include <stdlib.h>     // for free
+
+typedef void (*dbfaker_commit_cb)(uintptr_t sub, const char *changes, void *user_data);
+
+static inline void dbfaker_call_commit(dbfaker_commit_cb cb, uintptr_t sub, const char *changes, void *user_data) {
+	cb(sub, changes, user_data);
+}
+*/
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/cgo"
+	"sort"
+	"unsafe"
+
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// A host callback invoked after each committed write transaction on a db
+// that touched one of its tables.
+type subscription struct {
+	ptr C.uintptr_t
+	db  *sharedDb
+	// nil to watch every table
+	tables   map[string]bool
+	withKeys bool
+	cb       C.dbfaker_commit_cb
+	userData unsafe.Pointer
+}
+
+// The most keys a change set holds. Past that, as in large imports, the keys
+// are dropped and notifications say they were truncated, rather than holding
+// every key in memory until the commit.
+const maxChangeSetKeys = 100_000
+
+// The tables a write transaction put or deleted, in the order they were first
+// touched, and the keys of those a subscription with keys watches.
+type changeSet struct {
+	tables []string
+	seen   map[string]bool
+	// Keys are kept for every table if allKeys is set, else for those in
+	// keyTables.
+	allKeys   bool
+	keyTables map[string]bool
+	keys      map[string][]hexutil.Bytes
+	numKeys   int
+	truncated bool
+}
+
+func (c *changeSet) record(table string, k []byte) {
+	if c == nil {
+		return
+	}
+	if !c.seen[table] {
+		c.seen[table] = true
+		c.tables = append(c.tables, table)
+	}
+	if c.truncated || !(c.allKeys || c.keyTables[table]) {
+		return
+	}
+	if c.numKeys == maxChangeSetKeys {
+		c.keys, c.truncated = nil, true
+		return
+	}
+	c.numKeys++
+	// mdbx may reuse the key's memory once the call returns
+	c.keys[table] = append(c.keys[table], append(hexutil.Bytes(nil), k...))
+}
+
+// Invokes cb with userData after every write transaction on the db that
+// commits puts or deletes in one of the tables in the comma-separated list
+// tables, or in any table if tables is empty. cb receives the subscription
+// pointer and a JSON object {"tables": [...]} naming the touched tables, or,
+// with withKeys, {"tables": [...], "keys": {"<table>": ["0x..", ...]}} with
+// the keys too. A transaction that touches more than maxChangeSetKeys
+// (100000) keys of the watched tables reports {"tables": [...],
+// "truncated": true} instead of its keys. The string is only valid for the
+// duration of the callback.
+// Writes through every pointer on the db's path notify, except writes in a
+// test transaction, which never commit. cb runs on the thread of the write
+// once it has committed, so it must be thread-safe; it may read the db but
+// must not write to it. Release the subscription with Unsubscribe.
+//export Subscribe
+func Subscribe(dbPtr C.uintptr_t, tables string, withKeys bool, cb C.dbfaker_commit_cb, userData unsafe.Pointer) (exit int, ptr C.uintptr_t) {
+	defer timeOp("Subscribe", "tables", tables, "withKeys", withKeys)()
+	if cb == nil {
+		return exitCode("Subscribe", errors.New("no callback")), *new(C.uintptr_t)
+	}
+	db := getDbHandle(dbPtr)
+	sub := &subscription{db: db.sharedDb, withKeys: withKeys, cb: cb, userData: userData}
+	if names := splitTables(tables); names != nil {
+		sub.tables = make(map[string]bool, len(names))
+		for _, table := range names {
+			if !isChaindataTable(table) {
+				return exitCode("Subscribe", fmt.Errorf("unknown table %q", table)), *new(C.uintptr_t)
+			}
+			sub.tables[table] = true
+		}
+	}
+	sub.ptr = registerHandle("subscription", "Subscribe", dbPtr, sub)
+
+	db.subsMu.Lock()
+	defer db.subsMu.Unlock()
+	if db.subs == nil {
+		db.subs = make(map[*subscription]struct{})
+	}
+	db.subs[sub] = struct{}{}
+	return 1, sub.ptr
+}
+
+// Stops a subscription from Subscribe and releases its pointer. A
+// notification already being delivered on another thread may still arrive.
+//export Unsubscribe
+func Unsubscribe(subPtr C.uintptr_t) {
+	sub := cgo.Handle(subPtr).Value().(*subscription)
+	sub.db.subsMu.Lock()
+	delete(sub.db.subs, sub)
+	sub.db.subsMu.Unlock()
+	releaseHandle(subPtr)
+}
+
+// Returns a change set for a new write transaction, or nil if nobody is
+// subscribed to the db. It only records keys if a subscription asked for
+// them, and only of the tables those subscriptions watch.
+func (s *sharedDb) newChangeSet() *changeSet {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if len(s.subs) == 0 {
+		return nil
+	}
+	c := &changeSet{seen: make(map[string]bool)}
+	for sub := range s.subs {
+		if !sub.withKeys {
+			continue
+		}
+		if sub.tables == nil {
+			c.allKeys = true
+			continue
+		}
+		if c.keyTables == nil {
+			c.keyTables = make(map[string]bool)
+		}
+		for table := range sub.tables {
+			c.keyTables[table] = true
+		}
+	}
+	if c.allKeys || c.keyTables != nil {
+		c.keys = make(map[string][]hexutil.Bytes)
+	}
+	return c
+}
+
+// Notifies the subscriptions of the db of a committed change set.
+func (s *sharedDb) notifyCommit(c *changeSet) {
+	if c == nil || len(c.tables) == 0 {
+		return
+	}
+	s.subsMu.Lock()
+	subs := make([]*subscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.subsMu.Unlock()
+	// a stable order, for hosts that compare notifications
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ptr < subs[j].ptr })
+
+	for _, sub := range subs {
+		sub.notify(c)
+	}
+}
+
+func (sub *subscription) notify(c *changeSet) {
+	type changes struct {
+		Tables    []string                   `json:"tables"`
+		Keys      map[string][]hexutil.Bytes `json:"keys,omitempty"`
+		Truncated bool                       `json:"truncated,omitempty"`
+	}
+	var msg changes
+	msg.Truncated = sub.withKeys && c.truncated
+	for _, table := range c.tables {
+		if sub.tables != nil && !sub.tables[table] {
+			continue
+		}
+		msg.Tables = append(msg.Tables, table)
+		if sub.withKeys && !c.truncated {
+			if msg.Keys == nil {
+				msg.Keys = make(map[string][]hexutil.Bytes)
+			}
+			msg.Keys[table] = c.keys[table]
+		}
+	}
+	if len(msg.Tables) == 0 {
+		return
+	}
+	// the changes only have plain fields, so encoding cannot fail
+	enc, _ := json.Marshal(msg)
+	cs := C.CString(string(enc))
+	defer C.free(unsafe.Pointer(cs))
+	C.dbfaker_call_commit(sub.cb, sub.ptr, cs, sub.userData)
+}
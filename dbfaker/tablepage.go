@@ -0,0 +1,185 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// One page of a table walk.
+type tablePage struct {
+	Entries []tableEntry `json:"entries"`
+	// token to pass for the next page, empty once the table is done
+	Next string `json:"next"`
+}
+
+type tableEntry struct {
+	Key   hexutil.Bytes `json:"key"`
+	Value hexutil.Bytes `json:"value"`
+}
+
+// Returns one page of the entries of table, in key order, as JSON
+// {"entries": [{"key", "value"}, ...], "next": token}, so that a table too
+// large for one call can be exported a page at a time. after is the "next"
+// token of the previous page, or empty for the first page; the last page has
+// an empty "next". A page holds at most limit entries and stops once its keys
+// and values add up to maxBytes, after at least one entry; 0 means no limit.
+// Each page is read in a read transaction of its own, so no transaction stays
+// open between pages, and a page resumes after the last entry of the previous
+// one even if the table was written to meanwhile. The result must be released
+// with FreeBytes.
+//export DumpTablePage
+func DumpTablePage(dbPtr C.uintptr_t, table string, after string, limit, maxBytes uint64) (exit int, page *C.char) {
+	defer timeOp("DumpTablePage", "table", table, "after", after, "limit", limit, "maxBytes", maxBytes)()
+	p, err := dumpTablePage(context.Background(), getDbHandle(dbPtr), table, after, limit, maxBytes)
+	if err != nil {
+		return exitCode("DumpTablePage", err), nil
+	}
+	enc, err := json.Marshal(p)
+	if err != nil {
+		return exitCode("DumpTablePage", err), nil
+	}
+	return 1, C.CString(string(enc))
+}
+
+func dumpTablePage(ctx context.Context, db kv.RoDB, table, after string, limit, maxBytes uint64) (*tablePage, error) {
+	if !isChaindataTable(table) {
+		return nil, fmt.Errorf("unknown table %q", table)
+	}
+	// an empty array rather than null for an empty page
+	page := &tablePage{Entries: []tableEntry{}}
+	err := db.View(ctx, func(tx kv.Tx) error {
+		var size uint64
+		next, more, err := walkTable(ctx, tx, table, after, func(k, v []byte) bool {
+			if limit > 0 && uint64(len(page.Entries)) == limit {
+				return false
+			}
+			if maxBytes > 0 && len(page.Entries) > 0 && size+uint64(len(k)+len(v)) > maxBytes {
+				return false
+			}
+			size += uint64(len(k) + len(v))
+			// the memory of k and v is only valid within the transaction
+			page.Entries = append(page.Entries, tableEntry{common.CopyBytes(k), common.CopyBytes(v)})
+			return true
+		})
+		if more {
+			page.Next = next
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Calls take with the entries of table in order, starting after the entry the
+// continuation token after names, or at the first entry if after is empty,
+// until take returns false or the table ends. Returns the token of the last
+// entry taken, and whether entries remain.
+func walkTable(ctx context.Context, tx kv.Tx, table, after string, take func(k, v []byte) bool) (next string, more bool, err error) {
+	dupsort := isDupSortTable(table)
+	var c kv.Cursor
+	if dupsort {
+		c, err = tx.CursorDupSort(table)
+	} else {
+		c, err = tx.Cursor(table)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer c.Close()
+
+	lastK, lastV := []byte(nil), []byte(nil)
+	k, v, err := seekAfter(c, dupsort, after)
+	for ; ; k, v, err = c.Next() {
+		if err != nil {
+			return "", false, err
+		}
+		if k == nil {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return "", false, err
+		}
+		if !take(k, v) {
+			more = true
+			break
+		}
+		lastK, lastV = k, v
+	}
+	if lastK == nil {
+		// nothing taken: the walk resumes where it started
+		return after, more, nil
+	}
+	return tableToken(lastK, lastV, dupsort), more, nil
+}
+
+// Keys of dupsort tables repeat, once per value, except in the tables whose
+// keys Erigon splits into key and value prefix (PlainState, HashedStorage),
+// which cursors join back into unique keys.
+func isDupSortTable(table string) bool {
+	cfg := kv.ChaindataTablesCfg[table]
+	return cfg.Flags&kv.DupSort != 0 && !cfg.AutoDupSortKeysConversion
+}
+
+// Continuation tokens name the last entry of a page by its hex key, followed
+// in dupsort tables by a ':' and its hex value.
+func tableToken(k, v []byte, dupsort bool) string {
+	if dupsort {
+		return hex.EncodeToString(k) + ":" + hex.EncodeToString(v)
+	}
+	return hex.EncodeToString(k)
+}
+
+// Positions c on the first entry after the one the token after names, which
+// need not exist anymore.
+func seekAfter(c kv.Cursor, dupsort bool, after string) (k, v []byte, err error) {
+	if after == "" {
+		return c.First()
+	}
+	keyHex, valueHex, hasValue := strings.Cut(after, ":")
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || hasValue != dupsort {
+		return nil, nil, fmt.Errorf("invalid continuation token %q", after)
+	}
+	if !dupsort {
+		if k, v, err = c.Seek(key); err != nil || !bytes.Equal(k, key) {
+			return k, v, err
+		}
+		return c.Next()
+	}
+
+	value, err := hex.DecodeString(valueHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid continuation token %q", after)
+	}
+	dc := c.(kv.CursorDupSort)
+	if v, err = dc.SeekBothRange(key, value); err != nil {
+		return nil, nil, err
+	}
+	if v == nil {
+		// no value of key from value on, so resume at the next key
+		if k, v, err = dc.Seek(key); err != nil || !bytes.Equal(k, key) {
+			return k, v, err
+		}
+		return dc.NextNoDup()
+	}
+	if bytes.Equal(v, value) {
+		return dc.Next()
+	}
+	return key, v, nil
+}
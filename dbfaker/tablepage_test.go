@@ -0,0 +1,124 @@
+//go:build !slim
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/dbutils"
+)
+
+func TestDumpTablePage(t *testing.T) {
+	for _, table := range []string{kv.Headers, kv.AccountChangeSet} {
+		for _, size := range []struct {
+			limit, maxBytes uint64
+		}{{1, 0}, {0, 150}} {
+			name := fmt.Sprintf("%s/limit=%d,maxBytes=%d", table, size.limit, size.maxBytes)
+			t.Run(name, func(t *testing.T) {
+				testDumpTablePage(t, table, size.limit, size.maxBytes)
+			})
+		}
+	}
+}
+
+// Pages through table while it is written to between the first pages, and
+// checks that the pages add up to a full walk of the table as it ends up,
+// plus the entries deleted behind the walk.
+func testDumpTablePage(t *testing.T, table string, limit, maxBytes uint64) {
+	ctx := context.Background()
+	h := openSmallMap(t, 64*datasize.MB)
+	err := h.Update(ctx, func(tx kv.RwTx) error {
+		for num := uint64(0); num < 5; num++ {
+			for i := byte(0); i < 3; i++ {
+				var k, v []byte
+				if table == kv.AccountChangeSet {
+					// three accounts changed in each block
+					k = dbutils.EncodeBlockNumber(num)
+					v = append(bytes.Repeat([]byte{i}, common.AddressLength), 0xff, byte(num))
+				} else {
+					k = append(dbutils.EncodeBlockNumber(num), bytes.Repeat([]byte{i}, common.HashLength)...)
+					v = bytes.Repeat([]byte{byte(num)}, 32)
+				}
+				if err := tx.Put(table, k, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages, deleted []tableEntry
+	after := ""
+	for i := 0; ; i++ {
+		page, err := dumpTablePage(ctx, h, table, after, limit, maxBytes)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		if len(page.Entries) == 0 {
+			t.Fatalf("page %d is empty", i)
+		}
+		if limit > 0 && uint64(len(page.Entries)) > limit {
+			t.Fatalf("page %d has %d entries", i, len(page.Entries))
+		}
+		pages = append(pages, page.Entries...)
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+		if i >= 3 {
+			continue
+		}
+
+		// Right after the last entry taken, which the next page must start
+		// with, and deleting that entry, which the next page must resume
+		// after all the same.
+		last := page.Entries[len(page.Entries)-1]
+		err = h.Update(ctx, func(tx kv.RwTx) error {
+			k, v := append(common.CopyBytes(last.Key), 0), last.Value
+			if isDupSortTable(table) {
+				k, v = last.Key, append(common.CopyBytes(last.Value), 0)
+			}
+			if err := tx.Put(table, k, v); err != nil {
+				return err
+			}
+			return tx.Delete(table, last.Key, last.Value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted = append(deleted, last)
+	}
+
+	full, err := dumpTablePage(ctx, h, table, "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Next != "" {
+		t.Fatalf("a walk without limits has a next page %q", full.Next)
+	}
+	want := append(full.Entries, deleted...)
+	sort.Slice(want, func(i, j int) bool {
+		if c := bytes.Compare(want[i].Key, want[j].Key); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(want[i].Value, want[j].Value) < 0
+	})
+	if len(pages) != len(want) {
+		t.Fatalf("got %d entries in pages, want %d", len(pages), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(pages[i].Key, want[i].Key) || !bytes.Equal(pages[i].Value, want[i].Value) {
+			t.Fatalf("entry %d is %x => %x, want %x => %x", i, pages[i].Key, pages[i].Value, want[i].Key, want[i].Value)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// Records db operations as JSON lines. A nil tracer records nothing, so
+// callers don't need to check whether tracing is enabled.
+type tracer struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	nextTx uint64
+}
+
+// One line of a trace file.
+type traceEvent struct {
+	Time time.Time `json:"time"`
+	// Sequence number of the transaction within the trace, starting at 1.
+	Tx        uint64        `json:"tx"`
+	Op        string        `json:"op"`
+	Table     string        `json:"table,omitempty"`
+	Key       hexutil.Bytes `json:"key,omitempty"`
+	ValueSize int           `json:"valueSize"`
+	Duration  int64         `json:"durationNs"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Starts recording every operation on the db (puts, deletes, gets, cursor
+// reads, commits and rollbacks, with their table, key, value size, duration
+// and transaction) to a JSON-lines file at path, truncating it. An empty path
+// stops tracing. Only operations of transactions begun after the call are
+// recorded, and transactions still open on the previous trace must be ended
+// first.
+//export SetTrace
+func SetTrace(dbPtr C.uintptr_t, path string) (exit int) {
+	defer timeOp("SetTrace", "path", path)()
+	return exitCode("SetTrace", getDbHandle(dbPtr).setTrace(path))
+}
+
+func (h *dbHandle) setTrace(path string) error {
+	var next *tracer
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		next = &tracer{f: f, enc: json.NewEncoder(f)}
+	}
+
+	h.mu.Lock()
+	prev := h.tracer
+	h.tracer = next
+	h.mu.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+	return nil
+}
+
+// Returns the trace new transactions on h record to, or nil.
+func (h *dbHandle) currentTracer() *tracer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tracer
+}
+
+// Returns the id to record the operations of a new transaction under.
+func (t *tracer) beginTx() uint64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextTx++
+	return t.nextTx
+}
+
+func (t *tracer) record(tx uint64, op, table string, key []byte, valueSize int, start time.Time, err error) {
+	if t == nil {
+		return
+	}
+	ev := traceEvent{
+		Time:      start,
+		Tx:        tx,
+		Op:        op,
+		Table:     table,
+		Key:       key,
+		ValueSize: valueSize,
+		Duration:  time.Since(start).Nanoseconds(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.enc.Encode(ev); err != nil {
+		libLog.Error("trace", "err", err)
+	}
+}
+
+func (t *tracer) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.f.Close(); err != nil {
+		libLog.Error("trace close", "err", err)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build !slim
+
+package main
+
+import (
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// The write transaction handed out by begin. Every write is recorded in the
+// metrics, and, when enabled on the db, in its trace and audit table, and in
+// the change set for its subscribers. Puts fail instead of overwriting when
+// the transaction is insert-only.
+type instrumentedTx struct {
+	kv.RwTx
+	trace      *tracer
+	id         uint64
+	audit      *auditor
+	changes    *changeSet
+	insertOnly bool
+}
+
+func (tx instrumentedTx) Put(table string, k, v []byte) error {
+	if err := tx.checkInsert(table, k); err != nil {
+		return err
+	}
+	start := time.Now()
+	metrics.put(table, len(k)+len(v))
+	err := tx.RwTx.Put(table, k, v)
+	tx.trace.record(tx.id, "put", table, k, len(v), start, err)
+	if err != nil {
+		return err
+	}
+	tx.changes.record(table, k)
+	return tx.audit.record(tx.RwTx, auditPut, table, k)
+}
+
+func (tx instrumentedTx) Append(table string, k, v []byte) error {
+	start := time.Now()
+	metrics.put(table, len(k)+len(v))
+	err := tx.RwTx.Append(table, k, v)
+	tx.trace.record(tx.id, "append", table, k, len(v), start, err)
+	if err != nil {
+		return err
+	}
+	tx.changes.record(table, k)
+	return tx.audit.record(tx.RwTx, auditPut, table, k)
+}
+
+func (tx instrumentedTx) AppendDup(table string, k, v []byte) error {
+	start := time.Now()
+	metrics.put(table, len(k)+len(v))
+	err := tx.RwTx.AppendDup(table, k, v)
+	tx.trace.record(tx.id, "appendDup", table, k, len(v), start, err)
+	if err != nil {
+		return err
+	}
+	tx.changes.record(table, k)
+	return tx.audit.record(tx.RwTx, auditPut, table, k)
+}
+
+func (tx instrumentedTx) Delete(table string, k, v []byte) error {
+	start := time.Now()
+	metrics.delete(table)
+	err := tx.RwTx.Delete(table, k, v)
+	tx.trace.record(tx.id, "delete", table, k, len(v), start, err)
+	if err != nil {
+		return err
+	}
+	tx.changes.record(table, k)
+	return tx.audit.record(tx.RwTx, auditDelete, table, k)
+}
+
+func (tx instrumentedTx) GetOne(table string, k []byte) ([]byte, error) {
+	start := time.Now()
+	v, err := tx.RwTx.GetOne(table, k)
+	tx.trace.record(tx.id, "get", table, k, len(v), start, err)
+	return v, err
+}
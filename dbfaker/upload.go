@@ -0,0 +1,83 @@
+//go:build !slim
+
+package main
+
+/*
+#include <stdint.h>     // for uintptr_t
+*/
+import "C"
+import (
+	"fmt"
+	"runtime/cgo"
+	"sync"
+
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// The largest code an upload accepts, well above any contract size limit, so
+// that a runaway host loop fails instead of exhausting memory.
+const maxUploadSize = 64 << 20
+
+// Code being transferred in chunks, for bindings that limit the size of one
+// call's payload. Nothing is written until the upload ends.
+type codeUpload struct {
+	mu      sync.Mutex
+	db      *dbHandle
+	address []byte
+	code    []byte
+}
+
+// Starts an upload of the code of the account at address, returning an
+// ffi-safe pointer to pass the code to in pieces with PutCodeChunk. sizeHint,
+// if not 0, is the expected size of the code, to allocate it once.
+// PutCodeEnd writes the code as SetCode does, in one transaction, and
+// PutCodeAbort drops it; either releases the pointer.
+//export PutCodeBegin
+func PutCodeBegin(dbPtr C.uintptr_t, address []byte, sizeHint uint64) (exit int, ptr C.uintptr_t) {
+	defer timeOp("PutCodeBegin", "address", hexutil.Bytes(address), "size", sizeHint)()
+	if sizeHint > maxUploadSize {
+		return exitCode("PutCodeBegin", fmt.Errorf("code of %d bytes exceeds the upload limit of %d", sizeHint, maxUploadSize)), *new(C.uintptr_t)
+	}
+	u := &codeUpload{
+		db: getDbHandle(dbPtr),
+		// the slice is only valid for the duration of this call
+		address: append([]byte(nil), address...),
+		code:    make([]byte, 0, sizeHint),
+	}
+	return 1, registerHandle("upload", "PutCodeBegin", dbPtr, u)
+}
+
+// Appends chunk to the code of an upload from PutCodeBegin.
+//export PutCodeChunk
+func PutCodeChunk(uploadPtr C.uintptr_t, chunk []byte) (exit int) {
+	u := getCodeUpload(uploadPtr)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.code)+len(chunk) > maxUploadSize {
+		return exitCode("PutCodeChunk", fmt.Errorf("code exceeds the upload limit of %d bytes", maxUploadSize))
+	}
+	u.code = append(u.code, chunk...)
+	return 1
+}
+
+// Writes the code of an upload, as SetCode does, and releases the pointer. On
+// failure the pointer is released too, and nothing is written.
+//export PutCodeEnd
+func PutCodeEnd(uploadPtr C.uintptr_t) (exit int) {
+	u := getCodeUpload(uploadPtr)
+	releaseHandle(uploadPtr)
+	defer timeOp("PutCodeEnd", "address", hexutil.Bytes(u.address), "code", len(u.code))()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return exitCode("PutCodeEnd", setCode(u.db, u.address, u.code))
+}
+
+// Drops an upload without writing anything and releases the pointer.
+//export PutCodeAbort
+func PutCodeAbort(uploadPtr C.uintptr_t) {
+	releaseHandle(uploadPtr)
+}
+
+func getCodeUpload(uploadPtr C.uintptr_t) *codeUpload {
+	return cgo.Handle(uploadPtr).Value().(*codeUpload)
+}
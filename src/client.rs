@@ -336,6 +336,8 @@ mod tests {
         let val = Rand::rand(&mut rng);
 
         let mut w = Writer::open(TMP_DIR.clone())?;
+        // storage is written under the first contract incarnation
+        w.put_account(who, Account::new().incarnation(1))?;
         w.put_storage(who, key, val)?;
         let path = w.close()?;
 
@@ -158,6 +158,13 @@ impl<'env, K: TransactionKind, E: EnvironmentKind> Reader<'env, K, E> {
             .flatten())
     }
 
+    /// Returns the transaction with id `id` as stored in the BlockTransaction table
+    pub fn read_transaction_raw(&mut self, id: u64) -> Result<Vec<u8>> {
+        self.0
+            .get(ak_tables::BlockTransaction.erased(), id.encode().to_vec())?
+            .ok_or_else(|| format_err!("read_transaction_raw"))
+    }
+
     /// Returns the signers of each transaction in the block.
     /// If the block or the signers are not in the db, returns zero addresses.
     pub fn read_senders(&mut self, key: ak_tables::HeaderKey) -> Result<Vec<Address>> {
@@ -460,7 +467,9 @@ mod tests {
 
         let db = client(path)?;
         let mut dbtx = db.reader()?;
-        let read = dbtx.walk_account_storage(who, 0)?;
+        // the missing account was created with the first contract
+        // incarnation
+        let read = dbtx.walk_account_storage(who, 1)?;
 
         for r in read {
             let (key, val) = r?;
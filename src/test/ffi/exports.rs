@@ -0,0 +1,524 @@
+//! Tests of what the write exports store, beyond what the readers' tests cover.
+
+use akula::models::BlockHeader;
+use anyhow::Result;
+use ethers::types::H256;
+use fastrlp::Encodable;
+use rand::thread_rng;
+use std::path::PathBuf;
+
+use crate::{
+    client::Client,
+    models::Account,
+    test::{
+        ffi::writer::Writer,
+        rand::{rand_1559, rand_2930, rand_legacy, rand_signed, Rand},
+        TMP_DIR,
+    },
+};
+
+// RPC responses for the London block 12965000, in the format nodes return
+// them. Its transactions are signed with a test key, so the hashes are not
+// those of mainnet.
+#[cfg(not(dbfaker_slim))]
+const HEADER_JSON: &str = include_str!("testdata/header.json");
+#[cfg(not(dbfaker_slim))]
+const TRANSACTIONS_JSON: &str = include_str!("testdata/transactions.json");
+#[cfg(not(dbfaker_slim))]
+const RECEIPTS_JSON: &str = include_str!("testdata/receipts.json");
+
+// helper for type inference
+fn client(path: PathBuf) -> Result<Client<mdbx::NoWriteMap>> {
+    Client::open_new(path)
+}
+
+// A fresh directory for a db
+#[cfg(not(dbfaker_slim))]
+fn tmp_path() -> Result<PathBuf> {
+    Ok(tempfile::Builder::new()
+        .tempdir_in(TMP_DIR.clone())?
+        .into_path())
+}
+
+#[test]
+fn test_put_storage_creates_account() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let key = Rand::rand(&mut rng);
+    let val = Rand::rand(&mut rng);
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_storage(who, key, val)?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    // an empty contract of the first contract incarnation
+    dbtx.read_account_data_raw(who)?;
+    let acct = dbtx.read_account_data(who)?;
+    assert_eq!(acct.incarnation, 1);
+    assert_eq!(acct.nonce, 0);
+    assert!(acct.balance.is_zero());
+    assert_eq!(dbtx.read_account_storage(who, 1, key)?, val);
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_storage_orphan_mode() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let key = Rand::rand(&mut rng);
+    let val = Rand::rand(&mut rng);
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.set_put_storage_mode("orphan")?;
+    w.put_storage(who, key, val)?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    assert!(dbtx.read_account_data_raw(who).is_err());
+    assert_eq!(dbtx.read_account_storage(who, 1, key)?, val);
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_storage_strict_mode() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let key = Rand::rand(&mut rng);
+    let val = Rand::rand(&mut rng);
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.set_put_storage_mode("strict")?;
+    assert!(w.put_storage(who, key, val).is_err());
+    assert!(w.set_put_storage_mode("bogus").is_err());
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    assert!(dbtx.read_account_data_raw(who).is_err());
+    assert_eq!(dbtx.read_account_storage(who, 1, key)?, H256::zero());
+    Ok(())
+}
+
+// Runs against both builds (see DBFAKER_SLIM), which must store each
+// transaction exactly as rawdb.WriteTransactions does: the RLP encoding the
+// writer was given, with typed transactions wrapped in an RLP string. So a
+// fixture written by either build is byte-identical.
+#[test]
+fn test_put_transactions_stored_encoding() -> Result<()> {
+    let mut rng = thread_rng();
+    let base_id = u64::from(u32::rand(&mut rng));
+    let txs = [rand_legacy, rand_2930, rand_1559].map(|msg| {
+        let msg = msg(&mut rng);
+        rand_signed(&mut rng, msg)
+    });
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_transactions(txs.clone(), base_id)?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    for (i, tx) in txs.iter().enumerate() {
+        let mut want = vec![];
+        tx.encode(&mut want);
+        let raw = dbtx.read_transaction_raw(base_id + 1 + i as u64)?;
+        assert_eq!(hex::encode(raw), hex::encode(want), "tx {}", i);
+    }
+    // legacy as a list, typed as a string
+    assert!(dbtx.read_transaction_raw(base_id + 1)?[0] >= 0xc0);
+    assert!(dbtx.read_transaction_raw(base_id + 2)?[0] < 0xc0);
+    assert!(dbtx.read_transaction_raw(base_id + 3)?[0] < 0xc0);
+    Ok(())
+}
+
+#[test]
+fn test_put_account_merges() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let codehash = Rand::rand(&mut rng);
+    let bal = <[u8; 32]>::rand(&mut rng).into();
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_account(who, Account::new().incarnation(2).codehash(codehash))?;
+    // no code hash and incarnation 0 keep the stored ones
+    w.put_account(who, Account::new().nonce(7).balance(bal))?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let acct = db.reader()?.read_account_data(who)?;
+    assert_eq!(acct.nonce, 7);
+    assert_eq!(acct.balance, bal);
+    assert_eq!(acct.incarnation, 2);
+    assert_eq!(acct.codehash, codehash);
+    Ok(())
+}
+
+#[test]
+fn test_replace_account() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let codehash = Rand::rand(&mut rng);
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_account(who, Account::new().incarnation(2).codehash(codehash))?;
+    w.replace_account(who, Account::new().nonce(7))?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let acct = db.reader()?.read_account_data(who)?;
+    assert_eq!(acct, Account::new().nonce(7));
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_tx_lookup_entries_first_failure() -> Result<()> {
+    let mut rng = thread_rng();
+    let [a, b, c]: [H256; 3] = [
+        Rand::rand(&mut rng),
+        Rand::rand(&mut rng),
+        Rand::rand(&mut rng),
+    ];
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    // remapping a to another block fails
+    w.set_check_duplicate_txs(true)?;
+    w.put_tx_lookup_entries(1.into(), [a])?;
+    assert!(w.put_tx_lookup_entries(2.into(), [b, a, c]).is_err());
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    assert_eq!(dbtx.read_transaction_block_number(a)?, 1.into());
+    // the entries before the failing one were rolled back
+    assert!(dbtx.read_transaction_block_number(b).is_err());
+    assert!(dbtx.read_transaction_block_number(c).is_err());
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_tx_lookup_entries_lenient() -> Result<()> {
+    let mut rng = thread_rng();
+    let [a, b, c]: [H256; 3] = [
+        Rand::rand(&mut rng),
+        Rand::rand(&mut rng),
+        Rand::rand(&mut rng),
+    ];
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.set_check_duplicate_txs(true)?;
+    w.put_tx_lookup_entries(1.into(), [a])?;
+    w.put_tx_lookup_entries_lenient(2.into(), [b, a, c])?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    assert_eq!(dbtx.read_transaction_block_number(a)?, 1.into());
+    assert_eq!(dbtx.read_transaction_block_number(b)?, 2.into());
+    assert_eq!(dbtx.read_transaction_block_number(c)?, 2.into());
+    Ok(())
+}
+
+#[test]
+fn test_put_canonical_hash_strict() -> Result<()> {
+    let mut rng = thread_rng();
+    let header = BlockHeader::rand(&mut rng);
+    let (num, hash) = (header.number, header.hash());
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    assert!(w.put_canonical_hash_strict(hash, num).is_err());
+    w.put_header(header)?;
+    // the header is stored under its own number only
+    assert!(w
+        .put_canonical_hash_strict(hash, (*num ^ 1).into())
+        .is_err());
+    w.put_canonical_hash_strict(hash, num)?;
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    assert_eq!(dbtx.read_canonical_hash(num)?, hash);
+    assert!(dbtx.read_canonical_hash((*num ^ 1).into()).is_err());
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_restore_backup() -> Result<()> {
+    use crate::test::ffi::writer::restore;
+
+    let mut rng = thread_rng();
+    let (a, b) = (Rand::rand(&mut rng), Rand::rand(&mut rng));
+    let backup = tmp_path()?;
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_account(a, Account::new().nonce(1))?;
+    w.backup_to(&backup)?;
+    // written after the backup
+    w.put_account(b, Account::new().nonce(2))?;
+    let path = w.close()?;
+
+    // a db cannot be restored over without in_place
+    assert!(restore(&backup, &path, false).is_err());
+    let fresh = tmp_path()?;
+    restore(&backup, &fresh, false)?;
+    restore(&backup, &path, true)?;
+
+    for path in [fresh, path] {
+        let db = client(path)?;
+        let mut dbtx = db.reader()?;
+        assert_eq!(dbtx.read_account_data(a)?.nonce, 1);
+        assert!(dbtx.read_account_data_raw(b).is_err());
+    }
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_apply_migrations() -> Result<()> {
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    let pending = w.apply_migrations(true)?;
+    assert!(!pending.is_empty());
+    // recorded as applied, so there is nothing left to run
+    assert!(w.apply_migrations(true)?.is_empty());
+    assert!(w.apply_migrations(false)?.is_empty());
+    w.close()?;
+    Ok(())
+}
+
+// Writes the history of a contract at who through a self-destruct: block 1
+// creates it with vals[0] in the slot key, block 2 destroys it and block 3
+// recreates it at incarnation 2 with vals[1] in the slot. Returns copies of
+// the db as of the end of each block from 0 on, to read the state of each
+// block from with the plain state readers.
+#[cfg(not(dbfaker_slim))]
+fn write_selfdestruct_history(
+    w: &mut Writer,
+    who: ethers::types::Address,
+    key: H256,
+    vals: [H256; 2],
+) -> Result<Vec<PathBuf>> {
+    use crate::test::ffi::writer::restore;
+
+    let mut snapshots = vec![];
+    let mut snapshot = |w: &mut Writer| -> Result<()> {
+        let (backup, path) = (tmp_path()?, tmp_path()?);
+        w.backup_to(&backup)?;
+        restore(&backup, &path, false)?;
+        snapshots.push(path);
+        Ok(())
+    };
+
+    snapshot(w)?;
+    w.set_history(true, 1)?;
+    w.put_account(who, Account::new().nonce(1).incarnation(1))?;
+    w.put_storage(who, key, vals[0])?;
+    snapshot(w)?;
+    w.set_history(true, 2)?;
+    w.delete_account(who)?;
+    snapshot(w)?;
+    w.set_history(true, 3)?;
+    w.put_account(who, Account::new().nonce(2).incarnation(2))?;
+    w.put_storage(who, key, vals[1])?;
+    snapshot(w)?;
+    Ok(snapshots)
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_get_account_at_across_selfdestruct() -> Result<()> {
+    use akula::kv::traits::TableDecode;
+
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let key = Rand::rand(&mut rng);
+    let vals = [Rand::rand(&mut rng), Rand::rand(&mut rng)];
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    let snapshots = write_selfdestruct_history(&mut w, who, key, vals)?;
+    let mut accts = vec![];
+    // block 4 is after the last write, so it reads as block 3 does
+    for block in 0..=4 {
+        let db = client(snapshots[block.min(3)].clone())?;
+        let want = db.reader()?.read_account_data_raw(who).ok();
+        let got = w.get_account_at(who, block as u64)?;
+        assert_eq!(got, want, "block {}", block);
+        accts.push(got.map(|enc| Account::decode(&enc)).transpose()?);
+    }
+    w.close()?;
+
+    assert_eq!(accts[0], None);
+    assert_eq!(accts[1], Some(Account::new().nonce(1).incarnation(1)));
+    assert_eq!(accts[2], None);
+    assert_eq!(accts[3], Some(Account::new().nonce(2).incarnation(2)));
+    assert_eq!(accts[4], accts[3]);
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_get_storage_at_across_selfdestruct() -> Result<()> {
+    let mut rng = thread_rng();
+    let who = Rand::rand(&mut rng);
+    let key = Rand::rand(&mut rng);
+    let vals = [Rand::rand(&mut rng), Rand::rand(&mut rng)];
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    let snapshots = write_selfdestruct_history(&mut w, who, key, vals)?;
+    let mut slots = vec![];
+    // block 4 is after the last write, so it reads as block 3 does
+    for block in 0..=4 {
+        let db = client(snapshots[block.min(3)].clone())?;
+        let mut dbtx = db.reader()?;
+        // the slot under the incarnation of the account, if there is one
+        let want = match dbtx.read_account_data_raw(who) {
+            Ok(_) => {
+                let incarnation = dbtx.read_account_data(who)?.incarnation;
+                dbtx.read_account_storage(who, incarnation, key)?
+            }
+            Err(_) => H256::zero(),
+        };
+        let got = w.get_storage_at(who, key, block as u64)?;
+        assert_eq!(got, want, "block {}", block);
+        slots.push(got);
+    }
+    w.close()?;
+
+    assert_eq!(
+        slots,
+        [H256::zero(), vals[0], H256::zero(), vals[1], vals[1]]
+    );
+    // the first incarnation keeps its storage after the self-destruct
+    let db = client(snapshots[3].clone())?;
+    let mut dbtx = db.reader()?;
+    assert_eq!(dbtx.read_last_incarnation(who)?, 1);
+    assert_eq!(dbtx.read_account_storage(who, 1, key)?, vals[0]);
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_header_json() -> Result<()> {
+    use crate::utils::BlockCast;
+
+    let want: ethers::types::Block<H256> = serde_json::from_str(HEADER_JSON)?;
+    let num = akula::models::BlockNumber(want.number.unwrap().as_u64());
+    let hash = want.hash.unwrap();
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_header_json(HEADER_JSON)?;
+    // a header that does not hash to its "hash" is not written
+    let mut changed: serde_json::Value = serde_json::from_str(HEADER_JSON)?;
+    changed["gasUsed"] = "0x1".into();
+    assert!(w.put_header_json(&changed.to_string()).is_err());
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let header = db.reader()?.read_header((num, hash))?;
+    assert_eq!(header.hash(), hash);
+    let got = BlockCast(&header).cast::<H256>(vec![], num, hash, vec![]);
+    assert_eq!(got.parent_hash, want.parent_hash);
+    assert_eq!(got.state_root, want.state_root);
+    assert_eq!(got.transactions_root, want.transactions_root);
+    assert_eq!(got.receipts_root, want.receipts_root);
+    assert_eq!(got.logs_bloom, want.logs_bloom);
+    assert_eq!(got.gas_used, want.gas_used);
+    assert_eq!(got.timestamp, want.timestamp);
+    assert_eq!(got.base_fee_per_gas, want.base_fee_per_gas);
+    assert!(got.base_fee_per_gas.is_some());
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_transaction_json() -> Result<()> {
+    let mut rng = thread_rng();
+    let base_id = u64::from(u32::rand(&mut rng));
+    // a legacy, an access list and a dynamic fee transaction
+    let want: Vec<ethers::types::Transaction> = serde_json::from_str(TRANSACTIONS_JSON)?;
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_transaction_json(TRANSACTIONS_JSON, base_id)?;
+    // a transaction that does not hash to its "hash" is not written
+    let mut changed: serde_json::Value = serde_json::from_str(TRANSACTIONS_JSON)?;
+    changed[1]["nonce"] = "0x0".into();
+    assert!(w
+        .put_transaction_json(&changed.to_string(), base_id + 10)
+        .is_err());
+    let path = w.close()?;
+
+    let db = client(path)?;
+    let mut dbtx = db.reader()?;
+    let txs = dbtx.read_transactions(base_id + 1, want.len())?;
+    for (i, tx) in txs.iter().enumerate() {
+        assert_eq!(tx.hash(), want[i].hash, "tx {}", i);
+        assert_eq!(tx.recover_sender()?, want[i].from, "tx {}", i);
+    }
+    // legacy as a list, typed as a string
+    assert!(dbtx.read_transaction_raw(base_id + 1)?[0] >= 0xc0);
+    assert!(dbtx.read_transaction_raw(base_id + 2)?[0] < 0xc0);
+    assert!(dbtx.read_transaction_raw(base_id + 3)?[0] < 0xc0);
+    assert!(dbtx.read_transaction_raw(base_id + 11).is_err());
+    Ok(())
+}
+
+#[cfg(not(dbfaker_slim))]
+#[test]
+fn test_put_receipts_json() -> Result<()> {
+    use akula::models::{BlockNumber, BodyForStorage, TxIndex};
+
+    let mut rng = thread_rng();
+    let base_id = u64::from(u32::rand(&mut rng));
+    let block: ethers::types::Block<H256> = serde_json::from_str(HEADER_JSON)?;
+    let receipts: Vec<ethers::types::TransactionReceipt> = serde_json::from_str(RECEIPTS_JSON)?;
+    let num = BlockNumber(block.number.unwrap().as_u64());
+    let hash = block.hash.unwrap();
+    let body = BodyForStorage {
+        base_tx_id: TxIndex(base_id),
+        tx_amount: (block.transactions.len() + 2).try_into()?,
+        uncles: vec![],
+    };
+
+    let mut w = Writer::open(TMP_DIR.clone())?;
+    w.put_header_json(HEADER_JSON)?;
+    w.put_canonical_hash_strict(hash, num)?;
+    w.put_body_for_storage(hash, num, body)?;
+    w.put_transaction_json(TRANSACTIONS_JSON, base_id)?;
+    w.put_tx_lookup_entries(num, block.transactions.clone())?;
+    // the receipts name the block they are of
+    assert!(w.put_receipts_json(*num + 1, RECEIPTS_JSON).is_err());
+    w.put_receipts_json(*num, RECEIPTS_JSON)?;
+    let filter = serde_json::json!({ "blockHash": hash }).to_string();
+    let logs = w.get_logs(&filter)?;
+    let path = w.close()?;
+
+    // the legacy tx logs nothing, the two typed ones a transfer each
+    let want = receipts
+        .iter()
+        .flat_map(|r| r.logs.clone())
+        .collect::<Vec<_>>();
+    assert_eq!(want.len(), 2);
+    assert_eq!(logs, want);
+
+    let db = client(path)?;
+    let got = db.get_block(hash)?.unwrap();
+    assert_eq!(got.transactions, block.transactions);
+    for (i, r) in receipts.iter().enumerate() {
+        let tx = db.get_transaction(r.transaction_hash)?.unwrap();
+        assert_eq!(tx.block_hash, r.block_hash, "receipt {}", i);
+        assert_eq!(tx.block_number, r.block_number, "receipt {}", i);
+        assert_eq!(
+            tx.transaction_index,
+            Some(r.transaction_index),
+            "receipt {}",
+            i
+        );
+    }
+    Ok(())
+}
@@ -11,7 +11,7 @@ extern "C" {
     pub(crate) fn MdbxClose(db: GoPtr);
     pub(crate) fn PutHeadHeaderHash(db: GoPtr, hash: GoU256) -> GoExit;
     pub(crate) fn PutHeaderNumber(db: GoPtr, hash: GoU256, num: u64) -> GoExit;
-    pub(crate) fn PutCanonicalHash(db: GoPtr, hash: GoU256, num: u64) -> GoExit;
+    pub(crate) fn PutCanonicalHash(db: GoPtr, hash: GoU256, num: u64, strict: bool) -> GoExit;
     pub(crate) fn PutStorage(db: GoPtr, address: GoAddress, key: GoU256, val: GoU256) -> GoExit;
     #[allow(unused)]
     pub(crate) fn PutRawTransactions(db: GoPtr, txs: GoSlice, baseId: u64) -> GoExit;
@@ -26,15 +26,51 @@ extern "C" {
     pub(crate) fn PutHeader(db: GoPtr, header: GoRlp) -> GoExit;
     pub(crate) fn PutBodyForStorage(db: GoPtr, hash: GoU256, num: u64, body: GoRlp) -> GoExit;
     // tx_hashes: [][]byte
-    pub(crate) fn PutTxLookupEntries(db: GoPtr, block_num: GoSlice, tx_hashes: GoSlice) -> GoExit;
+    pub(crate) fn PutTxLookupEntries(
+        db: GoPtr,
+        block_num: GoSlice,
+        tx_hashes: GoSlice,
+        lenient: bool,
+    ) -> GoExit;
     pub(crate) fn PutAccount(
         ptr: GoPtr,
         address: GoAddress,
         rlpAccount: GoRlp,
         incarnation: u64,
+        replace: bool,
     ) -> GoExit;
 }
 
+// Exports of the full build only
+#[cfg(not(dbfaker_slim))]
+extern "C" {
+    pub(crate) fn SetPutStorageMode(db: GoPtr, mode: GoPath) -> GoExit;
+    pub(crate) fn SetCheckDuplicateTxs(db: GoPtr, enabled: bool) -> GoExit;
+    pub(crate) fn BackupTo(db: GoPtr, dest: GoPath) -> GoExit;
+    pub(crate) fn RestoreFrom(path: GoPath, dest: GoPath) -> GoExit;
+    pub(crate) fn RestoreInPlace(path: GoPath, dest: GoPath) -> GoExit;
+    // applied: JSON array of migration names, released with FreeBytes
+    pub(crate) fn ApplyMigrations(db: GoPtr, fake: bool) -> GoTuple<GoExit, *mut c_char>;
+    pub(crate) fn SetHistory(db: GoPtr, enabled: bool, block_num: u64) -> GoExit;
+    pub(crate) fn DeleteAccount(db: GoPtr, address: GoAddress) -> GoExit;
+    pub(crate) fn GetAccountAt(db: GoPtr, address: GoAddress, block_num: u64) -> GoBytes;
+    pub(crate) fn GetStorageAt(
+        db: GoPtr,
+        address: GoAddress,
+        key: GoU256,
+        block_num: u64,
+    ) -> GoBytes;
+    // header: the JSON object of eth_getBlockByNumber
+    pub(crate) fn PutHeaderJSON(db: GoPtr, header: GoPath) -> GoExit;
+    // txs: the JSON object of eth_getTransactionByHash, or an array of them
+    pub(crate) fn PutTransactionJSON(db: GoPtr, txs: GoPath, baseId: u64) -> GoExit;
+    // receipts: the JSON array of eth_getTransactionReceipt objects of the block
+    pub(crate) fn PutReceiptsJSON(db: GoPtr, num: u64, receipts: GoPath) -> GoExit;
+    // logs: JSON array in the eth_getLogs format, released with FreeBytes
+    pub(crate) fn GetLogs(db: GoPtr, filter: GoPath) -> GoTuple<GoExit, *mut c_char>;
+    pub(crate) fn FreeBytes(ptr: *mut c_void);
+}
+
 #[repr(transparent)]
 #[derive(Clone, Debug, PartialEq)]
 pub(crate) struct GoRlp<'a>(pub GoSlice<'a>);
@@ -46,6 +82,34 @@ pub(crate) struct GoTuple<A, B> {
     pub b: B,
 }
 
+// The (exit, found, val, valLen) the exports that read bytes return
+#[cfg(not(dbfaker_slim))]
+#[repr(C)]
+#[derive(Clone, Debug, PartialEq)]
+pub(crate) struct GoBytes {
+    pub exit: GoExit,
+    pub found: bool,
+    val: *mut c_void,
+    len: usize,
+}
+
+#[cfg(not(dbfaker_slim))]
+impl GoBytes {
+    // Copies the value out of Go's memory and releases it
+    pub fn take<E: Debug>(self, err_msg: E) -> anyhow::Result<Option<Vec<u8>>> {
+        self.exit.ok_or_fmt(err_msg)?;
+        if !self.found {
+            return Ok(None);
+        }
+        let val = unsafe {
+            let val = std::slice::from_raw_parts(self.val as *const u8, self.len).to_vec();
+            FreeBytes(self.val);
+            val
+        };
+        Ok(Some(val))
+    }
+}
+
 #[repr(C)]
 #[derive(Clone, Debug, PartialEq)]
 pub(crate) struct GoSlice<'a> {
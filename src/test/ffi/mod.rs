@@ -1,2 +1,4 @@
 pub mod interface;
 pub mod writer;
+
+mod exports;
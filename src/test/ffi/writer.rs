@@ -51,13 +51,36 @@ impl Writer {
         Ok(())
     }
 
-    pub fn put_canonical_hash(&mut self, mut hash: H256, num: BlockNumber) -> Result<()> {
-        let exit = unsafe { PutCanonicalHash(self.db_ptr, (&mut hash).into(), *num) };
+    pub fn put_canonical_hash(&mut self, hash: H256, num: BlockNumber) -> Result<()> {
+        self.write_canonical_hash(hash, num, false)
+    }
+
+    // Fails unless the header with hash is stored as block num
+    pub fn put_canonical_hash_strict(&mut self, hash: H256, num: BlockNumber) -> Result<()> {
+        self.write_canonical_hash(hash, num, true)
+    }
+
+    fn write_canonical_hash(
+        &mut self,
+        mut hash: H256,
+        num: BlockNumber,
+        strict: bool,
+    ) -> Result<()> {
+        let exit = unsafe { PutCanonicalHash(self.db_ptr, (&mut hash).into(), *num, strict) };
         exit.ok_or_fmt("PutCanonicalHash")?;
         Ok(())
     }
 
-    pub fn put_account(&mut self, mut who: Address, acct: Account) -> Result<()> {
+    pub fn put_account(&mut self, who: Address, acct: Account) -> Result<()> {
+        self.write_account(who, acct, false)
+    }
+
+    // Writes acct as given instead of merging it into the stored account
+    pub fn replace_account(&mut self, who: Address, acct: Account) -> Result<()> {
+        self.write_account(who, acct, true)
+    }
+
+    fn write_account(&mut self, mut who: Address, acct: Account, replace: bool) -> Result<()> {
         let rlp_acct: RlpAccount = acct.into();
         let mut buf = vec![];
         rlp_acct.encode(&mut buf);
@@ -68,6 +91,7 @@ impl Writer {
                 (&mut who).into(),
                 GoRlp((&mut buf[..]).into()),
                 acct.incarnation,
+                replace,
             )
         };
         exit.ok_or_fmt("PutAccount")?;
@@ -96,6 +120,130 @@ impl Writer {
         Ok(())
     }
 
+    #[cfg(not(dbfaker_slim))]
+    pub fn set_put_storage_mode(&mut self, mode: &str) -> Result<()> {
+        let mode = null_term(mode);
+        let exit = unsafe { SetPutStorageMode(self.db_ptr, GoPath::from(mode.as_ref())) };
+        exit.ok_or_fmt("SetPutStorageMode")?;
+        Ok(())
+    }
+
+    #[cfg(not(dbfaker_slim))]
+    pub fn set_check_duplicate_txs(&mut self, enabled: bool) -> Result<()> {
+        let exit = unsafe { SetCheckDuplicateTxs(self.db_ptr, enabled) };
+        exit.ok_or_fmt("SetCheckDuplicateTxs")?;
+        Ok(())
+    }
+
+    // Copies the open db into the directory dest
+    #[cfg(not(dbfaker_slim))]
+    pub fn backup_to<P: AsRef<Path>>(&mut self, dest: P) -> Result<()> {
+        let dest = null_term(dest.as_ref().to_str().unwrap());
+        let exit = unsafe { BackupTo(self.db_ptr, GoPath::from(dest.as_ref())) };
+        exit.ok_or_fmt("BackupTo")?;
+        Ok(())
+    }
+
+    // Returns the names of the migrations that were pending
+    #[cfg(not(dbfaker_slim))]
+    pub fn apply_migrations(&mut self, fake: bool) -> Result<Vec<String>> {
+        let GoTuple {
+            a: exit,
+            b: applied,
+        } = unsafe { ApplyMigrations(self.db_ptr, fake) };
+        exit.ok_or_fmt("ApplyMigrations")?;
+        let names = unsafe {
+            let names = std::ffi::CStr::from_ptr(applied).to_str().map(String::from);
+            FreeBytes(applied as *mut libc::c_void);
+            names?
+        };
+        Ok(serde_json::from_str(&names)?)
+    }
+
+    // Makes the writes that follow record history at block_num
+    #[cfg(not(dbfaker_slim))]
+    pub fn set_history(&mut self, enabled: bool, block_num: u64) -> Result<()> {
+        let exit = unsafe { SetHistory(self.db_ptr, enabled, block_num) };
+        exit.ok_or_fmt("SetHistory")?;
+        Ok(())
+    }
+
+    // Deletes the account as a self-destruct does
+    #[cfg(not(dbfaker_slim))]
+    pub fn delete_account(&mut self, mut who: Address) -> Result<()> {
+        let exit = unsafe { DeleteAccount(self.db_ptr, (&mut who).into()) };
+        exit.ok_or_fmt("DeleteAccount")?;
+        Ok(())
+    }
+
+    // Reads the account as of the end of block_num, in the PlainState encoding
+    #[cfg(not(dbfaker_slim))]
+    pub fn get_account_at(&mut self, mut who: Address, block_num: u64) -> Result<Option<Vec<u8>>> {
+        unsafe { GetAccountAt(self.db_ptr, (&mut who).into(), block_num) }.take("GetAccountAt")
+    }
+
+    // Reads the storage slot as of the end of block_num, zero if it is empty
+    #[cfg(not(dbfaker_slim))]
+    pub fn get_storage_at(
+        &mut self,
+        mut who: Address,
+        mut key: H256,
+        block_num: u64,
+    ) -> Result<H256> {
+        let val =
+            unsafe { GetStorageAt(self.db_ptr, (&mut who).into(), (&mut key).into(), block_num) }
+                .take("GetStorageAt")?
+                .unwrap_or_default();
+        // stored without leading zeros
+        let mut buf = [0; 32];
+        buf[32 - val.len()..].copy_from_slice(&val);
+        Ok(H256(buf))
+    }
+
+    // Writes a header given as the JSON object eth_getBlockByNumber returns
+    #[cfg(not(dbfaker_slim))]
+    pub fn put_header_json(&mut self, header: &str) -> Result<()> {
+        let header = null_term(header);
+        let exit = unsafe { PutHeaderJSON(self.db_ptr, GoPath::from(header.as_ref())) };
+        exit.ok_or_fmt("PutHeaderJSON")?;
+        Ok(())
+    }
+
+    // Writes transactions given as the JSON objects eth_getTransactionByHash
+    // returns, from base_id + 1 on
+    #[cfg(not(dbfaker_slim))]
+    pub fn put_transaction_json(&mut self, txs: &str, base_id: u64) -> Result<()> {
+        let txs = null_term(txs);
+        let exit = unsafe { PutTransactionJSON(self.db_ptr, GoPath::from(txs.as_ref()), base_id) };
+        exit.ok_or_fmt("PutTransactionJSON")?;
+        Ok(())
+    }
+
+    // Writes the receipts of the canonical block num given as the JSON objects
+    // eth_getTransactionReceipt returns, in order
+    #[cfg(not(dbfaker_slim))]
+    pub fn put_receipts_json(&mut self, num: u64, receipts: &str) -> Result<()> {
+        let receipts = null_term(receipts);
+        let exit = unsafe { PutReceiptsJSON(self.db_ptr, num, GoPath::from(receipts.as_ref())) };
+        exit.ok_or_fmt("PutReceiptsJSON")?;
+        Ok(())
+    }
+
+    // Returns the logs matching the eth_getLogs filter
+    #[cfg(not(dbfaker_slim))]
+    pub fn get_logs(&mut self, filter: &str) -> Result<Vec<ethers::types::Log>> {
+        let filter = null_term(filter);
+        let GoTuple { a: exit, b: found } =
+            unsafe { GetLogs(self.db_ptr, GoPath::from(filter.as_ref())) };
+        exit.ok_or_fmt("GetLogs")?;
+        let logs = unsafe {
+            let logs = std::ffi::CStr::from_ptr(found).to_str().map(String::from);
+            FreeBytes(found as *mut libc::c_void);
+            logs?
+        };
+        Ok(serde_json::from_str(&logs)?)
+    }
+
     //TODO: encoding is broken
     #[allow(unused)]
     pub fn put_raw_transactions<T: IntoIterator<Item = Transaction>>(
@@ -188,6 +336,24 @@ impl Writer {
         &mut self,
         block_num: ak_models::BlockNumber,
         tx_hashes: T,
+    ) -> Result<()> {
+        self.write_tx_lookup_entries(block_num, tx_hashes, false)
+    }
+
+    // Skips the entries that fail to be written instead of failing
+    pub fn put_tx_lookup_entries_lenient<T: IntoIterator<Item = ak_models::H256>>(
+        &mut self,
+        block_num: ak_models::BlockNumber,
+        tx_hashes: T,
+    ) -> Result<()> {
+        self.write_tx_lookup_entries(block_num, tx_hashes, true)
+    }
+
+    fn write_tx_lookup_entries<T: IntoIterator<Item = ak_models::H256>>(
+        &mut self,
+        block_num: ak_models::BlockNumber,
+        tx_hashes: T,
+        lenient: bool,
     ) -> Result<()> {
         let mut num = block_num.0.to_be_bytes();
         let mut tx_hashes = tx_hashes.into_iter().collect::<Vec<_>>();
@@ -202,6 +368,7 @@ impl Writer {
                 self.db_ptr,
                 (&mut num[..]).into(),
                 GoSlice::from(&mut bufs[..]),
+                lenient,
             )
         };
         exit.ok_or_fmt("PutTxLookupEntries")?;
@@ -213,3 +380,18 @@ impl Drop for Writer {
         unsafe { MdbxClose(self.db_ptr) }
     }
 }
+
+// Materializes the backup in src as the db in dest. Unless in_place is set,
+// dest must not hold a db yet.
+#[cfg(not(dbfaker_slim))]
+pub fn restore<P: AsRef<Path>, Q: AsRef<Path>>(src: P, dest: Q, in_place: bool) -> Result<()> {
+    let src = null_term(src.as_ref().to_str().unwrap());
+    let dest = null_term(dest.as_ref().to_str().unwrap());
+    let (src, dest) = (GoPath::from(src.as_ref()), GoPath::from(dest.as_ref()));
+    if in_place {
+        unsafe { RestoreInPlace(src, dest) }.ok_or_fmt("RestoreInPlace")?;
+    } else {
+        unsafe { RestoreFrom(src, dest) }.ok_or_fmt("RestoreFrom")?;
+    }
+    Ok(())
+}
@@ -147,12 +147,16 @@ impl Rand for MessageWithSender {
 impl Rand for MessageWithSignature {
     fn rand(rng: &mut ThreadRng) -> Self {
         let msg = Message::rand(rng);
-        let key = SigningKey::random(rng);
-        let sig = sign(key, msg.hash().as_bytes());
-        Self {
-            message: msg,
-            signature: sig,
-        }
+        rand_signed(rng, msg)
+    }
+}
+// Signs msg with a random key
+pub fn rand_signed(rng: &mut ThreadRng, msg: Message) -> MessageWithSignature {
+    let key = SigningKey::random(rng);
+    let sig = sign(key, msg.hash().as_bytes());
+    MessageWithSignature {
+        message: msg,
+        signature: sig,
     }
 }
 pub fn sign(key: SigningKey, msg: &[u8]) -> MessageSignature {